@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/smarthomeentry/agent/internal/health"
+)
+
+// adminTimeout bounds one admin connection, so a stuck client can't hold
+// the socket open.
+const adminTimeout = 10 * time.Second
+
+// errAdminNotUnix rejects admin addresses other than a Unix socket path.
+// A TCP port, even on loopback, is open to every local user.
+var errAdminNotUnix = errors.New("admin socket must be an absolute Unix socket path")
+
+// adminAgent is the part of the agent the admin socket drives.
+type adminAgent interface {
+	Reconnect(reason string)
+	RotateKey()
+	Status() health.Status
+}
+
+// listenAdmin opens the admin socket at path, readable by the owner only.
+func listenAdmin(path string) (net.Listener, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("%w: %q", errAdminNotUnix, path)
+	}
+	// A socket left behind by a crashed agent would block the bind.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+	// Create the socket owner-only from the start; a chmod after the bind
+	// leaves a window where others can connect.
+	old := syscall.Umask(0o177)
+	ln, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	if err != nil {
+		return nil, fmt.Errorf("admin socket: %w", err)
+	}
+	return ln, nil
+}
+
+// serveAdmin answers admin commands on ln until ctx is done. Each
+// connection sends one command per line: reconnect, reload, rotate-key or
+// status. Replies are "ok", "error: ..." or, for status, a JSON object.
+func serveAdmin(ctx context.Context, ln net.Listener, a adminAgent, reload func() error) {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	log.Printf("admin socket listening on %s", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("WARNING: admin socket: %v", err)
+			}
+			return
+		}
+		go handleAdmin(conn, a, reload)
+	}
+}
+
+func handleAdmin(conn net.Conn, a adminAgent, reload func() error) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(adminTimeout))
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		cmd := strings.TrimSpace(scanner.Text())
+		if cmd == "" {
+			continue
+		}
+		if _, err := fmt.Fprintln(conn, adminCommand(cmd, a, reload)); err != nil {
+			return
+		}
+	}
+}
+
+// adminCommand runs one admin command and returns its reply line.
+func adminCommand(cmd string, a adminAgent, reload func() error) string {
+	log.Printf("admin command: %s", cmd)
+	switch cmd {
+	case "reconnect":
+		a.Reconnect("reconnect requested on the admin socket")
+	case "reload":
+		if err := reload(); err != nil {
+			return "error: " + err.Error()
+		}
+	case "rotate-key":
+		a.RotateKey()
+	case "status":
+		b, err := json.Marshal(a.Status())
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return string(b)
+	default:
+		return fmt.Sprintf("error: unknown command %q (want reconnect, reload, rotate-key or status)", cmd)
+	}
+	return "ok"
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/smarthomeentry/agent/internal/health"
+)
+
+type fakeAdminAgent struct {
+	mu         sync.Mutex
+	reconnects int
+	rotations  int
+}
+
+func (f *fakeAdminAgent) Reconnect(string) {
+	f.mu.Lock()
+	f.reconnects++
+	f.mu.Unlock()
+}
+
+func (f *fakeAdminAgent) RotateKey() {
+	f.mu.Lock()
+	f.rotations++
+	f.mu.Unlock()
+}
+
+func (f *fakeAdminAgent) Status() health.Status {
+	return health.Status{State: health.StateConnected, Relay: "relay.example.com:22"}
+}
+
+func TestAdminSocket_commands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	ln, err := listenAdmin(path)
+	if err != nil {
+		t.Fatalf("listenAdmin: %v", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("socket mode=%v (%v), want 0600", fi.Mode().Perm(), err)
+	}
+
+	fake := &fakeAdminAgent{}
+	reloads := 0
+	reloadErr := error(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveAdmin(ctx, ln, fake, func() error {
+		reloads++
+		return reloadErr
+	})
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	send := func(cmd string) string {
+		t.Helper()
+		if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+			t.Fatalf("write %s: %v", cmd, err)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read reply to %s: %v", cmd, err)
+		}
+		return strings.TrimSpace(line)
+	}
+
+	if got := send("reconnect"); got != "ok" || fake.reconnects != 1 {
+		t.Errorf("reconnect: reply %q, %d reconnects", got, fake.reconnects)
+	}
+	if got := send("rotate-key"); got != "ok" || fake.rotations != 1 {
+		t.Errorf("rotate-key: reply %q, %d rotations", got, fake.rotations)
+	}
+	if got := send("reload"); got != "ok" || reloads != 1 {
+		t.Errorf("reload: reply %q, %d reloads", got, reloads)
+	}
+	reloadErr = errors.New("bad local address")
+	if got := send("reload"); got != "error: bad local address" {
+		t.Errorf("failed reload: reply %q", got)
+	}
+	var st health.Status
+	if err := json.Unmarshal([]byte(send("status")), &st); err != nil || st.Relay != "relay.example.com:22" {
+		t.Errorf("status: %+v (%v)", st, err)
+	}
+	if got := send("shutdown"); !strings.HasPrefix(got, "error: unknown command") {
+		t.Errorf("unknown command: reply %q", got)
+	}
+}
+
+func TestListenAdmin_socketOwnerOnlyUnderPermissiveUmask(t *testing.T) {
+	old := syscall.Umask(0)
+	t.Cleanup(func() { syscall.Umask(old) })
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	ln, err := listenAdmin(path)
+	if err != nil {
+		t.Fatalf("listenAdmin: %v", err)
+	}
+	defer ln.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("socket mode=%v (%v), want 0600 as created", fi.Mode().Perm(), err)
+	}
+	if got := syscall.Umask(0); got != 0 {
+		t.Errorf("umask left at %#o after listenAdmin, want it restored", got)
+	}
+}
+
+func TestListenAdmin_rejectsTCP(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "localhost:7000", "0.0.0.0:0", ":7000", "admin.sock"} {
+		if ln, err := listenAdmin(addr); !errors.Is(err, errAdminNotUnix) {
+			if ln != nil {
+				ln.Close()
+			}
+			t.Errorf("listenAdmin(%q): got %v, want errAdminNotUnix", addr, err)
+		}
+	}
+}
+
+func TestEnvOptions_adminSocketMustBeUnixPath(t *testing.T) {
+	t.Setenv("SMARTHOMEENTRY_ADMIN_SOCKET", "127.0.0.1:7000")
+	if _, err := envOptions(); !errors.Is(err, errAdminNotUnix) {
+		t.Fatalf("envOptions: got %v, want errAdminNotUnix", err)
+	}
+
+	t.Setenv("SMARTHOMEENTRY_ADMIN_SOCKET", "/run/smarthomeentry/admin.sock")
+	opts, err := envOptions()
+	if err != nil {
+		t.Fatalf("envOptions: %v", err)
+	}
+	if opts.AdminSocket != "/run/smarthomeentry/admin.sock" {
+		t.Errorf("AdminSocket=%q, want the configured path", opts.AdminSocket)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Credential names looked up in $CREDENTIALS_DIRECTORY, as set up with
+// LoadCredential= in the systemd unit.
+const (
+	credentialToken = "install-token"
+	credentialKey   = "ssh-key"
+)
+
+// credentialPath returns the path of the systemd credential name, or ""
+// when the agent runs without credentials or that one isn't provided.
+func credentialPath(name string) (string, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return "", nil
+	}
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return "", fmt.Errorf("credential %s: %w", name, err)
+	}
+	return path, nil
+}
+
+// readCredential returns the trimmed contents of the systemd credential
+// name, or "" when it isn't provided.
+func readCredential(name string) (string, error) {
+	path, err := credentialPath(name)
+	if err != nil || path == "" {
+		return "", err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("credential %s: %w", name, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
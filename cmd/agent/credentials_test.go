@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOptions_systemdCredentials(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, credentialToken), []byte("cred-token\n"), 0o400); err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, credentialKey)
+	if err := os.WriteFile(keyPath, []byte("cred-key"), 0o400); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+	t.Setenv("SMARTHOMEENTRY_API_URL", "https://api.example.com")
+	t.Setenv("SMARTHOMEENTRY_INSTALL_TOKEN", "env-token")
+
+	opts, err := loadOptions()
+	if err != nil {
+		t.Fatalf("loadOptions: %v", err)
+	}
+	if opts.Token != "cred-token" {
+		t.Errorf("Token = %q, want the credential", opts.Token)
+	}
+	if opts.CredentialKeyPath != keyPath {
+		t.Errorf("CredentialKeyPath = %q, want %q", opts.CredentialKeyPath, keyPath)
+	}
+}
+
+func TestLoadOptions_credentialsDirectoryWithoutCredentials(t *testing.T) {
+	t.Setenv("CREDENTIALS_DIRECTORY", t.TempDir())
+	t.Setenv("SMARTHOMEENTRY_API_URL", "https://api.example.com")
+	t.Setenv("SMARTHOMEENTRY_INSTALL_TOKEN", "env-token")
+
+	opts, err := loadOptions()
+	if err != nil {
+		t.Fatalf("loadOptions: %v", err)
+	}
+	if opts.Token != "env-token" || opts.CredentialKeyPath != "" {
+		t.Errorf("Token = %q, CredentialKeyPath = %q; want env token and no key", opts.Token, opts.CredentialKeyPath)
+	}
+}
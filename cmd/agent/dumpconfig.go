@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/smarthomeentry/agent/internal/agent"
+)
+
+// redacted replaces secret values in the dumped configuration.
+const redacted = "REDACTED"
+
+// secretOptions are the Options fields whose values are never printed.
+var secretOptions = map[string]bool{
+	"Token":           true,
+	"HeartbeatSecret": true,
+}
+
+// dumpConfig writes the effective configuration derived from opts — every
+// option with agent defaults filled in, plus the fixed file locations — as
+// indented JSON. Secrets and extra header values are redacted.
+func dumpConfig(w io.Writer, opts agent.Options) error {
+	eff := reflect.ValueOf(opts.Effective())
+	options := make(map[string]any, eff.NumField())
+	for i := 0; i < eff.NumField(); i++ {
+		name := eff.Type().Field(i).Name
+		switch v := eff.Field(i).Interface().(type) {
+		case string:
+			if secretOptions[name] && v != "" {
+				v = redacted
+			}
+			options[name] = v
+		case time.Duration:
+			options[name] = v.String()
+		case http.Header:
+			h := make(map[string]string, len(v))
+			for k := range v {
+				h[k] = redacted
+			}
+			options[name] = h
+		default:
+			options[name] = v
+		}
+	}
+
+	paths := agent.Paths()
+	paths["log"] = logFilePath
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]any{
+		"options": options,
+		"paths":   paths,
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDumpConfig_redactsSecrets(t *testing.T) {
+	t.Setenv("SMARTHOMEENTRY_API_URL", "https://api.example.com")
+	t.Setenv("SMARTHOMEENTRY_INSTALL_TOKEN", "tok-very-secret")
+	t.Setenv("SMARTHOMEENTRY_HEARTBEAT_SECRET", "hmac-very-secret")
+	t.Setenv("SMARTHOMEENTRY_EXTRA_HEADERS", "X-Api-Key:header-very-secret")
+	t.Setenv("SMARTHOMEENTRY_WATCHDOG_WINDOW", "90s")
+	t.Setenv("SMARTHOMEENTRY_ADMIN_SOCKET", "/run/smarthomeentry/admin.sock")
+
+	opts, err := loadOptions()
+	if err != nil {
+		t.Fatalf("loadOptions: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := dumpConfig(&buf, opts); err != nil {
+		t.Fatalf("dumpConfig: %v", err)
+	}
+	if strings.Contains(buf.String(), "very-secret") {
+		t.Fatalf("dump leaks a secret:\n%s", buf.String())
+	}
+
+	var dump struct {
+		Options map[string]any    `json:"options"`
+		Paths   map[string]string `json:"paths"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &dump); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	for key, want := range map[string]any{
+		"APIURL":          "https://api.example.com",
+		"Token":           redacted,
+		"HeartbeatSecret": redacted,
+		"LocalAddr":       "localhost:8080",
+		"WatchdogWindow":  "1m30s",
+		"TCPKeepAlive":    "30s",
+		"AdminSocket":     "/run/smarthomeentry/admin.sock",
+	} {
+		if got := dump.Options[key]; got != want {
+			t.Errorf("options[%s] = %v, want %v", key, got, want)
+		}
+	}
+	if _, ok := dump.Options["ExtraHeaders"]; !ok {
+		t.Error("options lack ExtraHeaders")
+	}
+	for _, key := range []string{"key", "lock", "known_hosts", "log"} {
+		if dump.Paths[key] == "" {
+			t.Errorf("paths[%s] is empty", key)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/smarthomeentry/agent/internal/agent"
+	"github.com/smarthomeentry/agent/systemd"
+)
+
+// runInstall implements "smarthomeentry-agent install": first-time setup
+// with interactive host-key confirmation.
+func runInstall(args []string) error {
+	fs := flag.NewFlagSet("install", flag.ContinueOnError)
+	apiURL := fs.String("api-url", os.Getenv("SMARTHOMEENTRY_API_URL"), "control-plane URL")
+	token := fs.String("token", os.Getenv("SMARTHOMEENTRY_INSTALL_TOKEN"), "install token")
+	yes := fs.Bool("yes", false, "trust the relay host key without asking")
+	unit := fs.Bool("systemd-unit", false, "print a systemd unit file to stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *apiURL == "" || *token == "" {
+		return errors.New("install: -api-url and -token (or SMARTHOMEENTRY_API_URL and SMARTHOMEENTRY_INSTALL_TOKEN) are required")
+	}
+
+	// The rest of the environment applies as it does to the service, so
+	// pins, extra headers and the DNS server hold for the install too.
+	env, err := envOptions()
+	if err != nil {
+		return fmt.Errorf("install: %w", err)
+	}
+	env.APIURL, env.Token = *apiURL, *token
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	opts := agent.InstallOptions{Options: env}
+	if !*yes {
+		opts.ConfirmHostKey = func(relay string, key ssh.PublicKey) bool {
+			return confirmHostKey(os.Stdin, os.Stderr, relay, key)
+		}
+	}
+	if _, err := agent.Install(ctx, opts); err != nil {
+		return fmt.Errorf("install: %w", err)
+	}
+
+	if *unit {
+		bin, err := os.Executable()
+		if err != nil {
+			bin = systemd.DefaultBinary
+		}
+		fmt.Print(systemd.Unit(bin))
+	}
+	fmt.Fprintln(os.Stderr, "install complete — put SMARTHOMEENTRY_API_URL and SMARTHOMEENTRY_INSTALL_TOKEN in /etc/smarthomeentry/agent.env and start the service")
+	return nil
+}
+
+// confirmHostKey shows the relay host key fingerprint on out and asks the
+// operator to confirm it on in.
+func confirmHostKey(in io.Reader, out io.Writer, relay string, key ssh.PublicKey) bool {
+	fmt.Fprintf(out, "Relay %s presented host key:\n  %s %s\n", relay, key.Type(), ssh.FingerprintSHA256(key))
+	fmt.Fprint(out, "Trust this host key? [y/N] ")
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
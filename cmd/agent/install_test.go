@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRunInstall_flagsWithoutEnvironment(t *testing.T) {
+	t.Setenv("SMARTHOMEENTRY_API_URL", "")
+	t.Setenv("SMARTHOMEENTRY_INSTALL_TOKEN", "")
+	t.Setenv("CREDENTIALS_DIRECTORY", "")
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	// The test server's certificate isn't trusted, so the install stops at
+	// the first request; it must get that far on the flags alone.
+	err := runInstall([]string{"-api-url", srv.URL, "-token", "flag-token", "-yes"})
+	if err == nil || !strings.Contains(err.Error(), srv.Listener.Addr().String()) {
+		t.Fatalf("runInstall: got %v, want a request to -api-url despite no environment", err)
+	}
+}
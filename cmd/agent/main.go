@@ -3,45 +3,88 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	"github.com/smarthomeentry/agent/internal/agent"
 )
 
-const logFilePath = "/var/log/smarthomeentry.log"
+const (
+	logFilePath = "/var/log/smarthomeentry.log"
+	// runLogFilePath is the first fallback when /var/log isn't writable;
+	// the unit grants write access to /var/run.
+	runLogFilePath = "/var/run/smarthomeentry/agent.log"
+)
 
 func main() {
 	if err := setupLogging(); err != nil {
-		fmt.Fprintf(os.Stderr, "warning: cannot open log file %s: %v\n", logFilePath, err)
+		fmt.Fprintf(os.Stderr, "warning: file logging disabled, no writable log location: %v\n", err)
 	}
 
-	apiURL := os.Getenv("SMARTHOMEENTRY_API_URL")
-	if apiURL == "" {
-		log.Fatal("SMARTHOMEENTRY_API_URL environment variable is required")
+	if len(os.Args) > 1 && os.Args[1] == "install" {
+		if err := runInstall(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	token := os.Getenv("SMARTHOMEENTRY_INSTALL_TOKEN")
-	if token == "" {
-		log.Fatal("SMARTHOMEENTRY_INSTALL_TOKEN environment variable is required")
+	dump := flag.Bool("dump-config", false, "print the effective configuration as JSON, with secrets redacted, and exit")
+	flag.Parse()
+
+	opts, err := loadOptions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *dump {
+		if err := dumpConfig(os.Stdout, opts); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	localAddr := os.Getenv("SMARTHOMEENTRY_LOCAL_ADDR")
+	grace, err := interruptGrace()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	a, err := agent.New(apiURL, token, localAddr)
+	a, err := agent.New(opts)
 	if err != nil {
 		log.Fatalf("agent init: %v", err)
 	}
 	defer a.Close()
+	handleReload(a)
 
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go handleSignals(sigs, cancel, grace, func(code int) {
+		a.Close()
+		os.Exit(code)
+	})
 
-	if err := a.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+	if opts.AdminSocket != "" {
+		ln, err := listenAdmin(opts.AdminSocket)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go serveAdmin(ctx, ln, a, func() error { return reload(a) })
+	}
+
+	err = a.Run(ctx)
+	switch {
+	case errors.Is(err, agent.ErrTokenRevoked):
+		// A clean exit keeps systemd from restarting a decommissioned agent.
+		log.Println("SmartHomeEntry Agent stopped: install token revoked")
+		return
+	case err != nil && !errors.Is(err, context.Canceled):
 		log.Fatalf("agent error: %v", err)
 	}
 
@@ -49,12 +92,36 @@ func main() {
 }
 
 func setupLogging() error {
-	f, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	// No fallback under a shared temporary directory: others could plant
+	// the file or a link there for root to append to.
+	f, err := openLogFile([]string{logFilePath, runLogFilePath})
 	if err != nil {
 		return err
 	}
 	log.SetOutput(io.MultiWriter(os.Stderr, f))
 	log.SetFlags(log.LstdFlags | log.Lmsgprefix)
 	log.SetPrefix("[smarthomeentry-agent] ")
+	if f.Name() != logFilePath {
+		log.Printf("WARNING: %s is not writable — logging to %s instead", logFilePath, f.Name())
+	}
 	return nil
 }
+
+// openLogFile opens the first of paths that can be appended to, creating
+// its directory if needed. A symlink in place of the file is not followed.
+func openLogFile(paths []string) (*os.File, error) {
+	var errs []error
+	for _, p := range paths {
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY|syscall.O_NOFOLLOW, 0o644)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return f, nil
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenLogFile_fallsBackWhenPrimaryUnwritable(t *testing.T) {
+	dir := t.TempDir()
+	// The primary's parent is a regular file, so it can never be created
+	// (this holds even when tests run as root).
+	blocker := filepath.Join(dir, "varlog")
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	primary := filepath.Join(blocker, "smarthomeentry.log")
+	fallback := filepath.Join(dir, "run", "agent.log")
+
+	f, err := openLogFile([]string{primary, fallback})
+	if err != nil {
+		t.Fatalf("openLogFile: %v", err)
+	}
+	defer f.Close()
+
+	if f.Name() != fallback {
+		t.Errorf("using %s, want fallback %s", f.Name(), fallback)
+	}
+	if _, err := f.WriteString("hello\n"); err != nil {
+		t.Fatalf("write to fallback: %v", err)
+	}
+	if data, _ := os.ReadFile(fallback); string(data) != "hello\n" {
+		t.Errorf("fallback file contains %q", data)
+	}
+}
+
+func TestOpenLogFile_noWritableLocation(t *testing.T) {
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := openLogFile([]string{filepath.Join(blocker, "a.log"), filepath.Join(blocker, "b.log")}); err == nil {
+		t.Fatal("expected error when no location is writable")
+	}
+}
+
+func TestOpenLogFile_skipsSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, nil, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	link := filepath.Join(dir, "agent.log")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	fallback := filepath.Join(dir, "run", "agent.log")
+
+	f, err := openLogFile([]string{link, fallback})
+	if err != nil {
+		t.Fatalf("openLogFile: %v", err)
+	}
+	defer f.Close()
+	if f.Name() != fallback {
+		t.Errorf("using %s, want the symlinked path skipped for %s", f.Name(), fallback)
+	}
+}
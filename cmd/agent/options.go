@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smarthomeentry/agent/internal/agent"
+	"github.com/smarthomeentry/agent/internal/api"
+)
+
+// loadOptions builds the agent options from SMARTHOMEENTRY_* environment
+// variables and requires the control-plane URL and install token.
+func loadOptions() (agent.Options, error) {
+	opts, err := envOptions()
+	if err != nil {
+		return opts, err
+	}
+	if opts.APIURL == "" {
+		return opts, errors.New("SMARTHOMEENTRY_API_URL environment variable is required")
+	}
+	if opts.Token == "" {
+		return opts, errors.New("SMARTHOMEENTRY_INSTALL_TOKEN environment variable is required")
+	}
+	return opts, nil
+}
+
+// envOptions builds the agent options from SMARTHOMEENTRY_* environment
+// variables without requiring any of them. Unset optional variables leave
+// the zero value so the agent applies its own defaults.
+func envOptions() (agent.Options, error) {
+	opts := agent.Options{
+		APIURL:     os.Getenv("SMARTHOMEENTRY_API_URL"),
+		Token:      os.Getenv("SMARTHOMEENTRY_INSTALL_TOKEN"),
+		LocalAddr:  os.Getenv("SMARTHOMEENTRY_LOCAL_ADDR"),
+		HealthAddr: os.Getenv("SMARTHOMEENTRY_HEALTH_ADDR"),
+
+		AdminSocket: os.Getenv("SMARTHOMEENTRY_ADMIN_SOCKET"),
+
+		LocalTLSServerName: os.Getenv("SMARTHOMEENTRY_LOCAL_TLS_SERVER_NAME"),
+		LocalTLSCAFile:     os.Getenv("SMARTHOMEENTRY_LOCAL_TLS_CA_FILE"),
+		LocalProxyProtocol: os.Getenv("SMARTHOMEENTRY_LOCAL_PROXY_PROTOCOL"),
+
+		HeartbeatSecret:  os.Getenv("SMARTHOMEENTRY_HEARTBEAT_SECRET"),
+		PinnedCertSHA256: os.Getenv("SMARTHOMEENTRY_PINNED_CERT_SHA256"),
+
+		StatsdAddr:  os.Getenv("SMARTHOMEENTRY_STATSD_ADDR"),
+		PublicIPURL: os.Getenv("SMARTHOMEENTRY_PUBLIC_IP_URL"),
+		LogLevel:    strings.ToLower(os.Getenv("SMARTHOMEENTRY_LOG_LEVEL")),
+		KeyPolicy:   strings.ToLower(os.Getenv("SMARTHOMEENTRY_KEY_POLICY")),
+
+		OnConnect:    os.Getenv("SMARTHOMEENTRY_ON_CONNECT"),
+		OnDisconnect: os.Getenv("SMARTHOMEENTRY_ON_DISCONNECT"),
+	}
+
+	switch opts.LogLevel {
+	case "", agent.LogLevelInfo, agent.LogLevelDebug:
+	default:
+		return opts, fmt.Errorf("SMARTHOMEENTRY_LOG_LEVEL: %q is not %s or %s", opts.LogLevel, agent.LogLevelInfo, agent.LogLevelDebug)
+	}
+	switch opts.KeyPolicy {
+	case "", agent.KeyPolicyConfigWins, agent.KeyPolicyDiskWins, agent.KeyPolicyErrorOnConflict:
+	default:
+		return opts, fmt.Errorf("SMARTHOMEENTRY_KEY_POLICY: %q is not %s, %s or %s", opts.KeyPolicy,
+			agent.KeyPolicyConfigWins, agent.KeyPolicyDiskWins, agent.KeyPolicyErrorOnConflict)
+	}
+	if opts.AdminSocket != "" && !strings.HasPrefix(opts.AdminSocket, "/") {
+		return opts, fmt.Errorf("SMARTHOMEENTRY_ADMIN_SOCKET: %w, got %q", errAdminNotUnix, opts.AdminSocket)
+	}
+
+	// systemd credentials take precedence over the environment.
+	token, err := readCredential(credentialToken)
+	if err != nil {
+		return opts, err
+	}
+	if token != "" {
+		opts.Token = token
+	}
+	if opts.CredentialKeyPath, err = credentialPath(credentialKey); err != nil {
+		return opts, err
+	}
+
+	if opts.TCPKeepAlive, err = envDuration("SMARTHOMEENTRY_TCP_KEEPALIVE"); err != nil {
+		return opts, err
+	}
+	if opts.MaxResponseBytes, err = envInt("SMARTHOMEENTRY_MAX_RESPONSE_BYTES"); err != nil {
+		return opts, err
+	}
+	if opts.SelfTest, err = envBool("SMARTHOMEENTRY_SELF_TEST"); err != nil {
+		return opts, err
+	}
+	schema, err := envInt("SMARTHOMEENTRY_HEARTBEAT_SCHEMA")
+	if err != nil {
+		return opts, err
+	}
+	if schema != 0 && (schema < api.HeartbeatSchemaV1 || schema > api.LatestHeartbeatSchema) {
+		return opts, fmt.Errorf("SMARTHOMEENTRY_HEARTBEAT_SCHEMA: unsupported version %d (supported: %d-%d)",
+			schema, api.HeartbeatSchemaV1, api.LatestHeartbeatSchema)
+	}
+	opts.HeartbeatSchema = int(schema)
+	connLogLimit, err := envInt("SMARTHOMEENTRY_CONN_LOG_LIMIT")
+	if err != nil {
+		return opts, err
+	}
+	opts.ConnLogLimit = int(connLogLimit)
+	maxConns, err := envInt("SMARTHOMEENTRY_MAX_CONNECTIONS")
+	if err != nil {
+		return opts, err
+	}
+	opts.MaxConnections = int(maxConns)
+	connRate, err := envInt("SMARTHOMEENTRY_MAX_CONN_RATE")
+	if err != nil {
+		return opts, err
+	}
+	opts.MaxConnRate = int(connRate)
+	maxTracked, err := envInt("SMARTHOMEENTRY_MAX_TRACKED_CONNS")
+	if err != nil {
+		return opts, err
+	}
+	opts.MaxTrackedConns = int(maxTracked)
+	maxKnownHosts, err := envInt("SMARTHOMEENTRY_MAX_KNOWN_HOSTS")
+	if err != nil {
+		return opts, err
+	}
+	opts.MaxKnownHosts = int(maxKnownHosts)
+	inactiveHBs, err := envInt("SMARTHOMEENTRY_INACTIVE_HEARTBEATS")
+	if err != nil {
+		return opts, err
+	}
+	opts.InactiveHeartbeats = int(inactiveHBs)
+	bufSize, err := envInt("SMARTHOMEENTRY_PROXY_BUFFER_SIZE")
+	if err != nil {
+		return opts, err
+	}
+	opts.ProxyBufferSize = int(bufSize)
+	cpuSamples, err := envInt("SMARTHOMEENTRY_CPU_SAMPLES")
+	if err != nil {
+		return opts, err
+	}
+	opts.CPUSamples = int(cpuSamples)
+	if opts.MetricsInterval, err = envDuration("SMARTHOMEENTRY_METRICS_INTERVAL"); err != nil {
+		return opts, err
+	}
+	// Metrics stay on unless explicitly turned off.
+	if os.Getenv("SMARTHOMEENTRY_METRICS") != "" {
+		on, err := envBool("SMARTHOMEENTRY_METRICS")
+		if err != nil {
+			return opts, err
+		}
+		opts.DisableMetrics = !on
+	}
+	if opts.HeartbeatTimeout, err = envDuration("SMARTHOMEENTRY_HEARTBEAT_TIMEOUT"); err != nil {
+		return opts, err
+	}
+	if opts.KeepAliveInterval, err = envDuration("SMARTHOMEENTRY_KEEPALIVE_INTERVAL"); err != nil {
+		return opts, err
+	}
+	if opts.KeepAliveJitter, err = envFloat("SMARTHOMEENTRY_KEEPALIVE_JITTER"); err != nil {
+		return opts, err
+	}
+	if opts.ProxyIdleTimeout, err = envDuration("SMARTHOMEENTRY_PROXY_IDLE_TIMEOUT"); err != nil {
+		return opts, err
+	}
+	if opts.HeartbeatInterval, err = envDuration("SMARTHOMEENTRY_HEARTBEAT_INTERVAL"); err != nil {
+		return opts, err
+	}
+	if opts.ConnStatsInterval, err = envDuration("SMARTHOMEENTRY_CONN_STATS_INTERVAL"); err != nil {
+		return opts, err
+	}
+	if opts.StatsdInterval, err = envDuration("SMARTHOMEENTRY_STATSD_INTERVAL"); err != nil {
+		return opts, err
+	}
+	if opts.BackoffInitial, err = envDuration("SMARTHOMEENTRY_BACKOFF_INITIAL"); err != nil {
+		return opts, err
+	}
+	if opts.BackoffMax, err = envDuration("SMARTHOMEENTRY_BACKOFF_MAX"); err != nil {
+		return opts, err
+	}
+	if opts.StartupValidationTimeout, err = envDuration("SMARTHOMEENTRY_STARTUP_VALIDATION_TIMEOUT"); err != nil {
+		return opts, err
+	}
+	if opts.TokenRevalidateInterval, err = envDuration("SMARTHOMEENTRY_TOKEN_REVALIDATE_INTERVAL"); err != nil {
+		return opts, err
+	}
+	if opts.StrictFileModes, err = envBool("SMARTHOMEENTRY_STRICT_FILE_MODES"); err != nil {
+		return opts, err
+	}
+	if opts.ReportForwardDenied, err = envBool("SMARTHOMEENTRY_REPORT_FORWARD_DENIED"); err != nil {
+		return opts, err
+	}
+	if opts.ConfigRefreshInterval, err = envDuration("SMARTHOMEENTRY_CONFIG_REFRESH_INTERVAL"); err != nil {
+		return opts, err
+	}
+	if opts.FirstHeartbeatDelay, err = envDuration("SMARTHOMEENTRY_FIRST_HEARTBEAT_DELAY"); err != nil {
+		return opts, err
+	}
+	if opts.FirstHeartbeatWindow, err = envDuration("SMARTHOMEENTRY_FIRST_HEARTBEAT_WINDOW"); err != nil {
+		return opts, err
+	}
+	if opts.PreflightTimeout, err = envDuration("SMARTHOMEENTRY_PREFLIGHT_TIMEOUT"); err != nil {
+		return opts, err
+	}
+	if opts.WatchdogWindow, err = envDuration("SMARTHOMEENTRY_WATCHDOG_WINDOW"); err != nil {
+		return opts, err
+	}
+	if opts.PublicIPInterval, err = envDuration("SMARTHOMEENTRY_PUBLIC_IP_INTERVAL"); err != nil {
+		return opts, err
+	}
+	if opts.LocalHealthInterval, err = envDuration("SMARTHOMEENTRY_LOCAL_HEALTH_INTERVAL"); err != nil {
+		return opts, err
+	}
+	if opts.DrainTimeout, err = envDuration("SMARTHOMEENTRY_DRAIN_TIMEOUT"); err != nil {
+		return opts, err
+	}
+	if opts.DeadlockTimeout, err = envDuration("SMARTHOMEENTRY_DEADLOCK_TIMEOUT"); err != nil {
+		return opts, err
+	}
+	opts.DNSServer = os.Getenv("SMARTHOMEENTRY_DNS_SERVER")
+	if opts.WakePollInterval, err = envDuration("SMARTHOMEENTRY_WAKE_POLL_INTERVAL"); err != nil {
+		return opts, err
+	}
+	if opts.StrictRelayCheck, err = envBool("SMARTHOMEENTRY_STRICT_RELAY_CHECK"); err != nil {
+		return opts, err
+	}
+	if opts.StrictBind, err = envBool("SMARTHOMEENTRY_STRICT_BIND"); err != nil {
+		return opts, err
+	}
+	if opts.StrictRelayOrder, err = envBool("SMARTHOMEENTRY_STRICT_RELAY_ORDER"); err != nil {
+		return opts, err
+	}
+	// Trust on first use stays on unless explicitly turned off.
+	if os.Getenv("SMARTHOMEENTRY_TOFU") != "" {
+		tofu, err := envBool("SMARTHOMEENTRY_TOFU")
+		if err != nil {
+			return opts, err
+		}
+		opts.DisableTOFU = !tofu
+	}
+	if opts.SSHHeartbeatFallback, err = envBool("SMARTHOMEENTRY_SSH_HEARTBEAT_FALLBACK"); err != nil {
+		return opts, err
+	}
+	if opts.EventHeartbeats, err = envBool("SMARTHOMEENTRY_EVENT_HEARTBEATS"); err != nil {
+		return opts, err
+	}
+	if opts.DebugForward, err = envBool("SMARTHOMEENTRY_DEBUG_FORWARD"); err != nil {
+		return opts, err
+	}
+	if opts.LocalTLS, err = envBool("SMARTHOMEENTRY_LOCAL_TLS"); err != nil {
+		return opts, err
+	}
+	if opts.RelaySRV, err = envBool("SMARTHOMEENTRY_RELAY_SRV"); err != nil {
+		return opts, err
+	}
+	if opts.RefuseRedirects, err = envBool("SMARTHOMEENTRY_REFUSE_REDIRECTS"); err != nil {
+		return opts, err
+	}
+	if opts.DisableLock, err = envBool("SMARTHOMEENTRY_DISABLE_LOCK"); err != nil {
+		return opts, err
+	}
+	if opts.WatchKey, err = envBool("SMARTHOMEENTRY_WATCH_KEY"); err != nil {
+		return opts, err
+	}
+	if spec := os.Getenv("SMARTHOMEENTRY_EXTRA_HEADERS"); spec != "" {
+		var ignored []string
+		opts.ExtraHeaders, ignored = api.ParseHeaders(spec)
+		for _, entry := range ignored {
+			log.Printf("ignoring malformed SMARTHOMEENTRY_EXTRA_HEADERS entry %q", entry)
+		}
+	}
+	return opts, nil
+}
+
+// envDuration parses a Go duration string (e.g. "30s") from the named
+// variable. An unset variable yields zero.
+func envDuration(name string) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid duration %q: %w", name, v, err)
+	}
+	return d, nil
+}
+
+// envInt parses a base-10 integer from the named variable. An unset variable
+// yields zero.
+func envInt(name string) (int64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid integer %q: %w", name, v, err)
+	}
+	return n, nil
+}
+
+// envFloat parses a decimal number from the named variable. An unset
+// variable yields zero.
+func envFloat(name string) (float64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid number %q: %w", name, v, err)
+	}
+	return f, nil
+}
+
+// envBool parses a boolean (1/0, true/false, on/off) from the named variable.
+// An unset variable yields false.
+func envBool(name string) (bool, error) {
+	switch v := strings.ToLower(os.Getenv(name)); v {
+	case "", "0", "false", "off", "no":
+		return false, nil
+	case "1", "true", "on", "yes":
+		return true, nil
+	default:
+		return false, fmt.Errorf("%s: invalid boolean %q", name, v)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/smarthomeentry/agent/internal/agent"
+)
+
+// envFilePath is the EnvironmentFile of the systemd unit. Environment
+// variables of a running process can't be changed from outside, so SIGHUP
+// re-reads reloadable settings from here.
+const envFilePath = "/etc/smarthomeentry/agent.env"
+
+// handleReload applies SMARTHOMEENTRY_LOCAL_ADDR from envFilePath to a on
+// every SIGHUP (systemctl reload).
+func handleReload(a *agent.Agent) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Printf("SIGHUP received — reloading the local address from %s", envFilePath)
+			if err := reload(a); err != nil {
+				log.Printf("WARNING: reload: %v", err)
+			}
+		}
+	}()
+}
+
+// reload applies SMARTHOMEENTRY_LOCAL_ADDR from envFilePath to a.
+func reload(a *agent.Agent) error {
+	env, err := readEnvFile(envFilePath)
+	if err != nil {
+		return err
+	}
+	if err := a.SetLocalAddr(env["SMARTHOMEENTRY_LOCAL_ADDR"]); err != nil {
+		return fmt.Errorf("keeping the current local address: %w", err)
+	}
+	return nil
+}
+
+// readEnvFile parses the KEY=VALUE lines of a systemd environment file,
+// skipping blank lines and # or ; comments and stripping matching quotes
+// around values.
+func readEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if n := len(value); n >= 2 && (value[0] == '"' || value[0] == '\'') && value[n-1] == value[0] {
+			value = value[1 : n-1]
+		}
+		env[strings.TrimSpace(key)] = value
+	}
+	return env, scanner.Err()
+}
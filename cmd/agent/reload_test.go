@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.env")
+	content := "# comment\n\nSMARTHOMEENTRY_API_URL=https://api.example.com\n" +
+		"SMARTHOMEENTRY_LOCAL_ADDR = \"localhost:8123\"\n; other comment\nnot a setting\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	env, err := readEnvFile(path)
+	if err != nil {
+		t.Fatalf("readEnvFile: %v", err)
+	}
+	if got := env["SMARTHOMEENTRY_LOCAL_ADDR"]; got != "localhost:8123" {
+		t.Errorf("local addr=%q, want localhost:8123", got)
+	}
+	if got := env["SMARTHOMEENTRY_API_URL"]; got != "https://api.example.com" {
+		t.Errorf("api url=%q", got)
+	}
+	if len(env) != 2 {
+		t.Errorf("parsed %d entries, want 2: %v", len(env), env)
+	}
+}
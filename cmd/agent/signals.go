@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+// defaultInterruptGrace is how long a shutdown started with Ctrl-C may take
+// before the agent exits anyway.
+const defaultInterruptGrace = 3 * time.Second
+
+// exitInterrupted is the exit status of a forced stop, as a shell reports
+// a process killed by SIGINT.
+const exitInterrupted = 130
+
+// handleSignals cancels the agent on the first SIGINT or SIGTERM. SIGTERM,
+// as sent by systemd, lets the shutdown drain open connections for as long
+// as it takes. SIGINT comes from an operator at a terminal: a second one,
+// or the shutdown outlasting grace (unless negative), calls exit without
+// waiting for the drain. It returns when sigs is closed.
+func handleSignals(sigs <-chan os.Signal, cancel context.CancelFunc, grace time.Duration, exit func(code int)) {
+	var force <-chan time.Time
+	stopping := false
+	for {
+		select {
+		case sig, ok := <-sigs:
+			if !ok {
+				return
+			}
+			switch {
+			case sig == syscall.SIGINT && stopping:
+				log.Println("interrupted again — exiting without waiting for the shutdown")
+				exit(exitInterrupted)
+				return
+			case sig == syscall.SIGINT:
+				log.Println("interrupted — shutting down; interrupt again to exit immediately")
+				if grace > 0 {
+					force = time.After(grace)
+				}
+			case stopping:
+				log.Printf("%v received — already shutting down", sig)
+			default:
+				log.Printf("%v received — shutting down gracefully", sig)
+			}
+			stopping = true
+			cancel()
+		case <-force:
+			log.Printf("shutdown still running %s after the interrupt — exiting immediately", grace)
+			exit(exitInterrupted)
+			return
+		}
+	}
+}
+
+// interruptGrace returns the SIGINT grace period from
+// SMARTHOMEENTRY_INTERRUPT_GRACE: unset or zero selects
+// defaultInterruptGrace, negative waits for a second SIGINT only.
+func interruptGrace() (time.Duration, error) {
+	d, err := envDuration("SMARTHOMEENTRY_INTERRUPT_GRACE")
+	if err != nil || d != 0 {
+		return d, err
+	}
+	return defaultInterruptGrace, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHandleSignals(t *testing.T) {
+	tests := []struct {
+		name     string
+		sigs     []os.Signal
+		grace    time.Duration
+		wantExit bool
+	}{
+		{"SIGTERM drains", []os.Signal{syscall.SIGTERM}, 20 * time.Millisecond, false},
+		{"second SIGTERM still drains", []os.Signal{syscall.SIGTERM, syscall.SIGTERM}, 20 * time.Millisecond, false},
+		{"second SIGINT forces exit", []os.Signal{syscall.SIGINT, syscall.SIGINT}, time.Hour, true},
+		{"SIGINT after SIGTERM forces exit", []os.Signal{syscall.SIGTERM, syscall.SIGINT}, time.Hour, true},
+		{"SIGINT forces exit after grace", []os.Signal{syscall.SIGINT}, 20 * time.Millisecond, true},
+		{"SIGINT without grace waits", []os.Signal{syscall.SIGINT}, -1, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			sigs := make(chan os.Signal, len(tc.sigs))
+			exited := make(chan int, 1)
+			done := make(chan struct{})
+			go func() {
+				handleSignals(sigs, cancel, tc.grace, func(code int) { exited <- code })
+				close(done)
+			}()
+
+			for _, sig := range tc.sigs {
+				sigs <- sig
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+				t.Fatal("first signal did not cancel the agent")
+			}
+
+			select {
+			case code := <-exited:
+				if !tc.wantExit {
+					t.Fatalf("forced exit with status %d, want a graceful shutdown", code)
+				}
+				if code != exitInterrupted {
+					t.Errorf("exit status %d, want %d", code, exitInterrupted)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tc.wantExit {
+					t.Fatal("no forced exit")
+				}
+				close(sigs)
+			}
+			<-done
+		})
+	}
+}
+
+func TestInterruptGrace(t *testing.T) {
+	tests := []struct {
+		env  string
+		want time.Duration
+	}{
+		{"", defaultInterruptGrace},
+		{"0", defaultInterruptGrace},
+		{"10s", 10 * time.Second},
+		{"-1s", -time.Second},
+	}
+	for _, tc := range tests {
+		t.Setenv("SMARTHOMEENTRY_INTERRUPT_GRACE", tc.env)
+		got, err := interruptGrace()
+		if err != nil || got != tc.want {
+			t.Errorf("%q: got %s, %v; want %s", tc.env, got, err, tc.want)
+		}
+	}
+	t.Setenv("SMARTHOMEENTRY_INTERRUPT_GRACE", "soon")
+	if _, err := interruptGrace(); err == nil {
+		t.Error("expected an error for an invalid duration")
+	}
+}
@@ -2,6 +2,7 @@ module github.com/smarthomeentry/agent
 
 go 1.22
 
-require golang.org/x/crypto v0.21.0
-
-require golang.org/x/sys v0.18.0 // indirect
+require (
+	golang.org/x/crypto v0.21.0
+	golang.org/x/sys v0.18.0
+)
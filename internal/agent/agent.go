@@ -2,147 +2,907 @@ package agent
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/smarthomeentry/agent/internal/api"
+	"github.com/smarthomeentry/agent/internal/atomicfile"
 	"github.com/smarthomeentry/agent/internal/backoff"
+	"github.com/smarthomeentry/agent/internal/health"
 	"github.com/smarthomeentry/agent/internal/metrics"
+	"github.com/smarthomeentry/agent/internal/sdnotify"
+	"github.com/smarthomeentry/agent/internal/statsd"
 	"github.com/smarthomeentry/agent/internal/tunnel"
 )
 
 const (
 	keyFilePath          = "/etc/smarthomeentry/agent_key"
-	configDir            = "/etc/smarthomeentry"
 	defaultLocalAddr     = "localhost:8080"
 	inactivePollInterval = 5 * time.Minute
 	stableThreshold      = time.Minute
+	// defaultStartupValidationTimeout is how long startup token validation
+	// retries transient errors.
+	defaultStartupValidationTimeout = 5 * time.Minute
+	// defaultConnStatsInterval is how often connection counters are
+	// logged when they changed.
+	defaultConnStatsInterval = 10 * time.Minute
+	// shutdownHeartbeatTimeout bounds the final heartbeat sent while the
+	// agent is shutting down.
+	shutdownHeartbeatTimeout = 5 * time.Second
+	defaultKeyWatchInterval  = 30 * time.Second
+
+	// fatalReportTimeout bounds the error report sent before exiting on an
+	// unrecoverable failure.
+	fatalReportTimeout = 5 * time.Second
+
+	// defaultDrainTimeout is how long a torn-down tunnel waits for the
+	// connections it is proxying to finish.
+	defaultDrainTimeout = 10 * time.Second
+
+	// defaultStatsdInterval is how often metrics are pushed to statsd.
+	defaultStatsdInterval = 10 * time.Second
+	// metricsNowTimeout bounds collecting and sending an on-demand metrics
+	// snapshot.
+	metricsNowTimeout = 15 * time.Second
+	// diskKeyRejectLimit is how many consecutive relay rejections of the
+	// key on disk make the agent ask the control plane for a fresh key.
+	diskKeyRejectLimit = 2
+)
+
+// Values for Options.LogLevel.
+const (
+	LogLevelInfo  = "info"
+	LogLevelDebug = "debug"
 )
 
 // ErrTokenRevoked signals that the control plane rejected our token during
 // periodic re-validation (HTTP 401/403). The agent should stop gracefully.
 var ErrTokenRevoked = fmt.Errorf("install token revoked by control plane")
 
+// errReconnect marks a deliberate teardown of a healthy tunnel (e.g. the key
+// changed on disk). Run reconnects immediately without consulting backoff.
+var errReconnect = errors.New("reconnect requested")
+
+// errFetchConfig wraps a failure to fetch the config at the start of a
+// cycle.
+var errFetchConfig = errors.New("fetch config")
+
+// errDiskKeyRejected means the relay keeps rejecting the key on disk and
+// the control plane, asked for a fresh key, sent none.
+var errDiskKeyRejected = errors.New("SSH key on disk rejected by relay")
+
+// Options configures an Agent. Zero values select the built-in defaults.
+type Options struct {
+	APIURL    string
+	Token     string
+	LocalAddr string
+
+	// TCPKeepAlive is the TCP keepalive period applied to proxied
+	// connections. Zero selects the tunnel default, negative disables it.
+	TCPKeepAlive time.Duration
+
+	// MaxResponseBytes caps control-plane response bodies. Zero selects
+	// api.DefaultMaxBodySize.
+	MaxResponseBytes int64
+
+	// SelfTest enables the local proxy and relay loopback self-tests after
+	// each connect (see tunnel.Config.SelfTest).
+	SelfTest bool
+
+	// ExtraHeaders are sent with every control-plane request.
+	ExtraHeaders http.Header
+
+	// HeartbeatSchema pins the heartbeat payload schema version. Zero
+	// selects api.LatestHeartbeatSchema.
+	HeartbeatSchema int
+
+	// MetricsInterval samples host metrics in the background at this
+	// interval, with heartbeats reusing the latest sample. Zero samples on
+	// demand for each heartbeat.
+	MetricsInterval time.Duration
+	// DisableMetrics turns host metrics sampling off entirely: heartbeats
+	// are sent bare and on-demand metrics requests are ignored.
+	DisableMetrics bool
+
+	// WatchKey polls the SSH key file while connected and reconnects when
+	// it changes, so out-of-band key rotations take effect promptly.
+	WatchKey bool
+
+	// HealthAddr, if set, serves /status and /healthz on a loopback
+	// "host:port" or a Unix socket given as "unix:/path/to.sock".
+	HealthAddr string
+
+	// AdminSocket is the path of the owner-only Unix socket the command
+	// serves admin commands on. The agent itself doesn't open it.
+	AdminSocket string
+
+	// OnConnect and OnDisconnect are commands run in the background when
+	// the tunnel comes up or goes down. Details are passed in the
+	// environment as SMARTHOMEENTRY_EVENT, SMARTHOMEENTRY_RELAY,
+	// SMARTHOMEENTRY_BIND_ADDR and, on disconnect, SMARTHOMEENTRY_ERROR.
+	OnConnect    string
+	OnDisconnect string
+
+	// StrictRelayCheck fails the connect when the relay host resolves to a
+	// loopback or local address instead of only warning.
+	StrictRelayCheck bool
+	// PreflightTimeout, if positive, bounds the TCP connect to the relay's
+	// SSH port so an unreachable relay fails fast.
+	PreflightTimeout time.Duration
+	// StrictRelayOrder tries relay addresses in DNS order instead of
+	// preferring the one with the lowest measured latency.
+	StrictRelayOrder bool
+	// StrictBind fails the tunnel when the relay turns out to have bound the
+	// reverse forward to a port other than the configured tunnel port,
+	// instead of warning.
+	StrictBind bool
+
+	// MaxKnownHosts caps the entries kept in known_hosts. Zero selects
+	// tunnel.DefaultMaxKnownHosts, negative disables pruning.
+	MaxKnownHosts int
+
+	// DisableTOFU requires relay host keys to be pre-provisioned in
+	// known_hosts rather than trusted on first use.
+	DisableTOFU bool
+
+	// CredentialKeyPath is a read-only, pre-provisioned SSH private key,
+	// typically a systemd credential. When set it is used instead of the
+	// key delivered in config or stored on disk.
+	CredentialKeyPath string
+
+	// KeyPolicy decides which SSH key wins when the config delivers one
+	// that differs from the key on disk: KeyPolicyConfigWins (the
+	// default), KeyPolicyDiskWins or KeyPolicyErrorOnConflict.
+	KeyPolicy string
+
+	// LogLevel is LogLevelInfo (the default) or LogLevelDebug, which adds
+	// a log line for every proxied connection opened and closed and a
+	// per-phase breakdown of how long the tunnel took to come up.
+	LogLevel string
+
+	// DebugForward logs the raw reverse-forward request and the relay's
+	// reply.
+	DebugForward bool
+
+	// PinnedCertSHA256 is a comma-separated list of SHA-256 fingerprints
+	// (hex, colons optional). When set, the control plane must present a
+	// matching leaf or intermediate certificate in addition to passing
+	// normal verification.
+	PinnedCertSHA256 string
+
+	// RefuseRedirects fails control-plane requests that are redirected to
+	// another host. By default such redirects are followed with the token
+	// and extra headers stripped.
+	RefuseRedirects bool
+
+	// PublicIPURL, if set, is an IP-echo service queried in the background
+	// for the agent's public egress IP, which heartbeats then report. The
+	// lookup repeats every PublicIPInterval (zero selects
+	// defaultPublicIPInterval).
+	PublicIPURL      string
+	PublicIPInterval time.Duration
+
+	// LocalHealthInterval, if positive, probes the local service this
+	// often. While it is down the tunnel and heartbeats stay up, relay
+	// connections are closed immediately and status reports the local
+	// service as down.
+	LocalHealthInterval time.Duration
+
+	// WakePollInterval, if positive, pings the heartbeat endpoint at this
+	// interval while the agent is deactivated, so reactivation is noticed
+	// before the next full config poll.
+	WakePollInterval time.Duration
+
+	// LocalTLS speaks TLS to the local service. LocalTLSServerName
+	// overrides the name verified against its certificate (default: host
+	// of LocalAddr) and LocalTLSCAFile adds a PEM bundle of trusted CAs,
+	// e.g. for a self-signed certificate.
+	LocalTLS           bool
+	LocalTLSServerName string
+	LocalTLSCAFile     string
+
+	// LocalProxyProtocol ("v1" or "v2") sends a PROXY protocol header with
+	// the visitor address to the local service. Empty or "off" disables it.
+	LocalProxyProtocol string
+
+	// ConnLogLimit caps per-connection log lines per minute. Zero selects
+	// the tunnel default, negative disables the limit.
+	ConnLogLimit int
+
+	// ProxyBufferSize is the per-direction copy buffer of each proxied
+	// connection in bytes. Zero selects tunnel.DefaultProxyBufferSize.
+	ProxyBufferSize int
+
+	// RelaySRV locates the relay's SSH endpoint through the
+	// _ssh._tcp.<host> SRV record when the config carries no port.
+	RelaySRV bool
+	// DNSServer, if set, is the IP address (optionally with a port) of the
+	// DNS server used to resolve the control plane and relay hosts,
+	// bypassing the system resolver.
+	DNSServer string
+
+	// HeartbeatTimeout bounds each heartbeat (including token
+	// re-validation). Zero selects the tunnel default.
+	HeartbeatTimeout time.Duration
+
+	// DisableLock skips the single-instance PID lock, for containers that
+	// are guaranteed to run one agent and may lack a writable /var/run.
+	DisableLock bool
+
+	// CPUSamples averages this many CPU readings per metrics sample and
+	// reports the peak alongside. Readings are spread across
+	// MetricsInterval when set, otherwise taken 1s apart (so keep it small
+	// relative to the heartbeat timeout). Zero or one takes a single reading.
+	CPUSamples int
+
+	// HeartbeatSecret, if set, HMAC-signs every heartbeat with a timestamp
+	// and nonce so the control plane can reject replays.
+	HeartbeatSecret string
+
+	// KeepAliveInterval, ProxyIdleTimeout and HeartbeatInterval override
+	// the values pushed by the control plane, which in turn override the
+	// tunnel defaults. Zero leaves the decision to the control plane.
+	KeepAliveInterval time.Duration
+	ProxyIdleTimeout  time.Duration
+	HeartbeatInterval time.Duration
+	// SSHHeartbeatFallback relays heartbeats through the relay's SSH
+	// connection once HTTPS heartbeats keep failing while the tunnel is
+	// up. The relay must support forwarding them. It is ignored when
+	// HeartbeatSecret is set, since the SSH request has nowhere to carry
+	// the signature.
+	SSHHeartbeatFallback bool
+	// EventHeartbeats sends a heartbeat right away, besides the periodic
+	// ones, when the tunnel or the local service goes up or down, at most
+	// once every few seconds.
+	EventHeartbeats bool
+	// KeepAliveJitter randomises each keepalive period by up to this
+	// fraction either way. Zero selects tunnel.DefaultKeepAliveJitter,
+	// negative disables it.
+	KeepAliveJitter float64
+	// FirstHeartbeatDelay delays the first heartbeat after connecting.
+	// Zero sends it right away; negative waits one heartbeat interval.
+	FirstHeartbeatDelay time.Duration
+
+	// FirstHeartbeatWindow forces a reconnect when no heartbeat succeeds
+	// this long after the tunnel comes up. Zero disables it.
+	FirstHeartbeatWindow time.Duration
+
+	// InactiveHeartbeats is how many consecutive heartbeats must report
+	// the agent inactive before the tunnel is closed. Zero or one closes
+	// it on the first.
+	InactiveHeartbeats int
+
+	// WatchdogWindow forces a reconnect when the tunnel sees neither a
+	// successful heartbeat nor an incoming connection for this long. Zero
+	// disables the watchdog.
+	WatchdogWindow time.Duration
+
+	// MaxConnections caps concurrently proxied connections. Zero means no
+	// limit beyond MaxTrackedConns.
+	MaxConnections int
+	// MaxTrackedConns bounds the connection tracking table. Zero selects
+	// tunnel.DefaultMaxTrackedConns, negative leaves it unbounded.
+	MaxTrackedConns int
+	// MaxConnRate tears the tunnel down and backs off when the relay opens
+	// more connections than this within a minute. Zero disables it.
+	MaxConnRate int
+	// ConnStatsInterval is how often connection counters are summarised
+	// in the log. Zero selects defaultConnStatsInterval; negative disables
+	// the summary.
+	ConnStatsInterval time.Duration
+	// DrainTimeout is how long a tunnel being torn down (for a reconnect
+	// or shutdown) keeps proxying open connections after releasing its
+	// port. Zero selects defaultDrainTimeout; negative closes them at once.
+	DrainTimeout time.Duration
+	// DeadlockTimeout exits the process when the reconnect loop and the
+	// tunnel heartbeat show no progress for this long, so a supervisor can
+	// restart a deadlocked agent. Zero selects defaultDeadlockTimeout;
+	// negative disables the watchdog.
+	DeadlockTimeout time.Duration
+
+	// StatsdAddr, if set, pushes the /metrics counters and gauges to a
+	// statsd collector at this UDP host:port every StatsdInterval (zero
+	// selects defaultStatsdInterval).
+	StatsdAddr     string
+	StatsdInterval time.Duration
+
+	// BackoffInitial and BackoffMax tune the retry delays used for
+	// reconnects and startup token validation. Zero keeps the backoff
+	// package defaults.
+	BackoffInitial time.Duration
+	BackoffMax     time.Duration
+	// StartupValidationTimeout caps how long transient failures of the
+	// startup token validation are retried before giving up. Zero selects
+	// defaultStartupValidationTimeout.
+	StartupValidationTimeout time.Duration
+	// TokenRevalidateInterval, if positive, re-validates the install token
+	// at this interval for the whole run. A definitive rejection (HTTP
+	// 401/403) stops the agent with ErrTokenRevoked instead of leaving it
+	// retrying a decommissioned token. Zero disables it.
+	TokenRevalidateInterval time.Duration
+
+	// ConfigRefreshInterval, if positive, re-fetches the config at this
+	// interval while the tunnel is up and reconnects when a setting the
+	// tunnel depends on changed. Zero only fetches it on reconnect.
+	ConfigRefreshInterval time.Duration
+
+	// ReportForwardDenied sends a heartbeat naming the tunnel port when the
+	// relay refuses its reverse forward, so the control plane can assign
+	// another port or relay.
+	ReportForwardDenied bool
+
+	// StrictFileModes refuses to start when the SSH key or known_hosts is
+	// accessible to other users, instead of fixing its mode to 0600.
+	StrictFileModes bool
+}
+
 type Agent struct {
-	api       *api.Client
-	bo        *backoff.Backoff
-	lockFH    *os.File
-	localAddr string
+	api *api.Client
+	// bo holds reconnect backoff state per relay address, so a long outage
+	// of one relay doesn't slow reconnecting to another. Failures before a
+	// relay is known (e.g. config fetch) are tracked under the empty key.
+	bo    map[string]*backoff.Backoff
+	relay string
+	// heartbeatURL is the last heartbeat URL from config, used by the wake
+	// poll while inactive.
+	heartbeatURL string
+	// maintenanceUntil is the end of the maintenance window the last
+	// config announced, zero outside one.
+	maintenanceUntil time.Time
+	// keySource reports where the SSH key of the current cycle came from
+	// (a string). It is read by heartbeats sent outside the cycle.
+	keySource atomic.Value
+	// wantFreshKey asks the control plane for a new key on the next config
+	// fetch, set once the relay repeatedly rejects the key on disk.
+	wantFreshKey bool
+	// hostKeyAlgo is the relay host key type of the current connection
+	// (a string).
+	hostKeyAlgo atomic.Value
+	addrs       *tunnel.AddrTracker
+	connStats   *tunnel.ConnStats
+	rtt         *tunnel.RTT
+	lockFH      *os.File
+	closeOnce   sync.Once
+	localAddr   string
+	localTLS    *tls.Config
+	// proxyProto is the parsed LocalProxyProtocol.
+	proxyProto int
+	opts       Options
+	keyPath    string
+
+	keyWatchInterval time.Duration
+
+	runTunnel func(context.Context, *tunnel.Config) error
+	metrics   *metrics.Collector
+	status    *health.Tracker
+	// notify reports readiness and status to systemd; nil outside systemd.
+	notify *sdnotify.Notifier
+
+	// mu guards localAddr, which SetLocalAddr may change while running,
+	// and cancelCycle, which tears down the current tunnel.
+	mu          sync.Mutex
+	cancelCycle context.CancelCauseFunc
+	// wake cuts a backoff sleep short when Reconnect is called between
+	// cycles.
+	wake chan struct{}
+	// rotateKey asks the next config fetch for a fresh SSH key.
+	rotateKey atomic.Bool
+	// events queues state transitions for event heartbeats; nil unless
+	// EventHeartbeats is set.
+	events *heartbeatEvents
+	// resolver resolves relay hosts; nil selects the system resolver.
+	resolver tunnel.Resolver
+
+	// tunnelUps counts tunnels brought up, for the reconnects metric.
+	tunnelUps atomic.Uint64
+	// publicIP is nil unless PublicIPURL is set.
+	publicIP *publicIP
+	// connectDuration holds the last tunnel's establishment time until
+	// the first heartbeat after connecting reports it.
+	connectDuration atomic.Int64
+	// backoffWait is the backoff being slept before the current connect
+	// attempt, zero once a tunnel is up.
+	backoffWait atomic.Int64
+	// lastErrCategory holds the errorCategory of the latest cycle error.
+	lastErrCategory atomic.Value
+	// localDown is set while the local service health probe fails.
+	localDown atomic.Bool
+	// lastHeartbeat is the latest heartbeat built, resent over SSH when
+	// the HTTPS path fails.
+	lastHeartbeat atomic.Pointer[api.Heartbeat]
+	// metricsNowBusy is set while an on-demand metrics snapshot is being
+	// sent, so repeated requests don't pile up.
+	metricsNowBusy atomic.Bool
+	// tunnelPort is the relay port the current cycle forwards, compared
+	// with the one heartbeat responses announce.
+	tunnelPort atomic.Int64
+	// beacon is advanced by the reconnect loop and tunnel heartbeats for
+	// the deadlock watchdog.
+	beacon beacon
+	// exit ends the process when the deadlock watchdog fires; nil selects
+	// os.Exit.
+	exit func(code int)
 }
 
-func New(apiURL, token, localAddr string) (*Agent, error) {
-	client, err := api.New(apiURL, token)
+func New(opts Options) (*Agent, error) {
+	resolver, err := dnsResolver(opts.DNSServer)
 	if err != nil {
-		return nil, fmt.Errorf("api client: %w", err)
+		return nil, err
+	}
+	client, err := newAPIClient(opts, resolver)
+	if err != nil {
+		return nil, err
 	}
 
-	lockFH, err := acquireLock()
+	localAddr, err := normalizeLocalAddr(opts.LocalAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	localTLS, err := localTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	proxyProto, err := tunnel.ParseProxyProtocol(opts.LocalProxyProtocol)
 	if err != nil {
+		return nil, fmt.Errorf("local PROXY protocol: %w", err)
+	}
+
+	if err := checkSecretFiles(opts.StrictFileModes, keyFilePath, tunnel.KnownHostsPath); err != nil {
+		return nil, err
+	}
+
+	var lockFH *os.File
+	if opts.DisableLock {
+		log.Println("WARNING: instance lock disabled — make sure only one agent runs with this key")
+	} else if lockFH, err = acquireLock(lockFilePath); err != nil {
 		return nil, err
 	}
 
-	if localAddr == "" {
-		localAddr = defaultLocalAddr
+	if opts.SSHHeartbeatFallback && opts.HeartbeatSecret != "" {
+		log.Println("WARNING: SSH heartbeat fallback disabled — it can't carry the heartbeat signature required by the heartbeat secret")
+	}
+
+	collector := metrics.NewCollector(opts.MetricsInterval, collectFunc(opts),
+		metrics.WithWindow(sampleWindow(opts)))
+	var pubIP *publicIP
+	if opts.PublicIPURL != "" {
+		pubIP = newPublicIP(opts.PublicIPURL, opts.PublicIPInterval)
+	}
+
+	a := &Agent{
+		api:        client,
+		bo:         make(map[string]*backoff.Backoff),
+		addrs:      tunnel.NewAddrTracker(),
+		connStats:  tunnel.NewConnStats(),
+		rtt:        tunnel.NewRTT(),
+		lockFH:     lockFH,
+		localAddr:  localAddr,
+		localTLS:   localTLS,
+		proxyProto: proxyProto,
+		opts:       opts,
+		keyPath:    keyFilePath,
+
+		keyWatchInterval: defaultKeyWatchInterval,
+		runTunnel:        tunnel.Run,
+		metrics:          collector,
+		status:           health.NewTracker(),
+		notify:           sdnotify.FromEnv(),
+		publicIP:         pubIP,
+		wake:             make(chan struct{}, 1),
+		exit:             os.Exit,
 	}
+	if resolver != nil {
+		// Only a non-nil resolver, so the interface stays nil otherwise.
+		a.resolver = resolver
+	}
+	if opts.EventHeartbeats {
+		a.events = newHeartbeatEvents(defaultEventDebounce)
+	}
+	return a, nil
+}
 
-	return &Agent{
-		api:       client,
-		bo:        backoff.New(),
-		lockFH:    lockFH,
-		localAddr: localAddr,
-	}, nil
+// newAPIClient builds the control-plane client from opts, resolving hosts
+// with resolver (nil for the system resolver). Install uses it too, so
+// first-time setup honours the same pins, headers and redirect policy.
+func newAPIClient(opts Options, resolver *net.Resolver) (*api.Client, error) {
+	pins, err := api.ParseCertPins(opts.PinnedCertSHA256)
+	if err != nil {
+		return nil, fmt.Errorf("pinned certificates: %w", err)
+	}
+	client, err := api.New(opts.APIURL, opts.Token,
+		api.WithMaxBodySize(opts.MaxResponseBytes),
+		api.WithHeaders(opts.ExtraHeaders),
+		api.WithHeartbeatSchema(opts.HeartbeatSchema),
+		api.WithRefuseCrossHostRedirects(opts.RefuseRedirects),
+		api.WithPortOptional(opts.RelaySRV),
+		api.WithHeartbeatSecret(opts.HeartbeatSecret),
+		api.WithPinnedCerts(pins),
+		api.WithResolver(resolver),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("api client: %w", err)
+	}
+	return client, nil
 }
 
+// Close releases the instance lock. It is safe to call more than once and
+// from several goroutines, as the forced exit on a signal does alongside
+// main's deferred call.
 func (a *Agent) Close() {
-	if a.lockFH != nil {
-		a.lockFH.Close()
-		_ = os.Remove(lockFilePath)
-	}
+	a.closeOnce.Do(func() {
+		if a.lockFH != nil {
+			a.lockFH.Close()
+			_ = os.Remove(lockFilePath)
+		}
+	})
 }
 
 // Run is the main blocking loop. Returns nil on clean shutdown (ctx cancelled)
 // and a non-nil error only for unrecoverable failures (e.g. invalid token).
-func (a *Agent) Run(ctx context.Context) error {
-	log.Println("SmartHomeEntry Agent starting")
+func (a *Agent) Run(ctx context.Context) (err error) {
+	log.Printf("SmartHomeEntry Agent starting: %s", a.startupSummary())
+	a.startNotify(ctx)
+	defer a.status.SetState(health.StateStopping)
+	defer func() {
+		if err != nil && ctx.Err() == nil {
+			a.reportFatal(ctx, err)
+		}
+	}()
+
+	if a.opts.HealthAddr != "" {
+		// Wait for the endpoint to shut down, so a Unix socket is removed
+		// before the process exits.
+		healthCtx, stopHealth := context.WithCancel(ctx)
+		healthDone := make(chan struct{})
+		defer func() {
+			stopHealth()
+			<-healthDone
+		}()
+		go func() {
+			defer close(healthDone)
+			if err := health.Serve(healthCtx, a.opts.HealthAddr, health.Handler(a.status, a.exportMetrics)); err != nil {
+				log.Printf("WARNING: health endpoint: %v", err)
+			}
+		}()
+	}
 
-	if err := a.api.ValidateToken(ctx); err != nil {
+	if err := a.validateToken(ctx); err != nil {
 		return fmt.Errorf("install token validation failed: %w", err)
 	}
 	log.Println("install token validated")
 
+	if a.opts.DisableMetrics {
+		log.Println("metrics disabled — sending heartbeats without metrics")
+	} else {
+		go a.metrics.Run(ctx)
+	}
+	go a.logConnStats(ctx)
+	if a.publicIP != nil {
+		go a.publicIP.Run(ctx)
+	}
+	a.startStatsd(ctx)
+	if a.events != nil {
+		go a.runEventHeartbeats(ctx)
+	}
+
+	runCtx, revoke := context.WithCancelCause(ctx)
+	defer revoke(nil)
+	if a.opts.TokenRevalidateInterval > 0 {
+		go a.revalidateToken(runCtx, a.opts.TokenRevalidateInterval, revoke)
+	}
+	if d := a.deadlockTimeout(); d > 0 {
+		a.beacon.beat(0)
+		go a.watchDeadlock(runCtx, d)
+	}
+	err = a.reconnectLoop(runCtx)
+	if cause := context.Cause(runCtx); ctx.Err() == nil && errors.Is(cause, ErrTokenRevoked) {
+		log.Println("install token revoked — agent decommissioned, shutting down")
+		return cause
+	}
+	return err
+}
+
+// reconnectLoop runs tunnel cycles until ctx is done or an error ends the
+// agent, backing off between failed cycles.
+func (a *Agent) reconnectLoop(ctx context.Context) error {
+	// authRefetched is set after an immediate retry following an SSH key
+	// rejection, so repeated rejections back off. diskKeyRejections counts
+	// consecutive rejections of the key on disk.
+	authRefetched := false
+	diskKeyRejections := 0
 	for {
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
 
+		a.beacon.beat(0)
+		a.relay = ""
+		a.status.SetState(health.StateConnecting)
 		err := a.runCycle(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			a.status.Update(func(s *health.Status) { s.LastError = err.Error() })
+			if !errors.Is(err, errReconnect) && !errors.Is(err, tunnel.ErrInactive) {
+				a.lastErrCategory.Store(errorCategory(err))
+			}
+		}
+
+		if errors.Is(err, errReconnect) {
+			log.Printf("%v — reconnecting", err)
+			continue
+		}
 
 		if err == nil || errors.Is(err, context.Canceled) {
 			return ctx.Err()
 		}
 
 		if errors.Is(err, tunnel.ErrInactive) {
-			log.Printf("agent is inactive — retrying config in %s", inactivePollInterval)
-			if !sleepCtx(ctx, inactivePollInterval) {
+			wait := inactivePollInterval
+			if until := a.maintenanceUntil; !until.IsZero() {
+				// Poll as usual, but wake up right when the window ends.
+				wait = min(wait, time.Until(until))
+				log.Printf("agent is in a maintenance window — resuming at %s", until.Format(time.RFC3339))
+			} else {
+				log.Printf("agent is inactive — retrying config in %s", wait)
+			}
+			a.status.SetState(health.StateInactive)
+			a.beacon.beat(wait)
+			if !a.waitInactive(ctx, wait) {
+				log.Println("shutting down while inactive")
+				a.status.SetState(health.StateStopping)
 				return ctx.Err()
 			}
 			continue
 		}
 
-		wait := a.bo.Next()
+		// A rejected key may just be stale: fetch the config once more right
+		// away in case it carries a new one, and only then back off.
+		if errors.Is(err, tunnel.ErrRelayAuth) {
+			if a.currentKeySource() == api.KeySourceDisk {
+				diskKeyRejections++
+			}
+			if !authRefetched {
+				authRefetched = true
+				log.Printf("%v — fetching fresh config before retrying", err)
+				continue
+			}
+			// The config re-fetch brought no new key, so the key on disk
+			// is dead: ask for a fresh one rather than retrying it.
+			if diskKeyRejections >= diskKeyRejectLimit && !a.wantFreshKey {
+				a.wantFreshKey = true
+				log.Printf("relay rejected the SSH key on disk %d times — requesting a fresh key", diskKeyRejections)
+				continue
+			}
+			log.Println("WARNING: relay still rejects the SSH key — it may have been revoked; regenerate the install token if this persists")
+		} else {
+			authRefetched = false
+			diskKeyRejections = 0
+		}
+		switch {
+		case errors.Is(err, tunnel.ErrHostKeyMismatch):
+			log.Printf("WARNING: relay presented an unexpected host key — connecting will keep failing until %s is fixed", tunnel.KnownHostsPath)
+		case errors.Is(err, tunnel.ErrUnknownHostKey):
+			log.Printf("WARNING: trust on first use is disabled and the relay's host key is not in %s — pre-provision it", tunnel.KnownHostsPath)
+		case errors.Is(err, tunnel.ErrRelayUnreachable):
+			log.Println("relay unreachable — check network connectivity to the relay")
+		}
+
+		bo := a.backoffFor(a.relay)
+		a.status.SetBackoff(time.Now().Add(bo.Peek()))
+		wait := bo.Next()
+		a.backoffWait.Store(int64(wait))
+		a.beacon.beat(wait)
 		log.Printf("cycle error: %v — reconnecting in %s", err, wait.Truncate(time.Millisecond))
-		if !sleepCtx(ctx, wait) {
+		select {
+		case <-ctx.Done():
 			return ctx.Err()
+		case <-a.wake:
+			log.Println("reconnect requested — skipping the rest of the backoff")
+		case <-time.After(wait):
 		}
 	}
 }
 
 func (a *Agent) runCycle(ctx context.Context) error {
 	log.Println("fetching config from control plane")
-	cfg, err := a.api.FetchConfig(ctx)
+	rotate := a.rotateKey.Swap(false)
+	fetch := a.api.FetchConfig
+	if a.wantFreshKey || rotate {
+		fetch = a.api.FetchConfigFreshKey
+	}
+	cfg, err := fetch(ctx)
 	if err != nil {
-		return fmt.Errorf("fetch config: %w", err)
+		return fmt.Errorf("%w: %w", errFetchConfig, err)
 	}
 	log.Printf("config: relay=%s ssh_port=%d tunnel_port=%d active=%v",
 		cfg.Host, cfg.Port, cfg.TunnelPort, cfg.Active)
 
+	a.relay = fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	a.heartbeatURL = cfg.HeartbeatURL
+
+	a.maintenanceUntil = time.Time{}
+	if until := cfg.MaintenanceUntil; until.After(time.Now()) {
+		a.maintenanceUntil = until
+		return tunnel.ErrInactive
+	}
 	if !cfg.Active {
 		return tunnel.ErrInactive
 	}
 
-	checkDomoticz(a.localAddr)
+	stateLost, err := ensureStateDir(filepath.Dir(a.keyPath))
+	if err != nil {
+		return err
+	}
 
-	// Use key from config if provided, otherwise fall back to key on disk
-	// (server returns empty string after the token has been consumed).
+	// A key provided as a credential wins. Otherwise use the key from
+	// config if provided, falling back to the key on disk (server returns
+	// empty string after the token has been consumed).
 	privateKey := cfg.PrivateKey
-	if privateKey != "" {
-		if err := writeKey(privateKey); err != nil {
+	switch {
+	case a.opts.CredentialKeyPath != "":
+		keyBytes, err := os.ReadFile(a.opts.CredentialKeyPath)
+		if err != nil {
+			return fmt.Errorf("read SSH key credential: %w", err)
+		}
+		privateKey = string(keyBytes)
+		a.keySource.Store(api.KeySourceCredential)
+		if cfg.PrivateKey != "" {
+			log.Printf("ignoring SSH key from config in favour of credential %s", a.opts.CredentialKeyPath)
+		}
+	case privateKey != "":
+		key, fromDisk, err := a.chooseKey(privateKey, a.wantFreshKey || rotate)
+		if err != nil {
+			return err
+		}
+		privateKey = key
+		if fromDisk {
+			a.keySource.Store(api.KeySourceDisk)
+			break
+		}
+		if err := writeKey(a.keyPath, privateKey); err != nil {
 			return fmt.Errorf("write SSH key: %w", err)
 		}
-	} else {
-		keyBytes, err := os.ReadFile(keyFilePath)
+		a.keySource.Store(api.KeySourceConfig)
+		if a.wantFreshKey || rotate {
+			log.Println("control plane issued a fresh SSH key")
+			a.wantFreshKey = false
+		}
+	case a.wantFreshKey:
+		return fmt.Errorf("%w: relay rejects the SSH key on disk (%s) and the control plane sent no replacement — regenerate install token", errDiskKeyRejected, a.keyPath)
+	default:
+		if rotate {
+			log.Println("WARNING: key rotation requested but the control plane sent no new key — keeping the key on disk")
+		}
+		keyBytes, err := os.ReadFile(a.keyPath)
+		if err != nil && stateLost {
+			return fmt.Errorf("SSH key was deleted with %s and the control plane no longer sends it: %w — regenerate install token", filepath.Dir(a.keyPath), err)
+		}
 		if err != nil {
-			return fmt.Errorf("SSH key not in config and not on disk (%s): %w — regenerate install token", keyFilePath, err)
+			return fmt.Errorf("SSH key not in config and not on disk (%s): %w — regenerate install token", a.keyPath, err)
 		}
 		privateKey = string(keyBytes)
-		log.Printf("using SSH key from disk (%s)", keyFilePath)
+		a.keySource.Store(api.KeySourceDisk)
+		log.Printf("using SSH key from disk (%s)", a.keyPath)
+	}
+
+	cycleCtx, cancelCycle := context.WithCancelCause(ctx)
+	defer cancelCycle(nil)
+	a.mu.Lock()
+	localAddr := a.localAddr
+	a.cancelCycle = cancelCycle
+	select {
+	case <-a.wake: // a reconnect asked for before this cycle is moot
+	default:
+	}
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.cancelCycle = nil
+		a.mu.Unlock()
+	}()
+
+	checkDomoticz(localAddr)
+	if a.opts.WatchKey {
+		go watchFile(cycleCtx, a.keyPath, a.keyWatchInterval, func() {
+			cancelCycle(fmt.Errorf("%w: SSH key file %s changed", errReconnect, a.keyPath))
+		})
+	}
+	if a.opts.ConfigRefreshInterval > 0 {
+		go a.watchConfig(cycleCtx, cfg, privateKey, func(change string) {
+			cancelCycle(fmt.Errorf("%w: control plane changed %s", errReconnect, change))
+		})
 	}
 
 	start := time.Now()
+	a.rtt.Reset()
+	a.events.setURL(cfg.HeartbeatURL)
+	a.tunnelPort.Store(int64(cfg.TunnelPort))
 
 	var hbCount int
-	err = tunnel.Run(ctx, &tunnel.Config{
-		Host:       cfg.Host,
-		Port:       cfg.Port,
-		TunnelPort: cfg.TunnelPort,
-		SSHUser:    cfg.SSHUser,
-		PrivateKey: privateKey,
-		LocalAddr:  a.localAddr,
+	var up *tunnel.UpInfo
+	err = a.runTunnel(cycleCtx, &tunnel.Config{
+		Host:         cfg.Host,
+		Port:         cfg.Port,
+		TunnelPort:   cfg.TunnelPort,
+		SSHUser:      cfg.SSHUser,
+		PrivateKey:   privateKey,
+		LocalAddr:    localAddr,
+		TCPKeepAlive: a.opts.TCPKeepAlive,
+		SelfTest:     a.opts.SelfTest,
+		Addrs:        a.addrs,
+
+		MaxConnections: a.opts.MaxConnections,
+		MaxConnRate:    a.opts.MaxConnRate,
+		Stats:          a.connStats,
+		Service:        cfg.ServiceName,
+
+		LocalTLS:           a.localTLS,
+		LocalTLSServerName: a.opts.LocalTLSServerName,
+		LocalProxyProtocol: a.proxyProto,
+		ConnLogLimit:       a.opts.ConnLogLimit,
+		ProxyBufferSize:    a.opts.ProxyBufferSize,
+		LookupSRV:          a.opts.RelaySRV,
+		Resolver:           a.resolver,
+		HeartbeatTimeout:   a.opts.HeartbeatTimeout,
+
+		KeepAliveInterval: tuning(a.opts.KeepAliveInterval, cfg.KeepaliveInterval),
+		ProxyIdleTimeout:  tuning(a.opts.ProxyIdleTimeout, cfg.ProxyIdleTimeout),
+		HeartbeatInterval: tuning(a.opts.HeartbeatInterval, cfg.HeartbeatInterval),
+		WatchdogWindow:    a.opts.WatchdogWindow,
+		KeepAliveJitter:   a.opts.KeepAliveJitter,
+
+		FirstHeartbeatDelay:  a.opts.FirstHeartbeatDelay,
+		FirstHeartbeatWindow: a.opts.FirstHeartbeatWindow,
+		InactiveHeartbeats:   a.opts.InactiveHeartbeats,
+
+		StrictRelayCheck: a.opts.StrictRelayCheck,
+		StrictBind:       a.opts.StrictBind,
+		StrictRelayOrder: a.opts.StrictRelayOrder,
+		PreflightTimeout: a.opts.PreflightTimeout,
+		DebugForward:     a.opts.DebugForward,
+		LogConnections:   a.opts.LogLevel == LogLevelDebug,
+		DebugTimings:     a.opts.LogLevel == LogLevelDebug,
+		RTT:              a.rtt,
+		MaxKnownHosts:    a.opts.MaxKnownHosts,
+		MaxTrackedConns:  a.opts.MaxTrackedConns,
+		DrainTimeout:     a.drainTimeout(),
+		DisableTOFU:      a.opts.DisableTOFU,
+
+		LocalHealthInterval: a.opts.LocalHealthInterval,
+		OnLocalHealth:       a.setLocalHealth,
+		SSHHeartbeat:        a.sshHeartbeat(),
+
+		OnUp: func(info tunnel.UpInfo) {
+			up = &info
+			a.tunnelUps.Add(1)
+			a.setLocalHealth(true)
+			a.backoffWait.Store(0)
+			a.hostKeyAlgo.Store(info.HostKeyAlgo)
+			a.connectDuration.Store(int64(info.ConnectDuration))
+			a.status.Update(func(s *health.Status) {
+				s.Relay = info.Relay
+				s.Service = cfg.ServiceName
+				s.HostKeyAlgo = info.HostKeyAlgo
+				s.ConnectDurationMs = float64(info.ConnectDuration) / float64(time.Millisecond)
+			})
+			a.status.SetState(health.StateConnected)
+			a.events.add(eventTunnelUp)
+			go runHook(a.opts.OnConnect, hookEventConnect, hookEnv(info)...)
+		},
 		HeartbeatFunc: func(hbCtx context.Context) (bool, error) {
+			a.beacon.beat(0)
 			hbCount++
 
 			// Re-validate token every 10 heartbeat cycles (~10 minutes).
@@ -158,36 +918,687 @@ func (a *Agent) runCycle(ctx context.Context) error {
 				}
 			}
 
-			var m *api.HeartbeatMetrics
-			if s, mErr := metrics.Collect(hbCtx); mErr != nil {
-				log.Printf("metrics collection error: %v (skipping metrics this heartbeat)", mErr)
-			} else {
-				m = &api.HeartbeatMetrics{
-					CPUPercent: s.CPUPercent,
-					RAMPercent: s.RAMPercent,
-					RAMUsedMB:  s.RAMUsedMB,
-					RAMTotalMB: s.RAMTotalMB,
-				}
-				log.Printf("metrics: cpu=%.1f%% ram=%.1f%% (%d/%d MB)",
-					m.CPUPercent, m.RAMPercent, m.RAMUsedMB, m.RAMTotalMB)
-			}
-
-			resp, hbErr := a.api.SendHeartbeat(hbCtx, cfg.HeartbeatURL, m)
-			if hbErr != nil {
-				return true, hbErr
-			}
-			return resp.Active, nil
+			return a.sendHeartbeat(hbCtx, cfg.HeartbeatURL)
 		},
 	})
 
+	if errors.Is(err, tunnel.ErrForwardDenied) && a.opts.ReportForwardDenied {
+		a.reportForwardDenied(ctx, cfg.HeartbeatURL, cfg.TunnelPort)
+	}
+
+	if up != nil && ctx.Err() == nil {
+		if time.Since(start) < stableThreshold {
+			a.events.add(eventFlap)
+		} else {
+			a.events.add(eventTunnelDown)
+		}
+	}
+	if up != nil {
+		env := hookEnv(*up)
+		if err != nil {
+			env = append(env, "SMARTHOMEENTRY_ERROR="+err.Error())
+		}
+		go runHook(a.opts.OnDisconnect, hookEventDisconnect, env...)
+	}
+
 	if elapsed := time.Since(start); elapsed >= stableThreshold {
 		log.Printf("connection was stable for %s — resetting backoff", elapsed.Truncate(time.Second))
-		a.bo.Reset()
+		a.backoffFor(a.relay).Reset()
 	}
 
+	if cause := context.Cause(cycleCtx); ctx.Err() == nil && errors.Is(cause, errReconnect) {
+		return cause
+	}
 	return err
 }
 
+// Reconnect tears down the current tunnel, or cuts the backoff before the
+// next attempt short, so the agent reconnects right away.
+func (a *Agent) Reconnect(reason string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cancelCycle != nil {
+		a.cancelCycle(fmt.Errorf("%w: %s", errReconnect, reason))
+		return
+	}
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// RotateKey reconnects with a fresh SSH key requested from the control
+// plane. If none is issued the key on disk stays in use.
+func (a *Agent) RotateKey() {
+	a.rotateKey.Store(true)
+	a.Reconnect("SSH key rotation requested")
+}
+
+// Status returns a snapshot of the agent's health status.
+func (a *Agent) Status() health.Status {
+	return a.status.Snapshot()
+}
+
+// SetLocalAddr switches the local service address. A running tunnel is
+// reconnected so new connections reach the new address; connections
+// already proxied to the old one are closed with it.
+func (a *Agent) SetLocalAddr(addr string) error {
+	addr, err := normalizeLocalAddr(addr)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if addr == a.localAddr {
+		return nil
+	}
+	log.Printf("local address changed from %s to %s", a.localAddr, addr)
+	a.localAddr = addr
+	if a.cancelCycle != nil {
+		a.cancelCycle(fmt.Errorf("%w: local address changed to %s", errReconnect, addr))
+	}
+	return nil
+}
+
+// logConnStats periodically logs how many connections were accepted,
+// rejected over the limit or failed to reach the local service, skipping
+// quiet periods.
+func (a *Agent) logConnStats(ctx context.Context) {
+	interval := a.opts.ConnStatsInterval
+	if interval < 0 || a.connStats == nil {
+		return
+	}
+	if interval == 0 {
+		interval = defaultConnStatsInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var prev tunnel.ConnCounts
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cur := a.connStats.Counts()
+			if d := cur.Sub(prev); d != (tunnel.ConnCounts{}) {
+				log.Printf("connections in the last %s: %d accepted, %d rejected (limit %d), %d local failures",
+					interval, d.Accepted, d.Rejected, a.opts.MaxConnections, d.LocalFailed)
+			}
+			prev = cur
+		}
+	}
+}
+
+// exportMetrics returns the counters and gauges served on /metrics and
+// pushed to statsd.
+func (a *Agent) exportMetrics() []health.Metric {
+	c := a.connStats.Counts()
+	bytesIn, bytesOut := a.connStats.Bytes()
+	var up, reconnects float64
+	if a.status.Snapshot().State == health.StateConnected {
+		up = 1
+	}
+	if n := a.tunnelUps.Load(); n > 1 {
+		reconnects = float64(n - 1)
+	}
+	metrics := []health.Metric{
+		{Name: "smarthomeentry_tunnel_up", Help: "Whether the tunnel to the relay is up.",
+			Type: "gauge", Value: up},
+		{Name: "smarthomeentry_reconnects_total", Help: "Tunnels re-established after the first.",
+			Type: "counter", Value: reconnects},
+		{Name: "smarthomeentry_bytes_in_total", Help: "Bytes proxied from the relay to the local service.",
+			Type: "counter", Value: float64(bytesIn)},
+		{Name: "smarthomeentry_bytes_out_total", Help: "Bytes proxied from the local service to the relay.",
+			Type: "counter", Value: float64(bytesOut)},
+		{Name: "smarthomeentry_relay_rtt_ms", Help: "Smoothed SSH keepalive round-trip time to the relay.",
+			Type: "gauge", Value: float64(a.rtt.Smoothed()) / float64(time.Millisecond)},
+		{Name: "smarthomeentry_connections_accepted_total", Help: "Relay connections handed to the local proxy.",
+			Type: "counter", Value: float64(c.Accepted)},
+		{Name: "smarthomeentry_connections_rejected_total", Help: "Relay connections refused because the connection limit was reached.",
+			Type: "counter", Value: float64(c.Rejected)},
+		{Name: "smarthomeentry_connections_local_failed_total", Help: "Relay connections dropped because the local service was unreachable.",
+			Type: "counter", Value: float64(c.LocalFailed)},
+		{Name: "smarthomeentry_backoff_seconds", Help: "Backoff before the current reconnect attempt; zero while connected.",
+			Type: "gauge", Value: time.Duration(a.backoffWait.Load()).Seconds()},
+	}
+	last, _ := a.lastErrCategory.Load().(string)
+	for _, cat := range errCategories {
+		var v float64
+		if cat == last {
+			v = 1
+		}
+		metrics = append(metrics, health.Metric{Name: "smarthomeentry_last_error", Help: "Category of the most recent connection error.",
+			Type: "gauge", Value: v, Labels: map[string]string{"category": cat}})
+	}
+	services := a.connStats.Services()
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		metrics = append(metrics, health.Metric{Name: "smarthomeentry_service_bytes_in_total", Help: "Bytes proxied from the relay to a named local service.",
+			Type: "counter", Value: float64(services[name].BytesIn), Labels: map[string]string{"service": name}})
+	}
+	for _, name := range names {
+		metrics = append(metrics, health.Metric{Name: "smarthomeentry_service_bytes_out_total", Help: "Bytes proxied from a named local service to the relay.",
+			Type: "counter", Value: float64(services[name].BytesOut), Labels: map[string]string{"service": name}})
+	}
+	return metrics
+}
+
+// startStatsd pushes exportMetrics to StatsdAddr until ctx is done. A
+// collector that can't be set up is logged and otherwise ignored.
+func (a *Agent) startStatsd(ctx context.Context) {
+	if a.opts.StatsdAddr == "" {
+		return
+	}
+	e, err := statsd.Dial(a.opts.StatsdAddr)
+	if err != nil {
+		log.Printf("WARNING: %v", err)
+		return
+	}
+	interval := a.opts.StatsdInterval
+	if interval <= 0 {
+		interval = defaultStatsdInterval
+	}
+	log.Printf("pushing metrics to statsd at %s every %s", a.opts.StatsdAddr, interval)
+	go func() {
+		defer e.Close()
+		e.Run(ctx, interval, a.exportMetrics)
+	}()
+}
+
+// startNotify mirrors state transitions to systemd: READY=1 once the first
+// tunnel is up, STATUS= on every change and STOPPING=1 on shutdown. It also
+// starts the watchdog pings when WatchdogSec is set. No-op outside systemd.
+func (a *Agent) startNotify(ctx context.Context) {
+	if a.notify == nil {
+		return
+	}
+	var ready sync.Once
+	a.status.OnChange(func(st health.Status) {
+		msgs := []string{sdnotify.Status(statusText(st))}
+		switch st.State {
+		case health.StateConnected:
+			ready.Do(func() { msgs = append(msgs, sdnotify.Ready) })
+		case health.StateStopping:
+			msgs = append(msgs, sdnotify.Stopping)
+		}
+		if err := a.notify.Send(msgs...); err != nil {
+			log.Printf("WARNING: %v", err)
+		}
+	})
+	go a.notify.RunWatchdog(ctx)
+}
+
+// statusText is the one-line status shown by systemctl status.
+func statusText(st health.Status) string {
+	switch {
+	case st.State == health.StateConnected && st.Relay != "":
+		return "connected to relay " + st.Relay
+	case st.State == health.StateBackoff && st.NextRetryAt != nil:
+		text := "reconnecting at " + st.NextRetryAt.Format(time.TimeOnly)
+		if st.LastError != "" {
+			text += " after error: " + st.LastError
+		}
+		return text
+	default:
+		return st.State
+	}
+}
+
+// waitInactive waits d until the next config poll while the agent is
+// deactivated. With a wake poll interval configured it pings the heartbeat
+// endpoint meanwhile and returns early once the control plane reports the
+// agent active again. It returns false if ctx is done.
+func (a *Agent) waitInactive(ctx context.Context, d time.Duration) bool {
+	interval := a.opts.WakePollInterval
+	if interval <= 0 || interval >= d || a.heartbeatURL == "" {
+		return sleepCtx(ctx, d)
+	}
+
+	deadline := time.Now().Add(d)
+	for {
+		wait := min(interval, time.Until(deadline))
+		if wait <= 0 {
+			return true
+		}
+		if !sleepCtx(ctx, wait) {
+			return false
+		}
+		resp, err := a.api.SendHeartbeat(ctx, a.heartbeatURL, &api.Heartbeat{
+			Platform: runtime.GOOS + "/" + runtime.GOARCH,
+		})
+		if err != nil {
+			log.Printf("wake poll error: %v", err)
+			continue
+		}
+		if resp.Active {
+			log.Println("wake poll: agent reactivated — fetching config")
+			return true
+		}
+	}
+}
+
+// watchFile polls path every interval and calls onChange once when its
+// modification time or size differs from the state at start. It returns
+// when ctx is done or after onChange has been called.
+func watchFile(ctx context.Context, path string, interval time.Duration, onChange func()) {
+	initial, initErr := os.Stat(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cur, err := os.Stat(path)
+			if (err != nil) != (initErr != nil) {
+				onChange()
+				return
+			}
+			if err == nil && (!cur.ModTime().Equal(initial.ModTime()) || cur.Size() != initial.Size()) {
+				onChange()
+				return
+			}
+		}
+	}
+}
+
+// watchConfig re-fetches the config every ConfigRefreshInterval and calls
+// onChange once, naming the setting, when it differs from cur in a way the
+// running tunnel would not pick up. Fetch errors are logged and retried on
+// the next tick. It returns when ctx is done or after onChange was called.
+func (a *Agent) watchConfig(ctx context.Context, cur *api.AgentConfig, key string, onChange func(string)) {
+	ticker := time.NewTicker(a.opts.ConfigRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			next, err := a.api.FetchConfig(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("config refresh failed (keeping current tunnel): %v", err)
+				}
+				continue
+			}
+			if change := a.configChange(cur, next, key); change != "" {
+				onChange(change)
+				return
+			}
+		}
+	}
+}
+
+// configChange names the first setting that differs between the config a
+// tunnel was started with and a fresh one, or returns "". A missing key is
+// not a change: the control plane only sends it until the token is used.
+// Tuning that a local option overrides is ignored.
+func (a *Agent) configChange(cur, next *api.AgentConfig, key string) string {
+	switch {
+	case next.Active != cur.Active:
+		return "active"
+	case next.Host != cur.Host || next.Port != cur.Port:
+		return "relay"
+	case next.TunnelPort != cur.TunnelPort:
+		return "tunnel_port"
+	case next.SSHUser != cur.SSHUser:
+		return "ssh_user"
+	case next.PrivateKey != "" && next.PrivateKey != key:
+		return "private_key"
+	case next.HeartbeatURL != cur.HeartbeatURL:
+		return "heartbeat_url"
+	case tuning(a.opts.KeepAliveInterval, next.KeepaliveInterval) != tuning(a.opts.KeepAliveInterval, cur.KeepaliveInterval):
+		return "keepalive_interval"
+	case tuning(a.opts.ProxyIdleTimeout, next.ProxyIdleTimeout) != tuning(a.opts.ProxyIdleTimeout, cur.ProxyIdleTimeout):
+		return "proxy_idle_timeout"
+	case tuning(a.opts.HeartbeatInterval, next.HeartbeatInterval) != tuning(a.opts.HeartbeatInterval, cur.HeartbeatInterval):
+		return "heartbeat_interval"
+	}
+	return ""
+}
+
+// currentKeySource returns where the key of the current cycle came from.
+func (a *Agent) currentKeySource() string {
+	s, _ := a.keySource.Load().(string)
+	return s
+}
+
+// currentHostKeyAlgo returns the relay host key type of the current
+// connection.
+func (a *Agent) currentHostKeyAlgo() string {
+	s, _ := a.hostKeyAlgo.Load().(string)
+	return s
+}
+
+// sendHeartbeat collects host metrics and posts a heartbeat. If ctx is
+// cancelled mid-collection (shutdown), the heartbeat is still sent on a short
+// detached context carrying the last cached sample, so the final heartbeat
+// before exit isn't empty.
+func (a *Agent) sendHeartbeat(ctx context.Context, url string) (bool, error) {
+	m := a.collectMetrics(ctx)
+
+	// Cancellation (not a per-call deadline) means the agent is shutting
+	// down.
+	if errors.Is(ctx.Err(), context.Canceled) {
+		log.Println("shutdown during heartbeat — sending final heartbeat with last metrics")
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.WithoutCancel(ctx), shutdownHeartbeatTimeout)
+		defer cancel()
+	}
+
+	hb := &api.Heartbeat{
+		Platform:    runtime.GOOS + "/" + runtime.GOARCH,
+		KeySource:   a.currentKeySource(),
+		HostKeyAlgo: a.currentHostKeyAlgo(),
+		RelayRTTMs:  float64(a.rtt.Smoothed()) / float64(time.Millisecond),
+		PublicIP:    a.publicIP.get(),
+
+		LocalServiceDown: a.localDown.Load(),
+		Events:           a.events.take(),
+	}
+	if st := a.status.Snapshot(); st.State == health.StateBackoff {
+		hb.NextRetryAt = st.NextRetryAt
+	}
+	if d := a.connectDuration.Swap(0); d > 0 {
+		hb.ConnectDurationMs = float64(d) / float64(time.Millisecond)
+	}
+	a.status.Update(func(s *health.Status) { s.RelayRTTMs = hb.RelayRTTMs })
+	if m != nil {
+		hb.HeartbeatMetrics = &api.HeartbeatMetrics{
+			CPUPercent: m.CPUPercent,
+			RAMPercent: m.RAMPercent,
+			RAMUsedMB:  m.RAMUsedMB,
+			RAMTotalMB: m.RAMTotalMB,
+		}
+		hb.CPUPeakPercent = m.CPUPeakPercent
+		if p := m.Pressure; p != nil {
+			hb.Pressure = &api.Pressure{CPU: p.CPU, Memory: p.Memory, IO: p.IO}
+		}
+	}
+	a.lastHeartbeat.Store(hb)
+	resp, err := a.api.SendHeartbeat(ctx, url, hb)
+	if err != nil {
+		return true, err
+	}
+	if resp.DecodeErr != nil {
+		log.Printf("WARNING: control plane sent a malformed heartbeat response, assuming the agent is active: %v", resp.DecodeErr)
+	}
+	if p := resp.TunnelPort; p != 0 && int64(p) != a.tunnelPort.Load() {
+		a.mu.Lock()
+		if a.cancelCycle != nil {
+			log.Printf("control plane moved the tunnel to port %d — reconnecting", p)
+			a.cancelCycle(fmt.Errorf("%w: control plane moved the tunnel to port %d", errReconnect, p))
+		}
+		a.mu.Unlock()
+	}
+	if resp.RequestMetricsNow && a.opts.DisableMetrics {
+		log.Println("control plane requested metrics, but metrics are disabled")
+	} else if resp.RequestMetricsNow && a.metricsNowBusy.CompareAndSwap(false, true) {
+		go func() {
+			defer a.metricsNowBusy.Store(false)
+			a.sendMetricsNow(ctx)
+		}()
+	}
+	return resp.Active, nil
+}
+
+// drainTimeout returns the tunnel drain timeout, zero when disabled.
+func (a *Agent) drainTimeout() time.Duration {
+	switch d := a.opts.DrainTimeout; {
+	case d < 0:
+		return 0
+	case d == 0:
+		return defaultDrainTimeout
+	default:
+		return d
+	}
+}
+
+// sshHeartbeat returns the payload builder for the SSH heartbeat fallback,
+// or nil when it is disabled. It resends the last heartbeat that failed to
+// go out over HTTPS. Signed heartbeats never take this path: the control
+// plane would have to accept them unsigned.
+func (a *Agent) sshHeartbeat() func(context.Context) ([]byte, error) {
+	if !a.opts.SSHHeartbeatFallback || a.opts.HeartbeatSecret != "" {
+		return nil
+	}
+	return func(context.Context) ([]byte, error) {
+		hb := a.lastHeartbeat.Load()
+		if hb == nil {
+			hb = &api.Heartbeat{Platform: runtime.GOOS + "/" + runtime.GOARCH, KeySource: a.currentKeySource()}
+		}
+		return a.api.HeartbeatBody(hb)
+	}
+}
+
+// sendMetricsNow collects a fresh metrics sample and sends it out of band,
+// as requested by the control plane in a heartbeat reply.
+func (a *Agent) sendMetricsNow(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), metricsNowTimeout)
+	defer cancel()
+
+	log.Println("control plane requested metrics — sending a fresh sample")
+	s, err := a.metrics.SampleNow(ctx)
+	if err != nil {
+		log.Printf("WARNING: on-demand metrics: %v", err)
+		return
+	}
+	err = a.api.SendMetrics(ctx, &api.HeartbeatMetrics{
+		CPUPercent: s.CPUPercent,
+		RAMPercent: s.RAMPercent,
+		RAMUsedMB:  s.RAMUsedMB,
+		RAMTotalMB: s.RAMTotalMB,
+	})
+	if err != nil {
+		log.Printf("WARNING: on-demand metrics: %v", err)
+	}
+}
+
+// reportFatal makes a best-effort attempt to tell the control plane why the
+// agent is giving up, so the failure is visible without local log access.
+func (a *Agent) reportFatal(ctx context.Context, cause error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), fatalReportTimeout)
+	defer cancel()
+
+	reason := "fatal"
+	switch {
+	case errors.Is(cause, api.ErrUnauthorized):
+		reason = "unauthorized"
+	case errors.Is(cause, ErrTokenRevoked):
+		reason = "token_revoked"
+	}
+	err := a.api.ReportFatal(ctx, &api.FatalReport{
+		Reason:   reason,
+		Error:    cause.Error(),
+		Platform: runtime.GOOS + "/" + runtime.GOARCH,
+	})
+	if err != nil {
+		log.Printf("could not report the fatal error to the control plane: %v", err)
+	}
+}
+
+// reportForwardDenied tells the control plane, through a heartbeat without
+// metrics, that the relay refused to forward port. Failures are only logged
+// since the cycle is failing anyway.
+func (a *Agent) reportForwardDenied(ctx context.Context, url string, port int) {
+	ctx, cancel := context.WithTimeout(ctx, a.opts.Effective().HeartbeatTimeout)
+	defer cancel()
+	_, err := a.api.SendHeartbeat(ctx, url, &api.Heartbeat{
+		Platform:          runtime.GOOS + "/" + runtime.GOARCH,
+		KeySource:         a.currentKeySource(),
+		ForwardDeniedPort: port,
+	})
+	if err != nil {
+		log.Printf("WARNING: reporting the denied forward to the control plane: %v", err)
+		return
+	}
+	log.Printf("reported denied forward for port %d to the control plane", port)
+}
+
+// collectMetrics returns the current host metrics, falling back to the last
+// successful sample when collection fails. It returns nil if no sample is
+// available.
+func (a *Agent) collectMetrics(ctx context.Context) *metrics.Sample {
+	if a.opts.DisableMetrics {
+		return nil
+	}
+	s, err := a.metrics.Sample(ctx)
+	if err != nil {
+		if s = a.metrics.Latest(); s == nil {
+			log.Printf("metrics collection error: %v (skipping metrics this heartbeat)", err)
+			return nil
+		}
+		log.Printf("metrics collection error: %v (reusing last sample)", err)
+	}
+
+	log.Printf("metrics: cpu=%.1f%% ram=%.1f%% (%d/%d MB)",
+		s.CPUPercent, s.RAMPercent, s.RAMUsedMB, s.RAMTotalMB)
+	return s
+}
+
+// tuning resolves an operational setting: the local value wins, then the
+// control plane's (in seconds); zero lets the tunnel apply its default.
+func tuning(local time.Duration, remoteSeconds int) time.Duration {
+	if local != 0 {
+		return local
+	}
+	if remoteSeconds > 0 {
+		return time.Duration(remoteSeconds) * time.Second
+	}
+	return 0
+}
+
+// collectFunc returns the metrics collection function for opts, or nil
+// for the default single-reading collector.
+func collectFunc(opts Options) func(context.Context) (*metrics.Sample, error) {
+	if opts.CPUSamples <= 1 {
+		return nil
+	}
+	return metrics.CollectAveraged(opts.CPUSamples, cpuSampleSpacing(opts))
+}
+
+// cpuSampleSpacing is the gap between averaged CPU readings.
+func cpuSampleSpacing(opts Options) time.Duration {
+	if opts.MetricsInterval > 0 {
+		return max(opts.MetricsInterval/time.Duration(opts.CPUSamples+1), time.Second)
+	}
+	return time.Second
+}
+
+// sampleWindow is how long one metrics collection takes, so heartbeats
+// with less time left skip it instead of delaying shutdown.
+func sampleWindow(opts Options) time.Duration {
+	if opts.CPUSamples <= 1 {
+		return metrics.DefaultWindow
+	}
+	return time.Duration(opts.CPUSamples) * cpuSampleSpacing(opts)
+}
+
+// backoffFor returns the backoff state for relay, creating it on first use.
+func (a *Agent) backoffFor(relay string) *backoff.Backoff {
+	bo, ok := a.bo[relay]
+	if !ok {
+		bo = backoff.New(backoff.WithInitial(a.opts.BackoffInitial), backoff.WithMax(a.opts.BackoffMax))
+		a.bo[relay] = bo
+	}
+	return bo
+}
+
+// validateToken validates the install token at startup, retrying transient
+// failures with the same backoff as config fetches until
+// StartupValidationTimeout has passed. A rejected token fails at once.
+func (a *Agent) validateToken(ctx context.Context) error {
+	budget := a.opts.StartupValidationTimeout
+	if budget <= 0 {
+		budget = defaultStartupValidationTimeout
+	}
+	bo := a.backoffFor("")
+	start := time.Now()
+	for {
+		err := a.api.ValidateToken(ctx)
+		if err == nil {
+			bo.Reset()
+			return nil
+		}
+		if errors.Is(err, api.ErrUnauthorized) || ctx.Err() != nil {
+			return err
+		}
+
+		wait := bo.Next()
+		if elapsed := time.Since(start); elapsed+wait > budget {
+			return fmt.Errorf("giving up after %s: %w", elapsed.Truncate(time.Second), err)
+		}
+		log.Printf("token validation error: %v — retrying in %s", err, wait.Truncate(time.Millisecond))
+		if !sleepCtx(ctx, wait) {
+			return ctx.Err()
+		}
+	}
+}
+
+// revalidateToken checks the install token every interval until ctx is
+// done. A rejected token cancels the run with ErrTokenRevoked; any other
+// failure is retried on the next tick.
+func (a *Agent) revalidateToken(ctx context.Context, interval time.Duration, revoke context.CancelCauseFunc) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := a.api.ValidateToken(ctx)
+		switch {
+		case err == nil:
+			log.Println("token re-validation OK")
+		case errors.Is(err, api.ErrUnauthorized):
+			log.Println("token re-validation failed: install token rejected — stopping")
+			revoke(ErrTokenRevoked)
+			return
+		case ctx.Err() == nil:
+			log.Printf("token re-validation error (non-fatal): %v", err)
+		}
+	}
+}
+
+// localTLSConfig builds the TLS config for the local service, or returns
+// nil when local TLS is disabled.
+func localTLSConfig(opts Options) (*tls.Config, error) {
+	if !opts.LocalTLS {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.LocalTLSCAFile != "" {
+		pem, err := os.ReadFile(opts.LocalTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("local TLS CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("local TLS CA file %s: no PEM certificates found", opts.LocalTLSCAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// setLocalHealth records the local service health reported by the
+// tunnel; a fresh tunnel starts out assuming it is up.
+func (a *Agent) setLocalHealth(up bool) {
+	if a.localDown.Swap(!up) == up {
+		if up {
+			a.events.add(eventLocalUp)
+		} else {
+			a.events.add(eventLocalDown)
+		}
+	}
+	a.status.Update(func(s *health.Status) { s.LocalServiceDown = !up })
+}
+
 func checkDomoticz(addr string) {
 	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
 	if err != nil {
@@ -198,12 +1609,14 @@ func checkDomoticz(addr string) {
 	log.Printf("local server reachable at %s", addr)
 }
 
-func writeKey(key string) error {
-	if err := os.MkdirAll(configDir, 0o755); err != nil {
+// writeKey stores key at path atomically, so a crash or full disk never
+// leaves a truncated key behind for the next start.
+func writeKey(path, key string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 		return fmt.Errorf("create config dir: %w", err)
 	}
-	if err := os.WriteFile(keyFilePath, []byte(key), 0o600); err != nil {
-		return fmt.Errorf("write key to %s: %w", keyFilePath, err)
+	if err := atomicfile.Write(path, []byte(key), secretFileMode); err != nil {
+		return fmt.Errorf("write key: %w", err)
 	}
 	return nil
 }
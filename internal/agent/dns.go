@@ -0,0 +1,38 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// dnsTimeout bounds each connection to the configured DNS server.
+const dnsTimeout = 5 * time.Second
+
+// dnsResolver returns a resolver that sends every query to server
+// (host[:port], port 53 by default) with the pure-Go resolver, bypassing
+// the system configuration. An empty server returns nil, meaning the
+// system resolver.
+func dnsResolver(server string) (*net.Resolver, error) {
+	if server == "" {
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, fmt.Errorf("DNS server %q: %w", server, err)
+	}
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("DNS server %q: must be an IP address", host)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: dnsTimeout}
+			return d.DialContext(ctx, network, server)
+		},
+	}, nil
+}
@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDNSResolver_queriesConfiguredServer(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer pc.Close()
+
+	r, err := dnsResolver(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dnsResolver: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	go func() { _, _ = r.LookupHost(ctx, "relay.example.test") }()
+
+	// The stub never answers; it only records the query.
+	_ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 512)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no query reached the configured DNS server: %v", err)
+	}
+	if !bytes.Contains(buf[:n], []byte("\x05relay\x07example\x04test")) {
+		t.Errorf("query %q does not ask for relay.example.test", buf[:n])
+	}
+}
+
+func TestDNSResolver_address(t *testing.T) {
+	if r, err := dnsResolver(""); r != nil || err != nil {
+		t.Errorf("empty server: got %v, %v, want the system resolver", r, err)
+	}
+	for _, server := range []string{"192.0.2.53", "192.0.2.53:5353", "2001:db8::53", "[2001:db8::53]:53"} {
+		if _, err := dnsResolver(server); err != nil {
+			t.Errorf("dnsResolver(%q): %v", server, err)
+		}
+	}
+	if _, err := dnsResolver("dns.example.com"); err == nil {
+		t.Error("a DNS server given by name was accepted")
+	}
+}
+
+func TestNew_dnsServerAppliesToRelayLookups(t *testing.T) {
+	a, err := New(Options{APIURL: "https://api.example.test", Token: "tok", DNSServer: "192.0.2.53", DisableLock: true})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer a.Close()
+	if a.resolver == nil {
+		t.Error("relay lookups don't use the configured DNS server")
+	}
+}
@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"github.com/smarthomeentry/agent/internal/api"
+	"github.com/smarthomeentry/agent/internal/backoff"
+	"github.com/smarthomeentry/agent/internal/tunnel"
+)
+
+// Effective returns o with zero values replaced by the defaults the agent
+// and its packages apply, for display. Settings whose zero value means
+// "disabled" or "let the control plane decide" are left as they are.
+func (o Options) Effective() Options {
+	if addr, err := normalizeLocalAddr(o.LocalAddr); err == nil {
+		o.LocalAddr = addr
+	}
+	if o.LogLevel == "" {
+		o.LogLevel = LogLevelInfo
+	}
+	if o.TCPKeepAlive == 0 {
+		o.TCPKeepAlive = tunnel.DefaultTCPKeepAlive
+	}
+	if o.MaxResponseBytes <= 0 {
+		o.MaxResponseBytes = api.DefaultMaxBodySize
+	}
+	if o.HeartbeatSchema == 0 {
+		o.HeartbeatSchema = api.LatestHeartbeatSchema
+	}
+	if o.HeartbeatTimeout <= 0 {
+		o.HeartbeatTimeout = tunnel.DefaultHeartbeatTimeout
+	}
+	if o.ConnLogLimit == 0 {
+		o.ConnLogLimit = tunnel.DefaultConnLogLimit
+	}
+	if o.MaxKnownHosts == 0 {
+		o.MaxKnownHosts = tunnel.DefaultMaxKnownHosts
+	}
+	if o.ProxyBufferSize <= 0 {
+		o.ProxyBufferSize = tunnel.DefaultProxyBufferSize
+	}
+	if o.CPUSamples < 1 {
+		o.CPUSamples = 1
+	}
+	if o.ConnStatsInterval == 0 {
+		o.ConnStatsInterval = defaultConnStatsInterval
+	}
+	if o.PublicIPURL != "" && o.PublicIPInterval <= 0 {
+		o.PublicIPInterval = defaultPublicIPInterval
+	}
+	if o.StatsdAddr != "" && o.StatsdInterval <= 0 {
+		o.StatsdInterval = defaultStatsdInterval
+	}
+	if o.BackoffInitial <= 0 {
+		o.BackoffInitial = backoff.DefaultInitial
+	}
+	if o.BackoffMax <= 0 {
+		o.BackoffMax = backoff.DefaultMax
+	}
+	if o.StartupValidationTimeout <= 0 {
+		o.StartupValidationTimeout = defaultStartupValidationTimeout
+	}
+	return o
+}
+
+// Paths returns the fixed filesystem locations the agent uses.
+func Paths() map[string]string {
+	return map[string]string{
+		"key":         keyFilePath,
+		"lock":        lockFilePath,
+		"known_hosts": tunnel.KnownHostsPath,
+	}
+}
@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"errors"
+
+	"github.com/smarthomeentry/agent/internal/tunnel"
+)
+
+// Categories of cycle errors, exported as the category label of the
+// smarthomeentry_last_error metric.
+const (
+	errCategoryConfig      = "config"
+	errCategoryUnreachable = "unreachable"
+	errCategoryAuth        = "auth"
+	errCategoryHostKey     = "host_key"
+	errCategoryForward     = "forward"
+	errCategoryKeepalive   = "keepalive"
+	errCategoryWatchdog    = "watchdog"
+	errCategoryConnFlood   = "conn_flood"
+	errCategoryOther       = "other"
+)
+
+// errCategories lists every category, in the order they are exported.
+var errCategories = []string{
+	errCategoryConfig,
+	errCategoryUnreachable,
+	errCategoryAuth,
+	errCategoryHostKey,
+	errCategoryForward,
+	errCategoryKeepalive,
+	errCategoryWatchdog,
+	errCategoryConnFlood,
+	errCategoryOther,
+}
+
+// errorCategory classifies a cycle error for the last-error metric, so
+// dashboards can alert on specific failure modes.
+func errorCategory(err error) string {
+	switch {
+	case errors.Is(err, errFetchConfig):
+		return errCategoryConfig
+	case errors.Is(err, tunnel.ErrRelayUnreachable), errors.Is(err, tunnel.ErrLocalRelay):
+		return errCategoryUnreachable
+	case errors.Is(err, tunnel.ErrRelayAuth), errors.Is(err, errDiskKeyRejected):
+		return errCategoryAuth
+	case errors.Is(err, tunnel.ErrHostKeyMismatch), errors.Is(err, tunnel.ErrUnknownHostKey):
+		return errCategoryHostKey
+	case errors.Is(err, tunnel.ErrForwardDenied), errors.Is(err, tunnel.ErrBindMismatch):
+		return errCategoryForward
+	case errors.Is(err, tunnel.ErrKeepalive):
+		return errCategoryKeepalive
+	case errors.Is(err, tunnel.ErrWatchdog), errors.Is(err, tunnel.ErrNoFirstHeartbeat):
+		return errCategoryWatchdog
+	case errors.Is(err, tunnel.ErrConnFlood):
+		return errCategoryConnFlood
+	default:
+		return errCategoryOther
+	}
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/smarthomeentry/agent/internal/api"
+	"github.com/smarthomeentry/agent/internal/health"
+	"github.com/smarthomeentry/agent/internal/tunnel"
+)
+
+func TestErrorCategory(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("%w: %w", errFetchConfig, errors.New("timeout")), errCategoryConfig},
+		{fmt.Errorf("%w: dial relay", tunnel.ErrRelayUnreachable), errCategoryUnreachable},
+		{fmt.Errorf("%w: relay", tunnel.ErrRelayAuth), errCategoryAuth},
+		{fmt.Errorf("%w for relay", tunnel.ErrHostKeyMismatch), errCategoryHostKey},
+		{fmt.Errorf("request reverse forward: %w", tunnel.ErrForwardDenied), errCategoryForward},
+		{fmt.Errorf("%w: keepalive timed out", tunnel.ErrKeepalive), errCategoryKeepalive},
+		{tunnel.ErrNoFirstHeartbeat, errCategoryWatchdog},
+		{tunnel.ErrConnFlood, errCategoryConnFlood},
+		{errors.New("something else"), errCategoryOther},
+	}
+	for _, tc := range tests {
+		if got := errorCategory(tc.err); got != tc.want {
+			t.Errorf("errorCategory(%v)=%q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestExportMetrics_lastErrorCategory(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/agent/config" {
+			_ = json.NewEncoder(w).Encode(api.AgentConfig{
+				Host: "relay.example.com", Port: 22, TunnelPort: 9000,
+				PrivateKey: "key", Active: true,
+			})
+		}
+	}))
+	defer srv.Close()
+
+	a := newTestAgent(t, srv)
+	a.opts.BackoffInitial = time.Millisecond
+	a.opts.BackoffMax = time.Millisecond
+	var cycles atomic.Int32
+	a.runTunnel = func(ctx context.Context, _ *tunnel.Config) error {
+		switch cycles.Add(1) {
+		case 1:
+			return fmt.Errorf("%w: keepalive timed out", tunnel.ErrKeepalive)
+		case 2:
+			return fmt.Errorf("%w: dial relay", tunnel.ErrRelayUnreachable)
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for cycles.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("agent did not reach the third cycle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	got := make(map[string]float64)
+	var backoff *health.Metric
+	for _, m := range a.exportMetrics() {
+		switch m.Name {
+		case "smarthomeentry_last_error":
+			got[m.Labels["category"]] = m.Value
+		case "smarthomeentry_backoff_seconds":
+			backoff = &m
+		}
+	}
+	if got[errCategoryUnreachable] != 1 || got[errCategoryKeepalive] != 0 {
+		t.Errorf("last_error series=%v, want only unreachable set", got)
+	}
+	if len(got) != len(errCategories) {
+		t.Errorf("exported %d last_error series, want one per category (%d)", len(got), len(errCategories))
+	}
+	if backoff == nil || backoff.Value <= 0 {
+		t.Errorf("backoff gauge=%v, want the last backoff", backoff)
+	}
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// State transitions reported in api.Heartbeat.Events.
+const (
+	eventTunnelUp   = "tunnel_up"
+	eventTunnelDown = "tunnel_down"
+	// eventFlap is a tunnel going down before it was up for
+	// stableThreshold.
+	eventFlap      = "flap"
+	eventLocalDown = "local_service_down"
+	eventLocalUp   = "local_service_up"
+)
+
+// defaultEventDebounce is the minimum gap between event heartbeats; events
+// in between are batched into the next one.
+const defaultEventDebounce = 5 * time.Second
+
+// heartbeatEvents queues state transitions until a heartbeat reports
+// them. A nil *heartbeatEvents discards events.
+type heartbeatEvents struct {
+	debounce time.Duration
+	// signal is poked when an event is queued.
+	signal chan struct{}
+
+	mu      sync.Mutex
+	url     string
+	pending []string
+}
+
+func newHeartbeatEvents(debounce time.Duration) *heartbeatEvents {
+	return &heartbeatEvents{debounce: debounce, signal: make(chan struct{}, 1)}
+}
+
+// add queues event for the next heartbeat and asks for one right away.
+func (e *heartbeatEvents) add(event string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.pending = append(e.pending, event)
+	e.mu.Unlock()
+	select {
+	case e.signal <- struct{}{}:
+	default:
+	}
+}
+
+// take returns and clears the queued events.
+func (e *heartbeatEvents) take() []string {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	events := e.pending
+	e.pending = nil
+	return events
+}
+
+// setURL sets the heartbeat URL event heartbeats are sent to.
+func (e *heartbeatEvents) setURL(url string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.url = url
+	e.mu.Unlock()
+}
+
+// runEventHeartbeats sends a heartbeat whenever events are queued, at most
+// once per debounce period, until ctx is done. Events a periodic heartbeat
+// already carried don't trigger another.
+func (a *Agent) runEventHeartbeats(ctx context.Context) {
+	e := a.events
+	var last time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.signal:
+		}
+		if wait := e.debounce - time.Since(last); wait > 0 && !sleepCtx(ctx, wait) {
+			return
+		}
+		e.mu.Lock()
+		url, n := e.url, len(e.pending)
+		e.mu.Unlock()
+		if n == 0 || url == "" {
+			continue
+		}
+		last = time.Now()
+		hbCtx, cancel := context.WithTimeout(ctx, a.opts.Effective().HeartbeatTimeout)
+		if _, err := a.sendHeartbeat(hbCtx, url); err != nil {
+			log.Printf("event heartbeat error: %v", err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/smarthomeentry/agent/internal/api"
+	"github.com/smarthomeentry/agent/internal/health"
+	"github.com/smarthomeentry/agent/internal/metrics"
+	"github.com/smarthomeentry/agent/internal/tunnel"
+)
+
+func TestEventHeartbeats_sentOnLocalServiceDown(t *testing.T) {
+	heartbeats := make(chan api.Heartbeat, 4)
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/agent/config":
+			_ = json.NewEncoder(w).Encode(api.AgentConfig{
+				Host: "relay.example.com", Port: 22, TunnelPort: 9000, Active: true,
+				PrivateKey: "key", HeartbeatURL: srv.URL + "/api/agent/heartbeat",
+			})
+		case "/api/agent/heartbeat":
+			body, _ := io.ReadAll(r.Body)
+			var hb api.Heartbeat
+			_ = json.Unmarshal(body, &hb)
+			heartbeats <- hb
+			_ = json.NewEncoder(w).Encode(api.HeartbeatResponse{Active: true})
+		}
+	}))
+	defer srv.Close()
+
+	a := newTestAgent(t, srv)
+	a.events = newHeartbeatEvents(50 * time.Millisecond)
+	localDown := make(chan struct{})
+	a.runTunnel = func(ctx context.Context, c *tunnel.Config) error {
+		// No periodic heartbeats: only events may trigger one.
+		c.OnUp(tunnel.UpInfo{Relay: "relay.example.com:22"})
+		<-localDown
+		c.OnLocalHealth(false)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.runEventHeartbeats(ctx)
+	go a.runCycle(ctx)
+
+	next := func() api.Heartbeat {
+		t.Helper()
+		select {
+		case hb := <-heartbeats:
+			return hb
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event heartbeat sent")
+			return api.Heartbeat{}
+		}
+	}
+	if hb := next(); !slices.Equal(hb.Events, []string{eventTunnelUp}) {
+		t.Errorf("first event heartbeat events=%q, want [tunnel_up]", hb.Events)
+	}
+
+	sent := time.Now()
+	close(localDown)
+	hb := next()
+	if !slices.Equal(hb.Events, []string{eventLocalDown}) || !hb.LocalServiceDown {
+		t.Errorf("event heartbeat=%+v, want local_service_down", hb)
+	}
+	if d := time.Since(sent); d > 2*time.Second {
+		t.Errorf("event heartbeat took %s", d)
+	}
+}
+
+func TestHeartbeatEvents_debounced(t *testing.T) {
+	e := newHeartbeatEvents(time.Hour)
+	e.add(eventLocalDown)
+	e.add(eventLocalUp)
+	if got := e.take(); !slices.Equal(got, []string{eventLocalDown, eventLocalUp}) {
+		t.Errorf("take()=%q, want both events batched", got)
+	}
+	if got := e.take(); got != nil {
+		t.Errorf("take() after take()=%q, want none", got)
+	}
+
+	var off *heartbeatEvents
+	off.add(eventTunnelUp) // disabled: must not panic
+	if off.take() != nil {
+		t.Error("disabled events returned events")
+	}
+}
+
+func TestSetLocalHealth_eventsOnTransitionsOnly(t *testing.T) {
+	a := &Agent{status: health.NewTracker(), events: newHeartbeatEvents(0)}
+	a.setLocalHealth(true)
+	a.setLocalHealth(false)
+	a.setLocalHealth(false)
+	a.setLocalHealth(true)
+	if got := a.events.take(); !slices.Equal(got, []string{eventLocalDown, eventLocalUp}) {
+		t.Errorf("events=%q, want one per transition", got)
+	}
+}
+
+// Run with -race: event heartbeats read cycle state while cycles keep
+// replacing it.
+func TestEventHeartbeats_duringCycles(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/agent/config":
+			_ = json.NewEncoder(w).Encode(api.AgentConfig{
+				Host: "relay.example.com", Port: 22, TunnelPort: 9000, Active: true,
+				PrivateKey: "key", HeartbeatURL: srv.URL + "/api/agent/heartbeat",
+			})
+		case "/api/agent/heartbeat":
+			_ = json.NewEncoder(w).Encode(api.HeartbeatResponse{Active: true})
+		}
+	}))
+	defer srv.Close()
+
+	a := newTestAgent(t, srv)
+	a.events = newHeartbeatEvents(0)
+	// Slow sampling keeps each heartbeat in flight across several cycles.
+	a.metrics = metrics.NewCollector(0, func(context.Context) (*metrics.Sample, error) {
+		time.Sleep(20 * time.Millisecond)
+		return &metrics.Sample{}, nil
+	})
+	a.runTunnel = func(ctx context.Context, c *tunnel.Config) error {
+		c.OnUp(tunnel.UpInfo{Relay: "relay.example.com:22", HostKeyAlgo: "ssh-ed25519"})
+		c.OnLocalHealth(false)
+		c.OnLocalHealth(true)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.runEventHeartbeats(ctx)
+	for i := 0; i < 50; i++ {
+		_ = a.runCycle(ctx)
+	}
+}
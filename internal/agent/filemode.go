@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+)
+
+// secretFileMode is the mode writeKey uses and checkSecretFiles expects.
+const secretFileMode = 0o600
+
+// ErrLoosePermissions is returned in strict mode when a secret file is
+// readable or writable by users other than its owner.
+var ErrLoosePermissions = errors.New("file is accessible to other users")
+
+// checkSecretFiles makes sure each existing file in paths is accessible to
+// its owner only. Loose files are chmod'ed to 0600 with a warning, or
+// refused with ErrLoosePermissions when strict. Missing files are skipped.
+func checkSecretFiles(strict bool, paths ...string) error {
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("check permissions of %s: %w", path, err)
+		}
+		mode := fi.Mode().Perm()
+		if mode&0o077 == 0 {
+			continue
+		}
+		if strict {
+			return fmt.Errorf("%w: %s has mode %04o — run: chmod 600 %s", ErrLoosePermissions, path, mode, path)
+		}
+		if err := os.Chmod(path, secretFileMode); err != nil {
+			return fmt.Errorf("%s has mode %04o and could not be fixed: %w", path, mode, err)
+		}
+		log.Printf("WARNING: %s had mode %04o, readable by other local users — changed it to %04o", path, mode, secretFileMode)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeLooseFile(t *testing.T, name string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte("secret"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	// Set explicitly: WriteFile's mode is subject to the umask.
+	if err := os.Chmod(path, 0o644); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	return path
+}
+
+func TestCheckSecretFiles_fixesLooseKey(t *testing.T) {
+	key := writeLooseFile(t, "agent_key")
+	missing := filepath.Join(t.TempDir(), "known_hosts")
+
+	if err := checkSecretFiles(false, key, missing); err != nil {
+		t.Fatalf("checkSecretFiles: %v", err)
+	}
+	fi, err := os.Stat(key)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0o600 {
+		t.Errorf("mode=%04o, want 0600", mode)
+	}
+}
+
+func TestCheckSecretFiles_strictRefusesLooseKey(t *testing.T) {
+	key := writeLooseFile(t, "agent_key")
+
+	err := checkSecretFiles(true, key)
+	if !errors.Is(err, ErrLoosePermissions) {
+		t.Fatalf("got %v, want ErrLoosePermissions", err)
+	}
+	if !strings.Contains(err.Error(), "chmod 600 "+key) {
+		t.Errorf("error lacks the remediation: %v", err)
+	}
+	fi, err := os.Stat(key)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0o644 {
+		t.Errorf("strict mode changed the file to %04o", mode)
+	}
+}
+
+func TestCheckSecretFiles_acceptsOwnerOnly(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "agent_key")
+	if err := os.WriteFile(key, []byte("secret"), 0o400); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := checkSecretFiles(true, key); err != nil {
+		t.Errorf("read-only key refused: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/smarthomeentry/agent/internal/tunnel"
+)
+
+// hookTimeout bounds how long an on-connect/on-disconnect command may run.
+const hookTimeout = 30 * time.Second
+
+// hookWaitDelay is how long runHook waits for the output pipe to close
+// after the hook exits. A hook that backgrounds a child keeps it open for
+// as long as the child lives.
+var hookWaitDelay = 5 * time.Second
+
+const (
+	hookEventConnect    = "connect"
+	hookEventDisconnect = "disconnect"
+)
+
+// runHook runs the command at path with the agent's environment plus
+// SMARTHOMEENTRY_EVENT and env, killing it after hookTimeout. Failures are
+// logged, never returned: hooks are side effects and must not affect the
+// tunnel. Callers run it on its own goroutine.
+func runHook(path, event string, env ...string) {
+	if path == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = append(os.Environ(), "SMARTHOMEENTRY_EVENT="+event)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.WaitDelay = hookWaitDelay
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Printf("WARNING: %s hook %s failed: %v %s", event, path, err, strings.TrimSpace(string(out)))
+		return
+	}
+	log.Printf("%s hook %s completed", event, path)
+}
+
+func hookEnv(up tunnel.UpInfo) []string {
+	return []string{
+		"SMARTHOMEENTRY_RELAY=" + up.Relay,
+		"SMARTHOMEENTRY_BIND_ADDR=" + up.BindAddr,
+	}
+}
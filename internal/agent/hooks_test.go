@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smarthomeentry/agent/internal/api"
+	"github.com/smarthomeentry/agent/internal/tunnel"
+)
+
+// writeHookScript creates a hook that dumps its environment to
+// dir/<event>.env.
+func writeHookScript(t *testing.T, dir string) string {
+	t.Helper()
+	path := filepath.Join(dir, "hook.sh")
+	script := "#!/bin/sh\nenv > \"" + dir + "/$SMARTHOMEENTRY_EVENT.env.tmp\" && mv \"" + dir + "/$SMARTHOMEENTRY_EVENT.env.tmp\" \"" + dir + "/$SMARTHOMEENTRY_EVENT.env\"\n"
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatalf("write hook: %v", err)
+	}
+	return path
+}
+
+func waitHookEnv(t *testing.T, path string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if b, err := os.ReadFile(path); err == nil {
+			return string(b)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("hook did not write %s", path)
+	return ""
+}
+
+func TestRunCycle_runsConnectAndDisconnectHooks(t *testing.T) {
+	cfg := api.AgentConfig{
+		Host: "relay.example.com", Port: 22, TunnelPort: 9000,
+		PrivateKey: "key", Active: true,
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(cfg)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	hook := writeHookScript(t, dir)
+
+	a := newTestAgent(t, srv)
+	a.opts.OnConnect = hook
+	a.opts.OnDisconnect = hook
+	a.runTunnel = func(ctx context.Context, c *tunnel.Config) error {
+		c.OnUp(tunnel.UpInfo{Relay: "relay.example.com:22", BindAddr: "127.0.0.1:9000"})
+		return errors.New("relay went away")
+	}
+
+	if err := a.runCycle(context.Background()); err == nil {
+		t.Fatal("expected tunnel error from runCycle")
+	}
+
+	up := waitHookEnv(t, filepath.Join(dir, "connect.env"))
+	for _, want := range []string{
+		"SMARTHOMEENTRY_EVENT=connect",
+		"SMARTHOMEENTRY_RELAY=relay.example.com:22",
+		"SMARTHOMEENTRY_BIND_ADDR=127.0.0.1:9000",
+	} {
+		if !strings.Contains(up, want) {
+			t.Errorf("connect hook env missing %q", want)
+		}
+	}
+
+	down := waitHookEnv(t, filepath.Join(dir, "disconnect.env"))
+	for _, want := range []string{
+		"SMARTHOMEENTRY_EVENT=disconnect",
+		"SMARTHOMEENTRY_RELAY=relay.example.com:22",
+		"SMARTHOMEENTRY_ERROR=relay went away",
+	} {
+		if !strings.Contains(down, want) {
+			t.Errorf("disconnect hook env missing %q", want)
+		}
+	}
+}
+
+func TestRunCycle_noDisconnectHookWithoutConnect(t *testing.T) {
+	cfg := api.AgentConfig{
+		Host: "relay.example.com", Port: 22, TunnelPort: 9000,
+		PrivateKey: "key", Active: true,
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(cfg)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	hook := writeHookScript(t, dir)
+
+	a := newTestAgent(t, srv)
+	a.opts.OnDisconnect = hook
+	a.runTunnel = func(context.Context, *tunnel.Config) error {
+		return errors.New("dial failed")
+	}
+	_ = a.runCycle(context.Background())
+
+	time.Sleep(200 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(dir, "disconnect.env")); err == nil {
+		t.Error("disconnect hook must not run when the tunnel never came up")
+	}
+}
+
+func TestRunHook_missingCommandReturns(t *testing.T) {
+	// runHook must return (and log) rather than hang on a failing hook.
+	done := make(chan struct{})
+	go func() {
+		runHook(filepath.Join(t.TempDir(), "missing"), hookEventConnect)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("runHook did not return for a missing command")
+	}
+}
+
+func TestRunHook_returnsDespiteBackgroundedChild(t *testing.T) {
+	old := hookWaitDelay
+	hookWaitDelay = 100 * time.Millisecond
+	t.Cleanup(func() { hookWaitDelay = old })
+
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\nsleep 60 &\necho started\n"), 0o755); err != nil {
+		t.Fatalf("write hook: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		runHook(path, hookEventConnect)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runHook waited for the hook's backgrounded child")
+	}
+}
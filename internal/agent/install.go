@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/smarthomeentry/agent/internal/api"
+	"github.com/smarthomeentry/agent/internal/tunnel"
+)
+
+// installDialTimeout bounds the host-key handshake with the relay.
+const installDialTimeout = 30 * time.Second
+
+// ErrHostKeyRejected is returned by Install when the operator does not
+// confirm the relay's host key.
+var ErrHostKeyRejected = errors.New("relay host key rejected by operator")
+
+// InstallOptions configures Install.
+type InstallOptions struct {
+	Options
+
+	// KeyPath and KnownHostsPath default to the agent's standard locations.
+	KeyPath        string
+	KnownHostsPath string
+
+	// ConfirmHostKey is shown the relay address and host key fingerprint
+	// and reports whether to trust it. Nil trusts the key without asking.
+	ConfirmHostKey func(relay string, key ssh.PublicKey) bool
+}
+
+// Install performs first-time setup: it validates the token, fetches the
+// config, stores the SSH key and records the relay's host key in
+// known_hosts after the operator confirms it, so the service never has to
+// trust a key on first use unattended. It returns the fetched config.
+func Install(ctx context.Context, opts InstallOptions) (*api.AgentConfig, error) {
+	keyPath := opts.KeyPath
+	if keyPath == "" {
+		keyPath = keyFilePath
+	}
+	knownHosts := opts.KnownHostsPath
+	if knownHosts == "" {
+		knownHosts = tunnel.KnownHostsPath
+	}
+
+	resolver, err := dnsResolver(opts.DNSServer)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newAPIClient(opts.Options, resolver)
+	if err != nil {
+		return nil, err
+	}
+	return install(ctx, client, keyPath, knownHosts, opts.ConfirmHostKey)
+}
+
+func install(ctx context.Context, client *api.Client, keyPath, knownHosts string, confirm func(string, ssh.PublicKey) bool) (*api.AgentConfig, error) {
+	if err := client.ValidateToken(ctx); err != nil {
+		return nil, fmt.Errorf("install token validation failed: %w", err)
+	}
+	log.Println("install token validated")
+
+	cfg, err := client.FetchConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	relay := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	log.Printf("config: relay=%s tunnel_port=%d active=%v", relay, cfg.TunnelPort, cfg.Active)
+
+	if cfg.PrivateKey != "" {
+		if err := writeKey(keyPath, cfg.PrivateKey); err != nil {
+			return nil, fmt.Errorf("write SSH key: %w", err)
+		}
+		log.Printf("SSH key written to %s", keyPath)
+	} else if _, err := os.Stat(keyPath); err != nil {
+		return nil, fmt.Errorf("SSH key not in config and not on disk (%s): %w — regenerate install token", keyPath, err)
+	} else {
+		log.Printf("keeping existing SSH key at %s", keyPath)
+	}
+
+	hostKey, err := tunnel.FetchHostKey(ctx, relay, installDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if confirm != nil && !confirm(relay, hostKey) {
+		return nil, ErrHostKeyRejected
+	}
+	if err := tunnel.TrustHostKey(knownHosts, relay, hostKey); err != nil {
+		return nil, err
+	}
+	log.Printf("relay host key %s %s trusted for %s", hostKey.Type(), ssh.FingerprintSHA256(hostKey), relay)
+	return cfg, nil
+}
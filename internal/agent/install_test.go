@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/smarthomeentry/agent/internal/api"
+)
+
+// startRelayHostKey runs an SSH server that presents a host key and stops
+// there, standing in for the relay during install.
+func startRelayHostKey(t *testing.T) (host string, port int, key ssh.PublicKey) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("host signer: %v", err)
+	}
+	cfg := &ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _, _, _ = ssh.NewServerConn(c, cfg)
+			}()
+		}
+	}()
+	a := ln.Addr().(*net.TCPAddr)
+	return a.IP.String(), a.Port, signer.PublicKey()
+}
+
+func installServer(t *testing.T, cfg api.AgentConfig) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/agent/validate" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(cfg)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestInstall_writesKeyAndKnownHosts(t *testing.T) {
+	host, port, hostKey := startRelayHostKey(t)
+	srv := installServer(t, api.AgentConfig{
+		Host: host, Port: port, TunnelPort: 9000, PrivateKey: "install-key", Active: true,
+	})
+	client, err := api.New(srv.URL, "test-token", api.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatalf("api.New: %v", err)
+	}
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "agent_key")
+	knownHosts := filepath.Join(dir, "known_hosts")
+
+	var shown string
+	cfg, err := install(context.Background(), client, keyPath, knownHosts, func(relay string, key ssh.PublicKey) bool {
+		shown = ssh.FingerprintSHA256(key)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if cfg.TunnelPort != 9000 {
+		t.Errorf("returned config tunnel_port=%d", cfg.TunnelPort)
+	}
+	if shown != ssh.FingerprintSHA256(hostKey) {
+		t.Errorf("operator was shown %s, want %s", shown, ssh.FingerprintSHA256(hostKey))
+	}
+	if b, _ := os.ReadFile(keyPath); string(b) != "install-key" {
+		t.Errorf("key file=%q", b)
+	}
+	kh, err := os.ReadFile(knownHosts)
+	if err != nil {
+		t.Fatalf("read known_hosts: %v", err)
+	}
+	if !strings.Contains(string(kh), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey)))) {
+		t.Errorf("known_hosts does not contain relay key:\n%s", kh)
+	}
+}
+
+func TestInstall_rejectedHostKeyNotTrusted(t *testing.T) {
+	host, port, _ := startRelayHostKey(t)
+	srv := installServer(t, api.AgentConfig{
+		Host: host, Port: port, TunnelPort: 9000, PrivateKey: "install-key", Active: true,
+	})
+	client, err := api.New(srv.URL, "test-token", api.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatalf("api.New: %v", err)
+	}
+	dir := t.TempDir()
+	knownHosts := filepath.Join(dir, "known_hosts")
+
+	_, err = install(context.Background(), client, filepath.Join(dir, "agent_key"), knownHosts,
+		func(string, ssh.PublicKey) bool { return false })
+	if !errors.Is(err, ErrHostKeyRejected) {
+		t.Fatalf("install: got %v, want ErrHostKeyRejected", err)
+	}
+	if _, err := os.Stat(knownHosts); !os.IsNotExist(err) {
+		t.Error("known_hosts must not be written when the operator rejects the key")
+	}
+}
+
+func TestInstall_missingKeyFails(t *testing.T) {
+	host, port, _ := startRelayHostKey(t)
+	srv := installServer(t, api.AgentConfig{Host: host, Port: port, TunnelPort: 9000, Active: true})
+	client, err := api.New(srv.URL, "test-token", api.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatalf("api.New: %v", err)
+	}
+	dir := t.TempDir()
+	if _, err := install(context.Background(), client, filepath.Join(dir, "agent_key"), filepath.Join(dir, "known_hosts"), nil); err == nil {
+		t.Fatal("expected error when no key is available")
+	}
+}
+
+func TestInstall_usesAgentClientOptions(t *testing.T) {
+	dir := t.TempDir()
+	_, err := Install(context.Background(), InstallOptions{
+		Options: Options{
+			APIURL:           "https://127.0.0.1:1",
+			Token:            "test-token",
+			PinnedCertSHA256: "not-a-fingerprint",
+		},
+		KeyPath:        filepath.Join(dir, "agent_key"),
+		KnownHostsPath: filepath.Join(dir, "known_hosts"),
+	})
+	if err == nil || !strings.Contains(err.Error(), "pinned certificates") {
+		t.Fatalf("Install: got %v, want the pin option rejected as it is by New", err)
+	}
+}
@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Values for Options.KeyPolicy, deciding which SSH key is used when the
+// config delivers one that differs from the key on disk.
+const (
+	// KeyPolicyConfigWins overwrites the key on disk (the default).
+	KeyPolicyConfigWins = "config-wins"
+	// KeyPolicyDiskWins keeps the key on disk, e.g. one rotated locally.
+	KeyPolicyDiskWins = "disk-wins"
+	// KeyPolicyErrorOnConflict fails the cycle until an operator resolves
+	// the conflict.
+	KeyPolicyErrorOnConflict = "error-on-conflict"
+)
+
+// errKeyConflict is returned under KeyPolicyErrorOnConflict when the key
+// from config differs from the key on disk.
+var errKeyConflict = errors.New("SSH key from config differs from the key on disk")
+
+// chooseKey applies the key policy to a key delivered in config. It
+// returns the key to use and whether it is the one on disk, in which case
+// nothing needs writing. A fresh key the agent asked for always wins.
+func (a *Agent) chooseKey(configKey string, fresh bool) (key string, fromDisk bool, err error) {
+	disk, err := os.ReadFile(a.keyPath)
+	if err != nil || strings.TrimSpace(string(disk)) == strings.TrimSpace(configKey) {
+		return configKey, false, nil
+	}
+	switch policy := a.opts.KeyPolicy; {
+	case fresh || policy == "" || policy == KeyPolicyConfigWins:
+		log.Printf("SSH key from config differs from the key on disk (%s) — using the key from config", a.keyPath)
+		return configKey, false, nil
+	case policy == KeyPolicyDiskWins:
+		log.Printf("SSH key from config differs from the key on disk (%s) — keeping the key on disk (%s)", a.keyPath, policy)
+		return strings.TrimSpace(string(disk)), true, nil
+	default:
+		return "", false, fmt.Errorf("%w (%s): resolve it or change the key policy (%s)", errKeyConflict, a.keyPath, policy)
+	}
+}
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/smarthomeentry/agent/internal/api"
+	"github.com/smarthomeentry/agent/internal/tunnel"
+)
+
+func TestRunCycle_keyPolicy(t *testing.T) {
+	tests := []struct {
+		policy   string
+		wantKey  string // used for the tunnel; empty when the cycle fails
+		wantDisk string
+		wantErr  error
+	}{
+		{"", "config-key", "config-key", nil},
+		{KeyPolicyConfigWins, "config-key", "config-key", nil},
+		{KeyPolicyDiskWins, "disk-key", "disk-key", nil},
+		{KeyPolicyErrorOnConflict, "", "disk-key", errKeyConflict},
+	}
+	for _, tc := range tests {
+		t.Run(tc.policy, func(t *testing.T) {
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewEncoder(w).Encode(api.AgentConfig{
+					Host: "relay.example.com", Port: 22, TunnelPort: 9000, Active: true, PrivateKey: "config-key",
+				})
+			}))
+			defer srv.Close()
+
+			a := newTestAgent(t, srv)
+			a.opts.KeyPolicy = tc.policy
+			if err := os.WriteFile(a.keyPath, []byte("disk-key\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			var used string
+			a.runTunnel = func(_ context.Context, c *tunnel.Config) error {
+				used = c.PrivateKey
+				return nil
+			}
+
+			err := a.runCycle(context.Background())
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("runCycle: got %v, want %v", err, tc.wantErr)
+			}
+			if used != tc.wantKey {
+				t.Errorf("tunnel used key %q, want %q", used, tc.wantKey)
+			}
+			if disk, _ := os.ReadFile(a.keyPath); string(disk) != tc.wantDisk && string(disk) != tc.wantDisk+"\n" {
+				t.Errorf("key on disk=%q, want %q", disk, tc.wantDisk)
+			}
+		})
+	}
+}
+
+func TestChooseKey_noConflict(t *testing.T) {
+	a := &Agent{keyPath: t.TempDir() + "/agent_key", opts: Options{KeyPolicy: KeyPolicyErrorOnConflict}}
+	// No key on disk yet: the config key is used and written.
+	if key, fromDisk, err := a.chooseKey("k", false); key != "k" || fromDisk || err != nil {
+		t.Errorf("no disk key: got %q, %v, %v", key, fromDisk, err)
+	}
+	// The same key, give or take a trailing newline, is no conflict.
+	if err := os.WriteFile(a.keyPath, []byte("k\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if key, fromDisk, err := a.chooseKey("k", false); key != "k" || fromDisk || err != nil {
+		t.Errorf("same key: got %q, %v, %v", key, fromDisk, err)
+	}
+}
+
+func TestChooseKey_freshKeyAlwaysWins(t *testing.T) {
+	for _, policy := range []string{KeyPolicyDiskWins, KeyPolicyErrorOnConflict} {
+		a := &Agent{keyPath: t.TempDir() + "/agent_key", opts: Options{KeyPolicy: policy}}
+		if err := os.WriteFile(a.keyPath, []byte("old"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if key, fromDisk, err := a.chooseKey("fresh", true); key != "fresh" || fromDisk || err != nil {
+			t.Errorf("%s: got %q, %v, %v, want the requested fresh key", policy, key, fromDisk, err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"os"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+)
+
+// defaultDeadlockTimeout is how long the liveness beacon may stay overdue
+// before the agent assumes it is deadlocked. It is far longer than any
+// heartbeat interval or network timeout, so a slow but working agent is
+// never restarted.
+const defaultDeadlockTimeout = 30 * time.Minute
+
+// beacon records when the reconnect loop or the tunnel's heartbeat next
+// promises to show progress.
+type beacon struct {
+	// due is the Unix nanosecond time by which the next beat is expected.
+	due atomic.Int64
+}
+
+// beat marks progress and expects the next beat within next, e.g. a
+// backoff sleep about to start.
+func (b *beacon) beat(next time.Duration) {
+	b.due.Store(time.Now().Add(next).UnixNano())
+}
+
+// overdue returns how long the next beat is late at now.
+func (b *beacon) overdue(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, b.due.Load()))
+}
+
+// deadlockTimeout returns the deadlock watchdog threshold, zero when
+// disabled.
+func (a *Agent) deadlockTimeout() time.Duration {
+	switch d := a.opts.DeadlockTimeout; {
+	case d < 0:
+		return 0
+	case d == 0:
+		return defaultDeadlockTimeout
+	default:
+		return d
+	}
+}
+
+// watchDeadlock exits the process once the beacon is overdue by more than
+// timeout, after logging a dump of every goroutine, so the supervisor
+// restarts an agent whose loops have stopped making progress. It returns
+// when ctx is done.
+func (a *Agent) watchDeadlock(ctx context.Context, timeout time.Duration) {
+	t := time.NewTicker(max(timeout/4, time.Millisecond))
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			late := a.beacon.overdue(now)
+			if late <= timeout {
+				continue
+			}
+			log.Printf("FATAL: agent made no progress for %s — assuming a deadlock, exiting so the supervisor restarts it; goroutine dump follows", late.Truncate(time.Second))
+			_ = pprof.Lookup("goroutine").WriteTo(log.Writer(), 2)
+			exit := a.exit
+			if exit == nil {
+				exit = os.Exit
+			}
+			exit(1)
+			return
+		}
+	}
+}
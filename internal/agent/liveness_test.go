@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchDeadlock_exitsWhenBeaconStalls(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	exited := make(chan int, 1)
+	a := &Agent{exit: func(code int) { exited <- code }}
+	a.beacon.beat(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		a.watchDeadlock(ctx, 50*time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case code := <-exited:
+		if code == 0 {
+			t.Error("watchdog exited with status 0, want non-zero")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchdog did not exit on a stalled beacon")
+	}
+	<-done
+	if !strings.Contains(buf.String(), "deadlock") || !strings.Contains(buf.String(), "goroutine ") {
+		t.Errorf("log lacks the diagnostic or goroutine dump:\n%s", buf.String())
+	}
+}
+
+func TestWatchDeadlock_beatingBeaconKeepsRunning(t *testing.T) {
+	exited := make(chan int, 1)
+	a := &Agent{exit: func(code int) { exited <- code }}
+	a.beacon.beat(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	go func() {
+		tick := time.NewTicker(10 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				a.beacon.beat(0)
+			}
+		}
+	}()
+	a.watchDeadlock(ctx, 100*time.Millisecond)
+
+	select {
+	case <-exited:
+		t.Fatal("watchdog fired while the beacon was beating")
+	default:
+	}
+}
+
+func TestWatchDeadlock_expectedWaitIsNotAStall(t *testing.T) {
+	exited := make(chan int, 1)
+	a := &Agent{exit: func(code int) { exited <- code }}
+	// A backoff sleep longer than the timeout announces its length.
+	a.beacon.beat(time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	a.watchDeadlock(ctx, 20*time.Millisecond)
+
+	select {
+	case <-exited:
+		t.Fatal("watchdog fired during an announced wait")
+	default:
+	}
+}
+
+func TestDeadlockTimeout(t *testing.T) {
+	tests := []struct {
+		opt, want time.Duration
+	}{
+		{0, defaultDeadlockTimeout},
+		{-1, 0},
+		{time.Minute, time.Minute},
+	}
+	for _, tc := range tests {
+		a := &Agent{opts: Options{DeadlockTimeout: tc.opt}}
+		if got := a.deadlockTimeout(); got != tc.want {
+			t.Errorf("deadlockTimeout(%s) = %s, want %s", tc.opt, got, tc.want)
+		}
+	}
+}
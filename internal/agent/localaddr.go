@@ -0,0 +1,57 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// normalizeLocalAddr turns the LocalAddr shorthands operators commonly use
+// into a dialable host:port: "" selects defaultLocalAddr, a bare port
+// ("8080") or a host-less one (":8080") means localhost. Input that cannot
+// be dialed as given — a host without a port, an unbracketed IPv6 address,
+// a URL or a non-numeric port — is rejected with an explanation.
+func normalizeLocalAddr(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return defaultLocalAddr, nil
+	}
+	if strings.Contains(addr, "://") {
+		return "", fmt.Errorf("local address %q: want host:port, not a URL", addr)
+	}
+	if isDigits(addr) {
+		addr = ":" + addr
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		switch {
+		case strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "["):
+			return "", fmt.Errorf("local address %q: put IPv6 addresses in brackets, e.g. [::1]:8080", addr)
+		case !strings.Contains(addr, ":"):
+			return "", fmt.Errorf("local address %q: missing port, e.g. %s:8080", addr, addr)
+		default:
+			return "", fmt.Errorf("local address %q: %w", addr, err)
+		}
+	}
+	if n, err := strconv.Atoi(port); err != nil || !isDigits(port) || n < 1 || n > 65535 {
+		return "", fmt.Errorf("local address %q: port %q must be a number from 1 to 65535", addr, port)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
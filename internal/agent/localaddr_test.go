@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeLocalAddr(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{in: "", want: defaultLocalAddr},
+		{in: "8080", want: "localhost:8080"},
+		{in: " 8080 ", want: "localhost:8080"},
+		{in: ":8080", want: "localhost:8080"},
+		{in: "localhost:8123", want: "localhost:8123"},
+		{in: "192.168.1.10:80", want: "192.168.1.10:80"},
+		{in: "[::1]:8080", want: "[::1]:8080"},
+		{in: "localhost", wantErr: "missing port"},
+		{in: "192.168.1.10", wantErr: "missing port"},
+		{in: "::1", wantErr: "brackets"},
+		{in: "fe80::1:8080", wantErr: "brackets"},
+		{in: "http://localhost:8080", wantErr: "not a URL"},
+		{in: "localhost:http", wantErr: "must be a number"},
+		{in: "localhost:", wantErr: "must be a number"},
+		{in: "localhost:0", wantErr: "must be a number"},
+		{in: "70000", wantErr: "must be a number"},
+		{in: "localhost:+80", wantErr: "must be a number"},
+	}
+	for _, tt := range tests {
+		got, err := normalizeLocalAddr(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("normalizeLocalAddr(%q) = %q, %v; want error containing %q", tt.in, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeLocalAddr(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
@@ -4,23 +4,35 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"syscall"
 )
 
 const lockFilePath = "/var/run/smarthomeentry-agent.pid"
 
-func acquireLock() (*os.File, error) {
-	f, err := os.OpenFile(lockFilePath, os.O_CREATE|os.O_RDWR, 0o644)
+// ErrAlreadyRunning is returned by acquireLock when another agent holds the
+// lock.
+var ErrAlreadyRunning = errors.New("another instance is already running")
+
+// acquireLock takes an exclusive flock on path, creating it and its parent
+// directory if needed, and writes our PID into it.
+func acquireLock(path string) (*os.File, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("cannot create lock file: run directory %s unavailable: %w", dir, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
 	if err != nil {
-		return nil, fmt.Errorf("open lock file %s: %w", lockFilePath, err)
+		return nil, fmt.Errorf("cannot create lock file %s (is %s writable and not full?): %w", path, dir, err)
 	}
 
 	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
 		f.Close()
 		if errors.Is(err, syscall.EWOULDBLOCK) {
-			return nil, fmt.Errorf("another instance is already running (lock: %s)", lockFilePath)
+			return nil, fmt.Errorf("%w (lock: %s)", ErrAlreadyRunning, path)
 		}
-		return nil, fmt.Errorf("acquire flock on %s: %w", lockFilePath, err)
+		return nil, fmt.Errorf("acquire flock on %s: %w", path, err)
 	}
 
 	if err := f.Truncate(0); err == nil {
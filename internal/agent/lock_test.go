@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAcquireLock_createsMissingRunDir(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "smarthomeentry", "agent.pid")
+
+	f, err := acquireLock(path)
+	if err != nil {
+		t.Fatalf("acquireLock: %v", err)
+	}
+	defer f.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read lock file: %v", err)
+	}
+	if got := strings.TrimSpace(string(data)); got != strconv.Itoa(os.Getpid()) {
+		t.Errorf("lock file contains %q, want our PID", got)
+	}
+}
+
+func TestAcquireLock_alreadyHeld(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.pid")
+
+	first, err := acquireLock(path)
+	if err != nil {
+		t.Fatalf("first acquireLock: %v", err)
+	}
+	defer first.Close()
+
+	_, err = acquireLock(path)
+	if !errors.Is(err, ErrAlreadyRunning) {
+		t.Fatalf("second acquireLock: got %v, want ErrAlreadyRunning", err)
+	}
+}
+
+func TestAcquireLock_runDirUnavailable(t *testing.T) {
+	// A regular file where the run directory should be.
+	parent := filepath.Join(t.TempDir(), "run")
+	if err := os.WriteFile(parent, nil, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	_, err := acquireLock(filepath.Join(parent, "agent.pid"))
+	if err == nil {
+		t.Fatal("expected error when the run directory cannot be created")
+	}
+	if errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("unavailable run dir must not be reported as another instance: %v", err)
+	}
+}
+
+func TestNew_lockDisabled(t *testing.T) {
+	_, statBefore := os.Stat(lockFilePath)
+
+	a, err := New(Options{
+		APIURL:      "https://control.example.com",
+		Token:       "tok",
+		DisableLock: true,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if a.lockFH != nil {
+		t.Error("lock handle must be nil when locking is disabled")
+	}
+	a.Close() // must tolerate the nil handle
+
+	if _, statAfter := os.Stat(lockFilePath); os.IsNotExist(statBefore) != os.IsNotExist(statAfter) {
+		t.Errorf("lock path %s touched with locking disabled", lockFilePath)
+	}
+}
+
+func TestClose_onceAcrossGoroutines(t *testing.T) {
+	if _, err := os.Stat(lockFilePath); err == nil {
+		t.Skipf("%s exists; not touching another agent's lock", lockFilePath)
+	}
+	f, err := acquireLock(lockFilePath)
+	if err != nil {
+		t.Skipf("cannot take the agent lock here: %v", err)
+	}
+	a := &Agent{lockFH: f}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.Close()
+		}()
+	}
+	wg.Wait()
+
+	// A new instance takes the lock; a late Close from the old one must
+	// leave its lock file alone.
+	next, err := acquireLock(lockFilePath)
+	if err != nil {
+		t.Fatalf("lock not released by Close: %v", err)
+	}
+	t.Cleanup(func() {
+		next.Close()
+		_ = os.Remove(lockFilePath)
+	})
+	a.Close()
+	if _, err := os.Stat(lockFilePath); err != nil {
+		t.Errorf("repeated Close removed the next instance's lock file: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultPublicIPInterval is how often the public IP is looked up
+	// again; egress addresses rarely change and echo services rate-limit.
+	defaultPublicIPInterval = time.Hour
+	// publicIPTimeout bounds one echo service lookup.
+	publicIPTimeout = 5 * time.Second
+)
+
+// publicIP caches the agent's public egress IP as reported by an IP-echo
+// service, such as https://api.ipify.org, that answers with the caller's
+// address as plain text. Run refreshes it in the background so heartbeats
+// never wait on the echo service.
+type publicIP struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+
+	mu sync.Mutex
+	ip string
+}
+
+func newPublicIP(url string, interval time.Duration) *publicIP {
+	if interval <= 0 {
+		interval = defaultPublicIPInterval
+	}
+	return &publicIP{url: url, interval: interval, client: &http.Client{Timeout: publicIPTimeout}}
+}
+
+// Run looks the IP up now and then every interval until ctx is done.
+func (p *publicIP) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh looks the IP up once. Failures are only logged and keep the
+// previous value, so a flaky echo service never affects heartbeats.
+func (p *publicIP) refresh(ctx context.Context) {
+	ip, err := p.lookup(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("public IP lookup: %v", err)
+		}
+		return
+	}
+	p.mu.Lock()
+	p.ip = ip
+	p.mu.Unlock()
+}
+
+// get returns the cached IP, or "" before the first successful lookup. A
+// nil *publicIP returns "".
+func (p *publicIP) get() string {
+	if p == nil {
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ip
+}
+
+func (p *publicIP) lookup(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: unexpected HTTP %d", p.url, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return "", fmt.Errorf("%s: response is not an IP address", p.url)
+	}
+	return ip.String(), nil
+}
@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/smarthomeentry/agent/internal/api"
+)
+
+func TestPublicIP_reportedAndCached(t *testing.T) {
+	var lookups atomic.Int32
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		io.WriteString(w, "203.0.113.7\n")
+	}))
+	defer echo.Close()
+
+	bodies := make(chan []byte, 2)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+		_ = json.NewEncoder(w).Encode(api.HeartbeatResponse{Active: true})
+	}))
+	defer srv.Close()
+
+	a := newTestAgent(t, srv)
+	a.publicIP = newPublicIP(echo.URL, time.Hour)
+	a.publicIP.refresh(context.Background())
+	for i := 0; i < 2; i++ {
+		if _, err := a.sendHeartbeat(context.Background(), srv.URL+"/heartbeat"); err != nil {
+			t.Fatalf("sendHeartbeat: %v", err)
+		}
+		var hb struct {
+			PublicIP string `json:"public_ip"`
+		}
+		if err := json.Unmarshal(<-bodies, &hb); err != nil {
+			t.Fatalf("decode heartbeat: %v", err)
+		}
+		if hb.PublicIP != "203.0.113.7" {
+			t.Errorf("heartbeat %d public_ip=%q, want 203.0.113.7", i, hb.PublicIP)
+		}
+	}
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("echo service queried %d times, want 1: heartbeats only read the cache", n)
+	}
+}
+
+func TestPublicIP_slowLookupDoesNotDelayHeartbeat(t *testing.T) {
+	release := make(chan struct{})
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		io.WriteString(w, "203.0.113.7")
+	}))
+	defer echo.Close()
+	defer close(release)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(api.HeartbeatResponse{Active: true})
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := newTestAgent(t, srv)
+	a.publicIP = newPublicIP(echo.URL, time.Hour)
+	go a.publicIP.Run(ctx)
+
+	hbCtx, hbCancel := context.WithTimeout(ctx, time.Second)
+	defer hbCancel()
+	if _, err := a.sendHeartbeat(hbCtx, srv.URL+"/heartbeat"); err != nil {
+		t.Fatalf("sendHeartbeat while the echo service hangs: %v", err)
+	}
+	if got := a.publicIP.get(); got != "" {
+		t.Errorf("get = %q before any lookup finished, want empty", got)
+	}
+}
+
+func TestPublicIP_failuresKeepLastValue(t *testing.T) {
+	var fail atomic.Bool
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			io.WriteString(w, "<html>rate limited</html>")
+			return
+		}
+		io.WriteString(w, "2001:db8::1")
+	}))
+	defer echo.Close()
+
+	p := newPublicIP(echo.URL, time.Hour)
+	p.refresh(context.Background())
+	if got := p.get(); got != "2001:db8::1" {
+		t.Fatalf("get = %q, want 2001:db8::1", got)
+	}
+	fail.Store(true)
+	p.refresh(context.Background())
+	if got := p.get(); got != "2001:db8::1" {
+		t.Errorf("after a bad response get = %q, want the previous IP", got)
+	}
+
+	var none *publicIP
+	if got := none.get(); got != "" {
+		t.Errorf("nil publicIP returned %q", got)
+	}
+}
@@ -0,0 +1,29 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+)
+
+// ensureStateDir recreates the state directory dir if it was removed while
+// the agent was running, e.g. by a cleanup job. The SSH key and known_hosts
+// went with it, so relay host keys are learned again on first use and the
+// key must come from the next config. It reports whether dir was recreated.
+func ensureStateDir(dir string) (bool, error) {
+	_, err := os.Stat(dir)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("check state dir %s: %w", dir, err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return false, fmt.Errorf("recreate state dir %s: %w", dir, err)
+	}
+	log.Printf("WARNING: state directory %s was removed while running — recreated it; "+
+		"relay host keys will be trusted again on first use and the SSH key must be re-delivered in config", dir)
+	return true, nil
+}
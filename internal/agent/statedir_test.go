@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/smarthomeentry/agent/internal/api"
+	"github.com/smarthomeentry/agent/internal/tunnel"
+)
+
+func TestEnsureStateDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if recreated, err := ensureStateDir(dir); err != nil || recreated {
+		t.Errorf("existing dir: recreated=%v err=%v", recreated, err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if recreated, err := ensureStateDir(dir); err != nil || !recreated {
+		t.Errorf("removed dir: recreated=%v err=%v", recreated, err)
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		t.Errorf("state dir not recreated: %v", err)
+	}
+}
+
+func TestRunCycle_recoversFromDeletedStateDir(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(api.AgentConfig{
+			Host: "relay.example.com", Port: 22, TunnelPort: 9000, Active: true,
+			HeartbeatURL: srv.URL + "/api/agent/heartbeat",
+			PrivateKey:   "config-key",
+		})
+	}))
+	defer srv.Close()
+
+	a := newTestAgent(t, srv)
+	stateDir := filepath.Join(t.TempDir(), "state")
+	a.keyPath = filepath.Join(stateDir, "agent_key")
+	a.runTunnel = func(context.Context, *tunnel.Config) error { return nil }
+
+	if err := a.runCycle(context.Background()); err != nil {
+		t.Fatalf("first cycle: %v", err)
+	}
+	if err := os.RemoveAll(stateDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.runCycle(context.Background()); err != nil {
+		t.Fatalf("cycle after the state dir was deleted: %v", err)
+	}
+	key, err := os.ReadFile(a.keyPath)
+	if err != nil || string(key) != "config-key" {
+		t.Errorf("key after recovery = %q, %v; want the config key rewritten", key, err)
+	}
+}
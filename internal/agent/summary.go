@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/smarthomeentry/agent/internal/tunnel"
+)
+
+// startupSummary is the effective configuration as one line of key=value
+// pairs, logged at start so operators can confirm what is running. The API
+// URL loses any credentials or query; the token and other secrets are
+// never included.
+func (a *Agent) startupSummary() string {
+	o := a.opts.Effective()
+	hbInterval := "control-plane"
+	if o.HeartbeatInterval > 0 {
+		hbInterval = o.HeartbeatInterval.String()
+	}
+	lock := lockFilePath
+	if o.DisableLock {
+		lock = "disabled"
+	}
+	key := a.keyPath
+	if o.CredentialKeyPath != "" {
+		key = o.CredentialKeyPath
+	}
+
+	var b strings.Builder
+	for _, kv := range [][2]string{
+		{"api_url", redactURLs(o.APIURL)},
+		{"local_addr", a.localAddr},
+		{"key", key},
+		{"known_hosts", tunnel.KnownHostsPath},
+		{"lock", lock},
+		{"log_level", o.LogLevel},
+		{"backoff_initial", o.BackoffInitial.String()},
+		{"backoff_max", o.BackoffMax.String()},
+		{"heartbeat_interval", hbInterval},
+		{"heartbeat_timeout", o.HeartbeatTimeout.String()},
+	} {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		v := kv[1]
+		if v == "" || strings.ContainsAny(v, " \"=") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&b, "%s=%s", kv[0], v)
+	}
+	return b.String()
+}
+
+// redactURLs strips user info and query strings, which may carry
+// credentials, from a comma-separated list of URLs.
+func redactURLs(list string) string {
+	var out []string
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			out = append(out, "invalid")
+			continue
+		}
+		u.User = nil
+		if u.RawQuery != "" {
+			u.RawQuery = "redacted"
+		}
+		u.Fragment = ""
+		out = append(out, u.String())
+	}
+	return strings.Join(out, ",")
+}
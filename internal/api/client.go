@@ -3,17 +3,55 @@ package api
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// DefaultMaxBodySize caps how much of a control-plane response is read.
+const DefaultMaxBodySize = 1 << 20
+
+// DefaultTimeout bounds each control-plane request, including reading the
+// response body. A caller's context deadline applies when it is sooner.
+const DefaultTimeout = 30 * time.Second
+
 // ErrUnauthorized is returned when the control plane rejects our token (HTTP 401/403).
 var ErrUnauthorized = errors.New("unauthorized: install token rejected by control plane")
 
+// ErrResponseTooLarge is returned when a response body exceeds the client's
+// maximum body size.
+var ErrResponseTooLarge = errors.New("response body exceeds size limit")
+
+// ErrRedirectRefused is returned when the control plane redirects a request
+// to another host and the client is configured to refuse such redirects.
+var ErrRedirectRefused = errors.New("cross-host redirect refused")
+
+// maxRedirects matches net/http's default redirect limit.
+const maxRedirects = 10
+
+// ConfigValidationError reports which field of a config response was
+// missing or invalid.
+type ConfigValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ConfigValidationError) Error() string {
+	return fmt.Sprintf("config response %s '%s' field", e.Reason, e.Field)
+}
+
 type AgentConfig struct {
 	Host         string `json:"host"`
 	Port         int    `json:"port"`
@@ -22,10 +60,113 @@ type AgentConfig struct {
 	PrivateKey   string `json:"private_key"`
 	Active       bool   `json:"active"`
 	HeartbeatURL string `json:"heartbeat_url"`
+	// ServiceName, if set, names the local service the tunnel forwards
+	// to, for connection logs, traffic accounting and status.
+	ServiceName string `json:"service_name,omitempty"`
+	// MaintenanceUntil, if in the future, keeps the agent deactivated until
+	// then. Unlike Active=false it tells the agent when to resume.
+	MaintenanceUntil time.Time `json:"maintenance_until,omitempty"`
+
+	// Optional fleet-wide tuning in seconds; zero means "not set". Local
+	// settings take precedence over these.
+	KeepaliveInterval int `json:"keepalive_interval,omitempty"`
+	ProxyIdleTimeout  int `json:"proxy_idle_timeout,omitempty"`
+	HeartbeatInterval int `json:"heartbeat_interval,omitempty"`
 }
 
 type HeartbeatResponse struct {
 	Active bool `json:"active"`
+	// RequestMetricsNow asks the agent to collect metrics and send them
+	// right away with SendMetrics, e.g. because an operator is looking.
+	RequestMetricsNow bool `json:"request_metrics_now,omitempty"`
+	// TunnelPort, if set, is the relay port the agent should forward.
+	// When it differs from the current one the agent reconnects to it.
+	TunnelPort int `json:"tunnel_port,omitempty"`
+
+	// DecodeErr is set when a 200 response carried a body that failed to
+	// decode. The response then keeps its fail-safe defaults (active).
+	DecodeErr error `json:"-"`
+}
+
+// Heartbeat payload schema versions. Older control planes may reject fields
+// they don't know, so the client can be pinned to an older schema.
+const (
+	// HeartbeatSchemaV1 is the original payload: the metrics object alone
+	// (or an empty body when no metrics are available).
+	HeartbeatSchemaV1 = 1
+	// HeartbeatSchemaV2 adds schema_version and the extended agent fields.
+	HeartbeatSchemaV2 = 2
+	// LatestHeartbeatSchema is the richest schema this client can send.
+	LatestHeartbeatSchema = HeartbeatSchemaV2
+)
+
+// Heartbeat is the payload POSTed to the heartbeat URL. Only the embedded
+// metrics are sent for HeartbeatSchemaV1; all other fields are V2+.
+type Heartbeat struct {
+	SchemaVersion int `json:"schema_version,omitempty"`
+	*HeartbeatMetrics
+
+	// Platform is the agent's GOOS/GOARCH.
+	Platform string `json:"platform,omitempty"`
+
+	// KeySource is where the SSH key in use came from; one of the
+	// KeySource* constants.
+	KeySource string `json:"key_source,omitempty"`
+
+	// CPUPeakPercent is the highest CPU reading when the agent averages
+	// several readings per heartbeat.
+	CPUPeakPercent float64 `json:"cpu_peak_percent,omitempty"`
+
+	// HostKeyAlgo is the type of the host key the relay presented, for
+	// compliance inventories.
+	HostKeyAlgo string `json:"host_key_algo,omitempty"`
+
+	// ForwardDeniedPort is set, on a heartbeat sent outside a connected
+	// tunnel, to the tunnel port the relay refused to forward.
+	ForwardDeniedPort int `json:"forward_denied_port,omitempty"`
+
+	// RelayRTTMs is the smoothed round-trip time to the relay, measured
+	// from SSH keepalives, in milliseconds.
+	RelayRTTMs float64 `json:"relay_rtt_ms,omitempty"`
+
+	// ConnectDurationMs is how long the tunnel took to establish, in
+	// milliseconds. Only set on the first heartbeat after connecting.
+	ConnectDurationMs float64 `json:"connect_duration_ms,omitempty"`
+
+	// PublicIP is the agent's public egress address, when configured to
+	// look it up.
+	PublicIP string `json:"public_ip,omitempty"`
+
+	// LocalServiceDown reports that the tunnel is up but the local service
+	// is failing its health probe, so visitors are turned away.
+	LocalServiceDown bool `json:"local_service_down,omitempty"`
+
+	// Pressure is the host's pressure stall information, when the kernel
+	// provides it.
+	Pressure *Pressure `json:"pressure,omitempty"`
+
+	// Events lists the state transitions (e.g. "tunnel_up") since the
+	// previous heartbeat, when the agent sends heartbeats on events.
+	Events []string `json:"events,omitempty"`
+
+	// NextRetryAt is when the agent will next try to connect, on a
+	// heartbeat sent while it sleeps in backoff.
+	NextRetryAt *time.Time `json:"next_retry_at,omitempty"`
+}
+
+// Values for Heartbeat.KeySource.
+const (
+	KeySourceConfig     = "config"     // delivered in the latest config response
+	KeySourceDisk       = "disk"       // fallback to the key stored on disk
+	KeySourceCredential = "credential" // read-only key from systemd credentials
+)
+
+// Pressure holds "some avg10" pressure stall percentages from
+// /proc/pressure.
+type Pressure struct {
+	CPU    float64 `json:"cpu_some_avg10"`
+	Memory float64 `json:"memory_some_avg10"`
+	IO     float64 `json:"io_some_avg10"`
 }
 
 type HeartbeatMetrics struct {
@@ -35,36 +176,359 @@ type HeartbeatMetrics struct {
 	RAMTotalMB int     `json:"ram_total_mb"`
 }
 
+// endpoint is one control-plane base URL together with its health record.
+type endpoint struct {
+	baseURL  string
+	failures int // consecutive failed requests
+}
+
 type Client struct {
-	baseURL string
-	token   string
-	http    *http.Client
+	mu          sync.Mutex
+	endpoints   []*endpoint
+	token       string
+	http        *http.Client
+	maxBodySize int64
+	headers     http.Header
+	hbSchema    int
+	// timeout bounds each request attempt, through its context so the
+	// caller's deadline and this one are reconciled.
+	timeout time.Duration
+
+	refuseRedirects bool
+	portOptional    bool
+	hbSecret        []byte
+	pins            [][]byte
+	resolver        *net.Resolver
+}
+
+// Option customises a Client created by New.
+type Option func(*Client)
+
+// WithHTTPClient replaces the underlying HTTP client, e.g. to trust a test
+// server's certificate.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
 }
 
-func New(baseURL, token string) (*Client, error) {
-	if !strings.HasPrefix(baseURL, "https://") {
-		return nil, fmt.Errorf("API_URL must use HTTPS, got: %q", baseURL)
+// WithTimeout sets the per-request timeout, DefaultTimeout unless set or
+// taken from a client given to WithHTTPClient. Values <= 0 are ignored.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		if d > 0 {
+			c.timeout = d
+		}
 	}
-	return &Client{
-		baseURL: strings.TrimRight(baseURL, "/"),
-		token:   token,
-		http: &http.Client{
-			Timeout: 30 * time.Second,
-		},
-	}, nil
 }
 
-func (c *Client) ValidateToken(ctx context.Context) error {
-	body, _ := json.Marshal(map[string]string{"token": c.token})
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
-		c.baseURL+"/api/agent/validate", bytes.NewReader(body))
-	if err != nil {
-		return fmt.Errorf("build validate request: %w", err)
+// WithHeaders adds static headers to every request, e.g. for an
+// authenticating gateway in front of the control plane.
+func WithHeaders(h http.Header) Option {
+	return func(c *Client) { c.headers = h.Clone() }
+}
+
+// ParseHeaders parses a "k1:v1,k2:v2" header list. Entries without a name or
+// colon, and attempts to set Authorization (reserved for the bearer token),
+// are skipped and returned in ignored.
+func ParseHeaders(spec string) (h http.Header, ignored []string) {
+	h = make(http.Header)
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") ||
+			strings.EqualFold(name, "Authorization") {
+			ignored = append(ignored, entry)
+			continue
+		}
+		h.Add(name, strings.TrimSpace(value))
+	}
+	return h, ignored
+}
+
+// setHeaders applies the configured extra headers and the bearer token.
+func (c *Client) setHeaders(req *http.Request) {
+	for name, values := range c.headers {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
 	}
-	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+c.token)
+}
 
-	resp, err := c.http.Do(req)
+// WithRefuseCrossHostRedirects makes cross-host redirects fail with
+// ErrRedirectRefused instead of being followed without credentials.
+func WithRefuseCrossHostRedirects(refuse bool) Option {
+	return func(c *Client) { c.refuseRedirects = refuse }
+}
+
+// checkRedirect keeps the bearer token and extra headers from following a
+// redirect to a different host (or port), where a misbehaving control plane
+// or a MITM could collect them. Redirects away from HTTPS are never followed.
+func (c *Client) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if req.URL.Scheme != "https" {
+		return fmt.Errorf("refusing redirect to non-HTTPS URL %s", req.URL.Redacted())
+	}
+	if strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+		return nil
+	}
+	if c.refuseRedirects {
+		return fmt.Errorf("%w: %s → %s", ErrRedirectRefused, via[0].URL.Host, req.URL.Host)
+	}
+	req.Header.Del("Authorization")
+	for name := range c.headers {
+		req.Header.Del(name)
+	}
+	return nil
+}
+
+// WithHeartbeatSecret enables HMAC signing of heartbeats with secret (see
+// signHeartbeat). An empty secret leaves heartbeats unsigned.
+func WithHeartbeatSecret(secret string) Option {
+	return func(c *Client) {
+		if secret != "" {
+			c.hbSecret = []byte(secret)
+		}
+	}
+}
+
+// Heartbeat signature headers. The signature is
+// "v1=" + hex(HMAC-SHA256(secret, timestamp + "\n" + nonce + "\n" + path + "\n" + body)),
+// so the control plane can reject stale timestamps and reused nonces.
+const (
+	HeaderTimestamp = "X-SmartHomeEntry-Timestamp"
+	HeaderNonce     = "X-SmartHomeEntry-Nonce"
+	HeaderSignature = "X-SmartHomeEntry-Signature"
+)
+
+// signHeartbeat adds the timestamp, nonce and signature headers to req.
+func (c *Client) signHeartbeat(req *http.Request, body []byte) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("heartbeat nonce: %w", err)
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	n := hex.EncodeToString(nonce)
+
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderNonce, n)
+	req.Header.Set(HeaderSignature, "v1="+heartbeatSignature(c.hbSecret, ts, n, req.URL.Path, body))
+	return nil
+}
+
+func heartbeatSignature(secret []byte, ts, nonce, path string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", ts, nonce, path)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// WithPortOptional accepts config responses without a relay port, for
+// relays located through a DNS SRV record.
+func WithPortOptional(optional bool) Option {
+	return func(c *Client) { c.portOptional = optional }
+}
+
+// WithHeartbeatSchema selects the heartbeat payload schema version. Values
+// outside 1..LatestHeartbeatSchema select LatestHeartbeatSchema.
+func WithHeartbeatSchema(v int) Option {
+	return func(c *Client) { c.hbSchema = v }
+}
+
+// encodeHeartbeat marshals hb according to the configured schema version.
+// A nil body is returned when there is nothing to send.
+func (c *Client) encodeHeartbeat(hb *Heartbeat) ([]byte, error) {
+	schema := c.hbSchema
+	if schema < HeartbeatSchemaV1 || schema > LatestHeartbeatSchema {
+		schema = LatestHeartbeatSchema
+	}
+
+	if schema == HeartbeatSchemaV1 {
+		if hb == nil || hb.HeartbeatMetrics == nil {
+			return nil, nil
+		}
+		return json.Marshal(hb.HeartbeatMetrics)
+	}
+
+	var out Heartbeat
+	if hb != nil {
+		out = *hb
+	}
+	out.SchemaVersion = schema
+	return json.Marshal(out)
+}
+
+// HeartbeatBody returns hb encoded as SendHeartbeat would post it, for
+// delivery over another transport such as the relay's SSH connection.
+func (c *Client) HeartbeatBody(hb *Heartbeat) ([]byte, error) {
+	return c.encodeHeartbeat(hb)
+}
+
+// WithMaxBodySize sets the maximum number of response bytes read before
+// decoding. Values <= 0 select DefaultMaxBodySize.
+func WithMaxBodySize(n int64) Option {
+	return func(c *Client) { c.maxBodySize = n }
+}
+
+// New creates a client for one or more control-plane base URLs. baseURL may
+// be a comma-separated list (primary first); every entry must use HTTPS.
+func New(baseURL, token string, opts ...Option) (*Client, error) {
+	var endpoints []*endpoint
+	for _, u := range strings.Split(baseURL, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		if !strings.HasPrefix(u, "https://") {
+			return nil, fmt.Errorf("API_URL must use HTTPS, got: %q", u)
+		}
+		endpoints = append(endpoints, &endpoint{baseURL: strings.TrimRight(u, "/")})
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("API_URL is empty")
+	}
+	c := &Client{
+		endpoints: endpoints,
+		token:     token,
+		http:      &http.Client{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.timeout == 0 {
+		c.timeout = c.http.Timeout
+	}
+	if err := c.installPins(); err != nil {
+		return nil, err
+	}
+	if err := c.installResolver(); err != nil {
+		return nil, err
+	}
+	// Install the redirect policy on a copy so a caller-supplied client
+	// isn't modified.
+	hc := *c.http
+	hc.CheckRedirect = c.checkRedirect
+	// The timeout is applied per request in do instead.
+	hc.Timeout = 0
+	c.http = &hc
+	return c, nil
+}
+
+// readBody reads r up to the client's size limit, returning
+// ErrResponseTooLarge rather than a truncated body when the limit is hit.
+func (c *Client) readBody(r io.Reader) ([]byte, error) {
+	limit := c.maxBodySize
+	if limit <= 0 {
+		limit = DefaultMaxBodySize
+	}
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w (%d bytes)", ErrResponseTooLarge, limit)
+	}
+	return data, nil
+}
+
+// orderedEndpoints returns the endpoints to try, healthiest first. Endpoints
+// with equal failure counts keep their configured order, so the primary is
+// preferred whenever it is healthy.
+func (c *Client) orderedEndpoints() []*endpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	eps := make([]*endpoint, len(c.endpoints))
+	copy(eps, c.endpoints)
+	sort.SliceStable(eps, func(i, j int) bool { return eps[i].failures < eps[j].failures })
+	return eps
+}
+
+func (c *Client) markEndpoint(ep *endpoint, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ok {
+		ep.failures = 0
+	} else {
+		ep.failures++
+	}
+}
+
+// do sends a request for path to each endpoint in turn until one answers
+// without a transport error or 5xx status. Any other status (including
+// 401/403) is a definitive answer from a healthy endpoint and is returned to
+// the caller for classification. The 5xx response of the last endpoint is
+// returned as-is so callers still see the status code.
+func (c *Client) do(ctx context.Context, method, path string, body []byte, contentType string) (*http.Response, error) {
+	eps := c.orderedEndpoints()
+	var lastErr error
+	for i, ep := range eps {
+		var bodyReader io.Reader
+		if body != nil {
+			bodyReader = bytes.NewReader(body)
+		}
+		// The attempt ends at the client timeout or the caller's
+		// deadline, whichever comes first.
+		reqCtx, cancel := context.WithTimeout(ctx, c.requestTimeout())
+		req, err := http.NewRequestWithContext(reqCtx, method, ep.baseURL+path, bodyReader)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("build request: %w", err)
+		}
+		c.setHeaders(req)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			cancel()
+			c.markEndpoint(ep, false)
+			lastErr = fmt.Errorf("%s: %w", ep.baseURL, err)
+			if ctx.Err() != nil {
+				return nil, lastErr
+			}
+			continue
+		}
+		resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		if resp.StatusCode >= 500 && i < len(eps)-1 {
+			resp.Body.Close()
+			c.markEndpoint(ep, false)
+			lastErr = fmt.Errorf("%s: unexpected HTTP %d", ep.baseURL, resp.StatusCode)
+			continue
+		}
+		c.markEndpoint(ep, resp.StatusCode < 500)
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+func (c *Client) requestTimeout() time.Duration {
+	if c.timeout <= 0 {
+		return DefaultTimeout
+	}
+	return c.timeout
+}
+
+// cancelOnClose releases a request's context once its response body is
+// closed, keeping the deadline in force while the body is read.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (c *Client) ValidateToken(ctx context.Context) error {
+	body, _ := json.Marshal(map[string]string{"token": c.token})
+	resp, err := c.do(ctx, http.MethodPost, "/api/agent/validate", body, "application/json")
 	if err != nil {
 		return fmt.Errorf("validate token: %w", err)
 	}
@@ -80,15 +544,63 @@ func (c *Client) ValidateToken(ctx context.Context) error {
 	}
 }
 
-func (c *Client) FetchConfig(ctx context.Context) (*AgentConfig, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
-		c.baseURL+"/api/agent/config", nil)
+// FatalReport describes the error that made the agent give up.
+type FatalReport struct {
+	// Reason is a short machine-readable category, e.g. "unauthorized".
+	Reason   string `json:"reason"`
+	Error    string `json:"error"`
+	Platform string `json:"platform,omitempty"`
+}
+
+// ReportFatal POSTs r to the control plane so an agent's exit shows up in
+// the fleet dashboard. Any 2xx status counts as delivered.
+func (c *Client) ReportFatal(ctx context.Context, r *FatalReport) error {
+	body, err := json.Marshal(r)
 	if err != nil {
-		return nil, fmt.Errorf("build config request: %w", err)
+		return fmt.Errorf("marshal fatal report: %w", err)
 	}
-	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.do(ctx, http.MethodPost, "/api/agent/error", body, "application/json")
+	if err != nil {
+		return fmt.Errorf("report fatal error: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("report fatal error: unexpected HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
 
-	resp, err := c.http.Do(req)
+// SendMetrics POSTs an out-of-band metrics snapshot, requested through
+// HeartbeatResponse.RequestMetricsNow. Any 2xx status counts as delivered.
+func (c *Client) SendMetrics(ctx context.Context, m *HeartbeatMetrics) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("marshal metrics: %w", err)
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/api/agent/metrics", body, "application/json")
+	if err != nil {
+		return fmt.Errorf("send metrics: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("send metrics: unexpected HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (c *Client) FetchConfig(ctx context.Context) (*AgentConfig, error) {
+	return c.fetchConfig(ctx, "/api/agent/config")
+}
+
+// FetchConfigFreshKey fetches the config asking the control plane to issue
+// a new SSH key, for when the relay rejects the one the agent holds. A
+// control plane that can't rotate keys may still return an empty key.
+func (c *Client) FetchConfigFreshKey(ctx context.Context) (*AgentConfig, error) {
+	return c.fetchConfig(ctx, "/api/agent/config?fresh_key=1")
+}
+
+func (c *Client) fetchConfig(ctx context.Context, path string) (*AgentConfig, error) {
+	resp, err := c.do(ctx, http.MethodGet, path, nil, "")
 	if err != nil {
 		return nil, fmt.Errorf("fetch config: %w", err)
 	}
@@ -102,32 +614,32 @@ func (c *Client) FetchConfig(ctx context.Context) (*AgentConfig, error) {
 		return nil, fmt.Errorf("fetch config: unexpected HTTP %d", resp.StatusCode)
 	}
 
+	data, err := c.readBody(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read config response: %w", err)
+	}
 	var cfg AgentConfig
-	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+	if err := json.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("decode config response: %w", err)
 	}
 	if cfg.Host == "" {
-		return nil, fmt.Errorf("config response missing 'host' field")
+		return nil, &ConfigValidationError{Field: "host", Reason: "missing"}
 	}
-	if cfg.Port == 0 {
-		return nil, fmt.Errorf("config response missing 'port' field")
+	if cfg.Port == 0 && !c.portOptional {
+		return nil, &ConfigValidationError{Field: "port", Reason: "missing"}
 	}
 	if cfg.TunnelPort == 0 {
-		return nil, fmt.Errorf("config response missing 'tunnel_port' field")
+		return nil, &ConfigValidationError{Field: "tunnel_port", Reason: "missing"}
 	}
 	return &cfg, nil
 }
 
 // SendHeartbeat POSTs to heartbeatURL. On transient errors, returns active=true
 // to avoid accidentally closing a healthy tunnel.
-func (c *Client) SendHeartbeat(ctx context.Context, heartbeatURL string, m *HeartbeatMetrics) (*HeartbeatResponse, error) {
-	var body []byte
-	if m != nil {
-		var err error
-		body, err = json.Marshal(m)
-		if err != nil {
-			return nil, fmt.Errorf("marshal heartbeat metrics: %w", err)
-		}
+func (c *Client) SendHeartbeat(ctx context.Context, heartbeatURL string, hb *Heartbeat) (*HeartbeatResponse, error) {
+	body, err := c.encodeHeartbeat(hb)
+	if err != nil {
+		return nil, fmt.Errorf("marshal heartbeat: %w", err)
 	}
 
 	var bodyReader *bytes.Reader
@@ -137,14 +649,21 @@ func (c *Client) SendHeartbeat(ctx context.Context, heartbeatURL string, m *Hear
 		bodyReader = bytes.NewReader(nil)
 	}
 
+	ctx, cancel := context.WithTimeout(ctx, c.requestTimeout())
+	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, heartbeatURL, bodyReader)
 	if err != nil {
 		return nil, fmt.Errorf("build heartbeat request: %w", err)
 	}
-	req.Header.Set("Authorization", "Bearer "+c.token)
+	c.setHeaders(req)
 	if body != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	if c.hbSecret != nil {
+		if err := c.signHeartbeat(req, body); err != nil {
+			return nil, err
+		}
+	}
 
 	resp, err := c.http.Do(req)
 	if err != nil {
@@ -156,8 +675,17 @@ func (c *Client) SendHeartbeat(ctx context.Context, heartbeatURL string, m *Hear
 		return nil, fmt.Errorf("heartbeat: unexpected HTTP %d", resp.StatusCode)
 	}
 
+	data, err := c.readBody(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read heartbeat response: %w", err)
+	}
+
 	var hbr HeartbeatResponse
 	hbr.Active = true
-	_ = json.NewDecoder(resp.Body).Decode(&hbr)
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &hbr); err != nil {
+			hbr = HeartbeatResponse{Active: true, DecodeErr: fmt.Errorf("decode heartbeat response: %w", err)}
+		}
+	}
 	return &hbr, nil
 }
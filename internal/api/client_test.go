@@ -2,18 +2,25 @@ package api
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
 
 func newTestClient(baseURL string) *Client {
 	return &Client{
-		baseURL: baseURL,
-		token:   "test-token",
-		http:    &http.Client{Timeout: 5 * time.Second},
+		endpoints: []*endpoint{{baseURL: baseURL}},
+		token:     "test-token",
+		http:      &http.Client{Timeout: 5 * time.Second},
 	}
 }
 
@@ -29,8 +36,8 @@ func TestNew_acceptsHTTPS(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if c.baseURL != "https://example.com" {
-		t.Errorf("baseURL=%q, want %q", c.baseURL, "https://example.com")
+	if got := c.endpoints[0].baseURL; got != "https://example.com" {
+		t.Errorf("baseURL=%q, want %q", got, "https://example.com")
 	}
 }
 
@@ -39,8 +46,136 @@ func TestNew_trailingSlashStripped(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if c.baseURL != "https://example.com" {
-		t.Errorf("baseURL=%q, expected trailing slash stripped", c.baseURL)
+	if got := c.endpoints[0].baseURL; got != "https://example.com" {
+		t.Errorf("baseURL=%q, expected trailing slash stripped", got)
+	}
+}
+
+func TestNew_multipleEndpoints(t *testing.T) {
+	c, err := New("https://a.example.com, https://b.example.com/", "tok")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(c.endpoints) != 2 {
+		t.Fatalf("expected 2 endpoints, got %d", len(c.endpoints))
+	}
+	if c.endpoints[0].baseURL != "https://a.example.com" || c.endpoints[1].baseURL != "https://b.example.com" {
+		t.Errorf("unexpected endpoints: %q, %q", c.endpoints[0].baseURL, c.endpoints[1].baseURL)
+	}
+}
+
+func TestNew_multipleEndpointsAllRequireHTTPS(t *testing.T) {
+	if _, err := New("https://a.example.com,http://b.example.com", "tok"); err == nil {
+		t.Fatal("expected error when any endpoint is plain HTTP")
+	}
+}
+
+func TestNew_emptyURL(t *testing.T) {
+	if _, err := New(" , ", "tok"); err == nil {
+		t.Fatal("expected error for empty endpoint list")
+	}
+}
+
+func newFailoverClient(urls ...string) *Client {
+	c := newTestClient(urls[0])
+	for _, u := range urls[1:] {
+		c.endpoints = append(c.endpoints, &endpoint{baseURL: u})
+	}
+	return c
+}
+
+func TestFailover_primaryUnreachable(t *testing.T) {
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	deadURL := dead.URL
+	dead.Close()
+
+	cfg := validConfig()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(cfg)
+	}))
+	defer healthy.Close()
+
+	c := newFailoverClient(deadURL, healthy.URL)
+	got, err := c.FetchConfig(context.Background())
+	if err != nil {
+		t.Fatalf("expected failover to secondary, got error: %v", err)
+	}
+	if got.Host != cfg.Host {
+		t.Errorf("Host=%q, want %q", got.Host, cfg.Host)
+	}
+	if c.endpoints[0].failures != 1 {
+		t.Errorf("primary failures=%d, want 1", c.endpoints[0].failures)
+	}
+	if c.endpoints[1].failures != 0 {
+		t.Errorf("secondary failures=%d, want 0", c.endpoints[1].failures)
+	}
+}
+
+func TestFailover_primaryServerError(t *testing.T) {
+	var primaryHits int
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer secondary.Close()
+
+	c := newFailoverClient(primary.URL, secondary.URL)
+	if err := c.ValidateToken(context.Background()); err != nil {
+		t.Fatalf("expected failover to secondary, got error: %v", err)
+	}
+
+	// The unhealthy primary is now ordered after the secondary.
+	if err := c.ValidateToken(context.Background()); err != nil {
+		t.Fatalf("second validate: %v", err)
+	}
+	if primaryHits != 1 {
+		t.Errorf("primary hit %d times, want 1 (secondary should be preferred once primary failed)", primaryHits)
+	}
+}
+
+func TestFailover_unauthorizedIsDefinitive(t *testing.T) {
+	var secondaryHits int
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secondaryHits++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer secondary.Close()
+
+	c := newFailoverClient(primary.URL, secondary.URL)
+	if err := c.ValidateToken(context.Background()); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized, got %v", err)
+	}
+	if secondaryHits != 0 {
+		t.Errorf("secondary must not be tried after a definitive 401, hits=%d", secondaryHits)
+	}
+}
+
+func TestFailover_allEndpointsFail(t *testing.T) {
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer b.Close()
+
+	c := newFailoverClient(a.URL, b.URL)
+	if _, err := c.FetchConfig(context.Background()); err == nil {
+		t.Fatal("expected error when every endpoint fails")
+	}
+	for i, ep := range c.endpoints {
+		if ep.failures != 1 {
+			t.Errorf("endpoint %d failures=%d, want 1", i, ep.failures)
+		}
 	}
 }
 
@@ -129,6 +264,50 @@ func validConfig() AgentConfig {
 	}
 }
 
+func TestReportFatal(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/agent/error" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		var got FatalReport
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		if got.Reason != "unauthorized" || got.Error != "boom" {
+			t.Errorf("unexpected report: %+v", got)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	if err := c.ReportFatal(context.Background(), &FatalReport{Reason: "unauthorized", Error: "boom"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSendMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/agent/metrics" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		var got HeartbeatMetrics
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		if got.CPUPercent != 12.5 || got.RAMTotalMB != 1024 {
+			t.Errorf("unexpected metrics: %+v", got)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	if err := c.SendMetrics(context.Background(), &HeartbeatMetrics{CPUPercent: 12.5, RAMTotalMB: 1024}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
 func TestFetchConfig_OK(t *testing.T) {
 	cfg := validConfig()
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -182,6 +361,41 @@ func TestFetchConfig_Inactive(t *testing.T) {
 	}
 }
 
+func TestFetchConfig_MaintenanceUntil(t *testing.T) {
+	tests := []struct {
+		body string
+		want time.Time
+	}{
+		{`{"host":"relay.example.com","port":22,"tunnel_port":9000,"active":true,"maintenance_until":"2026-05-01T02:30:00+02:00"}`,
+			time.Date(2026, 5, 1, 0, 30, 0, 0, time.UTC)},
+		{`{"host":"relay.example.com","port":22,"tunnel_port":9000,"active":true}`, time.Time{}},
+	}
+	for _, tc := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(tc.body))
+		}))
+		got, err := newTestClient(srv.URL).FetchConfig(context.Background())
+		srv.Close()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !got.MaintenanceUntil.Equal(tc.want) {
+			t.Errorf("MaintenanceUntil: got %v, want %v", got.MaintenanceUntil, tc.want)
+		}
+	}
+}
+
+func TestFetchConfig_InvalidMaintenanceUntil(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"host":"relay.example.com","port":22,"tunnel_port":9000,"active":true,"maintenance_until":"tomorrow"}`))
+	}))
+	defer srv.Close()
+
+	if _, err := newTestClient(srv.URL).FetchConfig(context.Background()); err == nil {
+		t.Error("expected an error for a maintenance_until that is not RFC3339")
+	}
+}
+
 func TestFetchConfig_MissingHost(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_ = json.NewEncoder(w).Encode(AgentConfig{Port: 22, TunnelPort: 9000})
@@ -208,6 +422,23 @@ func TestFetchConfig_MissingPort(t *testing.T) {
 	}
 }
 
+func TestFetchConfig_MissingPortAllowedForSRV(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(AgentConfig{Host: "relay.example.com", TunnelPort: 9000})
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	WithPortOptional(true)(c)
+	cfg, err := c.FetchConfig(context.Background())
+	if err != nil {
+		t.Fatalf("FetchConfig: %v", err)
+	}
+	if cfg.Port != 0 {
+		t.Errorf("port=%d, want 0 (resolved later via SRV)", cfg.Port)
+	}
+}
+
 func TestFetchConfig_MissingTunnelPort(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_ = json.NewEncoder(w).Encode(AgentConfig{Host: "relay.example.com", Port: 22})
@@ -322,6 +553,28 @@ func TestSendHeartbeat_EmptyBodyDefaultsToActive(t *testing.T) {
 	if !resp.Active {
 		t.Error("empty 200 response must default to active=true")
 	}
+	if resp.DecodeErr != nil {
+		t.Errorf("empty 200 response reported as malformed: %v", resp.DecodeErr)
+	}
+}
+
+func TestSendHeartbeat_MalformedBodyDefaultsToActive(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"active": false, "tunnel_port": "x"`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	resp, err := c.SendHeartbeat(context.Background(), srv.URL+"/heartbeat", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !resp.Active {
+		t.Error("malformed 200 response must default to active=true")
+	}
+	if resp.DecodeErr == nil {
+		t.Error("malformed 200 response not reported in DecodeErr")
+	}
 }
 
 func TestSendHeartbeat_NonOKStatus(t *testing.T) {
@@ -352,3 +605,482 @@ func TestSendHeartbeat_AuthHeaderSent(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
+
+func oversizedServer(size int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Valid JSON prefix followed by padding so only the size limit can fail.
+		_, _ = w.Write([]byte(`{"host":"relay.example.com","port":22,"tunnel_port":9000,"pad":"`))
+		_, _ = w.Write([]byte(strings.Repeat("x", size)))
+		_, _ = w.Write([]byte(`"}`))
+	}))
+}
+
+func TestFetchConfig_BodyTooLarge(t *testing.T) {
+	srv := oversizedServer(4096)
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	c.maxBodySize = 1024
+	_, err := c.FetchConfig(context.Background())
+	if !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("expected ErrResponseTooLarge, got %v", err)
+	}
+}
+
+func TestFetchConfig_BodyWithinLimit(t *testing.T) {
+	srv := oversizedServer(512)
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	c.maxBodySize = 1024
+	if _, err := c.FetchConfig(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestFetchConfig_DefaultLimitEnforced(t *testing.T) {
+	srv := oversizedServer(DefaultMaxBodySize + 1)
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	if _, err := c.FetchConfig(context.Background()); !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("expected ErrResponseTooLarge with default limit, got %v", err)
+	}
+}
+
+func TestSendHeartbeat_BodyTooLarge(t *testing.T) {
+	srv := oversizedServer(4096)
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	c.maxBodySize = 1024
+	if _, err := c.SendHeartbeat(context.Background(), srv.URL+"/heartbeat", nil); !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("expected ErrResponseTooLarge, got %v", err)
+	}
+}
+
+func TestWithMaxBodySize(t *testing.T) {
+	c, err := New("https://example.com", "tok", WithMaxBodySize(2048))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.maxBodySize != 2048 {
+		t.Errorf("maxBodySize=%d, want 2048", c.maxBodySize)
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	h, ignored := ParseHeaders("X-Api-Key: abc, CF-Access-Client-Id:id:with:colons,broken,:novalue,Authorization: Bearer x")
+	if got := h.Get("X-Api-Key"); got != "abc" {
+		t.Errorf("X-Api-Key=%q, want %q", got, "abc")
+	}
+	if got := h.Get("CF-Access-Client-Id"); got != "id:with:colons" {
+		t.Errorf("CF-Access-Client-Id=%q, want %q", got, "id:with:colons")
+	}
+	if h.Get("Authorization") != "" {
+		t.Error("Authorization must not be settable via extra headers")
+	}
+	if len(ignored) != 3 {
+		t.Errorf("ignored=%q, want 3 malformed entries", ignored)
+	}
+}
+
+func TestExtraHeaders_appliedToAllRequests(t *testing.T) {
+	seen := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen[r.URL.Path] = r.Header.Get("X-Api-Key")
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			t.Errorf("%s: bearer token missing alongside extra headers", r.URL.Path)
+		}
+		if r.URL.Path == "/api/agent/config" {
+			_ = json.NewEncoder(w).Encode(validConfig())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	WithHeaders(http.Header{"X-Api-Key": {"secret"}})(c)
+
+	if err := c.ValidateToken(context.Background()); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if _, err := c.FetchConfig(context.Background()); err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	if _, err := c.SendHeartbeat(context.Background(), srv.URL+"/heartbeat", nil); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+
+	for _, path := range []string{"/api/agent/validate", "/api/agent/config", "/heartbeat"} {
+		if seen[path] != "secret" {
+			t.Errorf("%s: X-Api-Key=%q, want %q", path, seen[path], "secret")
+		}
+	}
+}
+
+func sendTestHeartbeat(t *testing.T, c *Client, srvURL string, hb *Heartbeat) {
+	t.Helper()
+	if _, err := c.SendHeartbeat(context.Background(), srvURL+"/heartbeat", hb); err != nil {
+		t.Fatalf("SendHeartbeat: %v", err)
+	}
+}
+
+func heartbeatBodyServer(bodies chan<- []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestHeartbeatSchema_v1SendsMetricsOnly(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	srv := heartbeatBodyServer(bodies)
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	WithHeartbeatSchema(HeartbeatSchemaV1)(c)
+	sendTestHeartbeat(t, c, srv.URL, &Heartbeat{
+		HeartbeatMetrics: &HeartbeatMetrics{CPUPercent: 1.5, RAMTotalMB: 512},
+		Platform:         "linux/arm64",
+	})
+
+	var got map[string]any
+	if err := json.Unmarshal(<-bodies, &got); err != nil {
+		t.Fatalf("decode body: %v", err)
+	}
+	if _, ok := got["schema_version"]; ok {
+		t.Error("v1 payload must not include schema_version")
+	}
+	if _, ok := got["platform"]; ok {
+		t.Error("v1 payload must not include v2 fields")
+	}
+	if got["cpu_percent"] != 1.5 {
+		t.Errorf("cpu_percent=%v, want 1.5", got["cpu_percent"])
+	}
+}
+
+func TestHeartbeatSchema_v1WithoutMetricsSendsEmptyBody(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	srv := heartbeatBodyServer(bodies)
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	WithHeartbeatSchema(HeartbeatSchemaV1)(c)
+	sendTestHeartbeat(t, c, srv.URL, &Heartbeat{Platform: "linux/arm64"})
+
+	if body := <-bodies; len(body) != 0 {
+		t.Errorf("expected empty body, got %q", body)
+	}
+}
+
+func TestHeartbeatSchema_defaultIsLatest(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	srv := heartbeatBodyServer(bodies)
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	sendTestHeartbeat(t, c, srv.URL, &Heartbeat{
+		HeartbeatMetrics: &HeartbeatMetrics{CPUPercent: 2},
+		Platform:         "linux/arm64",
+	})
+
+	var got map[string]any
+	if err := json.Unmarshal(<-bodies, &got); err != nil {
+		t.Fatalf("decode body: %v", err)
+	}
+	if got["schema_version"] != float64(LatestHeartbeatSchema) {
+		t.Errorf("schema_version=%v, want %d", got["schema_version"], LatestHeartbeatSchema)
+	}
+	if got["platform"] != "linux/arm64" {
+		t.Errorf("platform=%v, want linux/arm64", got["platform"])
+	}
+	if got["cpu_percent"] != float64(2) {
+		t.Errorf("cpu_percent=%v, want 2 (metrics are flattened)", got["cpu_percent"])
+	}
+}
+
+func TestFetchConfig_ValidationErrorField(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   AgentConfig
+		field string
+	}{
+		{"missing host", AgentConfig{Port: 22, TunnelPort: 9000}, "host"},
+		{"missing port", AgentConfig{Host: "relay.example.com", TunnelPort: 9000}, "port"},
+		{"missing tunnel_port", AgentConfig{Host: "relay.example.com", Port: 22}, "tunnel_port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewEncoder(w).Encode(tt.cfg)
+			}))
+			defer srv.Close()
+
+			_, err := newTestClient(srv.URL).FetchConfig(context.Background())
+			var verr *ConfigValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected *ConfigValidationError, got %T: %v", err, err)
+			}
+			if verr.Field != tt.field {
+				t.Errorf("Field=%q, want %q", verr.Field, tt.field)
+			}
+			if want := "config response missing '" + tt.field + "' field"; err.Error() != want {
+				t.Errorf("message=%q, want %q", err.Error(), want)
+			}
+		})
+	}
+}
+
+// redirectPair starts a target server recording the Authorization and
+// X-Gateway-Key headers it receives, and an origin server that redirects
+// every request to it. The two listen on different ports, i.e. different
+// hosts as far as redirects are concerned.
+func redirectPair(t *testing.T) (origin, target *httptest.Server, seen chan http.Header) {
+	t.Helper()
+	seen = make(chan http.Header, 1)
+	target = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Clone()
+		_ = json.NewEncoder(w).Encode(HeartbeatResponse{Active: true})
+	}))
+	origin = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	t.Cleanup(target.Close)
+	t.Cleanup(origin.Close)
+	return origin, target, seen
+}
+
+func TestSendHeartbeat_crossHostRedirectStripsToken(t *testing.T) {
+	origin, _, seen := redirectPair(t)
+	c, err := New(origin.URL, "secret-token",
+		WithHTTPClient(origin.Client()),
+		WithHeaders(http.Header{"X-Gateway-Key": {"gw"}}),
+	)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if _, err := c.SendHeartbeat(context.Background(), origin.URL+"/hb", nil); err != nil {
+		t.Fatalf("SendHeartbeat: %v", err)
+	}
+	h := <-seen
+	if got := h.Get("Authorization"); got != "" {
+		t.Errorf("token forwarded across hosts: Authorization=%q", got)
+	}
+	if got := h.Get("X-Gateway-Key"); got != "" {
+		t.Errorf("extra header forwarded across hosts: X-Gateway-Key=%q", got)
+	}
+}
+
+func TestSendHeartbeat_crossHostRedirectRefused(t *testing.T) {
+	origin, _, seen := redirectPair(t)
+	c, err := New(origin.URL, "secret-token",
+		WithHTTPClient(origin.Client()),
+		WithRefuseCrossHostRedirects(true),
+	)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	_, err = c.SendHeartbeat(context.Background(), origin.URL+"/hb", nil)
+	if !errors.Is(err, ErrRedirectRefused) {
+		t.Fatalf("SendHeartbeat: got %v, want ErrRedirectRefused", err)
+	}
+	select {
+	case <-seen:
+		t.Error("redirect target must not be contacted when redirects are refused")
+	default:
+	}
+}
+
+func TestNew_sameHostRedirectKeepsToken(t *testing.T) {
+	seen := make(chan string, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusTemporaryRedirect)
+			return
+		}
+		seen <- r.Header.Get("Authorization")
+		_ = json.NewEncoder(w).Encode(HeartbeatResponse{Active: true})
+	}))
+	defer srv.Close()
+
+	c, err := New(srv.URL, "secret-token", WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := c.SendHeartbeat(context.Background(), srv.URL+"/old", nil); err != nil {
+		t.Fatalf("SendHeartbeat: %v", err)
+	}
+	if got := <-seen; got != "Bearer secret-token" {
+		t.Errorf("same-host redirect lost token: %q", got)
+	}
+}
+
+func TestSendHeartbeat_signed(t *testing.T) {
+	type captured struct {
+		header http.Header
+		path   string
+		body   []byte
+	}
+	got := make(chan captured, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- captured{r.Header.Clone(), r.URL.Path, body}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	const secret = "shared-secret"
+	c := newTestClient(srv.URL)
+	WithHeartbeatSecret(secret)(c)
+	hb := &Heartbeat{HeartbeatMetrics: &HeartbeatMetrics{CPUPercent: 12}}
+	sendTestHeartbeat(t, c, srv.URL, hb)
+	sendTestHeartbeat(t, c, srv.URL, hb)
+
+	first, second := <-got, <-got
+	for _, r := range []captured{first, second} {
+		ts, nonce, sig := r.header.Get(HeaderTimestamp), r.header.Get(HeaderNonce), r.header.Get(HeaderSignature)
+		if ts == "" || nonce == "" || sig == "" {
+			t.Fatalf("missing signature headers: ts=%q nonce=%q sig=%q", ts, nonce, sig)
+		}
+		if unix, err := strconv.ParseInt(ts, 10, 64); err != nil || time.Since(time.Unix(unix, 0)) > time.Minute {
+			t.Errorf("timestamp %q is not a current unix time", ts)
+		}
+
+		// Verify independently of the client's own helper.
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(ts + "\n" + nonce + "\n" + r.path + "\n"))
+		mac.Write(r.body)
+		want := "v1=" + hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(sig), []byte(want)) {
+			t.Errorf("signature %q does not verify (want %q)", sig, want)
+		}
+	}
+	if first.header.Get(HeaderNonce) == second.header.Get(HeaderNonce) {
+		t.Error("nonce must differ between heartbeats")
+	}
+}
+
+func TestSendHeartbeat_unsignedByDefault(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	sendTestHeartbeat(t, newTestClient(srv.URL), srv.URL, nil)
+	if h := <-headers; h.Get(HeaderSignature) != "" {
+		t.Errorf("unexpected signature header without a secret: %q", h.Get(HeaderSignature))
+	}
+}
+
+func TestFetchConfig_decodesTuning(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"host":"relay.example.com","port":22,"tunnel_port":9000,"active":true,
+			"keepalive_interval":15,"proxy_idle_timeout":600,"heartbeat_interval":30}`)
+	}))
+	defer srv.Close()
+
+	cfg, err := newTestClient(srv.URL).FetchConfig(context.Background())
+	if err != nil {
+		t.Fatalf("FetchConfig: %v", err)
+	}
+	if cfg.KeepaliveInterval != 15 || cfg.ProxyIdleTimeout != 600 || cfg.HeartbeatInterval != 30 {
+		t.Errorf("tuning fields not decoded: %+v", cfg)
+	}
+}
+
+func TestFetchConfig_tuningOptional(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"host":"relay.example.com","port":22,"tunnel_port":9000,"active":true}`)
+	}))
+	defer srv.Close()
+
+	cfg, err := newTestClient(srv.URL).FetchConfig(context.Background())
+	if err != nil {
+		t.Fatalf("FetchConfig: %v", err)
+	}
+	if cfg.KeepaliveInterval != 0 || cfg.ProxyIdleTimeout != 0 || cfg.HeartbeatInterval != 0 {
+		t.Errorf("absent tuning fields must decode as zero: %+v", cfg)
+	}
+}
+
+func TestClient_contextDeadlineShorterThanTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c := newTestClient(srv.URL)
+	c.timeout = time.Minute
+	c.http.Timeout = 0
+	calls := map[string]func(context.Context) error{
+		"ValidateToken": c.ValidateToken,
+		"FetchConfig": func(ctx context.Context) error {
+			_, err := c.FetchConfig(ctx)
+			return err
+		},
+		"SendHeartbeat": func(ctx context.Context) error {
+			_, err := c.SendHeartbeat(ctx, srv.URL+"/heartbeat", nil)
+			return err
+		},
+	}
+	for name, call := range calls {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		err := call(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: got %v, want a deadline error", name, err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: returned after %s, want the 100ms context deadline", name, elapsed)
+		}
+	}
+}
+
+func TestClient_timeoutShorterThanContext(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c := newTestClient(srv.URL)
+	c.timeout = 100 * time.Millisecond
+	c.http.Timeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.FetchConfig(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the client timeout to expire", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("returned after %s, want the 100ms client timeout", elapsed)
+	}
+}
+
+func TestNew_takesTimeoutFromHTTPClient(t *testing.T) {
+	c, err := New("https://example.com", "tok", WithHTTPClient(&http.Client{Timeout: 7 * time.Second}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.timeout != 7*time.Second || c.http.Timeout != 0 {
+		t.Errorf("timeout=%s http.Timeout=%s, want 7s applied per request", c.timeout, c.http.Timeout)
+	}
+	c, err = New("https://example.com", "tok", WithTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.requestTimeout() != time.Second {
+		t.Errorf("WithTimeout: got %s", c.requestTimeout())
+	}
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrCertPinMismatch is returned when none of the certificates presented by
+// the control plane matches a pinned fingerprint.
+var ErrCertPinMismatch = errors.New("control-plane certificate does not match any pinned SHA-256 fingerprint")
+
+// ParseCertPins parses a comma-separated list of SHA-256 certificate
+// fingerprints in hex, with or without colons between bytes (as printed by
+// openssl x509 -fingerprint -sha256).
+func ParseCertPins(spec string) ([][]byte, error) {
+	var pins [][]byte
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pin, err := hex.DecodeString(strings.ReplaceAll(entry, ":", ""))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 certificate fingerprint %q", entry)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// WithPinnedCerts requires the control plane's verified chain to include a
+// certificate — leaf or intermediate — whose SHA-256 fingerprint is one of
+// pins, on top of normal verification. No pins disables pinning.
+func WithPinnedCerts(pins [][]byte) Option {
+	return func(c *Client) { c.pins = pins }
+}
+
+// installPins adds the pin check to the TLS config of c's transport,
+// working on copies so a caller-supplied client isn't modified. The check
+// runs from VerifyConnection rather than VerifyPeerCertificate because the
+// latter is skipped on resumed sessions.
+func (c *Client) installPins() error {
+	if len(c.pins) == 0 {
+		return nil
+	}
+	var tr *http.Transport
+	switch t := c.http.Transport.(type) {
+	case nil:
+		tr = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		tr = t.Clone()
+	default:
+		return fmt.Errorf("certificate pinning needs an *http.Transport, got %T", t)
+	}
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+	tr.TLSClientConfig.VerifyConnection = verifyPins(c.pins)
+
+	hc := *c.http
+	hc.Transport = tr
+	c.http = &hc
+	return nil
+}
+
+// verifyPins returns a VerifyConnection callback accepting the connection
+// only if a certificate in one of the verified chains matches one of pins.
+// Certificates the server merely sent along are not considered: anyone can
+// append a public pinned certificate to an unrelated chain.
+func verifyPins(pins [][]byte) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				sum := sha256.Sum256(cert.Raw)
+				for _, pin := range pins {
+					if bytes.Equal(sum[:], pin) {
+						return nil
+					}
+				}
+			}
+		}
+		return ErrCertPinMismatch
+	}
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCertPins(t *testing.T) {
+	sum := sha256.Sum256([]byte("cert"))
+	plain := hex.EncodeToString(sum[:])
+	var colons []string
+	for i := 0; i < len(plain); i += 2 {
+		colons = append(colons, strings.ToUpper(plain[i:i+2]))
+	}
+
+	pins, err := ParseCertPins(plain + ", " + strings.Join(colons, ":"))
+	if err != nil {
+		t.Fatalf("ParseCertPins: %v", err)
+	}
+	if len(pins) != 2 || string(pins[0]) != string(sum[:]) || string(pins[1]) != string(sum[:]) {
+		t.Errorf("pins=%x, want the fingerprint twice", pins)
+	}
+	if _, err := ParseCertPins("abcd"); err == nil {
+		t.Error("short fingerprint accepted")
+	}
+}
+
+func newPinnedClient(t *testing.T, srv *httptest.Server, pin []byte) *Client {
+	t.Helper()
+	c, err := New(srv.URL, "test-token", WithHTTPClient(srv.Client()), WithPinnedCerts([][]byte{pin}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return c
+}
+
+func TestPinnedCerts_matchingFingerprintConnects(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	sum := sha256.Sum256(srv.Certificate().Raw)
+	if err := newPinnedClient(t, srv, sum[:]).ValidateToken(context.Background()); err != nil {
+		t.Fatalf("ValidateToken with matching pin: %v", err)
+	}
+}
+
+func TestPinnedCerts_mismatchRejectsConnection(t *testing.T) {
+	var reached bool
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer srv.Close()
+
+	other := sha256.Sum256([]byte("some other certificate"))
+	err := newPinnedClient(t, srv, other[:]).ValidateToken(context.Background())
+	if !errors.Is(err, ErrCertPinMismatch) {
+		t.Fatalf("ValidateToken: got %v, want ErrCertPinMismatch", err)
+	}
+	if reached {
+		t.Error("request reached the server despite the pin mismatch")
+	}
+}
+
+func TestPinnedCerts_unrelatedExtraCertRejected(t *testing.T) {
+	var reached bool
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer srv.Close()
+
+	// The pinned certificate is public; a server that holds some other
+	// trusted certificate can send it along without it being in the chain.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "pinned intermediate"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageCertSign,
+
+		BasicConstraintsValid: true,
+	}
+	pinned, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &srv.TLS.Certificates[0]
+	cert.Certificate = append(cert.Certificate, pinned)
+
+	sum := sha256.Sum256(pinned)
+	err = newPinnedClient(t, srv, sum[:]).ValidateToken(context.Background())
+	if !errors.Is(err, ErrCertPinMismatch) {
+		t.Fatalf("ValidateToken: got %v, want ErrCertPinMismatch", err)
+	}
+	if reached {
+		t.Error("request reached the server through an unrelated pinned certificate")
+	}
+}
+
+func TestPinnedCerts_callerClientUnchanged(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	hc := srv.Client()
+	other := sha256.Sum256([]byte("x"))
+	if _, err := New(srv.URL, "t", WithHTTPClient(hc), WithPinnedCerts([][]byte{other[:]})); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if hc.Transport.(*http.Transport).TLSClientConfig.VerifyConnection != nil {
+		t.Error("pinning modified the caller's transport")
+	}
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// WithResolver makes the client resolve the control-plane host with r
+// instead of the system resolver. Nil keeps the system resolver.
+func WithResolver(r *net.Resolver) Option {
+	return func(c *Client) { c.resolver = r }
+}
+
+// installResolver points the dialer of c's transport at c.resolver,
+// working on copies so a caller-supplied client isn't modified.
+func (c *Client) installResolver() error {
+	if c.resolver == nil {
+		return nil
+	}
+	var tr *http.Transport
+	switch t := c.http.Transport.(type) {
+	case nil:
+		tr = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		tr = t.Clone()
+	default:
+		return fmt.Errorf("a custom resolver needs an *http.Transport, got %T", t)
+	}
+	// The same settings as http.DefaultTransport's dialer.
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Resolver: c.resolver}
+	tr.DialContext = d.DialContext
+
+	hc := *c.http
+	hc.Transport = tr
+	c.http = &hc
+	return nil
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWithResolver_usedForControlPlaneLookups(t *testing.T) {
+	var dials atomic.Int32
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			dials.Add(1)
+			return nil, errors.New("stub resolver: no answers")
+		},
+	}
+	c, err := New("https://api.example.test", "tok", WithResolver(r))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := c.FetchConfig(context.Background()); err == nil {
+		t.Fatal("FetchConfig succeeded without a resolvable host")
+	}
+	if dials.Load() == 0 {
+		t.Error("the control-plane host was not resolved through the configured resolver")
+	}
+}
+
+func TestWithResolver_keepsCallerClient(t *testing.T) {
+	tr := &http.Transport{}
+	hc := &http.Client{Transport: tr}
+	if _, err := New("https://api.example.test", "tok", WithHTTPClient(hc), WithResolver(&net.Resolver{})); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if hc.Transport != tr || tr.DialContext != nil {
+		t.Error("the caller's HTTP client was modified")
+	}
+}
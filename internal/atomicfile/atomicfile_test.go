@@ -0,0 +1,84 @@
+package atomicfile
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agent_key")
+	if err := Write(path, []byte("first"), 0o600); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := Write(path, []byte("second"), 0o600); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil || string(got) != "second" {
+		t.Errorf("contents = %q, %v; want second", got, err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("mode = %v, %v; want 0600", fi.Mode(), err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d entries, want only the file (temp files left behind?)", len(entries))
+	}
+}
+
+func TestWrite_readersNeverSeePartialContents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent_key")
+	a := bytes.Repeat([]byte("a"), 1<<20)
+	b := bytes.Repeat([]byte("b"), 1<<20)
+	if err := Write(path, a, 0o600); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Errorf("read: %v", err)
+				return
+			}
+			if !bytes.Equal(got, a) && !bytes.Equal(got, b) {
+				t.Errorf("reader saw %d bytes of mixed or partial contents", len(got))
+				return
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		data := a
+		if i%2 == 0 {
+			data = b
+		}
+		if err := Write(path, data, 0o600); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestWrite_failureLeavesFileUntouched(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing-dir", "agent_key")
+	if err := Write(path, []byte("key"), 0o600); err == nil {
+		t.Fatal("Write into a missing directory succeeded")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file exists after a failed write: %v", err)
+	}
+}
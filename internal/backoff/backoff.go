@@ -19,15 +19,52 @@ type Backoff struct {
 	max     time.Duration
 	factor  float64
 	current time.Duration
+	// rng is this Backoff's own jitter source, guarded by mu.
+	rng *rand.Rand
 }
 
-func New() *Backoff {
-	return &Backoff{
+// Option customises a Backoff created by New.
+type Option func(*Backoff)
+
+// WithSeed seeds the jitter source, making the sequence of delays
+// reproducible.
+func WithSeed(seed int64) Option {
+	return func(b *Backoff) { b.rng = rand.New(rand.NewSource(seed)) }
+}
+
+// WithInitial sets the first delay, DefaultInitial unless set. Values <= 0
+// are ignored.
+func WithInitial(d time.Duration) Option {
+	return func(b *Backoff) {
+		if d > 0 {
+			b.initial, b.current = d, d
+		}
+	}
+}
+
+// WithMax caps the delay, DefaultMax unless set. Values <= 0 are ignored.
+func WithMax(d time.Duration) Option {
+	return func(b *Backoff) {
+		if d > 0 {
+			b.max = d
+		}
+	}
+}
+
+func New(opts ...Option) *Backoff {
+	b := &Backoff{
 		initial: DefaultInitial,
 		max:     DefaultMax,
 		factor:  DefaultFactor,
 		current: DefaultInitial,
 	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.rng == nil {
+		b.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return b
 }
 
 func (b *Backoff) Next() time.Duration {
@@ -37,7 +74,7 @@ func (b *Backoff) Next() time.Duration {
 	base := b.current
 
 	maxJitter := float64(base) * jitterFraction
-	jitter := time.Duration((rand.Float64()*2 - 1) * maxJitter)
+	jitter := time.Duration((b.rng.Float64()*2 - 1) * maxJitter)
 	d := base + jitter
 	if d < 0 {
 		d = b.initial
@@ -52,6 +89,14 @@ func (b *Backoff) Next() time.Duration {
 	return d
 }
 
+// Peek returns the base delay (before jitter) the next call to Next will use,
+// without advancing the sequence.
+func (b *Backoff) Peek() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.current
+}
+
 func (b *Backoff) Reset() {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -110,6 +110,20 @@ func TestNext_growsMonotonically(t *testing.T) {
 	}
 }
 
+func TestPeek_doesNotAdvance(t *testing.T) {
+	b := New()
+	if got := b.Peek(); got != DefaultInitial {
+		t.Errorf("Peek()=%v, want %v", got, DefaultInitial)
+	}
+	if got := b.Peek(); got != DefaultInitial {
+		t.Errorf("second Peek()=%v, want %v (Peek must not advance)", got, DefaultInitial)
+	}
+	b.Next()
+	if got, want := b.Peek(), time.Duration(float64(DefaultInitial)*DefaultFactor); got != want {
+		t.Errorf("Peek() after Next=%v, want %v", got, want)
+	}
+}
+
 func TestConcurrentSafe(t *testing.T) {
 	b := New()
 	var wg sync.WaitGroup
@@ -133,3 +147,48 @@ func TestConcurrentSafe(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestWithSeed_reproducibleJitter(t *testing.T) {
+	a := New(WithSeed(42))
+	b := New(WithSeed(42))
+	for i := 0; i < 10; i++ {
+		da, db := a.Next(), b.Next()
+		if da != db {
+			t.Fatalf("step %d: %v != %v with identical seeds", i, da, db)
+		}
+	}
+
+	c := New(WithSeed(43))
+	d := New(WithSeed(42))
+	same := true
+	for i := 0; i < 10; i++ {
+		if c.Next() != d.Next() {
+			same = false
+		}
+	}
+	if same {
+		t.Error("different seeds produced identical jitter sequences")
+	}
+}
+
+func TestWithInitialAndMax(t *testing.T) {
+	b := New(WithInitial(100*time.Millisecond), WithMax(300*time.Millisecond))
+	if b.Peek() != 100*time.Millisecond {
+		t.Fatalf("initial=%s, want 100ms", b.Peek())
+	}
+	for i := 0; i < 5; i++ {
+		b.Next()
+	}
+	if b.Peek() != 300*time.Millisecond {
+		t.Errorf("after growth=%s, want capped at 300ms", b.Peek())
+	}
+	b.Reset()
+	if b.Peek() != 100*time.Millisecond {
+		t.Errorf("after Reset=%s, want 100ms", b.Peek())
+	}
+
+	d := New(WithInitial(0), WithMax(-1))
+	if d.Peek() != DefaultInitial {
+		t.Errorf("zero initial must keep default, got %s", d.Peek())
+	}
+}
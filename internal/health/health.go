@@ -0,0 +1,289 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Agent states reported on /status.
+const (
+	StateStarting   = "starting"
+	StateConnecting = "connecting"
+	StateConnected  = "connected"
+	StateBackoff    = "backoff"
+	StateInactive   = "inactive"
+	StateStopping   = "stopping"
+)
+
+const (
+	unixPrefix     = "unix:"
+	socketFileMode = 0o660
+)
+
+// Status is the JSON document served on /status.
+type Status struct {
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	Relay     string    `json:"relay,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+
+	// Service names the local service the tunnel forwards to, when the
+	// control plane names it.
+	Service string `json:"service,omitempty"`
+
+	// HostKeyAlgo is the relay's host key type on the current or last
+	// connection.
+	HostKeyAlgo string `json:"host_key_algo,omitempty"`
+
+	// RelayRTTMs is the smoothed keepalive round-trip time to the relay
+	// in milliseconds.
+	RelayRTTMs float64 `json:"relay_rtt_ms,omitempty"`
+
+	// ConnectDurationMs is how long the current or last tunnel took to
+	// establish, in milliseconds.
+	ConnectDurationMs float64 `json:"connect_duration_ms,omitempty"`
+
+	// LocalServiceDown is set while the tunnel is up but the local
+	// service fails its health probe.
+	LocalServiceDown bool `json:"local_service_down,omitempty"`
+
+	// NextRetryAt is when the agent will next try to connect: the start of
+	// the backoff sleep plus the base delay, so the actual retry may land
+	// up to the backoff jitter either side. Only set while sleeping in
+	// backoff.
+	NextRetryAt *time.Time `json:"next_retry_at,omitempty"`
+}
+
+// Tracker holds the agent's current status. Safe for concurrent use.
+type Tracker struct {
+	mu        sync.Mutex
+	st        Status
+	observers []func(Status)
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{st: Status{State: StateStarting, Since: time.Now()}}
+}
+
+// SetState records a state transition and clears NextRetryAt. Since only
+// moves when the state actually changes.
+func (t *Tracker) SetState(state string) {
+	t.Update(func(s *Status) { s.set(state) })
+}
+
+// SetBackoff records that the agent is sleeping until retryAt before the
+// next connect attempt.
+func (t *Tracker) SetBackoff(retryAt time.Time) {
+	t.Update(func(s *Status) {
+		s.set(StateBackoff)
+		s.NextRetryAt = &retryAt
+	})
+}
+
+func (s *Status) set(state string) {
+	if s.State != state {
+		s.State = state
+		s.Since = time.Now()
+	}
+	s.NextRetryAt = nil
+}
+
+// Update applies fn to the status under the tracker's lock. Observers
+// registered with OnChange run afterwards if the state changed.
+func (t *Tracker) Update(fn func(*Status)) {
+	t.mu.Lock()
+	prev := t.st.State
+	fn(&t.st)
+	if t.st.State == prev || len(t.observers) == 0 {
+		t.mu.Unlock()
+		return
+	}
+	st := t.snapshot()
+	observers := t.observers
+	t.mu.Unlock()
+
+	for _, o := range observers {
+		o(st)
+	}
+}
+
+// OnChange registers fn to be called with the new status after every state
+// transition. fn runs synchronously on the updating goroutine.
+func (t *Tracker) OnChange(fn func(Status)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.observers = append(t.observers, fn)
+}
+
+// Snapshot returns a copy of the current status.
+func (t *Tracker) Snapshot() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.snapshot()
+}
+
+func (t *Tracker) snapshot() Status {
+	st := t.st
+	if st.NextRetryAt != nil {
+		at := *st.NextRetryAt
+		st.NextRetryAt = &at
+	}
+	return st
+}
+
+// Metric is a single counter or gauge exported on /metrics.
+type Metric struct {
+	Name  string
+	Help  string
+	Type  string // "counter" or "gauge"
+	Value float64
+
+	// Labels tells apart the series of one metric, e.g. category="auth".
+	// Series of the same metric must be adjacent.
+	Labels map[string]string
+}
+
+// LabelNames returns the metric's label names in sorted order.
+func (m Metric) LabelNames() []string {
+	names := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// series is the metric's name and labels in the Prometheus text format.
+func (m Metric) series() string {
+	if len(m.Labels) == 0 {
+		return m.Name
+	}
+	pairs := make([]string, 0, len(m.Labels))
+	for _, k := range m.LabelNames() {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, m.Labels[k]))
+	}
+	return m.Name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Handler serves /status (JSON) and /healthz (200 while connected, 503
+// otherwise). If metrics is non-nil, /metrics serves its result in the
+// Prometheus text format.
+func Handler(t *Tracker, metrics func() []Metric) http.Handler {
+	mux := http.NewServeMux()
+	if metrics != nil {
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			prev := ""
+			for _, m := range metrics() {
+				if m.Name != prev {
+					fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help, m.Name, m.Type)
+					prev = m.Name
+				}
+				fmt.Fprintf(w, "%s %v\n", m.series(), m.Value)
+			}
+		})
+	}
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(t.Snapshot())
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		st := t.Snapshot()
+		if st.State != StateConnected {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprintln(w, st.State)
+	})
+	return mux
+}
+
+// Listen opens the health endpoint listener. addr is either "unix:/path"
+// for a Unix domain socket or a loopback "host:port"; non-loopback TCP
+// addresses are refused so status is never exposed to the network.
+func Listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		return listenUnix(path)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("health addr %q: %w", addr, err)
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("health addr %q must be loopback or unix:/path", addr)
+		}
+	}
+	return net.Listen("tcp", addr)
+}
+
+func listenUnix(path string) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("health addr: empty unix socket path")
+	}
+	// Remove a stale socket left by an unclean exit, but never clobber a
+	// regular file that happens to live at the configured path.
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("health socket %s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale health socket %s: %w", path, err)
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, socketFileMode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("chmod health socket %s: %w", path, err)
+	}
+	return ln, nil
+}
+
+// Serve serves h on addr until ctx is done, then shuts the server down and
+// returns. A Unix socket is closed and removed before Serve returns, so
+// callers that wait for it leave nothing behind.
+func Serve(ctx context.Context, addr string, h http.Handler) error {
+	ln, err := Listen(addr)
+	if err != nil {
+		return err
+	}
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		defer os.Remove(path)
+	}
+
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 5 * time.Second}
+	served := make(chan error, 1)
+	log.Printf("health endpoint listening on %s", addr)
+	go func() { served <- srv.Serve(ln) }()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		_ = srv.Close()
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func unixClient(path string) *http.Client {
+	return &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+func TestServe_unixSocketStatus(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "status.sock")
+	tr := NewTracker()
+	tr.SetState(StateConnected)
+	tr.Update(func(s *Status) { s.Relay = "relay.example.com:22" })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- Serve(ctx, "unix:"+sock, Handler(tr, nil)) }()
+
+	client := unixClient(sock)
+	var resp *http.Response
+	var err error
+	for i := 0; i < 100; i++ {
+		resp, err = client.Get("http://unix/status")
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("GET /status over unix socket: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var st Status
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatalf("decode status: %v", err)
+	}
+	if st.State != StateConnected || st.Relay != "relay.example.com:22" {
+		t.Errorf("status=%+v, want connected via relay.example.com:22", st)
+	}
+
+	info, err := os.Stat(sock)
+	if err != nil {
+		t.Fatalf("stat socket: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != socketFileMode {
+		t.Errorf("socket permissions %04o, want %04o", perm, socketFileMode)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket must be removed on shutdown, stat err=%v", err)
+	}
+}
+
+func TestListen_replacesStaleSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "status.sock")
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	// Simulate an unclean exit: the socket file stays behind.
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := Listen("unix:" + sock)
+	if err != nil {
+		t.Fatalf("Listen over stale socket: %v", err)
+	}
+	ln.Close()
+}
+
+func TestListen_refusesRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not-a-socket")
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := Listen("unix:" + path); err == nil {
+		t.Fatal("expected error when path is a regular file")
+	}
+}
+
+func TestListen_tcpMustBeLoopback(t *testing.T) {
+	if _, err := Listen("0.0.0.0:0"); err == nil {
+		t.Error("expected error for non-loopback TCP address")
+	}
+	ln, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("loopback listen: %v", err)
+	}
+	ln.Close()
+}
+
+func TestHandler_healthz(t *testing.T) {
+	tr := NewTracker()
+	h := Handler(tr, nil)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("healthz while starting: %d, want 503", rec.Code)
+	}
+
+	tr.SetState(StateConnected)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("healthz while connected: %d, want 200", rec.Code)
+	}
+}
+
+func TestTracker_nextRetryAtClearedOnTransition(t *testing.T) {
+	tr := NewTracker()
+	at := time.Now().Add(time.Minute)
+	tr.SetBackoff(at)
+
+	st := tr.Snapshot()
+	if st.State != StateBackoff || st.NextRetryAt == nil || !st.NextRetryAt.Equal(at) {
+		t.Fatalf("after SetBackoff: %+v", st)
+	}
+
+	tr.SetState(StateConnected)
+	if st := tr.Snapshot(); st.NextRetryAt != nil {
+		t.Errorf("next_retry_at must be cleared once connected, got %v", st.NextRetryAt)
+	}
+}
+
+func TestTracker_onChangeFiresOnTransitionsOnly(t *testing.T) {
+	tr := NewTracker()
+	var got []string
+	tr.OnChange(func(st Status) { got = append(got, st.State) })
+
+	tr.SetState(StateConnecting)
+	tr.SetState(StateConnecting)
+	tr.Update(func(s *Status) { s.Relay = "relay.example.com:22" })
+	tr.SetState(StateConnected)
+	tr.SetBackoff(time.Now().Add(time.Minute))
+
+	want := []string{StateConnecting, StateConnected, StateBackoff}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("observed %v, want %v", got, want)
+	}
+}
+
+func TestHandler_metrics(t *testing.T) {
+	h := Handler(NewTracker(), func() []Metric {
+		return []Metric{{Name: "agent_connections_total", Help: "Connections.", Type: "counter", Value: 3}}
+	})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	want := "# HELP agent_connections_total Connections.\n# TYPE agent_connections_total counter\nagent_connections_total 3\n"
+	if rec.Body.String() != want {
+		t.Errorf("body=%q, want %q", rec.Body.String(), want)
+	}
+
+	h = Handler(NewTracker(), func() []Metric {
+		return []Metric{
+			{Name: "agent_last_error", Help: "Last error.", Type: "gauge", Value: 1, Labels: map[string]string{"category": "auth"}},
+			{Name: "agent_last_error", Help: "Last error.", Type: "gauge", Value: 0, Labels: map[string]string{"category": "keepalive"}},
+		}
+	})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	want = "# HELP agent_last_error Last error.\n# TYPE agent_last_error gauge\n" +
+		"agent_last_error{category=\"auth\"} 1\nagent_last_error{category=\"keepalive\"} 0\n"
+	if rec.Body.String() != want {
+		t.Errorf("labeled body=%q, want %q", rec.Body.String(), want)
+	}
+
+	rec = httptest.NewRecorder()
+	Handler(NewTracker(), nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("/metrics without metrics func: %d, want 404", rec.Code)
+	}
+}
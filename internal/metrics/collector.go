@@ -0,0 +1,164 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errNoSample = errors.New("metrics: no sample collected yet")
+
+// ErrNoTime is returned by Sample when the context deadline leaves less
+// time than a fresh sample takes.
+var ErrNoTime = errors.New("metrics: not enough time left to sample")
+
+// DefaultWindow is how long Collect spends measuring CPU usage.
+const DefaultWindow = time.Second
+
+// Collector decouples host sampling from heartbeat frequency. With a
+// positive interval Run samples in the background and Sample returns the
+// latest result, so more frequent heartbeats don't add /proc load. With a
+// zero interval Sample collects on demand.
+type Collector struct {
+	collect  func(context.Context) (*Sample, error)
+	interval time.Duration
+	// window is how long one collect call takes.
+	window time.Duration
+
+	mu      sync.Mutex
+	latest  *Sample
+	lastErr error
+	// inflight is the collection in progress, shared by callers asking for
+	// a fresh sample meanwhile; nil when idle.
+	inflight *flight
+}
+
+// flight is one collect call; done is closed once s and err are set.
+type flight struct {
+	done chan struct{}
+	s    *Sample
+	err  error
+}
+
+// Option configures a Collector.
+type Option func(*Collector)
+
+// WithWindow sets how long one collection takes, DefaultWindow unless set.
+// On-demand sampling is skipped when less than this is left before the
+// context deadline.
+func WithWindow(d time.Duration) Option {
+	return func(c *Collector) { c.window = d }
+}
+
+// NewCollector returns a Collector using collect, or Collect when nil.
+func NewCollector(interval time.Duration, collect func(context.Context) (*Sample, error), opts ...Option) *Collector {
+	if collect == nil {
+		collect = Collect
+	}
+	c := &Collector{collect: collect, interval: interval, window: DefaultWindow}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Run samples every interval until ctx is done. It returns immediately in
+// on-demand mode.
+func (c *Collector) Run(ctx context.Context) {
+	if c.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.sampleNow(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sample returns a metrics sample: the latest background sample, or a fresh
+// one in on-demand mode. A fresh sample is not attempted if ctx is done or
+// its deadline is closer than the collection window; Sample then returns
+// the context error or ErrNoTime without waiting.
+func (c *Collector) Sample(ctx context.Context) (*Sample, error) {
+	if c.interval > 0 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.latest != nil {
+			return c.latest, nil
+		}
+		if c.lastErr != nil {
+			return nil, c.lastErr
+		}
+		return nil, errNoSample
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < c.window {
+		return nil, ErrNoTime
+	}
+	return c.sampleNow(ctx)
+}
+
+// SampleNow collects a fresh sample even in background mode, for callers
+// that need current figures rather than the latest periodic ones.
+func (c *Collector) SampleNow(ctx context.Context) (*Sample, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.sampleNow(ctx)
+}
+
+// Latest returns the most recent successful sample, or nil.
+func (c *Collector) Latest() *Sample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.latest
+}
+
+// sampleNow runs one collection at a time: a caller arriving while another
+// collects waits for that result instead of sampling /proc again.
+func (c *Collector) sampleNow(ctx context.Context) (*Sample, error) {
+	for {
+		c.mu.Lock()
+		f := c.inflight
+		if f == nil {
+			break
+		}
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-f.done:
+		}
+		// The shared collection was cut short by its own caller's context;
+		// sample again for ours.
+		if f.err != nil && (errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded)) {
+			continue
+		}
+		return f.s, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	c.inflight = f
+	c.mu.Unlock()
+
+	s, err := c.collect(ctx)
+	c.mu.Lock()
+	if err != nil {
+		c.lastErr = err
+		s = nil
+	} else {
+		c.latest, c.lastErr = s, nil
+	}
+	c.inflight = nil
+	c.mu.Unlock()
+	f.s, f.err = s, err
+	close(f.done)
+	return s, err
+}
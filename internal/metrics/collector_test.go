@@ -0,0 +1,230 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func countingCollect(calls *atomic.Int32) func(context.Context) (*Sample, error) {
+	return func(context.Context) (*Sample, error) {
+		n := calls.Add(1)
+		return &Sample{CPUPercent: float64(n)}, nil
+	}
+}
+
+func TestCollector_backgroundSamplesAreReused(t *testing.T) {
+	var calls atomic.Int32
+	c := NewCollector(time.Hour, countingCollect(&calls))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	deadline := time.Now().Add(time.Second)
+	for c.Latest() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 10; i++ {
+		s, err := c.Sample(context.Background())
+		if err != nil {
+			t.Fatalf("Sample: %v", err)
+		}
+		if s.CPUPercent != 1 {
+			t.Errorf("heartbeat %d got sample %v, want the single background sample", i, s.CPUPercent)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("collect called %d times for 10 heartbeats, want 1", n)
+	}
+}
+
+func TestCollector_sampleNowBypassesBackgroundSample(t *testing.T) {
+	var calls atomic.Int32
+	c := NewCollector(time.Hour, countingCollect(&calls))
+	if _, err := c.SampleNow(context.Background()); err != nil {
+		t.Fatalf("SampleNow: %v", err)
+	}
+	s, err := c.SampleNow(context.Background())
+	if err != nil {
+		t.Fatalf("SampleNow: %v", err)
+	}
+	if s.CPUPercent != 2 || c.Latest() != s {
+		t.Errorf("sample %v, latest %v; want a second fresh sample that becomes the latest", s, c.Latest())
+	}
+}
+
+func TestCollector_cadenceIndependentOfCallers(t *testing.T) {
+	var calls atomic.Int32
+	c := NewCollector(20*time.Millisecond, countingCollect(&calls))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go c.Run(ctx)
+
+	// Hammer Sample far more often than the sampling interval.
+	stop := time.After(110 * time.Millisecond)
+loop:
+	for {
+		select {
+		case <-stop:
+			break loop
+		default:
+			_, _ = c.Sample(context.Background())
+			time.Sleep(time.Millisecond)
+		}
+	}
+	cancel()
+
+	if n := calls.Load(); n < 3 || n > 8 {
+		t.Errorf("collect called %d times in ~110ms at 20ms interval, want roughly 6", n)
+	}
+}
+
+func TestCollector_onDemandCollectsEachCall(t *testing.T) {
+	var calls atomic.Int32
+	c := NewCollector(0, countingCollect(&calls))
+	go c.Run(context.Background()) // no-op in on-demand mode
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.Sample(context.Background()); err != nil {
+			t.Fatalf("Sample: %v", err)
+		}
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("collect called %d times, want 3", n)
+	}
+}
+
+func TestCollector_latestSurvivesFailure(t *testing.T) {
+	fail := false
+	c := NewCollector(0, func(context.Context) (*Sample, error) {
+		if fail {
+			return nil, errors.New("proc unavailable")
+		}
+		return &Sample{CPUPercent: 7}, nil
+	})
+
+	if _, err := c.Sample(context.Background()); err != nil {
+		t.Fatalf("Sample: %v", err)
+	}
+	fail = true
+	if _, err := c.Sample(context.Background()); err == nil {
+		t.Fatal("expected collection error")
+	}
+	if l := c.Latest(); l == nil || l.CPUPercent != 7 {
+		t.Errorf("Latest()=%+v, want last successful sample", l)
+	}
+}
+
+func TestCollector_backgroundBeforeFirstSample(t *testing.T) {
+	c := NewCollector(time.Hour, func(context.Context) (*Sample, error) { return &Sample{}, nil })
+	if _, err := c.Sample(context.Background()); err == nil {
+		t.Error("expected error before the first background sample")
+	}
+}
+
+func TestCollector_skipsSampleWhenDeadlineIsNear(t *testing.T) {
+	var calls atomic.Int32
+	c := NewCollector(0, countingCollect(&calls), WithWindow(time.Second))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.Sample(ctx); !errors.Is(err, ErrNoTime) {
+		t.Errorf("Sample: got %v, want ErrNoTime", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Sample waited %s despite skipping", elapsed)
+	}
+
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if _, err := c.Sample(cancelled); !errors.Is(err, context.Canceled) {
+		t.Errorf("Sample on cancelled context: got %v, want context.Canceled", err)
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("collect called %d times, want 0", n)
+	}
+
+	roomy, cancelRoomy := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelRoomy()
+	if _, err := c.Sample(roomy); err != nil {
+		t.Errorf("Sample with enough time: %v", err)
+	}
+}
+
+func TestCollector_concurrentCallersShareOneSampling(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	c := NewCollector(0, func(context.Context) (*Sample, error) {
+		n := calls.Add(1)
+		<-release
+		return &Sample{CPUPercent: float64(n)}, nil
+	})
+
+	type result struct {
+		s   *Sample
+		err error
+	}
+	results := make(chan result, 2)
+	sample := func() {
+		s, err := c.Sample(context.Background())
+		results <- result{s, err}
+	}
+	go sample()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go sample()
+	time.Sleep(20 * time.Millisecond) // let the second caller join
+	close(release)
+
+	first, second := <-results, <-results
+	if first.err != nil || second.err != nil {
+		t.Fatalf("Sample errors: %v, %v", first.err, second.err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("/proc sampled %d times for two concurrent callers, want 1", n)
+	}
+	if first.s != second.s {
+		t.Errorf("callers got different samples %v and %v, want one shared sample", first.s, second.s)
+	}
+}
+
+func TestCollector_waiterResamplesWhenSharedCollectionIsCancelled(t *testing.T) {
+	var calls atomic.Int32
+	c := NewCollector(0, func(ctx context.Context) (*Sample, error) {
+		if calls.Add(1) == 1 {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return &Sample{CPUPercent: 7}, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := c.Sample(ctx)
+		leader <- err
+	}()
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	follower := make(chan *Sample, 1)
+	go func() {
+		s, _ := c.Sample(context.Background())
+		follower <- s
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Errorf("leader: got %v, want context.Canceled", err)
+	}
+	if s := <-follower; s == nil || s.CPUPercent != 7 {
+		t.Errorf("follower got %v, want its own fresh sample", s)
+	}
+}
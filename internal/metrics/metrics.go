@@ -1,130 +1,160 @@
 package metrics
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
-	"os"
-	"strconv"
-	"strings"
+	"log"
+	"sync"
 	"time"
 )
 
+// memClampOnce limits the warning about inconsistent memory readings to
+// one per process; the quirk is a property of the host.
+var memClampOnce sync.Once
+
+// pressureErrOnce limits the warning about unreadable pressure stall
+// information to one per process.
+var pressureErrOnce sync.Once
+
 type Sample struct {
 	CPUPercent float64
-	RAMPercent float64
-	RAMUsedMB  int
-	RAMTotalMB int
+	// CPUPeakPercent is the highest of the averaged CPU readings. It is
+	// only set when several readings were taken (see CollectAveraged).
+	CPUPeakPercent float64
+	RAMPercent     float64
+	RAMUsedMB      int
+	RAMTotalMB     int
+	// Pressure is the host's pressure stall information, nil when the
+	// source or kernel doesn't provide it.
+	Pressure *Pressure
+}
+
+// Source provides the raw host readings a Sample is computed from. The
+// default source is platform specific (/proc on Linux); tests and other
+// environments such as cgroups can supply their own via CollectFrom.
+type Source interface {
+	// ReadCPU returns the cumulative idle and total CPU time counters. A
+	// source that cannot measure CPU returns errors.ErrUnsupported, and
+	// CPU is reported as zero.
+	ReadCPU() (idle, total uint64, err error)
+	// ReadMem returns total and available memory in KiB.
+	ReadMem() (total, avail int, err error)
 }
 
-// Collect reads CPU and RAM metrics from /proc. CPU utilisation is computed
-// from two samples taken 1s apart.
+// Collect reads CPU and RAM metrics from the default source. CPU
+// utilisation is computed from two readings taken 1s apart.
 func Collect(ctx context.Context) (*Sample, error) {
-	idle0, total0, err := readCPUStat()
-	if err != nil {
-		return nil, fmt.Errorf("metrics: first cpu sample: %w", err)
-	}
+	return collect(ctx, defaultSource, 1, time.Second)
+}
 
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case <-time.After(time.Second):
+// CollectAveraged returns a collect function that takes samples CPU
+// readings spaced apart by spacing and reports their average, plus the
+// peak reading in CPUPeakPercent. samples <= 1 behaves like Collect.
+func CollectAveraged(samples int, spacing time.Duration) func(context.Context) (*Sample, error) {
+	if samples <= 1 {
+		return Collect
 	}
+	return CollectFrom(defaultSource, samples, spacing)
+}
 
-	idle1, total1, err := readCPUStat()
-	if err != nil {
-		return nil, fmt.Errorf("metrics: second cpu sample: %w", err)
+// CollectFrom is CollectAveraged for an arbitrary source.
+func CollectFrom(src Source, samples int, spacing time.Duration) func(context.Context) (*Sample, error) {
+	if samples < 1 {
+		samples = 1
+	}
+	return func(ctx context.Context) (*Sample, error) {
+		return collect(ctx, src, samples, spacing)
 	}
+}
 
-	var cpuPercent float64
-	deltaTotal := total1 - total0
-	deltaIdle := idle1 - idle0
-	if deltaTotal > 0 {
-		cpuPercent = (float64(deltaTotal-deltaIdle) / float64(deltaTotal)) * 100.0
+func collect(ctx context.Context, src Source, samples int, spacing time.Duration) (*Sample, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cpuPercent, cpuPeak, err := cpuUsage(ctx, src.ReadCPU, samples, spacing)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		return nil, err
 	}
 
-	memTotal, memAvail, err := readMemInfo()
+	memTotal, memAvail, err := src.ReadMem()
 	if err != nil {
 		return nil, fmt.Errorf("metrics: meminfo: %w", err)
 	}
 
+	// Available memory estimated from MemFree+Buffers+Cached, or reported
+	// by unusual kernels, can exceed the total; clamp rather than report
+	// negative usage.
+	memUsed := memTotal - memAvail
+	if memUsed < 0 || memUsed > memTotal {
+		memClampOnce.Do(func() {
+			log.Printf("WARNING: metrics: available memory %d KiB inconsistent with total %d KiB — clamping RAM usage", memAvail, memTotal)
+		})
+		memUsed = max(0, min(memUsed, memTotal))
+	}
+
 	var ramPercent float64
 	if memTotal > 0 {
-		ramPercent = float64(memTotal-memAvail) / float64(memTotal) * 100.0
+		ramPercent = max(0, min(float64(memUsed)/float64(memTotal)*100.0, 100))
 	}
-	ramUsedMB := (memTotal - memAvail) / 1024
+	ramUsedMB := memUsed / 1024
 	ramTotalMB := memTotal / 1024
 
-	return &Sample{
+	s := &Sample{
 		CPUPercent: cpuPercent,
 		RAMPercent: ramPercent,
 		RAMUsedMB:  ramUsedMB,
 		RAMTotalMB: ramTotalMB,
-	}, nil
-}
-
-func readCPUStat() (idle, total uint64, err error) {
-	f, err := os.Open("/proc/stat")
-	if err != nil {
-		return 0, 0, err
 	}
-	defer f.Close()
-
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "cpu ") {
-			continue
-		}
-		fields := strings.Fields(line)
-		if len(fields) < 5 {
-			return 0, 0, fmt.Errorf("unexpected /proc/stat format: %q", line)
-		}
-		var vals [10]uint64
-		for i := 1; i < len(fields) && i <= 10; i++ {
-			v, parseErr := strconv.ParseUint(fields[i], 10, 64)
-			if parseErr != nil {
-				return 0, 0, fmt.Errorf("parse /proc/stat field %d: %w", i, parseErr)
-			}
-			vals[i-1] = v
-			total += v
+	if samples > 1 {
+		s.CPUPeakPercent = cpuPeak
+	}
+	if ps, ok := src.(PressureSource); ok {
+		p, err := ps.ReadPressure()
+		if err != nil {
+			pressureErrOnce.Do(func() {
+				log.Printf("WARNING: metrics: pressure stall information unavailable: %v", err)
+			})
 		}
-		idle = vals[3] + vals[4]
-		return idle, total, nil
+		s.Pressure = p
 	}
-	return 0, 0, fmt.Errorf("/proc/stat: cpu line not found")
+	return s, nil
 }
 
-func readMemInfo() (memTotal, memAvail int, err error) {
-	f, err := os.Open("/proc/meminfo")
+// cpuUsage takes samples+1 CPU readings via read, spacing apart, and
+// returns the utilisation over the whole span together with the highest
+// utilisation of any single interval.
+func cpuUsage(ctx context.Context, read func() (idle, total uint64, err error), samples int, spacing time.Duration) (avg, peak float64, err error) {
+	idle0, total0, err := read()
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, fmt.Errorf("metrics: first cpu sample: %w", err)
 	}
-	defer f.Close()
-
-	scanner := bufio.NewScanner(f)
-	found := 0
-	for scanner.Scan() && found < 2 {
-		line := scanner.Text()
-		fields := strings.Fields(line)
-		if len(fields) < 2 {
-			continue
+	firstIdle, firstTotal := idle0, total0
+
+	for i := 0; i < samples; i++ {
+		select {
+		case <-ctx.Done():
+			return 0, 0, ctx.Err()
+		case <-time.After(spacing):
 		}
-		v, parseErr := strconv.Atoi(fields[1])
-		if parseErr != nil {
-			continue
+
+		idle1, total1, err := read()
+		if err != nil {
+			return 0, 0, fmt.Errorf("metrics: cpu sample %d: %w", i+2, err)
 		}
-		switch fields[0] {
-		case "MemTotal:":
-			memTotal = v
-			found++
-		case "MemAvailable:":
-			memAvail = v
-			found++
+		if p := cpuPercent(idle1-idle0, total1-total0); p > peak {
+			peak = p
 		}
+		idle0, total0 = idle1, total1
 	}
-	if memTotal == 0 {
-		return 0, 0, fmt.Errorf("/proc/meminfo: MemTotal not found")
+	// Averaging over the whole span weights each interval by its tick
+	// count, which equals the mean of equally spaced readings.
+	return cpuPercent(idle0-firstIdle, total0-firstTotal), peak, nil
+}
+
+func cpuPercent(deltaIdle, deltaTotal uint64) float64 {
+	if deltaTotal == 0 {
+		return 0
 	}
-	return memTotal, memAvail, nil
+	return float64(deltaTotal-deltaIdle) / float64(deltaTotal) * 100.0
 }
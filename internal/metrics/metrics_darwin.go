@@ -0,0 +1,31 @@
+//go:build darwin
+
+package metrics
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// darwinSource reports total RAM from sysctl only. CPU and memory usage
+// need Mach host_statistics (cgo), so they are reported as zero; this keeps
+// development runs free of per-heartbeat metrics errors.
+type darwinSource struct{}
+
+var defaultSource Source = darwinSource{}
+
+func (darwinSource) ReadCPU() (idle, total uint64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
+
+// ReadMem reports all memory as available, since usage is unknown.
+func (darwinSource) ReadMem() (total, avail int, err error) {
+	memBytes, err := unix.SysctlUint64("hw.memsize")
+	if err != nil {
+		return 0, 0, fmt.Errorf("sysctl hw.memsize: %w", err)
+	}
+	kib := int(memBytes / 1024)
+	return kib, kib, nil
+}
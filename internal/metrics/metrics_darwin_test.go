@@ -0,0 +1,18 @@
+//go:build darwin
+
+package metrics
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCollect_darwin(t *testing.T) {
+	s, err := Collect(context.Background())
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if s.RAMTotalMB <= 0 {
+		t.Errorf("RAMTotalMB=%d, expected total memory from sysctl", s.RAMTotalMB)
+	}
+}
@@ -0,0 +1,86 @@
+//go:build !darwin
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// procSource reads /proc/stat, /proc/meminfo and /proc/pressure.
+type procSource struct{}
+
+var defaultSource Source = procSource{}
+
+func (procSource) ReadCPU() (idle, total uint64, err error) { return readCPUStat() }
+func (procSource) ReadMem() (total, avail int, err error)   { return readMemInfo() }
+func (procSource) ReadPressure() (*Pressure, error)         { return readPressure("/proc/pressure") }
+
+func readCPUStat() (idle, total uint64, err error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "cpu ") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			return 0, 0, fmt.Errorf("unexpected /proc/stat format: %q", line)
+		}
+		var vals [10]uint64
+		for i := 1; i < len(fields) && i <= 10; i++ {
+			v, parseErr := strconv.ParseUint(fields[i], 10, 64)
+			if parseErr != nil {
+				return 0, 0, fmt.Errorf("parse /proc/stat field %d: %w", i, parseErr)
+			}
+			vals[i-1] = v
+			total += v
+		}
+		idle = vals[3] + vals[4]
+		return idle, total, nil
+	}
+	return 0, 0, fmt.Errorf("/proc/stat: cpu line not found")
+}
+
+func readMemInfo() (memTotal, memAvail int, err error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	found := 0
+	for scanner.Scan() && found < 2 {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		v, parseErr := strconv.Atoi(fields[1])
+		if parseErr != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			memTotal = v
+			found++
+		case "MemAvailable:":
+			memAvail = v
+			found++
+		}
+	}
+	if memTotal == 0 {
+		return 0, 0, fmt.Errorf("/proc/meminfo: MemTotal not found")
+	}
+	return memTotal, memAvail, nil
+}
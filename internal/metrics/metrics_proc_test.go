@@ -0,0 +1,18 @@
+//go:build !darwin
+
+package metrics
+
+import "testing"
+
+func TestProcSource_readsHost(t *testing.T) {
+	if _, total, err := (procSource{}).ReadCPU(); err != nil || total == 0 {
+		t.Fatalf("ReadCPU: total=%d err=%v", total, err)
+	}
+	total, avail, err := (procSource{}).ReadMem()
+	if err != nil {
+		t.Fatalf("ReadMem: %v", err)
+	}
+	if total <= 0 || avail < 0 || avail > total {
+		t.Errorf("ReadMem: total=%d avail=%d", total, avail)
+	}
+}
@@ -0,0 +1,141 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// statSequence returns a read function yielding the given cumulative
+// (idle, total) /proc/stat readings in order.
+func statSequence(readings [][2]uint64) func() (uint64, uint64, error) {
+	i := 0
+	return func() (uint64, uint64, error) {
+		if i >= len(readings) {
+			return 0, 0, errors.New("no more readings")
+		}
+		r := readings[i]
+		i++
+		return r[0], r[1], nil
+	}
+}
+
+func TestCPUUsage_averageAndPeak(t *testing.T) {
+	// Three 100-tick intervals at 10%, 50% and 30% busy.
+	read := statSequence([][2]uint64{
+		{0, 0},
+		{90, 100},
+		{140, 200},
+		{210, 300},
+	})
+	avg, peak, err := cpuUsage(context.Background(), read, 3, 0)
+	if err != nil {
+		t.Fatalf("cpuUsage: %v", err)
+	}
+	if math.Abs(avg-30) > 1e-9 {
+		t.Errorf("avg=%.2f, want 30", avg)
+	}
+	if math.Abs(peak-50) > 1e-9 {
+		t.Errorf("peak=%.2f, want 50", peak)
+	}
+}
+
+func TestCPUUsage_singleSample(t *testing.T) {
+	read := statSequence([][2]uint64{{1000, 2000}, {1075, 2100}})
+	avg, peak, err := cpuUsage(context.Background(), read, 1, 0)
+	if err != nil {
+		t.Fatalf("cpuUsage: %v", err)
+	}
+	if math.Abs(avg-25) > 1e-9 || math.Abs(peak-25) > 1e-9 {
+		t.Errorf("avg=%.2f peak=%.2f, want 25/25", avg, peak)
+	}
+}
+
+func TestCPUUsage_readErrorPropagates(t *testing.T) {
+	read := statSequence([][2]uint64{{0, 0}})
+	if _, _, err := cpuUsage(context.Background(), read, 2, 0); err == nil {
+		t.Fatal("expected error when a reading fails")
+	}
+}
+
+// fakeSource returns scripted CPU readings and a fixed memory reading.
+type fakeSource struct {
+	cpu         func() (uint64, uint64, error)
+	total, free int
+	memErr      error
+}
+
+func (f *fakeSource) ReadCPU() (uint64, uint64, error) { return f.cpu() }
+func (f *fakeSource) ReadMem() (int, int, error)       { return f.total, f.free, f.memErr }
+
+func TestCollectFrom_fakeSource(t *testing.T) {
+	src := &fakeSource{
+		cpu:   statSequence([][2]uint64{{0, 0}, {80, 100}, {120, 200}}),
+		total: 4 * 1024 * 1024, // 4 GiB in KiB
+		free:  1 * 1024 * 1024,
+	}
+	s, err := CollectFrom(src, 2, 0)(context.Background())
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	// Intervals at 20% and 60% busy.
+	if math.Abs(s.CPUPercent-40) > 1e-9 || math.Abs(s.CPUPeakPercent-60) > 1e-9 {
+		t.Errorf("cpu=%.2f peak=%.2f, want 40/60", s.CPUPercent, s.CPUPeakPercent)
+	}
+	if s.RAMTotalMB != 4096 || s.RAMUsedMB != 3072 || math.Abs(s.RAMPercent-75) > 1e-9 {
+		t.Errorf("ram total=%d used=%d pct=%.2f, want 4096/3072/75", s.RAMTotalMB, s.RAMUsedMB, s.RAMPercent)
+	}
+}
+
+func TestCollectFrom_unsupportedCPUReportsZero(t *testing.T) {
+	src := &fakeSource{
+		cpu:   func() (uint64, uint64, error) { return 0, 0, errors.ErrUnsupported },
+		total: 2048, free: 2048,
+	}
+	s, err := CollectFrom(src, 3, time.Hour)(context.Background())
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	if s.CPUPercent != 0 || s.RAMTotalMB != 2 || s.RAMUsedMB != 0 {
+		t.Errorf("sample=%+v, want zero CPU and 2 MB total", s)
+	}
+}
+
+func TestCollectFrom_clampsInconsistentMemory(t *testing.T) {
+	tests := []struct {
+		name        string
+		total, free int
+		wantUsedMB  int
+		wantPercent float64
+	}{
+		{name: "available above total", total: 2048 * 1024, free: 3000 * 1024, wantUsedMB: 0, wantPercent: 0},
+		{name: "negative available", total: 2048 * 1024, free: -1024, wantUsedMB: 2048, wantPercent: 100},
+		{name: "no total", total: 0, free: 1024, wantUsedMB: 0, wantPercent: 0},
+	}
+	for _, tt := range tests {
+		src := &fakeSource{
+			cpu:   func() (uint64, uint64, error) { return 0, 0, errors.ErrUnsupported },
+			total: tt.total, free: tt.free,
+		}
+		s, err := CollectFrom(src, 1, 0)(context.Background())
+		if err != nil {
+			t.Fatalf("%s: collect: %v", tt.name, err)
+		}
+		if s.RAMUsedMB != tt.wantUsedMB || s.RAMPercent != tt.wantPercent {
+			t.Errorf("%s: used=%d MB pct=%.2f, want %d MB and %.0f", tt.name, s.RAMUsedMB, s.RAMPercent, tt.wantUsedMB, tt.wantPercent)
+		}
+	}
+}
+
+func TestCollectFrom_errors(t *testing.T) {
+	cpuErr := &fakeSource{cpu: func() (uint64, uint64, error) { return 0, 0, errors.New("boom") }, total: 1}
+	if _, err := CollectFrom(cpuErr, 1, 0)(context.Background()); err == nil {
+		t.Error("CPU read error not returned")
+	}
+	memErr := &fakeSource{cpu: statSequence([][2]uint64{{0, 0}, {1, 2}}), memErr: errors.New("boom")}
+	if _, err := CollectFrom(memErr, 1, 0)(context.Background()); err == nil {
+		t.Error("memory read error not returned")
+	}
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Pressure holds the "some avg10" pressure stall figures: the percentage
+// of the last 10 seconds in which at least one task was stalled waiting
+// for CPU, memory or I/O.
+type Pressure struct {
+	CPU    float64
+	Memory float64
+	IO     float64
+}
+
+// PressureSource is implemented by sources that can report pressure stall
+// information. ReadPressure returns nil, nil when the host has none.
+type PressureSource interface {
+	ReadPressure() (*Pressure, error)
+}
+
+// readPressure reads the cpu, memory and io files of a PSI directory such
+// as /proc/pressure. Kernels without PSI (before 4.20, or booted with
+// psi=0) yield nil, nil.
+func readPressure(dir string) (*Pressure, error) {
+	var p Pressure
+	for _, r := range []struct {
+		name string
+		dst  *float64
+	}{{"cpu", &p.CPU}, {"memory", &p.Memory}, {"io", &p.IO}} {
+		f, err := os.Open(filepath.Join(dir, r.name))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		v, err := parsePressure(f)
+		f.Close()
+		if errors.Is(err, syscall.EOPNOTSUPP) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Join(dir, r.name), err)
+		}
+		*r.dst = v
+	}
+	return &p, nil
+}
+
+// parsePressure returns the avg10 value of the "some" line of a PSI file:
+//
+//	some avg10=0.12 avg60=0.05 avg300=0.01 total=123456
+//	full avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func parsePressure(r io.Reader) (float64, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "some" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if v, ok := strings.CutPrefix(field, "avg10="); ok {
+				f, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					return 0, fmt.Errorf("parse avg10: %w", err)
+				}
+				return f, nil
+			}
+		}
+		return 0, fmt.Errorf("no avg10 in %q", scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("no \"some\" line")
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writePressure(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestReadPressure(t *testing.T) {
+	dir := writePressure(t, map[string]string{
+		// cpu has no "full" line before 5.13.
+		"cpu": "some avg10=1.50 avg60=0.80 avg300=0.20 total=123456\n",
+		"memory": "some avg10=0.25 avg60=0.10 avg300=0.00 total=4242\n" +
+			"full avg10=0.10 avg60=0.00 avg300=0.00 total=1000\n",
+		"io": "some avg10=12.04 avg60=8.00 avg300=3.10 total=99999999\n" +
+			"full avg10=9.00 avg60=6.00 avg300=2.00 total=88888888\n",
+	})
+	p, err := readPressure(dir)
+	if err != nil {
+		t.Fatalf("readPressure: %v", err)
+	}
+	if want := (Pressure{CPU: 1.5, Memory: 0.25, IO: 12.04}); p == nil || *p != want {
+		t.Errorf("pressure=%+v, want %+v", p, want)
+	}
+}
+
+func TestReadPressure_absent(t *testing.T) {
+	p, err := readPressure(filepath.Join(t.TempDir(), "pressure"))
+	if p != nil || err != nil {
+		t.Errorf("readPressure without /proc/pressure: %+v, %v; want nil, nil", p, err)
+	}
+}
+
+func TestParsePressure_malformed(t *testing.T) {
+	for _, in := range []string{"", "full avg10=1.00\n", "some avg60=1.00\n", "some avg10=x\n"} {
+		if _, err := parsePressure(strings.NewReader(in)); err == nil {
+			t.Errorf("parsePressure(%q) succeeded", in)
+		}
+	}
+}
+
+type pressureSource struct {
+	fakeSource
+	p *Pressure
+}
+
+func (s *pressureSource) ReadPressure() (*Pressure, error) { return s.p, nil }
+
+func TestCollectFrom_pressure(t *testing.T) {
+	src := &pressureSource{
+		fakeSource: fakeSource{cpu: statSequence([][2]uint64{{0, 0}, {50, 100}}), total: 1024, free: 512},
+		p:          &Pressure{CPU: 3},
+	}
+	s, err := CollectFrom(src, 1, time.Millisecond)(context.Background())
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	if s.Pressure == nil || s.Pressure.CPU != 3 {
+		t.Errorf("Pressure=%+v, want the source's reading", s.Pressure)
+	}
+
+	s, err = CollectFrom(&fakeSource{cpu: statSequence([][2]uint64{{0, 0}, {50, 100}}), total: 1024}, 1, time.Millisecond)(context.Background())
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	if s.Pressure != nil {
+		t.Errorf("Pressure=%+v from a source without PSI", s.Pressure)
+	}
+}
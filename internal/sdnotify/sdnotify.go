@@ -0,0 +1,119 @@
+// Package sdnotify implements the systemd sd_notify protocol: readiness,
+// status and watchdog messages sent as datagrams to $NOTIFY_SOCKET.
+package sdnotify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Messages understood by systemd.
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status returns a STATUS= message, shown by systemctl status.
+func Status(text string) string {
+	return "STATUS=" + text
+}
+
+// Notifier sends messages to systemd. A nil *Notifier is valid and does
+// nothing, so callers need not check whether they run under systemd.
+type Notifier struct {
+	socket   string
+	watchdog time.Duration
+}
+
+// New returns a Notifier for the given socket path. A leading '@' denotes
+// an abstract socket. watchdog is the WatchdogSec period; zero disables
+// watchdog pings.
+func New(socket string, watchdog time.Duration) *Notifier {
+	return &Notifier{socket: socket, watchdog: watchdog}
+}
+
+// FromEnv returns a Notifier configured from NOTIFY_SOCKET and
+// WATCHDOG_USEC, or nil when the process was not started by systemd with
+// notify support.
+func FromEnv() *Notifier {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	wd, err := watchdogFromEnv()
+	if err != nil {
+		log.Printf("WARNING: ignoring systemd watchdog: %v", err)
+	}
+	return New(socket, wd)
+}
+
+// watchdogFromEnv reads WATCHDOG_USEC. The watchdog applies only if
+// WATCHDOG_PID is unset or names this process.
+func watchdogFromEnv() (time.Duration, error) {
+	v := os.Getenv("WATCHDOG_USEC")
+	if v == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	usec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", v)
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// Send writes the messages as one datagram, newline-separated.
+func (n *Notifier) Send(msgs ...string) error {
+	if n == nil || len(msgs) == 0 {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: n.socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(strings.Join(msgs, "\n"))); err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	return nil
+}
+
+// WatchdogInterval returns the systemd watchdog period, or zero if the
+// watchdog is not enabled.
+func (n *Notifier) WatchdogInterval() time.Duration {
+	if n == nil {
+		return 0
+	}
+	return n.watchdog
+}
+
+// RunWatchdog sends WATCHDOG=1 at half the watchdog period until ctx is
+// done, as systemd recommends. It returns immediately if the watchdog is
+// not enabled.
+func (n *Notifier) RunWatchdog(ctx context.Context) {
+	interval := n.WatchdogInterval() / 2
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := n.Send(Watchdog); err != nil {
+				log.Printf("WARNING: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package sdnotify
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listenNotify opens a fake systemd notify socket and returns its path
+// with a channel of received datagrams.
+func listenNotify(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	msgs := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			msgs <- string(buf[:n])
+		}
+	}()
+	return path, msgs
+}
+
+func TestSend(t *testing.T) {
+	path, msgs := listenNotify(t)
+	n := New(path, 0)
+
+	if err := n.Send(Ready, Status("connected")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	select {
+	case got := <-msgs:
+		if want := "READY=1\nSTATUS=connected"; got != want {
+			t.Errorf("datagram=%q, want %q", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no datagram received")
+	}
+}
+
+func TestNilNotifierIsNoop(t *testing.T) {
+	var n *Notifier
+	if err := n.Send(Ready); err != nil {
+		t.Errorf("nil Send: %v", err)
+	}
+	if n.WatchdogInterval() != 0 {
+		t.Error("nil notifier must report no watchdog")
+	}
+	n.RunWatchdog(context.Background()) // must return immediately
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if FromEnv() != nil {
+		t.Error("expected nil notifier without NOTIFY_SOCKET")
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "/run/systemd/notify")
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if got := FromEnv().WatchdogInterval(); got != 30*time.Second {
+		t.Errorf("watchdog=%s, want 30s", got)
+	}
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if got := FromEnv().WatchdogInterval(); got != 0 {
+		t.Errorf("watchdog for another PID must be ignored, got %s", got)
+	}
+}
+
+func TestRunWatchdog_pings(t *testing.T) {
+	path, msgs := listenNotify(t)
+	n := New(path, 40*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.RunWatchdog(ctx)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-msgs:
+			if got != Watchdog {
+				t.Errorf("ping %d=%q, want %q", i, got, Watchdog)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("watchdog ping %d not received", i)
+		}
+	}
+}
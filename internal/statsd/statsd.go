@@ -0,0 +1,118 @@
+// Package statsd pushes metrics to a local statsd (or telegraf statsd
+// input) collector over UDP, for setups that prefer pushing to scraping
+// /metrics.
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/smarthomeentry/agent/internal/health"
+)
+
+// maxDatagram keeps each packet under a typical Ethernet MTU; lines that
+// don't fit go out in further packets.
+const maxDatagram = 1432
+
+// Emitter sends metrics to a statsd collector. Counters are sent as the
+// increase since the previous Send, gauges as their current value.
+type Emitter struct {
+	conn net.Conn
+	prev map[string]float64
+}
+
+// Dial returns an Emitter sending to the collector at addr (host:port).
+// UDP is connectionless, so an absent collector is not detected here.
+func Dial(addr string) (*Emitter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("statsd %s: %w", addr, err)
+	}
+	return &Emitter{conn: conn, prev: make(map[string]float64)}, nil
+}
+
+func (e *Emitter) Close() error {
+	return e.conn.Close()
+}
+
+// Send writes one statsd line per metric. Counters that did not change
+// since the previous Send are skipped.
+func (e *Emitter) Send(metrics []health.Metric) error {
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		name := bucket(m)
+		var line string
+		switch m.Type {
+		case "counter":
+			delta := m.Value - e.prev[name]
+			if delta < 0 {
+				// The counter was reset; everything counted since is new.
+				delta = m.Value
+			}
+			e.prev[name] = m.Value
+			if delta == 0 {
+				continue
+			}
+			line = name + ":" + formatValue(delta) + "|c"
+		default:
+			line = name + ":" + formatValue(m.Value) + "|g"
+		}
+		if buf.Len() > 0 && buf.Len()+1+len(line) > maxDatagram {
+			if _, err := e.conn.Write(buf.Bytes()); err != nil {
+				return fmt.Errorf("statsd send: %w", err)
+			}
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	if _, err := e.conn.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("statsd send: %w", err)
+	}
+	return nil
+}
+
+// Run sends metrics() every interval until ctx is done. Send errors are
+// logged once until sending succeeds again, since a missing collector
+// would otherwise log on every tick.
+func (e *Emitter) Run(ctx context.Context, interval time.Duration, metrics func() []health.Metric) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := e.Send(metrics())
+			if err != nil && !failing {
+				log.Printf("WARNING: %v", err)
+			}
+			failing = err != nil
+		}
+	}
+}
+
+// bucket is the statsd name for m. Plain statsd has no labels, so label
+// values are appended to the name, e.g. smarthomeentry_last_error.auth.
+func bucket(m health.Metric) string {
+	name := m.Name
+	for _, k := range m.LabelNames() {
+		name += "." + m.Labels[k]
+	}
+	return name
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
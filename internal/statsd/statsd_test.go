@@ -0,0 +1,97 @@
+package statsd
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smarthomeentry/agent/internal/health"
+)
+
+func listen(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UDPConn) string {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64*1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestEmitter_Send(t *testing.T) {
+	collector := listen(t)
+	e, err := Dial(collector.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer e.Close()
+
+	metrics := []health.Metric{
+		{Name: "smarthomeentry_tunnel_up", Type: "gauge", Value: 1},
+		{Name: "smarthomeentry_reconnects_total", Type: "counter", Value: 2},
+		{Name: "smarthomeentry_bytes_in_total", Type: "counter", Value: 1500},
+		{Name: "smarthomeentry_relay_rtt_ms", Type: "gauge", Value: 12.5},
+	}
+	if err := e.Send(metrics); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	want := "smarthomeentry_tunnel_up:1|g\n" +
+		"smarthomeentry_reconnects_total:2|c\n" +
+		"smarthomeentry_bytes_in_total:1500|c\n" +
+		"smarthomeentry_relay_rtt_ms:12.5|g"
+	if got := receive(t, collector); got != want {
+		t.Errorf("first packet:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Counters are sent as increments; unchanged ones are skipped.
+	metrics[2].Value = 4000
+	if err := e.Send(metrics); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	want = "smarthomeentry_tunnel_up:1|g\n" +
+		"smarthomeentry_bytes_in_total:2500|c\n" +
+		"smarthomeentry_relay_rtt_ms:12.5|g"
+	if got := receive(t, collector); got != want {
+		t.Errorf("second packet:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestEmitter_Send_splitsLargeBatches(t *testing.T) {
+	collector := listen(t)
+	e, err := Dial(collector.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer e.Close()
+
+	var metrics []health.Metric
+	for i := 0; i < 100; i++ {
+		metrics = append(metrics, health.Metric{Name: strings.Repeat("m", 40), Type: "gauge", Value: float64(i)})
+	}
+	if err := e.Send(metrics); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	lines := 0
+	for lines < len(metrics) {
+		pkt := receive(t, collector)
+		if len(pkt) > maxDatagram {
+			t.Fatalf("packet of %d bytes exceeds %d", len(pkt), maxDatagram)
+		}
+		lines += strings.Count(pkt, "\n") + 1
+	}
+	if lines != len(metrics) {
+		t.Errorf("received %d lines, want %d", lines, len(metrics))
+	}
+}
@@ -0,0 +1,54 @@
+package tunnel
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultProxyBufferSize is the per-direction copy buffer of a proxied
+// connection when Config.ProxyBufferSize is unset, matching io.Copy.
+const DefaultProxyBufferSize = 32 * 1024
+
+// bufferPool recycles proxy copy buffers of one size so connections don't
+// each allocate their own.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+	// allocs counts buffers allocated because the pool was empty.
+	allocs atomic.Int64
+}
+
+var (
+	bufferPoolsMu sync.Mutex
+	bufferPools   = make(map[int]*bufferPool)
+)
+
+// bufferPoolFor returns the shared pool for size, or for
+// DefaultProxyBufferSize when size <= 0. Pools outlive a single Run so
+// buffers are reused across reconnects.
+func bufferPoolFor(size int) *bufferPool {
+	if size <= 0 {
+		size = DefaultProxyBufferSize
+	}
+	bufferPoolsMu.Lock()
+	defer bufferPoolsMu.Unlock()
+	if p, ok := bufferPools[size]; ok {
+		return p
+	}
+	p := &bufferPool{size: size}
+	p.pool.New = func() any {
+		p.allocs.Add(1)
+		b := make([]byte, size)
+		return &b
+	}
+	bufferPools[size] = p
+	return p
+}
+
+func (p *bufferPool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *bufferPool) put(b *[]byte) {
+	p.pool.Put(b)
+}
@@ -0,0 +1,149 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBufferPoolFor_defaultsAndSharing(t *testing.T) {
+	if got := bufferPoolFor(0).size; got != DefaultProxyBufferSize {
+		t.Errorf("size=%d, want DefaultProxyBufferSize", got)
+	}
+	if bufferPoolFor(4096) != bufferPoolFor(4096) {
+		t.Error("pools of the same size are not shared")
+	}
+	if b := bufferPoolFor(4096).get(); len(*b) != 4096 {
+		t.Errorf("buffer length %d, want 4096", len(*b))
+	}
+}
+
+func TestPipe_customBufferSizeTransfersAndReusesBuffers(t *testing.T) {
+	// An odd size no other test uses, so the allocation count is ours.
+	const size = 1021
+	bufs := bufferPoolFor(size)
+
+	const conns = 10
+	for i := 0; i < conns; i++ {
+		remote, relayPeer := net.Pipe()
+		local, localPeer := net.Pipe()
+
+		want := make([]byte, 64*1024)
+		_, _ = rand.Read(want)
+
+		resCh := make(chan copyResult, 1)
+		go func() { resCh <- pipe(remote, local, 0, bufs) }()
+		go func() {
+			_, _ = relayPeer.Write(want)
+			relayPeer.Close()
+		}()
+
+		received := make(chan []byte, 1)
+		go func() {
+			got, _ := io.ReadAll(localPeer)
+			received <- got
+		}()
+
+		select {
+		case res := <-resCh:
+			if res.bytes != int64(len(want)) {
+				t.Errorf("conn %d: copied %d bytes, want %d", i, res.bytes, len(want))
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("conn %d: pipe did not return", i)
+		}
+		remote.Close()
+		local.Close()
+		if got := <-received; !bytes.Equal(got, want) {
+			t.Fatalf("conn %d: received %d bytes that differ from the %d sent", i, len(got), len(want))
+		}
+		localPeer.Close()
+	}
+
+	// Without pooling every connection would allocate two buffers.
+	if n := bufs.allocs.Load(); n >= 2*conns {
+		t.Errorf("%d buffers allocated for %d connections, want reuse", n, conns)
+	}
+}
+
+// sizeConn records the largest buffer passed to Read and Write.
+type sizeConn struct {
+	net.Conn
+	mu                sync.Mutex
+	maxRead, maxWrite int
+}
+
+func (c *sizeConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	c.maxRead = max(c.maxRead, len(p))
+	c.mu.Unlock()
+	return c.Conn.Read(p)
+}
+
+func (c *sizeConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.maxWrite = max(c.maxWrite, len(p))
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	server, err = ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestPipe_usesPoolBufferWithTCPConns(t *testing.T) {
+	const size = 2039
+	relayEnd, relayPeer := tcpPair(t)
+	local, localPeer := tcpPair(t)
+	// *net.TCPConn implements ReaderFrom and WriterTo; sizeConn doesn't,
+	// so it sees the copy's own buffer in both directions.
+	remote := &sizeConn{Conn: relayEnd}
+	go pipe(remote, local, 0, bufferPoolFor(size))
+
+	want := make([]byte, 256*1024)
+	_, _ = rand.Read(want)
+	var wg sync.WaitGroup
+	for _, c := range []net.Conn{relayPeer, localPeer} {
+		wg.Add(1)
+		go func(c net.Conn) {
+			defer wg.Done()
+			_, _ = c.Write(want)
+		}(c)
+	}
+	for _, c := range []net.Conn{localPeer, relayPeer} {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(c, got); err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("transfer corrupted: %v", err)
+		}
+	}
+	wg.Wait()
+
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+	if remote.maxRead != size || remote.maxWrite > size {
+		t.Errorf("largest read %d, write %d; want the %d-byte pool buffer", remote.maxRead, remote.maxWrite, size)
+	}
+}
@@ -0,0 +1,41 @@
+package tunnel
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// connectTimer times the phases of bringing a tunnel up: resolving and
+// dialling the relay, the SSH handshake and the reverse-forward request. A
+// nil timer records nothing.
+type connectTimer struct {
+	start, last time.Time
+	phases      []string
+}
+
+func newConnectTimer() *connectTimer {
+	now := time.Now()
+	return &connectTimer{start: now, last: now}
+}
+
+// mark ends the current phase, attributing the time since the previous
+// mark to it.
+func (t *connectTimer) mark(phase string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.phases = append(t.phases, fmt.Sprintf("%s=%s", phase, now.Sub(t.last).Round(time.Microsecond)))
+	t.last = now
+}
+
+// total is the time since the timer started.
+func (t *connectTimer) total() time.Duration {
+	return time.Since(t.start)
+}
+
+// String lists the marked phases and their durations, in order.
+func (t *connectTimer) String() string {
+	return strings.Join(t.phases, " ")
+}
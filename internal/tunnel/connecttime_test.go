@@ -0,0 +1,62 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun_reportsConnectDuration(t *testing.T) {
+	client, _ := newTestRelay(t)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up := make(chan UpInfo, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, &Config{
+			Client:        client,
+			TunnelPort:    9000,
+			DebugTimings:  true,
+			HeartbeatFunc: func(context.Context) (bool, error) { return true, nil },
+			OnUp:          func(info UpInfo) { up <- info },
+		})
+	}()
+
+	select {
+	case info := <-up:
+		if info.ConnectDuration <= 0 {
+			t.Errorf("ConnectDuration=%s, want > 0", info.ConnectDuration)
+		}
+	case err := <-done:
+		t.Fatalf("Run returned before the tunnel came up: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel did not come up")
+	}
+	cancel()
+	<-done
+
+	if out := buf.String(); !strings.Contains(out, "debug: tunnel established in") || !strings.Contains(out, "forward=") {
+		t.Errorf("phase breakdown not logged:\n%s", out)
+	}
+}
+
+func TestConnectTimer_phases(t *testing.T) {
+	timer := newConnectTimer()
+	timer.mark("resolve")
+	timer.mark("dial")
+	if got := timer.String(); !strings.HasPrefix(got, "resolve=") || !strings.Contains(got, " dial=") {
+		t.Errorf("String()=%q, want resolve then dial", got)
+	}
+
+	var nilTimer *connectTimer
+	nilTimer.mark("resolve") // must not panic
+}
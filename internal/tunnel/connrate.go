@@ -0,0 +1,43 @@
+package tunnel
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrConnFlood is returned by Run when the relay opened more connections
+// within connRateWindow than Config.MaxConnRate allows. A healthy relay
+// only forwards what visitors open, so a flood points at a misbehaving or
+// compromised relay; tearing down puts the agent into reconnect backoff.
+var ErrConnFlood = errors.New("relay connection rate exceeded")
+
+// connRateWindow is the sliding window MaxConnRate applies to.
+const connRateWindow = time.Minute
+
+// connRate detects more than limit events within window. It is used from
+// the accept loop only and is not safe for concurrent use.
+type connRate struct {
+	limit  int
+	window time.Duration
+	// times holds the most recent accept times as a ring of limit entries;
+	// next is the oldest.
+	times []time.Time
+	next  int
+}
+
+func newConnRate(limit int, window time.Duration) *connRate {
+	return &connRate{limit: limit, window: window, times: make([]time.Time, 0, limit)}
+}
+
+// add records a connection at now and reports whether the rate is now
+// over the limit, i.e. limit+1 connections arrived within the window.
+func (r *connRate) add(now time.Time) bool {
+	if len(r.times) < r.limit {
+		r.times = append(r.times, now)
+		return false
+	}
+	oldest := r.times[r.next]
+	r.times[r.next] = now
+	r.next = (r.next + 1) % r.limit
+	return now.Sub(oldest) < r.window
+}
@@ -0,0 +1,72 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConnRate_tripsOnlyWithinWindow(t *testing.T) {
+	r := newConnRate(3, time.Minute)
+	start := time.Unix(1_700_000_000, 0)
+
+	// Three per minute, spread out, never trips.
+	for i := 0; i < 9; i++ {
+		if r.add(start.Add(time.Duration(i) * 21 * time.Second)) {
+			t.Fatalf("tripped at steady connection %d", i)
+		}
+	}
+
+	// A burst of four within a second does.
+	r = newConnRate(3, time.Minute)
+	for i := 0; i < 3; i++ {
+		if r.add(start.Add(time.Duration(i) * time.Millisecond)) {
+			t.Fatalf("tripped at burst connection %d, within the limit", i)
+		}
+	}
+	if !r.add(start.Add(time.Second)) {
+		t.Error("fourth connection within the window did not trip")
+	}
+}
+
+func TestRun_connectionFloodTearsDownTunnel(t *testing.T) {
+	client, relay := newTestRelay(t)
+
+	up := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(context.Background(), &Config{
+			Client:        client,
+			TunnelPort:    9000,
+			HeartbeatFunc: func(context.Context) (bool, error) { return true, nil },
+			MaxConnRate:   5,
+			OnUp:          func(UpInfo) { close(up) },
+		})
+	}()
+	select {
+	case <-up:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel did not come up")
+	}
+	fwd := <-relay.forwards
+
+	// The relay floods the agent; once the guard trips the forward is
+	// cancelled and further opens fail, which ends the flood.
+	for i := 0; i < 20; i++ {
+		ch, err := relay.openForwarded(fwd)
+		if err != nil {
+			break
+		}
+		defer ch.Close()
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrConnFlood) {
+			t.Fatalf("Run: got %v, want ErrConnFlood", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection flood did not tear the tunnel down")
+	}
+}
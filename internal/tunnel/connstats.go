@@ -0,0 +1,173 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ConnStats counts relay connections handled by the proxy. Share one
+// across Run calls to keep totals over reconnects. A nil *ConnStats is
+// valid and counts nothing.
+type ConnStats struct {
+	accepted    atomic.Uint64
+	rejected    atomic.Uint64
+	localFailed atomic.Uint64
+
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+
+	// services holds the counters of named local services (see
+	// Config.Service).
+	mu       sync.Mutex
+	services map[string]*serviceStats
+}
+
+// serviceStats counts the traffic of one named local service.
+type serviceStats struct {
+	accepted atomic.Uint64
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+}
+
+// ServiceCounts is a point-in-time copy of one service's counters.
+type ServiceCounts struct {
+	Accepted uint64
+	BytesIn  uint64 // from the relay to the local service
+	BytesOut uint64 // from the local service to the relay
+}
+
+// ConnCounts is a point-in-time copy of ConnStats.
+type ConnCounts struct {
+	Accepted    uint64 // handed to the local proxy
+	Rejected    uint64 // refused because MaxConnections was reached
+	LocalFailed uint64 // dropped because the local service was unreachable
+}
+
+func NewConnStats() *ConnStats {
+	return &ConnStats{}
+}
+
+// Counts returns the current totals.
+func (s *ConnStats) Counts() ConnCounts {
+	if s == nil {
+		return ConnCounts{}
+	}
+	return ConnCounts{
+		Accepted:    s.accepted.Load(),
+		Rejected:    s.rejected.Load(),
+		LocalFailed: s.localFailed.Load(),
+	}
+}
+
+// Bytes returns the bytes proxied from the relay to the local service (in)
+// and back (out).
+func (s *ConnStats) Bytes() (in, out uint64) {
+	if s == nil {
+		return 0, 0
+	}
+	return s.bytesIn.Load(), s.bytesOut.Load()
+}
+
+// Services returns the counters of every named service seen so far.
+func (s *ConnStats) Services() map[string]ServiceCounts {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]ServiceCounts, len(s.services))
+	for name, svc := range s.services {
+		out[name] = ServiceCounts{
+			Accepted: svc.accepted.Load(),
+			BytesIn:  svc.bytesIn.Load(),
+			BytesOut: svc.bytesOut.Load(),
+		}
+	}
+	return out
+}
+
+// service returns the counters of the named service, creating them on
+// first use, or nil when s is nil or name is empty.
+func (s *ConnStats) service(name string) *serviceStats {
+	if s == nil || name == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	svc, ok := s.services[name]
+	if !ok {
+		if s.services == nil {
+			s.services = make(map[string]*serviceStats)
+		}
+		svc = &serviceStats{}
+		s.services[name] = svc
+	}
+	return svc
+}
+
+// Sub returns the counts accumulated since prev.
+func (c ConnCounts) Sub(prev ConnCounts) ConnCounts {
+	return ConnCounts{
+		Accepted:    c.Accepted - prev.Accepted,
+		Rejected:    c.Rejected - prev.Rejected,
+		LocalFailed: c.LocalFailed - prev.LocalFailed,
+	}
+}
+
+func (s *ConnStats) addAccepted(svc *serviceStats) {
+	if s != nil {
+		s.accepted.Add(1)
+	}
+	if svc != nil {
+		svc.accepted.Add(1)
+	}
+}
+
+func (s *ConnStats) addRejected() {
+	if s != nil {
+		s.rejected.Add(1)
+	}
+}
+
+func (s *ConnStats) addLocalFailed() {
+	if s != nil {
+		s.localFailed.Add(1)
+	}
+}
+
+// countReads wraps conn so that bytes read from it are counted as coming
+// from the relay or, if fromRelay is false, from the local service, in
+// the totals and in svc when not nil. It returns conn unchanged when s is
+// nil.
+func (s *ConnStats) countReads(conn net.Conn, fromRelay bool, svc *serviceStats) net.Conn {
+	if s == nil {
+		return conn
+	}
+	c := &countingConn{Conn: conn, n: &s.bytesOut}
+	if fromRelay {
+		c.n = &s.bytesIn
+	}
+	if svc != nil {
+		c.svc = &svc.bytesOut
+		if fromRelay {
+			c.svc = &svc.bytesIn
+		}
+	}
+	return c
+}
+
+type countingConn struct {
+	net.Conn
+	n   *atomic.Uint64
+	svc *atomic.Uint64 // may be nil
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.n.Add(uint64(n))
+	if c.svc != nil {
+		c.svc.Add(uint64(n))
+	}
+	return n, err
+}
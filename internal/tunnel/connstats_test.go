@@ -0,0 +1,141 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent log writes.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRun_attributesConnectionsToNamedServices(t *testing.T) {
+	client, relay := newTestRelay(t)
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	echo := func() string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer c.Close()
+					_, _ = io.Copy(c, c)
+				}()
+			}
+		}()
+		return ln.Addr().String()
+	}
+
+	// Two named targets forwarded over one relay connection.
+	stats := NewConnStats()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	forwards := make(map[string]relayForward)
+	for i, service := range []string{"domoticz", "camera"} {
+		up := make(chan struct{})
+		go Run(ctx, &Config{
+			Client:         client,
+			TunnelPort:     9000 + i,
+			LocalAddr:      echo(),
+			HeartbeatFunc:  func(context.Context) (bool, error) { return true, nil },
+			Stats:          stats,
+			Service:        service,
+			LogConnections: true,
+			OnUp:           func(UpInfo) { close(up) },
+		})
+		select {
+		case <-up:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("tunnel for %s did not come up", service)
+		}
+		forwards[service] = <-relay.forwards
+	}
+
+	send := func(service, msg string) {
+		t.Helper()
+		ch, err := relay.openForwarded(forwards[service])
+		if err != nil {
+			t.Fatalf("open channel to %s: %v", service, err)
+		}
+		defer ch.Close()
+		if _, err := ch.Write([]byte(msg)); err != nil {
+			t.Fatalf("write to %s: %v", service, err)
+		}
+		if _, err := io.ReadFull(ch, make([]byte, len(msg))); err != nil {
+			t.Fatalf("read from %s: %v", service, err)
+		}
+	}
+	send("domoticz", "ping")
+	send("camera", "snapshot-please")
+
+	want := map[string]ServiceCounts{
+		"domoticz": {Accepted: 1, BytesIn: 4, BytesOut: 4},
+		"camera":   {Accepted: 1, BytesIn: 15, BytesOut: 15},
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := stats.Services()
+		if got["domoticz"] == want["domoticz"] && got["camera"] == want["camera"] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("service counts=%+v, want %+v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if in, _ := stats.Bytes(); in != 19 {
+		t.Errorf("total bytes in=%d, want 19", in)
+	}
+	for _, service := range []string{"domoticz", "camera"} {
+		if !strings.Contains(logs.String(), "→ "+service+" (") {
+			t.Errorf("no connection log line names %s:\n%s", service, logs.String())
+		}
+	}
+}
+
+func TestConnStats_unnamedServiceNotTracked(t *testing.T) {
+	s := NewConnStats()
+	if s.service("") != nil {
+		t.Error("an unnamed service got its own counters")
+	}
+	var nilStats *ConnStats
+	if nilStats.service("x") != nil || nilStats.Services() != nil {
+		t.Error("a nil ConnStats tracked a service")
+	}
+	s.addAccepted(s.service("ha"))
+	if got := s.Services()["ha"].Accepted; got != 1 {
+		t.Errorf("ha accepted=%d, want 1", got)
+	}
+}
@@ -0,0 +1,131 @@
+package tunnel
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxTrackedConns bounds how many proxied connections are tracked,
+// and so served, at once when MaxConnections doesn't set a lower limit.
+const DefaultMaxTrackedConns = 4096
+
+// connReconcileInterval is how often the tracker is checked for entries
+// of connections that were closed but never released.
+const connReconcileInterval = time.Minute
+
+// trackedConn is a relay connection registered with a connTracker. Close
+// marks it closed so a missed release can be detected.
+type trackedConn struct {
+	net.Conn
+	id       uint64
+	closedAt atomic.Int64 // Unix nanoseconds, zero while open
+}
+
+func (c *trackedConn) Close() error {
+	c.closedAt.CompareAndSwap(0, time.Now().UnixNano())
+	return c.Conn.Close()
+}
+
+// connTracker holds the relay connections being proxied. Entries are
+// removed when the connection is released; reconcile cleans up any that
+// were closed but leaked. The zero value is ready to use.
+type connTracker struct {
+	mu sync.Mutex
+	// limit caps the entries; zero selects DefaultMaxTrackedConns and
+	// negative leaves it unbounded.
+	limit int
+	next  uint64
+	conns map[uint64]*trackedConn
+}
+
+// capacity is the number of entries allowed, the lower of max (when
+// positive) and the tracker's own limit, or zero for no limit.
+func (t *connTracker) capacity(max int) int {
+	limit := t.limit
+	if limit == 0 {
+		limit = DefaultMaxTrackedConns
+	}
+	if max > 0 && (limit < 0 || max < limit) {
+		return max
+	}
+	if limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// add registers conn, reporting false when the tracker already holds
+// capacity(max) entries.
+func (t *connTracker) add(conn net.Conn, max int) (*trackedConn, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c := t.capacity(max); c > 0 && len(t.conns) >= c {
+		return nil, false
+	}
+	if t.conns == nil {
+		t.conns = make(map[uint64]*trackedConn)
+	}
+	t.next++
+	tc := &trackedConn{Conn: conn, id: t.next}
+	t.conns[tc.id] = tc
+	return tc, true
+}
+
+func (t *connTracker) remove(tc *trackedConn) {
+	t.mu.Lock()
+	delete(t.conns, tc.id)
+	t.mu.Unlock()
+}
+
+func (t *connTracker) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// closeAll closes every tracked connection. Entries stay until their
+// connections are released.
+func (t *connTracker) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range t.conns {
+		c.Close()
+	}
+}
+
+// reconcile removes entries for connections closed before cutoff and
+// returns how many it removed. Released connections are gone already, so
+// any found are leaks.
+func (t *connTracker) reconcile(cutoff time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for id, c := range t.conns {
+		if at := c.closedAt.Load(); at != 0 && at < cutoff.UnixNano() {
+			delete(t.conns, id)
+			n++
+		}
+	}
+	return n
+}
+
+// run reconciles the tracker every interval until ctx is done. Entries are
+// given one interval after closing to be released normally.
+func (t *connTracker) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n := t.reconcile(now.Add(-interval)); n > 0 {
+				log.Printf("WARNING: removed %d closed connections that were never released from the connection tracker", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocalProxy_trackerEmptiesAfterConnections(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	p := &localProxy{addr: echo.Addr().String(), stats: NewConnStats()}
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		remote, peer := net.Pipe()
+		tc, ok := p.admit(remote)
+		if !ok {
+			t.Fatalf("connection %d refused", i)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer p.release(tc)
+			p.serve(tc)
+		}()
+		if _, err := peer.Write([]byte("ping")); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, err := io.ReadFull(peer, make([]byte, 4)); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		peer.Close()
+	}
+	wg.Wait()
+	if n := p.conns.len(); n != 0 {
+		t.Errorf("tracker holds %d connections after all closed, want 0", n)
+	}
+}
+
+func TestConnTracker_limit(t *testing.T) {
+	tr := &connTracker{limit: 2}
+	a, _ := net.Pipe()
+	b, _ := net.Pipe()
+	c, _ := net.Pipe()
+	ta, ok := tr.add(a, 0)
+	if !ok {
+		t.Fatal("first connection refused")
+	}
+	if _, ok := tr.add(b, 0); !ok {
+		t.Fatal("second connection refused")
+	}
+	if _, ok := tr.add(c, 0); ok {
+		t.Fatal("connection beyond the tracking limit accepted")
+	}
+	tr.remove(ta)
+	if _, ok := tr.add(c, 0); !ok {
+		t.Fatal("connection refused after one was released")
+	}
+	if got := tr.capacity(1); got != 1 {
+		t.Errorf("capacity with a lower MaxConnections=%d, want 1", got)
+	}
+	if got := (&connTracker{limit: -1}).capacity(0); got != 0 {
+		t.Errorf("unbounded capacity=%d, want 0", got)
+	}
+}
+
+func TestConnTracker_reconcileRemovesLeaked(t *testing.T) {
+	var tr connTracker
+	a, _ := net.Pipe()
+	b, _ := net.Pipe()
+	leaked, _ := tr.add(a, 0)
+	if _, ok := tr.add(b, 0); !ok {
+		t.Fatal("add refused")
+	}
+	leaked.Close() // closed but never released
+
+	if n := tr.reconcile(time.Now().Add(-time.Minute)); n != 0 {
+		t.Errorf("reconcile removed %d recently closed entries, want 0", n)
+	}
+	if n := tr.reconcile(time.Now().Add(time.Second)); n != 1 {
+		t.Errorf("reconcile removed %d, want the leaked entry", n)
+	}
+	if n := tr.len(); n != 1 {
+		t.Errorf("tracker holds %d, want the open connection only", n)
+	}
+}
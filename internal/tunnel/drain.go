@@ -0,0 +1,33 @@
+package tunnel
+
+import (
+	"io"
+	"log"
+	"time"
+)
+
+// drainPollInterval is how often drain checks for remaining connections.
+const drainPollInterval = 50 * time.Millisecond
+
+// drain stops accepting relay connections by closing the forward, then
+// waits up to timeout for the connections being proxied to finish,
+// closing any that remain. It reports whether they all finished.
+func (p *localProxy) drain(forward io.Closer, timeout time.Duration) bool {
+	forward.Close()
+	n := p.conns.len()
+	if n == 0 {
+		return true
+	}
+	log.Printf("draining %d connections (up to %s)", n, timeout)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+		if p.conns.len() == 0 {
+			log.Println("all connections drained")
+			return true
+		}
+	}
+	log.Printf("WARNING: %d connections still open after %s — closing them", p.conns.len(), timeout)
+	p.conns.closeAll()
+	return false
+}
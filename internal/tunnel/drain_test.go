@@ -0,0 +1,115 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRun_drainsConnectionsBeforeMovingPort(t *testing.T) {
+	client, relay := newTestRelay(t)
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	run := func(ctx context.Context, port int) (<-chan error, relayForward) {
+		t.Helper()
+		up := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			done <- Run(ctx, &Config{
+				Client:        client,
+				TunnelPort:    port,
+				LocalAddr:     echo.Addr().String(),
+				HeartbeatFunc: func(context.Context) (bool, error) { return true, nil },
+				DrainTimeout:  5 * time.Second,
+				OnUp:          func(UpInfo) { close(up) },
+			})
+		}()
+		select {
+		case <-up:
+		case err := <-done:
+			t.Fatalf("Run returned before forwarding: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("tunnel did not come up")
+		}
+		return done, <-relay.forwards
+	}
+	ping := func(rw io.ReadWriter) error {
+		if _, err := rw.Write([]byte("ping")); err != nil {
+			return err
+		}
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(rw, buf)
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done, fwd := run(ctx, 9000)
+	ch, err := relay.openForwarded(fwd)
+	if err != nil {
+		t.Fatalf("open forwarded channel: %v", err)
+	}
+	if err := ping(ch); err != nil {
+		t.Fatalf("ping before reconnect: %v", err)
+	}
+
+	// The port moved: tear down, but let the open connection finish.
+	cancel()
+	select {
+	case err := <-done:
+		t.Fatalf("Run returned %v with a connection still open", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := ping(ch); err != nil {
+		t.Fatalf("ping while draining: %v", err)
+	}
+	ch.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Run returned %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return once the connection closed")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	if _, fwd := run(ctx, 9001); fwd.Port != 9001 {
+		t.Errorf("forward requested for port %d, want 9001", fwd.Port)
+	}
+}
+
+func TestDrain_closesStragglers(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	p := &localProxy{}
+	if _, ok := p.conns.add(a, 0); !ok {
+		t.Fatal("add rejected")
+	}
+	if p.drain(io.NopCloser(nil), 10*time.Millisecond) {
+		t.Fatal("drain reported success with a connection open")
+	}
+	if _, err := b.Write([]byte("x")); err == nil {
+		t.Error("straggling connection left open after the drain timeout")
+	}
+}
@@ -0,0 +1,306 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrBindMismatch is returned by Run in strict mode when the relay bound
+// the reverse forward to a different port than requested.
+var ErrBindMismatch = errors.New("relay bound a different port than requested")
+
+// ErrForwardDenied means the relay accepted the SSH login but refused the
+// tcpip-forward request, typically because its policy does not allow the
+// agent's user to forward that port. Retrying will not help until the
+// relay or the tunnel port assignment changes.
+var ErrForwardDenied = errors.New("relay denied the reverse forward")
+
+// forwardBacklog is how many relay connections may wait for Accept.
+const forwardBacklog = 16
+
+// The reverse forward is requested and served here rather than through
+// ssh.Client.Listen, which assumes the relay honoured the requested port
+// and drops the port each forwarded-tcpip channel says it arrived on. The
+// tcpip-forward reply only carries a port when port 0 was requested (RFC
+// 4254 section 7.1), so those channels are the only place a relay that
+// remapped a fixed port shows it.
+
+// forwardRequest is the payload of tcpip-forward and cancel-tcpip-forward
+// (RFC 4254 section 7.1).
+type forwardRequest struct {
+	Addr string
+	Port uint32
+}
+
+// forwardedPayload is the payload of a forwarded-tcpip channel open.
+type forwardedPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// forwardMux routes forwarded-tcpip channels of one SSH connection to the
+// listener registered for their port. One is shared by every tunnel on a
+// connection, since x/crypto only lets a channel type be claimed once.
+type forwardMux struct {
+	mu        sync.Mutex
+	listeners map[uint32]*forwardListener
+}
+
+var (
+	forwardMuxMu sync.Mutex
+	forwardMuxes = make(map[*ssh.Client]*forwardMux)
+)
+
+func muxFor(client *ssh.Client) (*forwardMux, error) {
+	forwardMuxMu.Lock()
+	defer forwardMuxMu.Unlock()
+	if m, ok := forwardMuxes[client]; ok {
+		return m, nil
+	}
+	chans := client.HandleChannelOpen("forwarded-tcpip")
+	if chans == nil {
+		return nil, errors.New("forwarded-tcpip channels are already handled on this SSH connection")
+	}
+	m := &forwardMux{listeners: make(map[uint32]*forwardListener)}
+	forwardMuxes[client] = m
+	go m.run(client, chans)
+	return m, nil
+}
+
+// run dispatches channels until the connection closes, then closes every
+// listener so their Accept returns.
+func (m *forwardMux) run(client *ssh.Client, chans <-chan ssh.NewChannel) {
+	for nc := range chans {
+		var p forwardedPayload
+		if err := ssh.Unmarshal(nc.ExtraData(), &p); err != nil {
+			_ = nc.Reject(ssh.ConnectionFailed, "malformed forwarded-tcpip payload")
+			continue
+		}
+		m.mu.Lock()
+		l := m.listeners[p.Port]
+		if l == nil {
+			l = m.adopt(p)
+		}
+		m.mu.Unlock()
+		if l == nil || !l.deliver(nc, p) {
+			_ = nc.Reject(ssh.Prohibited, "no forward for address")
+		}
+	}
+
+	forwardMuxMu.Lock()
+	delete(forwardMuxes, client)
+	forwardMuxMu.Unlock()
+
+	m.mu.Lock()
+	listeners := m.listeners
+	m.listeners = make(map[uint32]*forwardListener)
+	m.mu.Unlock()
+	for _, l := range listeners {
+		l.shutdown()
+	}
+}
+
+// adopt picks the listener for a channel on a port nobody registered: the
+// one listener on p.Addr still keyed by the fixed port it requested, which
+// the relay must have bound elsewhere. It is re-keyed to the channel's port
+// so later channels find it directly. With no such listener, or more than
+// one, it returns nil. m.mu must be held.
+func (m *forwardMux) adopt(p forwardedPayload) *forwardListener {
+	var found *forwardListener
+	for key, l := range m.listeners {
+		if l.req.Port == 0 || key != l.req.Port || l.req.Addr != p.Addr {
+			continue
+		}
+		if found != nil {
+			return nil
+		}
+		found = l
+	}
+	if found != nil {
+		delete(m.listeners, found.key)
+		found.key = p.Port
+		m.listeners[p.Port] = found
+	}
+	return found
+}
+
+// forwardListener is a net.Listener for one reverse forward.
+type forwardListener struct {
+	client   *ssh.Client
+	mux      *forwardMux
+	req      forwardRequest // as sent to the relay
+	addr     *net.TCPAddr   // as bound by the relay, as far as its reply tells
+	key      uint32         // port in mux.listeners, guarded by mux.mu
+	incoming chan forwardedChannel
+	done     chan struct{}
+	once     sync.Once
+}
+
+type forwardedChannel struct {
+	nc      ssh.NewChannel
+	payload forwardedPayload
+}
+
+// listenForward asks the relay to forward host:port back over client. The
+// returned listener's Addr carries the requested port, or for port 0 the
+// one the relay allocated. Each accepted conn's LocalAddr carries the port
+// the relay says it arrived on. With debug set, the raw request and reply
+// are logged.
+func listenForward(client *ssh.Client, host string, port int, debug bool) (*forwardListener, error) {
+	m, err := muxFor(client)
+	if err != nil {
+		return nil, err
+	}
+
+	req := forwardRequest{Addr: host, Port: uint32(port)}
+	payload := ssh.Marshal(&req)
+	if debug {
+		log.Printf("debug: tcpip-forward request: addr=%q port=%d want_reply=true payload=%x", req.Addr, req.Port, payload)
+	}
+	ok, resp, err := client.SendRequest("tcpip-forward", true, payload)
+	if err != nil {
+		if debug {
+			log.Printf("debug: tcpip-forward request failed: %v", err)
+		}
+		return nil, err
+	}
+	bound := req.Port
+	var reply struct{ Port uint32 }
+	if len(resp) > 0 && ssh.Unmarshal(resp, &reply) == nil && req.Port == 0 && reply.Port != 0 {
+		bound = reply.Port
+	}
+	if debug {
+		log.Printf("debug: tcpip-forward reply: ok=%v payload=%x reported_port=%d bound_port=%d", ok, resp, reply.Port, bound)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w for port %d", ErrForwardDenied, port)
+	}
+
+	l := &forwardListener{
+		client:   client,
+		mux:      m,
+		req:      req,
+		addr:     &net.TCPAddr{IP: net.ParseIP(host), Port: int(bound)},
+		key:      bound,
+		incoming: make(chan forwardedChannel, forwardBacklog),
+		done:     make(chan struct{}),
+	}
+	m.mu.Lock()
+	m.listeners[bound] = l
+	m.mu.Unlock()
+	return l, nil
+}
+
+// deliver queues a relay connection, reporting false if the listener is
+// closed or its backlog is full.
+func (l *forwardListener) deliver(nc ssh.NewChannel, p forwardedPayload) bool {
+	select {
+	case <-l.done:
+		return false
+	default:
+	}
+	select {
+	case l.incoming <- forwardedChannel{nc, p}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *forwardListener) Accept() (net.Conn, error) {
+	for {
+		select {
+		case <-l.done:
+			return nil, io.EOF
+		case fc := <-l.incoming:
+			ch, reqs, err := fc.nc.Accept()
+			if err != nil {
+				log.Printf("accept forwarded channel: %v", err)
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+			return &channelConn{
+				Channel: ch,
+				laddr: &net.TCPAddr{
+					IP:   net.ParseIP(fc.payload.Addr),
+					Port: int(fc.payload.Port),
+				},
+				raddr: &net.TCPAddr{
+					IP:   net.ParseIP(fc.payload.OriginAddr),
+					Port: int(fc.payload.OriginPort),
+				},
+			}, nil
+		}
+	}
+}
+
+// Close stops accepting and asks the relay to cancel the forward.
+func (l *forwardListener) Close() error {
+	if !l.shutdown() {
+		return nil
+	}
+	l.mux.mu.Lock()
+	if l.mux.listeners[l.key] == l {
+		delete(l.mux.listeners, l.key)
+	}
+	l.mux.mu.Unlock()
+
+	cancelReq := forwardRequest{Addr: l.req.Addr, Port: uint32(l.addr.Port)}
+	ok, _, err := l.client.SendRequest("cancel-tcpip-forward", true, ssh.Marshal(&cancelReq))
+	if err == nil && !ok {
+		err = errors.New("cancel-tcpip-forward request denied by relay")
+	}
+	return err
+}
+
+// shutdown closes done once, reporting whether this call closed it.
+func (l *forwardListener) shutdown() bool {
+	closed := false
+	l.once.Do(func() {
+		close(l.done)
+		closed = true
+	})
+	return closed
+}
+
+func (l *forwardListener) Addr() net.Addr {
+	return l.addr
+}
+
+// checkBind compares the port a relay connection arrived on with the
+// requested one. A mismatch is logged, and refused with ErrBindMismatch
+// when strict.
+func checkBind(requested, port int, strict bool) error {
+	if requested == 0 || port == requested {
+		return nil
+	}
+	if strict {
+		return fmt.Errorf("%w: requested %d, relay bound %d", ErrBindMismatch, requested, port)
+	}
+	log.Printf("WARNING: relay bound the reverse forward to port %d instead of the requested %d — "+
+		"the control plane will route visitors to the wrong port", port, requested)
+	return nil
+}
+
+// channelConn adapts a forwarded SSH channel to net.Conn.
+type channelConn struct {
+	ssh.Channel
+	laddr, raddr net.Addr
+}
+
+var errChannelDeadline = errors.New("deadlines are not supported on forwarded SSH channels")
+
+func (c *channelConn) LocalAddr() net.Addr              { return c.laddr }
+func (c *channelConn) RemoteAddr() net.Addr             { return c.raddr }
+func (c *channelConn) SetDeadline(time.Time) error      { return errChannelDeadline }
+func (c *channelConn) SetReadDeadline(time.Time) error  { return errChannelDeadline }
+func (c *channelConn) SetWriteDeadline(time.Time) error { return errChannelDeadline }
@@ -0,0 +1,243 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun_detectsRemappedForwardPort(t *testing.T) {
+	client, relay := newTestRelay(t)
+	relay.bindPort.Store(9100)
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	var buf syncBuffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, &Config{
+			Client:        client,
+			LocalAddr:     echo.Addr().String(),
+			TunnelPort:    9000,
+			HeartbeatFunc: func(context.Context) (bool, error) { return true, nil },
+			OnUp:          func(UpInfo) { close(up) },
+		})
+	}()
+	select {
+	case <-up:
+	case err := <-done:
+		t.Fatalf("Run: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel did not come up")
+	}
+
+	// The reply names no port; the channel is the first sign of the remap.
+	// Connections arriving on the remapped port are still served.
+	ch, err := relay.openForwarded(<-relay.forwards)
+	if err != nil {
+		t.Fatalf("open forwarded channel on remapped port: %v", err)
+	}
+	defer ch.Close()
+	if _, err := ch.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(ch, got); err != nil || string(got) != "ping" {
+		t.Fatalf("echo through remapped port: %q, %v", got, err)
+	}
+	if !strings.Contains(buf.String(), "port 9100 instead of the requested 9000") {
+		t.Errorf("remap not logged: %q", buf.String())
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Run returned in non-strict mode: %v", err)
+	default:
+	}
+}
+
+func TestRun_strictBindRefusesRemappedPort(t *testing.T) {
+	client, relay := newTestRelay(t)
+	relay.bindPort.Store(9100)
+
+	up := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(context.Background(), &Config{
+			Client:        client,
+			TunnelPort:    9000,
+			HeartbeatFunc: func(context.Context) (bool, error) { return true, nil },
+			StrictBind:    true,
+			OnUp:          func(UpInfo) { close(up) },
+		})
+	}()
+	select {
+	case <-up:
+	case err := <-done:
+		t.Fatalf("Run: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel did not come up")
+	}
+
+	if ch, err := relay.openForwarded(<-relay.forwards); err == nil {
+		ch.Close()
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrBindMismatch) {
+			t.Fatalf("Run: got %v, want ErrBindMismatch", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run kept the tunnel up on a remapped port")
+	}
+}
+
+func TestListenForward_usesReplyPortOnlyForPortZero(t *testing.T) {
+	client, relay := newTestRelay(t)
+	relay.bindPort.Store(9100)
+
+	l, err := listenForward(client, "127.0.0.1", 0, false)
+	if err != nil {
+		t.Fatalf("listenForward: %v", err)
+	}
+	defer l.Close()
+	if got := l.Addr().String(); got != "127.0.0.1:9100" {
+		t.Errorf("Addr=%s, want the port allocated by the relay", got)
+	}
+}
+
+func TestRun_forwardDeniedByRelayPolicy(t *testing.T) {
+	client, relay := newTestRelay(t)
+	relay.denyForwards.Store(true)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	err := Run(context.Background(), &Config{
+		Client:        client,
+		TunnelPort:    9000,
+		HeartbeatFunc: func(context.Context) (bool, error) { return true, nil },
+		OnUp:          func(UpInfo) { t.Error("tunnel reported up despite the denied forward") },
+	})
+	if !errors.Is(err, ErrForwardDenied) {
+		t.Fatalf("Run: got %v, want ErrForwardDenied", err)
+	}
+	if !strings.Contains(buf.String(), "relay denied reverse-forward for port 9000 — check relay permissions") {
+		t.Errorf("denial not logged clearly: %q", buf.String())
+	}
+}
+
+func TestListenForward_debugLogsRequestAndReply(t *testing.T) {
+	client, relay := newTestRelay(t)
+	relay.bindPort.Store(9100)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	l, err := listenForward(client, "127.0.0.1", 9000, true)
+	if err != nil {
+		t.Fatalf("listenForward: %v", err)
+	}
+	defer l.Close()
+
+	out := buf.String()
+	for _, want := range []string{
+		`tcpip-forward request: addr="127.0.0.1" port=9000`,
+		"tcpip-forward reply: ok=true",
+		"reported_port=0 bound_port=9000",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("debug log lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestListenForward_quietWithoutDebug(t *testing.T) {
+	client, _ := newTestRelay(t)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	l, err := listenForward(client, "127.0.0.1", 9000, false)
+	if err != nil {
+		t.Fatalf("listenForward: %v", err)
+	}
+	defer l.Close()
+	if strings.Contains(buf.String(), "debug:") {
+		t.Errorf("debug output without debug mode: %s", buf.String())
+	}
+}
+
+func TestCheckBind_warnsOnMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	if err := checkBind(9000, 9000, true); err != nil {
+		t.Errorf("matching port: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("unexpected log for matching port: %s", buf.String())
+	}
+	if err := checkBind(9000, 9100, false); err != nil {
+		t.Errorf("non-strict mismatch must only warn, got %v", err)
+	}
+	if !strings.Contains(buf.String(), "port 9100 instead of the requested 9000") {
+		t.Errorf("mismatch not logged: %q", buf.String())
+	}
+}
+
+func TestForwardListener_closeUnblocksAccept(t *testing.T) {
+	client, _ := newTestRelay(t)
+	l, err := listenForward(client, "127.0.0.1", 9000, false)
+	if err != nil {
+		t.Fatalf("listenForward: %v", err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		errCh <- err
+	}()
+	if err := l.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	select {
+	case err := <-errCh:
+		if err != io.EOF {
+			t.Errorf("Accept after Close: %v, want EOF", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Accept still blocked after Close")
+	}
+}
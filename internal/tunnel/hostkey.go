@@ -0,0 +1,72 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// errHostKeyCaptured aborts the handshake in FetchHostKey once the server
+// has presented its key.
+var errHostKeyCaptured = errors.New("host key captured")
+
+// FetchHostKey connects to the relay at hostport and returns the host key
+// it presents. The handshake is abandoned before authentication, so no
+// credentials are needed or sent.
+func FetchHostKey(ctx context.Context, hostport string, timeout time.Duration) (ssh.PublicKey, error) {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", hostport)
+	if err != nil {
+		return nil, fmt.Errorf("dial relay %s: %w", hostport, err)
+	}
+	defer conn.Close()
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	var hostKey ssh.PublicKey
+	_, _, _, err = ssh.NewClientConn(conn, hostport, &ssh.ClientConfig{
+		User: "smarthomeentry",
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return errHostKeyCaptured
+		},
+	})
+	if hostKey == nil {
+		return nil, fmt.Errorf("relay %s handshake: %w", hostport, err)
+	}
+	return hostKey, nil
+}
+
+// TrustHostKey records key as the trusted host key for hostport in the
+// known_hosts file at path. It is a no-op if the key is already trusted and
+// fails if a different key is on record for the host.
+func TrustHostKey(path, hostport string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create config dir: %w", err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		cb, err := knownhosts.New(path)
+		if err != nil {
+			return fmt.Errorf("load known_hosts: %w", err)
+		}
+		// knownhosts only uses the address for IP-keyed entries.
+		kerr := cb(hostport, &net.TCPAddr{IP: net.IPv4zero}, key)
+		if kerr == nil {
+			return nil
+		}
+		var keyErr *knownhosts.KeyError
+		if errors.As(kerr, &keyErr) && len(keyErr.Want) > 0 {
+			return fmt.Errorf("%s already has a different host key in %s — remove it first if the relay key legitimately changed", hostport, path)
+		}
+	}
+	return appendKnownHost(path, hostport, key,
+		"confirmed at install "+time.Now().UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,116 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startHostKeyServer runs an SSH server that only gets as far as presenting
+// its host key, and returns its address and that key.
+func startHostKeyServer(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("host signer: %v", err)
+	}
+	cfg := &ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _, _, _ = ssh.NewServerConn(c, cfg)
+			}()
+		}
+	}()
+	return ln.Addr().String(), signer.PublicKey()
+}
+
+func TestFetchHostKey(t *testing.T) {
+	addr, want := startHostKeyServer(t)
+	got, err := FetchHostKey(context.Background(), addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("FetchHostKey: %v", err)
+	}
+	if ssh.FingerprintSHA256(got) != ssh.FingerprintSHA256(want) {
+		t.Errorf("fingerprint %s, want %s", ssh.FingerprintSHA256(got), ssh.FingerprintSHA256(want))
+	}
+}
+
+func TestTrustHostKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	_, key := startHostKeyServer(t)
+
+	if err := TrustHostKey(path, "relay.example.com:22", key); err != nil {
+		t.Fatalf("TrustHostKey: %v", err)
+	}
+	// Trusting the same key again must not duplicate the entry.
+	if err := TrustHostKey(path, "relay.example.com:22", key); err != nil {
+		t.Fatalf("TrustHostKey again: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if n := strings.Count(string(data), "\n"); n != 1 {
+		t.Errorf("known_hosts has %d lines, want 1:\n%s", n, data)
+	}
+
+	_, other := startHostKeyServer(t)
+	if err := TrustHostKey(path, "relay.example.com:22", other); err == nil {
+		t.Error("expected error when a different key is already on record")
+	}
+}
+
+func TestRecordHostKeyType(t *testing.T) {
+	addr, _ := startHostKeyServer(t)
+
+	var algo string
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "agent",
+		HostKeyCallback: recordHostKeyType(ssh.InsecureIgnoreHostKey(), &algo),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	client.Close()
+	if algo != ssh.KeyAlgoED25519 {
+		t.Errorf("recorded %q, want %q", algo, ssh.KeyAlgoED25519)
+	}
+
+	var rejected string
+	reject := func(string, net.Addr, ssh.PublicKey) error { return errors.New("untrusted") }
+	_, err = ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "agent",
+		HostKeyCallback: recordHostKeyType(reject, &rejected),
+		Timeout:         5 * time.Second,
+	})
+	if err == nil {
+		t.Fatal("expected dial to fail with rejected host key")
+	}
+	if rejected != "" {
+		t.Errorf("rejected key recorded as %q", rejected)
+	}
+}
@@ -0,0 +1,65 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func testKeyPair(t *testing.T) (private, public []byte) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatalf("marshal private key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("signer: %v", err)
+	}
+	return pem.EncodeToMemory(block), ssh.MarshalAuthorizedKey(signer.PublicKey())
+}
+
+func TestParsePrivateKey_publicKeyGiven(t *testing.T) {
+	_, pub := testKeyPair(t)
+
+	for name, key := range map[string][]byte{
+		"authorized_keys line": pub,
+		"with comment":         []byte(strings.TrimSpace(string(pub)) + " user@host\n"),
+		"truncated":            pub[:40],
+	} {
+		_, err := parsePrivateKey(key)
+		if !errors.Is(err, ErrPublicKeyGiven) {
+			t.Errorf("%s: got %v, want ErrPublicKeyGiven", name, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), "public key, not a private key") {
+			t.Errorf("%s: error message %q does not explain the mistake", name, err)
+		}
+	}
+}
+
+func TestParsePrivateKey_valid(t *testing.T) {
+	priv, _ := testKeyPair(t)
+	if _, err := parsePrivateKey(priv); err != nil {
+		t.Fatalf("parsePrivateKey: %v", err)
+	}
+}
+
+func TestParsePrivateKey_garbage(t *testing.T) {
+	_, err := parsePrivateKey([]byte("not a key"))
+	if err == nil {
+		t.Fatal("expected error for garbage input")
+	}
+	if errors.Is(err, ErrPublicKeyGiven) {
+		t.Errorf("garbage misreported as a public key: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/smarthomeentry/agent/internal/atomicfile"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// DefaultMaxKnownHosts caps the entries kept in known_hosts. Relay pools
+// and key rotations add entries that are never removed otherwise.
+const DefaultMaxKnownHosts = 256
+
+// pruneKnownHosts rewrites the known_hosts file at path so it holds at most
+// max entries. Duplicate entries (same hosts and key) are dropped first,
+// then the oldest entries, except any for keep — the relay being connected
+// to — which are never removed. Comments and blank lines are preserved. It
+// returns the number of entries removed.
+func pruneKnownHosts(path string, max int, keep string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("read known_hosts: %w", err)
+	}
+	keep = knownhosts.Normalize(keep)
+
+	type line struct {
+		text  string
+		hosts string // empty for comments and blank lines
+		drop  bool
+	}
+	var lines []line
+	seen := make(map[string]bool)
+	entries, removed := 0, 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		text := scanner.Text()
+		fields := strings.Fields(text)
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			lines = append(lines, line{text: text})
+			continue
+		}
+		id := strings.Join(fields[:3], " ")
+		if seen[id] {
+			removed++
+			continue
+		}
+		seen[id] = true
+		lines = append(lines, line{text: text, hosts: fields[0]})
+		entries++
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("read known_hosts: %w", err)
+	}
+
+	// Entries are appended as they are trusted, so the oldest come first.
+	for i := range lines {
+		if entries <= max {
+			break
+		}
+		if lines[i].hosts == "" || lines[i].hosts == keep {
+			continue
+		}
+		lines[i].drop = true
+		entries--
+		removed++
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+
+	var buf bytes.Buffer
+	for _, l := range lines {
+		if l.drop {
+			continue
+		}
+		buf.WriteString(l.text)
+		buf.WriteByte('\n')
+	}
+	if err := atomicfile.Write(path, buf.Bytes(), 0o600); err != nil {
+		return 0, fmt.Errorf("prune known_hosts: %w", err)
+	}
+	return removed, nil
+}
@@ -0,0 +1,61 @@
+package tunnel
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPruneKnownHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	// The connected relay's entry is the oldest, so plain age-based
+	// pruning would drop it first.
+	if err := appendKnownHost(path, "current.example.com:22", generateTestKey(t), "first"); err != nil {
+		t.Fatal(err)
+	}
+	dup := generateTestKey(t)
+	for i := 0; i < 50; i++ {
+		key := generateTestKey(t)
+		if i == 10 {
+			key = dup
+		}
+		if err := appendKnownHost(path, fmt.Sprintf("relay%d.example.com:22", i), key, "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := appendKnownHost(path, "relay10.example.com:22", dup, "again"); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := pruneKnownHosts(path, 10, "current.example.com:22")
+	if err != nil {
+		t.Fatalf("pruneKnownHosts: %v", err)
+	}
+	if removed != 42 {
+		t.Errorf("removed %d entries, want 42", removed)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 10 {
+		t.Fatalf("%d entries after pruning, want 10:\n%s", len(lines), data)
+	}
+	if !strings.HasPrefix(lines[0], "current.example.com ") {
+		t.Errorf("connected relay's entry was pruned:\n%s", data)
+	}
+	if !strings.HasPrefix(lines[9], "relay49.example.com ") {
+		t.Errorf("newest entry was pruned:\n%s", data)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("known_hosts mode after pruning: %v, %v", fi.Mode(), err)
+	}
+
+	if removed, err := pruneKnownHosts(path, 10, "current.example.com:22"); err != nil || removed != 0 {
+		t.Errorf("second prune removed %d, %v; want 0", removed, err)
+	}
+}
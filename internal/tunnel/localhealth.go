@@ -0,0 +1,40 @@
+package tunnel
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+)
+
+// watchLocal probes the local service every interval until ctx is done.
+// While it is down, serve closes relay connections immediately instead of
+// dialling a refused port; the tunnel and heartbeats are unaffected.
+// onChange, if set, is called on every transition with the new state.
+func (p *localProxy) watchLocal(ctx context.Context, interval time.Duration, onChange func(up bool)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		conn, err := net.DialTimeout("tcp", p.addr, localDialTimeout)
+		up := err == nil
+		if up {
+			conn.Close()
+		}
+		if p.localDown.Swap(!up) == up {
+			if up {
+				log.Printf("local service at %s is back — proxying resumed", p.addr)
+			} else {
+				log.Printf("WARNING: local service at %s is down (%v) — closing relay connections until it recovers", p.addr, err)
+			}
+			if onChange != nil {
+				onChange(up)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
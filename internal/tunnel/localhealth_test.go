@@ -0,0 +1,111 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRun_localHealthStopsProxyingWithoutTeardown(t *testing.T) {
+	client, relay := newTestRelay(t)
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	localAddr := echo.Addr().String()
+	serveEcho := func(ln net.Listener) {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}
+	go serveEcho(echo)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up := make(chan struct{})
+	health := make(chan bool, 4)
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, &Config{
+			Client:              client,
+			TunnelPort:          9000,
+			LocalAddr:           localAddr,
+			LocalHealthInterval: 20 * time.Millisecond,
+			OnLocalHealth:       func(ok bool) { health <- ok },
+			HeartbeatFunc:       func(context.Context) (bool, error) { return true, nil },
+			OnUp:                func(UpInfo) { close(up) },
+		})
+	}()
+	select {
+	case <-up:
+	case err := <-done:
+		t.Fatalf("Run returned early: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel did not come up")
+	}
+	fwd := <-relay.forwards
+
+	roundTrip := func() error {
+		ch, err := relay.openForwarded(fwd)
+		if err != nil {
+			return err
+		}
+		defer ch.Close()
+		if _, err := ch.Write([]byte("ping")); err != nil {
+			return err
+		}
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(ch, buf)
+		return err
+	}
+	waitHealth := func(want bool) {
+		t.Helper()
+		select {
+		case got := <-health:
+			if got != want {
+				t.Fatalf("local health=%v, want %v", got, want)
+			}
+		case err := <-done:
+			t.Fatalf("tunnel torn down: %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("local health never became %v", want)
+		}
+	}
+
+	if err := roundTrip(); err != nil {
+		t.Fatalf("proxy while healthy: %v", err)
+	}
+
+	echo.Close()
+	waitHealth(false)
+	if err := roundTrip(); err == nil {
+		t.Error("relay connection proxied while the local service was down")
+	}
+
+	echo, err = net.Listen("tcp", localAddr)
+	if err != nil {
+		t.Fatalf("relisten on %s: %v", localAddr, err)
+	}
+	defer echo.Close()
+	go serveEcho(echo)
+	waitHealth(true)
+	if err := roundTrip(); err != nil {
+		t.Fatalf("proxy after recovery: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("tunnel torn down: %v", err)
+	default:
+	}
+}
@@ -0,0 +1,73 @@
+package tunnel
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// connLogWindow is the period over which Config.ConnLogLimit applies.
+const connLogWindow = time.Minute
+
+// DefaultConnLogLimit caps per-connection log lines per connLogWindow.
+const DefaultConnLogLimit = 60
+
+// logLimiter passes through at most limit lines per window and counts the
+// rest. When a window in which lines were dropped ends, a single summary
+// line reports how many. A nil *logLimiter logs everything.
+type logLimiter struct {
+	mu         sync.Mutex
+	limit      int
+	window     time.Duration
+	start      time.Time
+	count      int
+	suppressed int
+	logf       func(format string, args ...any)
+}
+
+func newLogLimiter(limit int, window time.Duration) *logLimiter {
+	return &logLimiter{limit: limit, window: window, logf: log.Printf}
+}
+
+func (l *logLimiter) Printf(format string, args ...any) {
+	if l == nil {
+		log.Printf(format, args...)
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if now.Sub(l.start) >= l.window {
+		l.rollLocked(now)
+	}
+	if l.count < l.limit {
+		l.count++
+		l.mu.Unlock()
+		l.logf(format, args...)
+		return
+	}
+	l.suppressed++
+	if l.suppressed == 1 {
+		// Report at the end of this window even if no further lines
+		// arrive to trigger the roll-over.
+		time.AfterFunc(l.start.Add(l.window).Sub(now), l.flush)
+	}
+	l.mu.Unlock()
+}
+
+// flush closes the current window if it has ended.
+func (l *logLimiter) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now := time.Now(); now.Sub(l.start) >= l.window {
+		l.rollLocked(now)
+	}
+}
+
+func (l *logLimiter) rollLocked(now time.Time) {
+	if l.suppressed > 0 {
+		l.logf("suppressed %d connection log lines in the last %s", l.suppressed, l.window)
+	}
+	l.start = now
+	l.count = 0
+	l.suppressed = 0
+}
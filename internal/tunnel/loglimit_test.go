@@ -0,0 +1,64 @@
+package tunnel
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type lineRecorder struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (r *lineRecorder) logf(format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, fmt.Sprintf(format, args...))
+}
+
+func (r *lineRecorder) snapshot() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+func TestLogLimiter_suppressesAndSummarises(t *testing.T) {
+	rec := &lineRecorder{}
+	l := newLogLimiter(2, 50*time.Millisecond)
+	l.logf = rec.logf
+
+	for i := 0; i < 5; i++ {
+		l.Printf("connection %d closed", i)
+	}
+	if got := rec.snapshot(); len(got) != 2 {
+		t.Fatalf("logged %d lines within the window, want 2: %v", len(got), got)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		got := rec.snapshot()
+		if len(got) == 3 {
+			if !strings.Contains(got[2], "suppressed 3 ") {
+				t.Errorf("summary=%q, want 3 suppressed", got[2])
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := rec.snapshot(); len(got) != 3 {
+		t.Fatalf("no summary after the window ended: %v", got)
+	}
+
+	l.Printf("connection after window")
+	if got := rec.snapshot(); len(got) != 4 || got[3] != "connection after window" {
+		t.Errorf("new window should log again: %v", got)
+	}
+}
+
+func TestLogLimiter_nilLogsEverything(t *testing.T) {
+	var l *logLimiter
+	l.Printf("no limiter configured") // must not panic
+}
@@ -0,0 +1,139 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The loopback self-test connects to the reverse forward from the relay's
+// side and sends a random token. Only this agent's proxy, through the
+// forward the relay routes to it, knows the token and answers it, so the
+// answer proves visitors reach this agent rather than some other one.
+const (
+	loopbackPrefix = "SMARTHOMEENTRY-SELFTEST "
+	loopbackReply  = "SMARTHOMEENTRY-SELFTEST-OK "
+)
+
+// loopbackPeek bounds how long a relay connection is held back, while a
+// token is outstanding, waiting for it to show it is not the test
+// connection. Clients of the usual services speak first and are not
+// delayed at all. A variable so tests can shorten it.
+var loopbackPeek = 2 * time.Second
+
+// errLoopbackRefused means the relay refused to open a connection to the
+// forwarded port on its side, so the round trip can't be tested.
+var errLoopbackRefused = errors.New("relay refused a loopback connection")
+
+// loopbackSelfTest sends a fresh token to port on the relay's loopback
+// interface and checks that p answers it through the reverse forward.
+func loopbackSelfTest(ctx context.Context, client *ssh.Client, p *localProxy, port int) error {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return fmt.Errorf("generate token: %w", err)
+	}
+	token := hex.EncodeToString(raw)
+	p.loopbackToken.Store(&token)
+	defer p.loopbackToken.Store(nil)
+
+	ctx, cancel := context.WithTimeout(ctx, selfTestTimeout)
+	defer cancel()
+	conn, err := client.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("%w to port %d: %w", errLoopbackRefused, port, err)
+	}
+	defer conn.Close()
+	// SSH channels have no deadlines; closing the connection ends the read.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if _, err := io.WriteString(conn, loopbackPrefix+token+"\n"); err != nil {
+		return fmt.Errorf("send token: %w", err)
+	}
+	answer, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return fmt.Errorf("token did not come back through the relay forward: %w", err)
+	}
+	if answer != loopbackReply+token+"\n" {
+		return fmt.Errorf("unexpected answer %.64q through the relay forward — it may lead to another agent or service", answer)
+	}
+	return nil
+}
+
+// answerLoopback checks whether conn carries the outstanding self-test
+// token and answers it if so, reporting true. Otherwise it returns a
+// connection that replays whatever was read while checking.
+func (p *localProxy) answerLoopback(conn net.Conn, token string) (net.Conn, bool) {
+	want := []byte(loopbackPrefix + token + "\n")
+	buf := make([]byte, len(want))
+	got := 0
+	timer := time.NewTimer(loopbackPeek)
+	defer timer.Stop()
+	for got < len(want) {
+		// Relay connections are SSH channels without read deadlines, so
+		// the read runs aside and is handed over if it outlasts the peek.
+		done := make(chan peekRead, 1)
+		go func(b []byte) {
+			n, err := conn.Read(b)
+			done <- peekRead{n, err}
+		}(buf[got:])
+		select {
+		case r := <-done:
+			got += r.n
+			if r.err != nil || !bytes.Equal(buf[:got], want[:got]) {
+				return &peekConn{Conn: conn, buf: buf[:got], err: r.err}, false
+			}
+		case <-timer.C:
+			return &peekConn{Conn: conn, buf: buf[:got], pending: done, pendBuf: buf[got:]}, false
+		}
+	}
+	_, _ = io.WriteString(conn, loopbackReply+token+"\n")
+	return conn, true
+}
+
+// peekRead is the result of a Read started while peeking.
+type peekRead struct {
+	n   int
+	err error
+}
+
+// peekConn replays the bytes read from a connection while peeking at it.
+type peekConn struct {
+	net.Conn
+	// buf holds bytes read but not yet returned; err is the error that
+	// ended the peek, returned once buf is drained.
+	buf []byte
+	err error
+	// pending is a Read into pendBuf still in flight, nil once collected.
+	pending <-chan peekRead
+	pendBuf []byte
+}
+
+func (c *peekConn) Read(p []byte) (int, error) {
+	if len(c.buf) == 0 && c.pending != nil {
+		r := <-c.pending
+		c.buf, c.err, c.pending = c.pendBuf[:r.n], r.err, nil
+	}
+	if len(c.buf) > 0 {
+		n := copy(p, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,130 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeHTTPService answers every connection with an HTTP status line and
+// records what it was sent.
+func fakeHTTPService(t *testing.T, received *syncBuffer) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 512)
+				n, _ := c.Read(buf)
+				_, _ = received.Write(buf[:n])
+				_, _ = io.WriteString(c, "HTTP/1.0 200 OK\r\n\r\n")
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRun_loopbackSelfTest(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    int32
+		wantLog string
+	}{
+		{"round trip", loopbackBridge, "relay loopback self-test OK"},
+		{"misrouted", loopbackEcho, "WARNING: relay loopback self-test failed: unexpected answer"},
+		{"refused", loopbackRefuse, "relay loopback self-test skipped"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs syncBuffer
+			log.SetOutput(&logs)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+			client, relay := newTestRelay(t)
+			relay.loopback.Store(tc.mode)
+			var received syncBuffer
+			local := fakeHTTPService(t, &received)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() {
+				done <- Run(ctx, &Config{
+					Client:        client,
+					TunnelPort:    9000,
+					LocalAddr:     local,
+					SelfTest:      true,
+					HeartbeatFunc: func(context.Context) (bool, error) { return true, nil },
+				})
+			}()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for !strings.Contains(logs.String(), tc.wantLog) {
+				if time.Now().After(deadline) {
+					t.Fatalf("no %q in log:\n%s", tc.wantLog, logs.String())
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if strings.Contains(received.String(), loopbackPrefix) {
+				t.Errorf("self-test token reached the local service: %q", received.String())
+			}
+			cancel()
+			<-done
+		})
+	}
+}
+
+func TestAnswerLoopback_replaysOtherTraffic(t *testing.T) {
+	p := &localProxy{}
+	client, relaySide := net.Pipe()
+	defer client.Close()
+
+	msg := "GET / HTTP/1.1\r\nHost: example\r\n\r\n"
+	go func() { _, _ = io.WriteString(client, msg) }()
+	conn, answered := p.answerLoopback(relaySide, "0123456789abcdef")
+	if answered {
+		t.Fatal("ordinary request taken for the self-test")
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read replayed request: %v", err)
+	}
+	if string(got) != msg {
+		t.Errorf("replayed %q, want %q", got, msg)
+	}
+}
+
+func TestAnswerLoopback_handsOverSilentConnection(t *testing.T) {
+	old := loopbackPeek
+	loopbackPeek = 20 * time.Millisecond
+	t.Cleanup(func() { loopbackPeek = old })
+
+	p := &localProxy{}
+	client, relaySide := net.Pipe()
+	defer client.Close()
+
+	// The visitor waits for the service to speak first.
+	conn, answered := p.answerLoopback(relaySide, "0123456789abcdef")
+	if answered {
+		t.Fatal("silent connection taken for the self-test")
+	}
+	go func() { _, _ = io.WriteString(client, "late") }()
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "late" {
+		t.Errorf("read after hand-over: %q, %v", got, err)
+	}
+}
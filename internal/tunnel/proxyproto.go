@@ -0,0 +1,83 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// PROXY protocol versions for Config.LocalProxyProtocol.
+const (
+	ProxyProtocolOff = 0
+	ProxyProtocolV1  = 1
+	ProxyProtocolV2  = 2
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ParseProxyProtocol parses a PROXY protocol setting: "" or "off", "v1"
+// or "v2".
+func ParseProxyProtocol(s string) (int, error) {
+	switch s {
+	case "", "off":
+		return ProxyProtocolOff, nil
+	case "v1", "1":
+		return ProxyProtocolV1, nil
+	case "v2", "2":
+		return ProxyProtocolV2, nil
+	default:
+		return 0, fmt.Errorf("unsupported PROXY protocol version %q (want v1 or v2)", s)
+	}
+}
+
+// proxyHeader returns the PROXY protocol header announcing a connection
+// from src to dst. src is the visitor address the relay reported in the
+// forwarded-tcpip channel. When it is missing or loopback — the relay did
+// not know the real client — the header carries the protocol's "unknown"
+// placeholder (UNKNOWN in v1, LOCAL in v2) so the local service falls
+// back to the socket address instead of logging a bogus one.
+func proxyHeader(version int, src, dst net.Addr) []byte {
+	s, sok := src.(*net.TCPAddr)
+	d, dok := dst.(*net.TCPAddr)
+	known := sok && dok && s.IP != nil && d.IP != nil && !s.IP.IsLoopback() && !s.IP.IsUnspecified()
+
+	if version == ProxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		if s.IP.To4() != nil && d.IP.To4() != nil {
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", s.IP, d.IP, s.Port, d.Port))
+		}
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(s.IP), ipv6String(d.IP), s.Port, d.Port))
+	}
+
+	hdr := append([]byte(nil), proxyV2Signature...)
+	if !known {
+		// Version 2, LOCAL command, unspecified family, no addresses.
+		return append(hdr, 0x20, 0x00, 0x00, 0x00)
+	}
+	var addrs []byte
+	family := byte(0x11) // TCP over IPv4
+	if sIP, dIP := s.IP.To4(), d.IP.To4(); sIP != nil && dIP != nil {
+		addrs = append(append(addrs, sIP...), dIP...)
+	} else {
+		family = 0x21 // TCP over IPv6
+		addrs = append(append(addrs, s.IP.To16()...), d.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(s.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(d.Port))
+
+	hdr = append(hdr, 0x21, family) // version 2, PROXY command
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+// ipv6String formats ip for a TCP6 header, writing IPv4 addresses in their
+// IPv4-mapped form since both addresses must share a family.
+func ipv6String(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return "::ffff:" + v4.String()
+	}
+	return ip.String()
+}
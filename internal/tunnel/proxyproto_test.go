@@ -0,0 +1,112 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyHeader_v1(t *testing.T) {
+	dst := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+	tests := []struct {
+		src  net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 50000}, "PROXY TCP4 203.0.113.9 127.0.0.1 50000 9000\r\n"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, "PROXY TCP6 2001:db8::1 ::ffff:127.0.0.1 443 9000\r\n"},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}, "PROXY UNKNOWN\r\n"},
+		{nil, "PROXY UNKNOWN\r\n"},
+	}
+	for _, tc := range tests {
+		if got := string(proxyHeader(ProxyProtocolV1, tc.src, dst)); got != tc.want {
+			t.Errorf("src %v: header=%q, want %q", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestProxyHeader_v2(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 50000}
+	dst := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+
+	got := proxyHeader(ProxyProtocolV2, src, dst)
+	want := append([]byte("\r\n\r\n\x00\r\nQUIT\n"),
+		0x21, 0x11, 0x00, 0x0c, // v2 PROXY, TCP4, 12 address bytes
+		203, 0, 113, 9, 127, 0, 0, 1,
+		0xc3, 0x50, 0x23, 0x28) // ports 50000, 9000
+	if !bytes.Equal(got, want) {
+		t.Errorf("header=% x\nwant    % x", got, want)
+	}
+
+	local := proxyHeader(ProxyProtocolV2, nil, dst)
+	if want := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20, 0x00, 0x00, 0x00); !bytes.Equal(local, want) {
+		t.Errorf("unknown source: header=% x, want LOCAL command % x", local, want)
+	}
+}
+
+func TestParseProxyProtocol(t *testing.T) {
+	for in, want := range map[string]int{"": ProxyProtocolOff, "off": ProxyProtocolOff, "v1": ProxyProtocolV1, "v2": ProxyProtocolV2} {
+		got, err := ParseProxyProtocol(in)
+		if err != nil || got != want {
+			t.Errorf("ParseProxyProtocol(%q)=%d, %v; want %d", in, got, err, want)
+		}
+	}
+	if _, err := ParseProxyProtocol("v3"); err == nil {
+		t.Error("expected error for unsupported version")
+	}
+}
+
+func TestRun_writesProxyHeaderToLocalService(t *testing.T) {
+	client, relay := newTestRelay(t)
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer local.Close()
+	lines := make(chan string, 1)
+	go func() {
+		c, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		lines <- line
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up := make(chan struct{})
+	go Run(ctx, &Config{
+		Client:             client,
+		TunnelPort:         9000,
+		LocalAddr:          local.Addr().String(),
+		LocalProxyProtocol: ProxyProtocolV1,
+		HeartbeatFunc:      func(context.Context) (bool, error) { return true, nil },
+		OnUp:               func(UpInfo) { close(up) },
+	})
+	select {
+	case <-up:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel did not come up")
+	}
+
+	// The test relay reports the visitor as 203.0.113.9:50000.
+	ch, err := relay.openForwarded(<-relay.forwards)
+	if err != nil {
+		t.Fatalf("open forwarded channel: %v", err)
+	}
+	defer ch.Close()
+
+	select {
+	case line := <-lines:
+		if want := "PROXY TCP4 203.0.113.9 127.0.0.1 50000 9000\r\n"; line != want {
+			t.Errorf("local service read %q, want %q", line, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("local service received no PROXY header")
+	}
+}
@@ -0,0 +1,219 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrLocalRelay is returned in strict mode when the relay host resolves to
+// this machine, which would loop the tunnel back onto itself.
+var ErrLocalRelay = errors.New("relay host resolves to a local address")
+
+// Resolver looks up the addresses of a relay host. *net.Resolver satisfies it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// rttMaxAge is how long a latency sample orders relays; after that the
+// address counts as unmeasured and is probed again.
+const rttMaxAge = 10 * time.Minute
+
+// relayProbeTimeout bounds the connect probes to unmeasured relay
+// addresses.
+const relayProbeTimeout = 2 * time.Second
+
+// AddrTracker remembers relay IPs that failed recently so later reconnects
+// prefer a sibling A record, and the latency last measured to each so the
+// fastest healthy relay can be preferred. Share one tracker across Run
+// calls.
+type AddrTracker struct {
+	mu       sync.Mutex
+	failures map[string]int
+	rtt      map[string]rttSample
+}
+
+type rttSample struct {
+	d  time.Duration
+	at time.Time
+}
+
+func NewAddrTracker() *AddrTracker {
+	return &AddrTracker{failures: make(map[string]int), rtt: make(map[string]rttSample)}
+}
+
+// latency returns the RTT sample for addr, zero if there is none younger
+// than rttMaxAge. t.mu must be held.
+func (t *AddrTracker) latency(addr string) time.Duration {
+	s := t.rtt[addr]
+	if time.Since(s.at) > rttMaxAge {
+		return 0
+	}
+	return s.d
+}
+
+// order returns addrs sorted by consecutive failure count. With byLatency,
+// equals are further sorted by their last measured RTT, addresses not
+// measured recently last; otherwise, and among unmeasured addresses,
+// resolver order is kept. A nil tracker leaves the order unchanged.
+func (t *AddrTracker) order(addrs []string, byLatency bool) []string {
+	out := append([]string(nil), addrs...)
+	if t == nil {
+		return out
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sort.SliceStable(out, func(i, j int) bool {
+		if fi, fj := t.failures[out[i]], t.failures[out[j]]; fi != fj || !byLatency {
+			return fi < fj
+		}
+		ri, rj := t.latency(out[i]), t.latency(out[j])
+		return ri > 0 && (rj == 0 || ri < rj)
+	})
+	return out
+}
+
+// unmeasured returns the addrs without a latency sample younger than
+// rttMaxAge. A nil tracker returns none.
+func (t *AddrTracker) unmeasured(addrs []string) []string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []string
+	for _, a := range addrs {
+		if t.latency(a) == 0 {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// recordRTT notes the latency measured to addr. Zero is ignored.
+func (t *AddrTracker) recordRTT(addr string, d time.Duration) {
+	if t == nil || d <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rtt[addr] = rttSample{d: d, at: time.Now()}
+}
+
+// probeRelays connects to each of addrs in parallel and records the connect
+// time, or a failure, in t, so relays the agent hasn't used yet get a
+// latency to be ordered by. The connections are closed right away.
+func probeRelays(ctx context.Context, addrs []string, port int, timeout time.Duration, t *AddrTracker) {
+	var wg sync.WaitGroup
+	for _, ip := range addrs {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			start := time.Now()
+			conn, err := dialTCP(ctx, timeout, net.JoinHostPort(ip, strconv.Itoa(port)))
+			if err != nil {
+				t.record(ip, false)
+				return
+			}
+			t.recordRTT(ip, time.Since(start))
+			conn.Close()
+		}(ip)
+	}
+	wg.Wait()
+}
+
+// record notes the outcome of a connection attempt to addr.
+func (t *AddrTracker) record(addr string, ok bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ok {
+		delete(t.failures, addr)
+	} else {
+		t.failures[addr]++
+	}
+}
+
+// resolveRelay resolves host afresh and returns its addresses, most
+// preferred first (see AddrTracker.order).
+func resolveRelay(ctx context.Context, r Resolver, host string, t *AddrTracker, byLatency bool) ([]string, error) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	addrs, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve relay %s: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("resolve relay %s: no addresses", host)
+	}
+	return t.order(addrs, byLatency), nil
+}
+
+// checkRelayRemote flags relay addresses that point back at this machine:
+// loopback, unspecified, or assigned to a local interface. It logs a warning
+// and returns nil unless strict is set.
+func checkRelayRemote(host string, addrs []string, strict bool) error {
+	local := localIPs()
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			continue
+		}
+		if !ip.IsLoopback() && !ip.IsUnspecified() && !local[ip.String()] {
+			continue
+		}
+		if strict {
+			return fmt.Errorf("%w: %s → %s", ErrLocalRelay, host, a)
+		}
+		log.Printf("WARNING: relay %s resolves to local address %s — the relay should be remote", host, a)
+		return nil
+	}
+	return nil
+}
+
+// localIPs returns the addresses assigned to this host's interfaces.
+func localIPs() map[string]bool {
+	out := make(map[string]bool)
+	ifAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return out
+	}
+	for _, a := range ifAddrs {
+		if n, ok := a.(*net.IPNet); ok {
+			out[n.IP.String()] = true
+		}
+	}
+	return out
+}
+
+// resolveSRV looks up _ssh._tcp.<host> and returns the preferred target and
+// port. Records are ordered by priority and weight by the resolver.
+func resolveSRV(ctx context.Context, r Resolver, host string) (string, int, error) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	_, srvs, err := r.LookupSRV(ctx, "ssh", "tcp", host)
+	if err != nil {
+		return "", 0, fmt.Errorf("SRV lookup _ssh._tcp.%s: %w", host, err)
+	}
+	for _, s := range srvs {
+		target := strings.TrimSuffix(s.Target, ".")
+		if target == "" || s.Port == 0 {
+			log.Printf("WARNING: ignoring invalid SRV record for %s: target=%q port=%d", host, s.Target, s.Port)
+			continue
+		}
+		return target, int(s.Port), nil
+	}
+	return "", 0, fmt.Errorf("SRV lookup _ssh._tcp.%s: no usable records", host)
+}
@@ -0,0 +1,317 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// stubResolver returns the next address set on every lookup, so tests can
+// simulate a DNS record changing between reconnects.
+type stubResolver struct {
+	answers [][]string
+	calls   int
+	err     error
+	srv     []*net.SRV
+}
+
+func (r *stubResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	i := r.calls
+	if i >= len(r.answers) {
+		i = len(r.answers) - 1
+	}
+	r.calls++
+	return r.answers[i], nil
+}
+
+func (r *stubResolver) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	if service != "ssh" || proto != "tcp" {
+		return "", nil, errors.New("unexpected SRV query")
+	}
+	return "_ssh._tcp." + name + ".", r.srv, nil
+}
+
+func TestResolveRelay_reResolvesEachCall(t *testing.T) {
+	r := &stubResolver{answers: [][]string{{"10.0.0.1"}, {"10.0.0.2"}}}
+
+	first, err := resolveRelay(context.Background(), r, "relay.example.com", nil, true)
+	if err != nil {
+		t.Fatalf("first resolve: %v", err)
+	}
+	second, err := resolveRelay(context.Background(), r, "relay.example.com", nil, true)
+	if err != nil {
+		t.Fatalf("second resolve: %v", err)
+	}
+
+	if first[0] != "10.0.0.1" || second[0] != "10.0.0.2" {
+		t.Errorf("expected changed DNS answer to be picked up, got %v then %v", first, second)
+	}
+	if r.calls != 2 {
+		t.Errorf("resolver called %d times, want 2 (no caching)", r.calls)
+	}
+}
+
+func TestResolveRelay_prefersAddressWithoutFailures(t *testing.T) {
+	r := &stubResolver{answers: [][]string{{"10.0.0.1", "10.0.0.2", "10.0.0.3"}}}
+	tr := NewAddrTracker()
+	tr.record("10.0.0.1", false)
+	tr.record("10.0.0.1", false)
+	tr.record("10.0.0.2", false)
+
+	got, err := resolveRelay(context.Background(), r, "relay.example.com", tr, true)
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	want := []string{"10.0.0.3", "10.0.0.2", "10.0.0.1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("order=%v, want %v", got, want)
+	}
+
+	tr.record("10.0.0.1", true)
+	got, _ = resolveRelay(context.Background(), r, "relay.example.com", tr, true)
+	if got[0] != "10.0.0.1" {
+		t.Errorf("after success, 10.0.0.1 should regain its resolver position, got %v", got)
+	}
+}
+
+func TestResolveRelay_prefersLowestLatency(t *testing.T) {
+	// Measure two relays the way a tunnel does, via keepalive round trips.
+	tr := NewAddrTracker()
+	for ip, delay := range map[string]time.Duration{"10.0.0.1": 60 * time.Millisecond, "10.0.0.2": 5 * time.Millisecond} {
+		client, relay := newTestRelay(t)
+		relay.keepaliveDelay.Store(int64(delay))
+		rtt := NewRTT()
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		if err := runKeepalive(ctx, client, 10*time.Millisecond, 0, rtt); err != nil {
+			t.Fatalf("runKeepalive: %v", err)
+		}
+		cancel()
+		tr.recordRTT(ip, rtt.Smoothed())
+	}
+	r := &stubResolver{answers: [][]string{{"10.0.0.1", "10.0.0.2", "10.0.0.3"}}}
+
+	got, err := resolveRelay(context.Background(), r, "relay.example.com", tr, true)
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if want := []string{"10.0.0.2", "10.0.0.1", "10.0.0.3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order=%v, want the faster relay first: %v", got, want)
+	}
+
+	// Strict ordering ignores latency.
+	got, _ = resolveRelay(context.Background(), r, "relay.example.com", tr, false)
+	if got[0] != "10.0.0.1" {
+		t.Errorf("strict order=%v, want resolver order", got)
+	}
+
+	// A failing relay loses its place however fast it was.
+	tr.record("10.0.0.2", false)
+	got, _ = resolveRelay(context.Background(), r, "relay.example.com", tr, true)
+	if got[0] != "10.0.0.1" {
+		t.Errorf("order=%v, want the failing fast relay demoted", got)
+	}
+}
+
+func TestResolveRelay_errors(t *testing.T) {
+	if _, err := resolveRelay(context.Background(), &stubResolver{err: errors.New("nxdomain")}, "relay", nil, true); err == nil {
+		t.Error("expected lookup error to propagate")
+	}
+	if _, err := resolveRelay(context.Background(), &stubResolver{answers: [][]string{{}}}, "relay", nil, true); err == nil {
+		t.Error("expected error for empty answer")
+	}
+}
+
+func TestDialFirst_skipsDeadAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	// Nothing listens on 127.0.0.2 at this port, so it refuses connections.
+	tr := NewAddrTracker()
+	conn, ip, err := dialFirst(context.Background(), []string{"127.0.0.2", "127.0.0.1"}, port, time.Second, tr)
+	if err != nil {
+		t.Fatalf("dialFirst: %v", err)
+	}
+	conn.Close()
+
+	if ip != "127.0.0.1" {
+		t.Errorf("connected via %s, want 127.0.0.1", ip)
+	}
+	if got := tr.order([]string{"127.0.0.2", "127.0.0.1"}, false); got[0] != "127.0.0.1" {
+		t.Errorf("dead address should be recorded as failing, order=%v", got)
+	}
+}
+
+func TestDialFirst_allDead(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	if _, _, err := dialFirst(context.Background(), []string{"127.0.0.1", "127.0.0.2"}, port, time.Second, nil); err == nil {
+		t.Fatal("expected error when every address is dead")
+	}
+}
+
+func TestCheckRelayRemote_loopback(t *testing.T) {
+	if err := checkRelayRemote("127.0.0.1", []string{"127.0.0.1"}, false); err != nil {
+		t.Errorf("non-strict mode must only warn, got %v", err)
+	}
+	err := checkRelayRemote("127.0.0.1", []string{"127.0.0.1"}, true)
+	if !errors.Is(err, ErrLocalRelay) {
+		t.Errorf("strict mode: got %v, want ErrLocalRelay", err)
+	}
+	if err := checkRelayRemote("relay.example.com", []string{"203.0.113.7"}, true); err != nil {
+		t.Errorf("remote address rejected: %v", err)
+	}
+}
+
+func TestDialRelay_strictRefusesLoopbackRelay(t *testing.T) {
+	cfg := &Config{
+		Host:             "127.0.0.1",
+		Port:             22,
+		Resolver:         &stubResolver{answers: [][]string{{"127.0.0.1"}}},
+		StrictRelayCheck: true,
+	}
+	_, err := dialRelay(context.Background(), cfg, "127.0.0.1:22", &ssh.ClientConfig{Timeout: time.Second}, nil)
+	if !errors.Is(err, ErrLocalRelay) {
+		t.Fatalf("dialRelay: got %v, want ErrLocalRelay", err)
+	}
+}
+
+func TestDialRelay_preflightFailsFastOnClosedPort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	cfg := &Config{
+		Host:             "relay.example.com",
+		Port:             port,
+		Resolver:         &stubResolver{answers: [][]string{{"127.0.0.1"}}},
+		PreflightTimeout: 500 * time.Millisecond,
+	}
+	start := time.Now()
+	_, err = dialRelay(context.Background(), cfg, fmt.Sprintf("relay.example.com:%d", port), &ssh.ClientConfig{Timeout: 30 * time.Second}, nil)
+	if !errors.Is(err, ErrRelayUnreachable) || !strings.Contains(err.Error(), "relay SSH port") {
+		t.Fatalf("dialRelay: got %v, want a relay SSH port unreachable error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("failure took %s, want well under the SSH timeout", elapsed)
+	}
+}
+
+func TestDialRelay_probesUnmeasuredRelaysAndPrefersFastest(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// Both relay addresses lead to the listener; the second is faster.
+	delays := map[string]time.Duration{"10.0.0.1": 60 * time.Millisecond, "10.0.0.2": 5 * time.Millisecond}
+	var mu sync.Mutex
+	var dialed []string
+	orig := dialTCP
+	t.Cleanup(func() { dialTCP = orig })
+	dialTCP = func(ctx context.Context, timeout time.Duration, address string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(address)
+		mu.Lock()
+		dialed = append(dialed, host)
+		mu.Unlock()
+		time.Sleep(delays[host])
+		return orig(ctx, timeout, ln.Addr().String())
+	}
+	takeDialed := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		d := dialed
+		dialed = nil
+		return d
+	}
+
+	cfg := &Config{
+		Host:     "relay.example.com",
+		Port:     22,
+		Resolver: &stubResolver{answers: [][]string{{"10.0.0.1", "10.0.0.2"}}},
+		Addrs:    NewAddrTracker(),
+	}
+	clientCfg := &ssh.ClientConfig{Timeout: time.Second, HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+	// The handshake fails against the bare listener; only the address
+	// dialed for it matters.
+	_, _ = dialRelay(context.Background(), cfg, "relay.example.com:22", clientCfg, nil)
+	if got := takeDialed(); len(got) != 3 || got[2] != "10.0.0.2" {
+		t.Errorf("dials=%v, want both addresses probed, then the faster 10.0.0.2", got)
+	}
+
+	// Both are measured now, so the next reconnect goes straight to the
+	// faster one.
+	_, _ = dialRelay(context.Background(), cfg, "relay.example.com:22", clientCfg, nil)
+	if got := takeDialed(); !reflect.DeepEqual(got, []string{"10.0.0.2"}) {
+		t.Errorf("dials=%v, want only 10.0.0.2", got)
+	}
+
+	// Strict ordering dials in resolver order without probing.
+	cfg.Addrs, cfg.StrictRelayOrder = NewAddrTracker(), true
+	_, _ = dialRelay(context.Background(), cfg, "relay.example.com:22", clientCfg, nil)
+	if got := takeDialed(); !reflect.DeepEqual(got, []string{"10.0.0.1"}) {
+		t.Errorf("strict dials=%v, want only 10.0.0.1", got)
+	}
+}
+
+func TestResolveSRV(t *testing.T) {
+	r := &stubResolver{srv: []*net.SRV{
+		{Target: ".", Port: 22},
+		{Target: "ssh1.relay.example.com.", Port: 2222, Priority: 10},
+	}}
+	host, port, err := resolveSRV(context.Background(), r, "relay.example.com")
+	if err != nil {
+		t.Fatalf("resolveSRV: %v", err)
+	}
+	if host != "ssh1.relay.example.com" || port != 2222 {
+		t.Errorf("got %s:%d, want ssh1.relay.example.com:2222", host, port)
+	}
+
+	if _, _, err := resolveSRV(context.Background(), &stubResolver{}, "relay.example.com"); err == nil {
+		t.Error("expected error when no SRV records exist")
+	}
+}
@@ -0,0 +1,57 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// rttAlpha is the weight of a new sample in the smoothed RTT, as in TCP's
+// SRTT (RFC 6298).
+const rttAlpha = 0.125
+
+// RTT tracks the round-trip time of SSH keepalive requests to the relay as
+// an exponentially weighted moving average. A nil *RTT is valid and
+// records nothing.
+type RTT struct {
+	mu       sync.Mutex
+	smoothed time.Duration
+}
+
+func NewRTT() *RTT {
+	return &RTT{}
+}
+
+// observe folds one measured round trip into the average. The first
+// sample is taken as is.
+func (r *RTT) observe(d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.smoothed == 0 {
+		r.smoothed = d
+		return
+	}
+	r.smoothed += time.Duration(rttAlpha * float64(d-r.smoothed))
+}
+
+// Smoothed returns the current average, or zero before the first sample.
+func (r *RTT) Smoothed() time.Duration {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.smoothed
+}
+
+// Reset discards the average, e.g. when connecting to a different relay.
+func (r *RTT) Reset() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.smoothed = 0
+}
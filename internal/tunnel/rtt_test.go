@@ -0,0 +1,44 @@
+package tunnel
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRTT_smoothing(t *testing.T) {
+	var nilRTT *RTT
+	nilRTT.observe(time.Second)
+	if nilRTT.Smoothed() != 0 {
+		t.Error("nil RTT reported a value")
+	}
+
+	r := NewRTT()
+	r.observe(100 * time.Millisecond)
+	if got := r.Smoothed(); got != 100*time.Millisecond {
+		t.Fatalf("first sample: %s, want 100ms", got)
+	}
+	// One outlier moves the average by only an eighth of the difference.
+	r.observe(900 * time.Millisecond)
+	if got := r.Smoothed(); got != 200*time.Millisecond {
+		t.Errorf("after outlier: %s, want 200ms", got)
+	}
+}
+
+func TestRunKeepalive_measuresRelayLatency(t *testing.T) {
+	client, relay := newTestRelay(t)
+	const delay = 50 * time.Millisecond
+	relay.keepaliveDelay.Store(int64(delay))
+
+	rtt := NewRTT()
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+	if err := runKeepalive(ctx, client, 10*time.Millisecond, 0, rtt); err != nil {
+		t.Fatalf("runKeepalive: %v", err)
+	}
+
+	got := rtt.Smoothed()
+	if got < delay || got > delay+100*time.Millisecond {
+		t.Errorf("smoothed RTT %s, want about %s", got, delay)
+	}
+}
@@ -0,0 +1,45 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHHeartbeatRequest is the SSH global request type carrying a heartbeat
+// to the relay, which forwards it to the control plane. A relay that
+// doesn't know it replies false.
+const SSHHeartbeatRequest = "heartbeat@smarthomeentry.com"
+
+// DefaultSSHHeartbeatAfter is how many consecutive heartbeat failures
+// switch to the SSH fallback.
+const DefaultSSHHeartbeatAfter = 3
+
+// ErrSSHHeartbeatRefused means the relay declined an SSH heartbeat,
+// typically because it doesn't support forwarding them.
+var ErrSSHHeartbeatRefused = errors.New("relay refused the SSH heartbeat")
+
+// sendSSHHeartbeat sends the payload built by payload as an
+// SSHHeartbeatRequest and waits for the relay's reply until ctx is done.
+func sendSSHHeartbeat(ctx context.Context, client *ssh.Client, payload func(context.Context) ([]byte, error)) error {
+	body, err := payload(ctx)
+	if err != nil {
+		return fmt.Errorf("build SSH heartbeat: %w", err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		ok, _, err := client.SendRequest(SSHHeartbeatRequest, true, body)
+		if err == nil && !ok {
+			err = ErrSSHHeartbeatRefused
+		}
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,57 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRun_sshHeartbeatFallback(t *testing.T) {
+	client, relay := newTestRelay(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var httpsCalls atomic.Int32
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, &Config{
+			Client:            client,
+			TunnelPort:        9000,
+			HeartbeatInterval: 20 * time.Millisecond,
+			HeartbeatFunc: func(context.Context) (bool, error) {
+				httpsCalls.Add(1)
+				return true, errors.New("control plane unreachable")
+			},
+			SSHHeartbeat:      func(context.Context) ([]byte, error) { return []byte(`{"schema_version":2}`), nil },
+			SSHHeartbeatAfter: 2,
+		})
+	}()
+
+	select {
+	case payload := <-relay.sshHeartbeats:
+		if string(payload) != `{"schema_version":2}` {
+			t.Errorf("SSH heartbeat payload=%q", payload)
+		}
+		if n := httpsCalls.Load(); n < 2 {
+			t.Errorf("fallback after %d HTTPS heartbeats, want at least 2", n)
+		}
+	case err := <-done:
+		t.Fatalf("Run returned: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no SSH heartbeat reached the relay")
+	}
+}
+
+func TestSendSSHHeartbeat_refused(t *testing.T) {
+	client, relay := newTestRelay(t)
+	relay.refuseHeartbeats.Store(true)
+
+	err := sendSSHHeartbeat(context.Background(), client, func(context.Context) ([]byte, error) {
+		return []byte("{}"), nil
+	})
+	if !errors.Is(err, ErrSSHHeartbeatRefused) {
+		t.Errorf("got %v, want ErrSSHHeartbeatRefused", err)
+	}
+}
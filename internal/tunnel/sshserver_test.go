@@ -0,0 +1,225 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testRelay is a minimal in-process SSH server standing in for the relay.
+// It accepts any client, grants tcpip-forward requests and can open
+// forwarded-tcpip channels back to the client as if a visitor had connected
+// to the forwarded port.
+type testRelay struct {
+	conn     *ssh.ServerConn
+	forwards chan relayForward
+	// bindPort, if set, is the port the relay binds instead of the one
+	// requested, like a relay that remaps forwards. As RFC 4254 prescribes,
+	// the reply only reports it when port 0 was requested; channels opened
+	// for the forward carry it.
+	bindPort atomic.Uint32
+	// denyForwards refuses every tcpip-forward request, like a relay whose
+	// policy restricts the ports a user may forward.
+	denyForwards atomic.Bool
+	// keepaliveDelay delays replies to keepalive requests, simulating
+	// network latency.
+	keepaliveDelay atomic.Int64
+	// keepalives receives the arrival time of each keepalive request; a
+	// full channel drops them.
+	keepalives chan time.Time
+	// sshHeartbeats receives the payload of each SSH heartbeat request,
+	// which the relay accepts unless refuseHeartbeats is set.
+	sshHeartbeats    chan []byte
+	refuseHeartbeats atomic.Bool
+	// loopback selects how direct-tcpip channels, i.e. connections the
+	// client opens from the relay's side, are handled; see the
+	// loopback* constants.
+	loopback atomic.Int32
+}
+
+// Values for testRelay.loopback.
+const (
+	// loopbackRefuse rejects direct-tcpip channels.
+	loopbackRefuse = iota
+	// loopbackBridge connects them to the client's forward for the
+	// destination port, as a relay does.
+	loopbackBridge
+	// loopbackEcho echoes them, like a relay routing the port to some
+	// other service.
+	loopbackEcho
+)
+
+// relayForward is a granted tcpip-forward request.
+type relayForward struct {
+	Addr string
+	Port uint32
+}
+
+// newTestRelay starts a relay on a loopback port and returns a client
+// connected to it. Both are closed when the test ends.
+func newTestRelay(t *testing.T) (*ssh.Client, *testRelay) {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate host key: %v", err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("host signer: %v", err)
+	}
+	srvCfg := &ssh.ServerConfig{NoClientAuth: true}
+	srvCfg.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	relay := &testRelay{forwards: make(chan relayForward, 4), keepalives: make(chan time.Time, 64), sshHeartbeats: make(chan []byte, 4)}
+	ready := make(chan error, 1)
+	go func() {
+		nc, err := ln.Accept()
+		if err != nil {
+			ready <- err
+			return
+		}
+		conn, chans, reqs, err := ssh.NewServerConn(nc, srvCfg)
+		if err != nil {
+			ready <- err
+			return
+		}
+		relay.conn = conn
+		ready <- nil
+		go func() {
+			for nc := range chans {
+				if nc.ChannelType() == "direct-tcpip" && relay.loopback.Load() != loopbackRefuse {
+					go relay.serveLoopback(nc)
+					continue
+				}
+				_ = nc.Reject(ssh.Prohibited, "no channels accepted by test relay")
+			}
+		}()
+		relay.serveGlobal(reqs)
+	}()
+
+	client, err := ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{
+		User:            "agent",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("dial test relay: %v", err)
+	}
+	if err := <-ready; err != nil {
+		t.Fatalf("test relay handshake: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		relay.conn.Close()
+	})
+	return client, relay
+}
+
+func (r *testRelay) serveGlobal(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			var fwd relayForward
+			if err := ssh.Unmarshal(req.Payload, &fwd); err != nil || r.denyForwards.Load() {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			requested := fwd.Port
+			if p := r.bindPort.Load(); p != 0 {
+				fwd.Port = p
+			}
+			var reply []byte
+			if requested == 0 {
+				reply = ssh.Marshal(struct{ Port uint32 }{fwd.Port})
+			}
+			_ = req.Reply(true, reply)
+			r.forwards <- fwd
+		case "cancel-tcpip-forward":
+			_ = req.Reply(true, nil)
+		case SSHHeartbeatRequest:
+			select {
+			case r.sshHeartbeats <- req.Payload:
+			default:
+			}
+			_ = req.Reply(!r.refuseHeartbeats.Load(), nil)
+		default:
+			if req.Type == "keepalive@openssh.com" {
+				select {
+				case r.keepalives <- time.Now():
+				default:
+				}
+				time.Sleep(time.Duration(r.keepaliveDelay.Load()))
+			}
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// serveLoopback handles a direct-tcpip channel according to r.loopback.
+func (r *testRelay) serveLoopback(nc ssh.NewChannel) {
+	var dest struct {
+		Addr       string
+		Port       uint32
+		OriginAddr string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &dest); err != nil {
+		_ = nc.Reject(ssh.ConnectionFailed, "malformed direct-tcpip payload")
+		return
+	}
+	var fwd ssh.Channel
+	if r.loopback.Load() == loopbackBridge {
+		var err error
+		if fwd, err = r.openForwarded(relayForward{Addr: dest.Addr, Port: dest.Port}); err != nil {
+			_ = nc.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+		defer fwd.Close()
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	if fwd == nil {
+		_, _ = io.Copy(ch, ch)
+		return
+	}
+	go func() {
+		_, _ = io.Copy(fwd, ch)
+		_ = fwd.CloseWrite()
+	}()
+	_, _ = io.Copy(ch, fwd)
+}
+
+// openForwarded opens a forwarded-tcpip channel for fwd, as the relay does
+// when a visitor connects to the forwarded port.
+func (r *testRelay) openForwarded(fwd relayForward) (ssh.Channel, error) {
+	payload := ssh.Marshal(struct {
+		Addr       string
+		Port       uint32
+		OriginAddr string
+		OriginPort uint32
+	}{fwd.Addr, fwd.Port, "203.0.113.9", 50000})
+	ch, reqs, err := r.conn.OpenChannel("forwarded-tcpip", payload)
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return ch, nil
+}
@@ -1,27 +1,80 @@
 package tunnel
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/smarthomeentry/agent/internal/atomicfile"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 const (
-	keepAliveInterval = 30 * time.Second
-	keepAliveTimeout  = 10 * time.Second
-	knownHostsPath    = "/etc/smarthomeentry/known_hosts"
+	keepAliveInterval   = 30 * time.Second
+	keepAliveTimeout    = 10 * time.Second
+	DefaultTCPKeepAlive = 30 * time.Second
+	selfTestTimeout     = 10 * time.Second
+	localDialTimeout    = 5 * time.Second
+	// defaultHeartbeatInterval is how often HeartbeatFunc is called.
+	defaultHeartbeatInterval = 60 * time.Second
+	// DefaultHeartbeatTimeout bounds each HeartbeatFunc call, well under
+	// the API client's own 30s timeout.
+	DefaultHeartbeatTimeout = 15 * time.Second
+	// DefaultKeepAliveJitter spreads each keepalive period by up to ±10%
+	// so agents that connected together don't hit the relay in step.
+	DefaultKeepAliveJitter = 0.1
+	// maxKeepAliveJitter keeps the jittered period well above zero.
+	maxKeepAliveJitter = 0.5
 )
 
+// KnownHostsPath is where trusted relay host keys are stored.
+const KnownHostsPath = "/etc/smarthomeentry/known_hosts"
+
 var ErrInactive = errors.New("agent deactivated by server")
 
+// Relay connection failures, as classified by dialRelay. The original error
+// stays in the chain.
+var (
+	// ErrRelayUnreachable means no TCP connection or SSH handshake could be
+	// completed with the relay: a network problem.
+	ErrRelayUnreachable = errors.New("relay unreachable")
+	// ErrRelayAuth means the relay rejected the agent's SSH key.
+	ErrRelayAuth = errors.New("relay rejected the SSH key")
+	// ErrHostKeyMismatch means the relay presented a host key other than
+	// the one in known_hosts.
+	ErrHostKeyMismatch = errors.New("HOST KEY MISMATCH")
+	// ErrUnknownHostKey means the relay's host is not in known_hosts and
+	// trust on first use is disabled.
+	ErrUnknownHostKey = errors.New("relay host key not in known_hosts")
+)
+
+// ErrKeepalive is returned by Run when an SSH keepalive to the relay failed
+// or timed out.
+var ErrKeepalive = errors.New("keepalive")
+
+// ErrWatchdog is returned by Run when the tunnel saw neither a successful
+// heartbeat nor an accepted connection within Config.WatchdogWindow.
+var ErrWatchdog = errors.New("tunnel watchdog expired")
+
+// ErrNoFirstHeartbeat is returned by Run when no heartbeat succeeded within
+// Config.FirstHeartbeatWindow of the tunnel coming up.
+var ErrNoFirstHeartbeat = errors.New("no successful heartbeat after connect")
+
 type Config struct {
 	Host          string
 	Port          int
@@ -30,86 +83,456 @@ type Config struct {
 	PrivateKey    string
 	HeartbeatFunc func(ctx context.Context) (active bool, err error)
 	LocalAddr     string
+
+	// TCPKeepAlive is the TCP keepalive period set on both sides of every
+	// proxied connection. Zero selects DefaultTCPKeepAlive; negative disables.
+	TCPKeepAlive time.Duration
+
+	// Resolver resolves the relay host on every connect. Nil selects
+	// net.DefaultResolver.
+	Resolver Resolver
+	// Addrs carries relay IP failure and latency history across
+	// reconnects so a relay IP that keeps failing is tried after its
+	// siblings and, among healthy ones, the fastest is tried first. May
+	// be nil.
+	Addrs *AddrTracker
+	// PreflightTimeout, if positive, bounds the TCP connect to the relay's
+	// SSH port, so a relay that is down or firewalled fails fast with a
+	// clear error instead of waiting out the full SSH timeout. The
+	// connection is then reused for the handshake.
+	PreflightTimeout time.Duration
+	// StrictRelayOrder ignores latency and tries healthy relay IPs in
+	// resolver order. Otherwise addresses without a recent latency sample
+	// are probed with a TCP connect before ordering.
+	StrictRelayOrder bool
+
+	// MaxConnections caps concurrently proxied connections; relay
+	// connections beyond it are closed immediately. Zero means no limit
+	// beyond MaxTrackedConns.
+	MaxConnections int
+	// MaxTrackedConns bounds the connections tracked, and so served, at
+	// once regardless of MaxConnections. Zero selects
+	// DefaultMaxTrackedConns, negative leaves it unbounded.
+	MaxTrackedConns int
+	// DrainTimeout, if positive, is how long Run waits for proxied
+	// connections to finish once ctx is cancelled, after closing the
+	// forward so no new ones arrive. The SSH connection stays up
+	// meanwhile.
+	DrainTimeout time.Duration
+	// Stats counts accepted, rejected and failed connections. May be nil.
+	Stats *ConnStats
+	// Service names the local service this forward maps to. When set it
+	// tags the per-connection log lines, and Stats counts the service's
+	// traffic separately (see ConnStats.Services).
+	Service string
+
+	// SelfTest sends a synthetic HTTP request through the proxy path once the
+	// forward is established and logs whether the local service answered.
+	// It then sends a random token to the forwarded port from the relay's
+	// side and logs whether it came back to this agent, catching a relay
+	// that routes the port elsewhere.
+	SelfTest bool
+
+	// StrictRelayCheck refuses to connect when the relay host resolves to
+	// this machine. By default that case only logs a warning.
+	StrictRelayCheck bool
+
+	// StrictBind fails the tunnel with ErrBindMismatch when the first relay
+	// connection arrives on a port other than TunnelPort, showing the relay
+	// bound the reverse forward elsewhere. By default the mismatch only
+	// logs a warning.
+	StrictBind bool
+
+	// LocalTLS, if set, makes the agent speak TLS to the local service.
+	// LocalTLSServerName overrides the name used for SNI and certificate
+	// verification; it defaults to the host part of LocalAddr.
+	LocalTLS           *tls.Config
+	LocalTLSServerName string
+
+	// LocalProxyProtocol, if ProxyProtocolV1 or ProxyProtocolV2, prepends
+	// a PROXY protocol header carrying the visitor address reported by the
+	// relay to every local connection, ahead of any TLS handshake.
+	LocalProxyProtocol int
+
+	// ConnLogLimit caps per-connection log lines per minute; the number
+	// suppressed is summarised once the minute ends. Zero selects
+	// DefaultConnLogLimit, negative disables the limit.
+	ConnLogLimit int
+
+	// MaxKnownHosts caps the entries in the known_hosts file; the oldest
+	// are pruned when a new relay key is trusted. Zero selects
+	// DefaultMaxKnownHosts, negative disables pruning.
+	MaxKnownHosts int
+
+	// DisableTOFU rejects relays whose host key is not already in
+	// known_hosts instead of trusting and recording it on first use, so
+	// relay keys must be pre-provisioned.
+	DisableTOFU bool
+
+	// LogConnections logs the open and close of every proxied connection
+	// (subject to ConnLogLimit). Otherwise only connections that fail are
+	// logged, leaving the periodic summaries to show traffic.
+	LogConnections bool
+
+	// DebugForward logs the raw tcpip-forward request sent to the relay and
+	// its reply, for diagnosing relay-side forwarding quirks.
+	DebugForward bool
+
+	// DebugTimings logs how long each phase of bringing the tunnel up
+	// took, alongside the total reported in UpInfo.ConnectDuration.
+	DebugTimings bool
+
+	// RTT, if set, receives the round-trip time of every SSH keepalive.
+	RTT *RTT
+
+	// MaxConnRate tears the tunnel down with ErrConnFlood when the relay
+	// opens more than this many connections within a minute. Unlike
+	// MaxConnections it guards against a flooding relay rather than
+	// bounding load. Zero disables it.
+	MaxConnRate int
+
+	// ProxyBufferSize is the copy buffer size, per direction, of each
+	// proxied connection. Larger buffers cut syscalls on bulk streams such
+	// as cameras; smaller ones save memory with many connections. Zero
+	// selects DefaultProxyBufferSize.
+	ProxyBufferSize int
+
+	// LookupSRV resolves the relay endpoint from the _ssh._tcp.<Host> SRV
+	// record when Port is zero.
+	LookupSRV bool
+
+	// KeepAliveInterval is the SSH keepalive period. Zero selects
+	// keepAliveInterval.
+	KeepAliveInterval time.Duration
+	// KeepAliveJitter randomises each keepalive period by up to this
+	// fraction either way (capped at 0.5). Zero selects
+	// DefaultKeepAliveJitter, negative disables it.
+	KeepAliveJitter float64
+	// ProxyIdleTimeout closes proxied connections idle for this long. Zero
+	// leaves them open until either side closes.
+	ProxyIdleTimeout time.Duration
+
+	// HeartbeatInterval and HeartbeatTimeout set how often HeartbeatFunc
+	// runs and how long each call may take. Zero selects the defaults.
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+	// FirstHeartbeatDelay is how long after the tunnel comes up the first
+	// heartbeat is sent, so the control plane sees the agent online
+	// without waiting a full interval. Zero sends it immediately; negative
+	// waits one HeartbeatInterval.
+	FirstHeartbeatDelay time.Duration
+	// FirstHeartbeatWindow tears the tunnel down with ErrNoFirstHeartbeat
+	// when no heartbeat has succeeded this long after it came up, so a
+	// tunnel the control plane can't see isn't kept for long. Zero
+	// disables the check.
+	FirstHeartbeatWindow time.Duration
+	// SSHHeartbeat, if set, builds a heartbeat payload to send to the relay
+	// as an SSHHeartbeatRequest once SSHHeartbeatAfter consecutive
+	// HeartbeatFunc calls failed, for when the control plane is
+	// unreachable over HTTPS but the relay is not. A delivered SSH
+	// heartbeat counts as an active one. Zero SSHHeartbeatAfter selects
+	// DefaultSSHHeartbeatAfter.
+	SSHHeartbeat      func(ctx context.Context) ([]byte, error)
+	SSHHeartbeatAfter int
+	// InactiveHeartbeats is how many consecutive heartbeats must report
+	// the agent inactive before the tunnel is closed, so one spurious
+	// active=false doesn't disconnect users. Zero or one closes it on the
+	// first.
+	InactiveHeartbeats int
+
+	// WatchdogWindow tears the tunnel down when neither a heartbeat
+	// succeeds nor a connection is accepted for this long, as a safety net
+	// against wedged goroutines. It should span several heartbeat
+	// intervals. Zero disables the watchdog.
+	WatchdogWindow time.Duration
+
+	// Client, if set, is an already-established SSH connection to the relay
+	// used instead of dialling one, e.g. a connection shared by several
+	// tunnels. The caller owns it: Run neither closes it nor needs
+	// PrivateKey, Host or Port. Only the reverse forward is torn down on
+	// return.
+	Client *ssh.Client
+
+	// OnUp, if set, is called once the reverse forward is established.
+	OnUp func(UpInfo)
+
+	// LocalHealthInterval, if positive, probes the local service this
+	// often. While it is down the tunnel and heartbeats stay up but relay
+	// connections are closed immediately. OnLocalHealth, if set, is
+	// called whenever the local service goes down or comes back.
+	LocalHealthInterval time.Duration
+	OnLocalHealth       func(up bool)
+}
+
+// UpInfo describes an established tunnel, as passed to Config.OnUp.
+type UpInfo struct {
+	Relay    string // relay host:port as dialled
+	BindAddr string // relay-side address of the reverse forward
+	// HostKeyAlgo is the type of the host key the relay presented, e.g.
+	// "ssh-ed25519". Empty when Config.Client was supplied.
+	HostKeyAlgo string
+	// ConnectDuration is the time from the start of Run to the reverse
+	// forward being active.
+	ConnectDuration time.Duration
 }
 
 func Run(ctx context.Context, cfg *Config) error {
+	timer := newConnectTimer()
 	localAddr := cfg.LocalAddr
 	if localAddr == "" {
 		localAddr = "localhost:8080"
 	}
-
-	signer, err := ssh.ParsePrivateKey([]byte(cfg.PrivateKey))
-	if err != nil {
-		return fmt.Errorf("parse private key: %w", err)
+	tcpKeepAlive := cfg.TCPKeepAlive
+	if tcpKeepAlive == 0 {
+		tcpKeepAlive = DefaultTCPKeepAlive
 	}
-
-	hkc, err := buildHostKeyCallback(knownHostsPath)
-	if err != nil {
-		return fmt.Errorf("host key setup: %w", err)
+	keepAlive := cfg.KeepAliveInterval
+	if keepAlive <= 0 {
+		keepAlive = keepAliveInterval
+	}
+	keepAliveJitter := cfg.KeepAliveJitter
+	if keepAliveJitter == 0 {
+		keepAliveJitter = DefaultKeepAliveJitter
+	}
+	hbInterval := cfg.HeartbeatInterval
+	if hbInterval <= 0 {
+		hbInterval = defaultHeartbeatInterval
+	}
+	hbTimeout := cfg.HeartbeatTimeout
+	if hbTimeout <= 0 {
+		hbTimeout = DefaultHeartbeatTimeout
+	}
+	if cfg.WatchdogWindow > 0 && cfg.WatchdogWindow <= hbInterval {
+		log.Printf("WARNING: watchdog window %s is not longer than the heartbeat interval %s; "+
+			"the tunnel may be restarted while healthy", cfg.WatchdogWindow, hbInterval)
 	}
 
-	clientCfg := &ssh.ClientConfig{
-		User:            cfg.SSHUser,
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
-		HostKeyCallback: hkc,
-		Timeout:         30 * time.Second,
+	proxy := &localProxy{
+		addr:         localAddr,
+		tcpKeepAlive: tcpKeepAlive,
+		tls:          localTLSConfig(cfg.LocalTLS, cfg.LocalTLSServerName, localAddr),
+		idleTimeout:  cfg.ProxyIdleTimeout,
+		bufs:         bufferPoolFor(cfg.ProxyBufferSize),
+		proxyProto:   cfg.LocalProxyProtocol,
+		max:          cfg.MaxConnections,
+		conns:        connTracker{limit: cfg.MaxTrackedConns},
+		stats:        cfg.Stats,
+		logConns:     cfg.LogConnections,
+		service:      cfg.Service,
+		svc:          cfg.Stats.service(cfg.Service),
+	}
+	switch {
+	case cfg.ConnLogLimit == 0:
+		proxy.connLog = newLogLimiter(DefaultConnLogLimit, connLogWindow)
+	case cfg.ConnLogLimit > 0:
+		proxy.connLog = newLogLimiter(cfg.ConnLogLimit, connLogWindow)
 	}
 
-	relayAddr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
-	log.Printf("connecting to relay %s as user %q", relayAddr, cfg.SSHUser)
+	var relayAddr, hostKeyAlgo string
+	client := cfg.Client
+	if client != nil {
+		relayAddr = client.RemoteAddr().String()
+		log.Printf("using shared SSH connection to relay %s", relayAddr)
+	} else {
+		if cfg.Port == 0 {
+			if !cfg.LookupSRV {
+				return fmt.Errorf("relay %s: no SSH port configured and SRV lookup disabled", cfg.Host)
+			}
+			host, port, err := resolveSRV(ctx, cfg.Resolver, cfg.Host)
+			if err != nil {
+				return err
+			}
+			log.Printf("relay %s: SRV record points to %s:%d", cfg.Host, host, port)
+			c := *cfg
+			c.Host, c.Port = host, port
+			cfg = &c
+			timer.mark("srv")
+		}
 
-	client, err := ssh.Dial("tcp", relayAddr, clientCfg)
-	if err != nil {
-		return fmt.Errorf("dial relay %s: %w", relayAddr, err)
+		signer, err := parsePrivateKey([]byte(cfg.PrivateKey))
+		if err != nil {
+			return err
+		}
+
+		hkc, err := buildHostKeyCallback(KnownHostsPath, cfg.MaxKnownHosts, !cfg.DisableTOFU)
+		if err != nil {
+			return fmt.Errorf("host key setup: %w", err)
+		}
+
+		clientCfg := &ssh.ClientConfig{
+			User:            cfg.SSHUser,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: recordHostKeyType(hkc, &hostKeyAlgo),
+			Timeout:         30 * time.Second,
+		}
+
+		relayAddr = fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+		log.Printf("connecting to relay %s as user %q", relayAddr, cfg.SSHUser)
+
+		client, err = dialRelay(ctx, cfg, relayAddr, clientCfg, timer)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		if host, _, err := net.SplitHostPort(client.RemoteAddr().String()); err == nil {
+			// The keepalive average is the better latency figure for
+			// choosing the relay next time.
+			defer func() { cfg.Addrs.recordRTT(host, cfg.RTT.Smoothed()) }()
+		}
 	}
-	defer client.Close()
 
 	// Always bind to 127.0.0.1 — never 0.0.0.0.
 	bindAddr := fmt.Sprintf("127.0.0.1:%d", cfg.TunnelPort)
-	listener, err := client.Listen("tcp", bindAddr)
+	listener, err := listenForward(client, "127.0.0.1", cfg.TunnelPort, cfg.DebugForward)
 	if err != nil {
+		if errors.Is(err, ErrForwardDenied) {
+			log.Printf("WARNING: relay denied reverse-forward for port %d — check relay permissions", cfg.TunnelPort)
+		}
 		return fmt.Errorf("request reverse forward %s: %w", bindAddr, err)
 	}
 	defer listener.Close()
+	timer.mark("forward")
+	bindAddr = listener.Addr().String()
+
+	if cfg.SelfTest {
+		if err := selfTest(proxy); err != nil {
+			log.Printf("WARNING: proxy self-test failed: %v", err)
+		} else {
+			log.Printf("proxy self-test OK: %s answered through the proxy path", localAddr)
+		}
+	}
 
-	log.Printf("reverse tunnel active: relay %s → %s", bindAddr, localAddr)
+	connectDuration := timer.total()
+	log.Printf("reverse tunnel active: relay %s → %s", bindAddr, proxy.target())
+	if cfg.DebugTimings {
+		log.Printf("debug: tunnel established in %s (%s)", connectDuration.Round(time.Microsecond), timer)
+	}
+	if cfg.OnUp != nil {
+		cfg.OnUp(UpInfo{Relay: relayAddr, BindAddr: bindAddr, HostKeyAlgo: hostKeyAlgo, ConnectDuration: connectDuration})
+	}
 
 	tunnelCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	// An in-flight heartbeat may still be sending a final report on
+	// shutdown; wait for it so the process doesn't exit underneath it.
+	var hbWG sync.WaitGroup
+	defer func() {
+		cancel()
+		hbWG.Wait()
+	}()
+
+	tunnelErr := make(chan error, 4)
 
-	tunnelErr := make(chan error, 3)
+	// lastAlive is the time of the last successful heartbeat or accepted
+	// connection, as Unix nanoseconds, for the watchdog.
+	var lastAlive atomic.Int64
+	alive := func() { lastAlive.Store(time.Now().UnixNano()) }
+	alive()
+
+	// firstHB is closed by the first successful heartbeat.
+	firstHB := make(chan struct{})
+	var firstHBOnce sync.Once
+
+	go proxy.conns.run(tunnelCtx, connReconcileInterval)
+	if cfg.LocalHealthInterval > 0 {
+		go proxy.watchLocal(tunnelCtx, cfg.LocalHealthInterval, cfg.OnLocalHealth)
+	}
 
 	go func() {
-		if err := runKeepalive(tunnelCtx, client); err != nil {
+		if err := runKeepalive(tunnelCtx, client, keepAlive, keepAliveJitter, cfg.RTT); err != nil {
 			log.Printf("keepalive error: %v — treating connection as dead", err)
-			tunnelErr <- fmt.Errorf("keepalive: %w", err)
+			tunnelErr <- fmt.Errorf("%w: %w", ErrKeepalive, err)
 		}
 	}()
 
+	hbWG.Add(1)
 	go func() {
-		ticker := time.NewTicker(60 * time.Second)
-		defer ticker.Stop()
+		defer hbWG.Done()
+		first := cfg.FirstHeartbeatDelay
+		if first < 0 {
+			first = hbInterval
+		}
+		next := time.NewTimer(first)
+		defer next.Stop()
+		sshAfter := cfg.SSHHeartbeatAfter
+		if sshAfter <= 0 {
+			sshAfter = DefaultSSHHeartbeatAfter
+		}
+		inactive, failed := 0, 0
 		for {
 			select {
 			case <-tunnelCtx.Done():
 				return
-			case <-ticker.C:
-				active, err := cfg.HeartbeatFunc(tunnelCtx)
+			case <-next.C:
+				next.Reset(hbInterval)
+				active, err := heartbeatOnce(tunnelCtx, cfg.HeartbeatFunc, hbTimeout)
 				if err != nil {
+					failed++
 					log.Printf("heartbeat error: %v (keeping tunnel alive)", err)
-					continue
+					if cfg.SSHHeartbeat == nil || failed < sshAfter {
+						continue
+					}
+					if _, err := heartbeatOnce(tunnelCtx, func(ctx context.Context) (bool, error) {
+						return true, sendSSHHeartbeat(ctx, client, cfg.SSHHeartbeat)
+					}, hbTimeout); err != nil {
+						log.Printf("WARNING: SSH heartbeat fallback after %d failures: %v", failed, err)
+						continue
+					}
+					log.Printf("heartbeat delivered through relay %s over SSH after %d HTTPS failures", relayAddr, failed)
+					active = true
+				} else {
+					failed = 0
 				}
 				if !active {
+					inactive++
+					if inactive < cfg.InactiveHeartbeats {
+						log.Printf("control plane reports agent inactive (%d of %d) — keeping tunnel for now",
+							inactive, cfg.InactiveHeartbeats)
+						continue
+					}
 					log.Println("control plane deactivated agent — closing tunnel")
 					tunnelErr <- ErrInactive
 					return
 				}
+				inactive = 0
+				alive()
+				firstHBOnce.Do(func() { close(firstHB) })
 				log.Println("heartbeat OK")
 			}
 		}
 	}()
 
+	if cfg.FirstHeartbeatWindow > 0 {
+		go func() {
+			timer := time.NewTimer(cfg.FirstHeartbeatWindow)
+			defer timer.Stop()
+			select {
+			case <-tunnelCtx.Done():
+			case <-firstHB:
+			case <-timer.C:
+				log.Printf("WARNING: no successful heartbeat within %s of connecting — the control plane can't see this tunnel; reconnecting",
+					cfg.FirstHeartbeatWindow)
+				tunnelErr <- fmt.Errorf("%w: none within %s", ErrNoFirstHeartbeat, cfg.FirstHeartbeatWindow)
+			}
+		}()
+	}
+
+	if cfg.WatchdogWindow > 0 {
+		go func() {
+			if err := runWatchdog(tunnelCtx, cfg.WatchdogWindow, &lastAlive); err != nil {
+				log.Printf("WARNING: %v — forcing reconnect", err)
+				tunnelErr <- err
+			}
+		}()
+	}
+
+	var rate *connRate
+	if cfg.MaxConnRate > 0 {
+		rate = newConnRate(cfg.MaxConnRate, connRateWindow)
+	}
 	go func() {
+		// The first relay connection shows which port the relay really
+		// bound; later ones arrive on the same port.
+		bindChecked := false
 		for {
 			conn, err := listener.Accept()
 			if err != nil {
@@ -120,48 +543,513 @@ func Run(ctx context.Context, cfg *Config) error {
 				}
 				return
 			}
-			go proxyConn(conn, localAddr)
+			alive()
+			if !bindChecked {
+				bindChecked = true
+				if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+					if err := checkBind(cfg.TunnelPort, addr.Port, cfg.StrictBind); err != nil {
+						conn.Close()
+						tunnelErr <- err
+						return
+					}
+				}
+			}
+			if rate != nil && rate.add(time.Now()) {
+				conn.Close()
+				log.Printf("WARNING: SECURITY: relay %s opened more than %d connections within %s — "+
+					"tearing down the tunnel; the relay may be misbehaving or compromised",
+					relayAddr, cfg.MaxConnRate, connRateWindow)
+				tunnelErr <- fmt.Errorf("%w: more than %d connections within %s", ErrConnFlood, cfg.MaxConnRate, connRateWindow)
+				return
+			}
+			tc, ok := proxy.admit(conn)
+			if !ok {
+				proxy.connLog.Printf("connection limit (%d) reached — rejecting connection from %s",
+					proxy.conns.capacity(proxy.max), conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer proxy.release(tc)
+				proxy.serve(tc)
+			}()
 		}
 	}()
 
+	if cfg.SelfTest {
+		go func() {
+			err := loopbackSelfTest(tunnelCtx, client, proxy, listener.addr.Port)
+			switch {
+			case tunnelCtx.Err() != nil:
+			case errors.Is(err, errLoopbackRefused):
+				log.Printf("relay loopback self-test skipped: %v", err)
+			case err != nil:
+				log.Printf("WARNING: relay loopback self-test failed: %v", err)
+			default:
+				log.Printf("relay loopback self-test OK: relay %s forwards to this agent", bindAddr)
+			}
+		}()
+	}
+
 	select {
 	case <-ctx.Done():
+		if cfg.DrainTimeout > 0 {
+			proxy.drain(listener, cfg.DrainTimeout)
+		}
 		return ctx.Err()
 	case err := <-tunnelErr:
 		return err
 	}
 }
 
-func proxyConn(remote net.Conn, localAddr string) {
+// heartbeatOnce calls fn with its own deadline so one slow control-plane
+// call can't stall the heartbeat loop.
+func heartbeatOnce(ctx context.Context, fn func(context.Context) (bool, error), timeout time.Duration) (bool, error) {
+	hbCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return fn(hbCtx)
+}
+
+// runWatchdog returns ErrWatchdog once lastAlive (Unix nanoseconds) is
+// older than window, or nil when ctx is done.
+func runWatchdog(ctx context.Context, window time.Duration, lastAlive *atomic.Int64) error {
+	check := window / 4
+	if check <= 0 {
+		check = window
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if idle := time.Since(time.Unix(0, lastAlive.Load())); idle >= window {
+				return fmt.Errorf("%w: no successful heartbeat or accepted connection for %s",
+					ErrWatchdog, idle.Round(time.Millisecond))
+			}
+		}
+	}
+}
+
+// localProxy forwards relay connections to the local service.
+type localProxy struct {
+	addr         string
+	tcpKeepAlive time.Duration
+	// tls, if set, is used to speak TLS to the local service.
+	tls *tls.Config
+	// proxyProto is the PROXY protocol version written to the local
+	// service, or ProxyProtocolOff.
+	proxyProto int
+	// idleTimeout closes a proxied connection after this long without
+	// data in either direction. Zero disables it.
+	idleTimeout time.Duration
+	// bufs supplies the copy buffers.
+	bufs *bufferPool
+	// connLog rate-limits the per-connection lines. Errors are always
+	// logged directly.
+	connLog *logLimiter
+	// logConns logs every connection open and close; otherwise only
+	// connections that end on an error are logged.
+	logConns bool
+	// max caps concurrent connections (zero: unlimited); conns tracks
+	// the ones being served.
+	max   int
+	conns connTracker
+	stats *ConnStats
+	// service names the local service, svc counts its traffic (nil
+	// without a name).
+	service string
+	svc     *serviceStats
+	// localDown is set by watchLocal while the local service is failing
+	// its health probe.
+	localDown atomic.Bool
+	// loopbackToken is the outstanding loopback self-test token, nil
+	// when no test is running.
+	loopbackToken atomic.Pointer[string]
+}
+
+// admit registers conn in a connection slot, reporting false when the
+// limit is reached. The returned connection is served in place of conn and
+// must be passed to release once done.
+func (p *localProxy) admit(conn net.Conn) (*trackedConn, bool) {
+	tc, ok := p.conns.add(conn, p.max)
+	if !ok {
+		p.stats.addRejected()
+		return nil, false
+	}
+	p.stats.addAccepted(p.svc)
+	return tc, true
+}
+
+// target describes the local service in log lines: its address, prefixed
+// by its name when it has one.
+func (p *localProxy) target() string {
+	if p.service == "" {
+		return p.addr
+	}
+	return fmt.Sprintf("%s (%s)", p.service, p.addr)
+}
+
+func (p *localProxy) release(tc *trackedConn) {
+	p.conns.remove(tc)
+}
+
+// dial connects to the local service for a relay connection from src to
+// dst, writing the PROXY header and completing the TLS handshake when
+// configured.
+func (p *localProxy) dial(src, dst net.Addr) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", p.addr, localDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := setTCPKeepAlive(conn, p.tcpKeepAlive); err != nil {
+		log.Printf("tcp keepalive on local connection %s: %v", p.addr, err)
+	}
+	if p.proxyProto != ProxyProtocolOff {
+		_ = conn.SetWriteDeadline(time.Now().Add(localDialTimeout))
+		if _, err := conn.Write(proxyHeader(p.proxyProto, src, dst)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("write PROXY header to %s: %w", p.addr, err)
+		}
+		_ = conn.SetWriteDeadline(time.Time{})
+	}
+	if p.tls == nil {
+		return conn, nil
+	}
+
+	tc := tls.Client(conn, p.tls)
+	_ = tc.SetDeadline(time.Now().Add(localDialTimeout))
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s (server name %q): %w", p.addr, p.tls.ServerName, err)
+	}
+	_ = tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// serve proxies remote to the local service until either side closes.
+func (p *localProxy) serve(remote net.Conn) {
 	defer remote.Close()
 
-	local, err := net.DialTimeout("tcp", localAddr, 5*time.Second)
+	if token := p.loopbackToken.Load(); token != nil {
+		var answered bool
+		if remote, answered = p.answerLoopback(remote, *token); answered {
+			return
+		}
+	}
+
+	if p.localDown.Load() {
+		p.stats.addLocalFailed()
+		p.connLog.Printf("connection %s closed: local service %s is down", remote.RemoteAddr(), p.target())
+		return
+	}
+
+	local, err := p.dial(remote.RemoteAddr(), remote.LocalAddr())
 	if err != nil {
+		p.stats.addLocalFailed()
 		log.Printf("ERROR: local service at %s is not reachable — incoming tunnel request dropped. "+
 			"Make sure your local server (e.g. Domoticz) is running and listening on %s. Raw error: %v",
-			localAddr, localAddr, err)
+			p.target(), p.addr, err)
 		return
 	}
 	defer local.Close()
 
-	done := make(chan struct{}, 2)
-	go func() { _, _ = io.Copy(local, remote); done <- struct{}{} }()
-	go func() { _, _ = io.Copy(remote, local); done <- struct{}{} }()
-	<-done
+	if err := setTCPKeepAlive(remote, p.tcpKeepAlive); err != nil {
+		log.Printf("tcp keepalive on relay connection: %v", err)
+	}
+
+	if p.logConns {
+		p.connLog.Printf("connection %s → %s opened", remote.RemoteAddr(), p.target())
+	}
+	res := pipe(p.stats.countReads(remote, true, p.svc), p.stats.countReads(local, false, p.svc), p.idleTimeout, p.bufs)
+	if p.logConns || res.failed() {
+		p.connLog.Printf("connection %s → %s closed by %s (%s)",
+			remote.RemoteAddr(), p.target(), res.side, res.reason())
+	}
+}
+
+// localTLSConfig returns the TLS config for the local service, or nil for
+// plain TCP. ServerName defaults to serverName, then to the host part of
+// localAddr.
+func localTLSConfig(base *tls.Config, serverName, localAddr string) *tls.Config {
+	if base == nil {
+		return nil
+	}
+	c := base.Clone()
+	if c.ServerName == "" {
+		c.ServerName = serverName
+	}
+	if c.ServerName == "" {
+		if host, _, err := net.SplitHostPort(localAddr); err == nil {
+			c.ServerName = host
+		}
+	}
+	return c
 }
 
-func runKeepalive(ctx context.Context, client *ssh.Client) error {
-	ticker := time.NewTicker(keepAliveInterval)
-	defer ticker.Stop()
+// dialRelay re-resolves the relay host, connects to the preferred address
+// and performs the SSH handshake. The handshake uses relayAddr (host name,
+// not IP) so known_hosts entries stay keyed by the relay's name. Each
+// phase is marked on timer, which may be nil.
+func dialRelay(ctx context.Context, cfg *Config, relayAddr string, clientCfg *ssh.ClientConfig, timer *connectTimer) (*ssh.Client, error) {
+	addrs, err := resolveRelay(ctx, cfg.Resolver, cfg.Host, cfg.Addrs, !cfg.StrictRelayOrder)
+	if err != nil {
+		return nil, err
+	}
+	timer.mark("resolve")
+	if err := checkRelayRemote(cfg.Host, addrs, cfg.StrictRelayCheck); err != nil {
+		return nil, err
+	}
+
+	dialTimeout := clientCfg.Timeout
+	if cfg.PreflightTimeout > 0 {
+		dialTimeout = cfg.PreflightTimeout
+	}
+	// Only addresses that get dialed are measured, so probe the others
+	// before ordering by latency; otherwise the first answer stays
+	// preferred however slow it is.
+	if stale := cfg.Addrs.unmeasured(addrs); !cfg.StrictRelayOrder && len(addrs) > 1 && len(stale) > 0 {
+		probeRelays(ctx, stale, cfg.Port, min(dialTimeout, relayProbeTimeout), cfg.Addrs)
+		addrs = cfg.Addrs.order(addrs, true)
+	}
+	log.Printf("relay %s resolved to %v", cfg.Host, addrs)
+	conn, ip, err := dialFirst(ctx, addrs, cfg.Port, dialTimeout, cfg.Addrs)
+	if err != nil && cfg.PreflightTimeout > 0 {
+		return nil, fmt.Errorf("%w: relay SSH port %s unreachable within %s: %w", ErrRelayUnreachable, relayAddr, dialTimeout, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: dial relay %s: %w", ErrRelayUnreachable, relayAddr, err)
+	}
+	timer.mark("dial")
+	target := conn.RemoteAddr().String()
+	log.Printf("connected to relay %s via %s", relayAddr, target)
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, relayAddr, clientCfg)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: relay %s (%s): %w", classifyHandshake(err), relayAddr, target, err)
+	}
+	timer.mark("handshake")
+	cfg.Addrs.record(ip, true)
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// classifyHandshake maps an SSH handshake error to ErrHostKeyMismatch,
+// ErrUnknownHostKey, ErrRelayAuth or, for anything else such as a dropped
+// connection, ErrRelayUnreachable.
+func classifyHandshake(err error) error {
+	switch {
+	case errors.Is(err, ErrHostKeyMismatch):
+		return ErrHostKeyMismatch
+	case errors.Is(err, ErrUnknownHostKey):
+		return ErrUnknownHostKey
+	case strings.Contains(err.Error(), "ssh: unable to authenticate"):
+		// x/crypto reports exhausted auth methods only as text.
+		return ErrRelayAuth
+	default:
+		return ErrRelayUnreachable
+	}
+}
+
+// dialTCP opens a TCP connection to a relay address. Tests replace it to
+// simulate latency.
+var dialTCP = func(ctx context.Context, timeout time.Duration, address string) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	return d.DialContext(ctx, "tcp", address)
+}
+
+// dialFirst tries each address in order and returns the first TCP
+// connection that succeeds, so one dead A record doesn't block a reconnect
+// a sibling could serve. Every attempt's outcome is recorded in t, along
+// with the connect time of the successful one as a first latency sample.
+func dialFirst(ctx context.Context, addrs []string, port int, timeout time.Duration, t *AddrTracker) (net.Conn, string, error) {
+	var errs []error
+	for _, ip := range addrs {
+		target := net.JoinHostPort(ip, strconv.Itoa(port))
+		start := time.Now()
+		conn, err := dialTCP(ctx, timeout, target)
+		if err == nil {
+			t.recordRTT(ip, time.Since(start))
+			return conn, ip, nil
+		}
+		t.record(ip, false)
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+		log.Printf("relay address %s unreachable: %v", target, err)
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// selfTest routes a synthetic HTTP request through the proxy, exactly as a
+// relay-forwarded connection would be handled, and checks that an HTTP
+// response comes back from the local service.
+func selfTest(p *localProxy) error {
+	client, relaySide := net.Pipe()
+	defer client.Close()
+	go p.serve(relaySide)
+
+	_ = client.SetDeadline(time.Now().Add(selfTestTimeout))
+	req := fmt.Sprintf("HEAD / HTTP/1.0\r\nHost: %s\r\nUser-Agent: smarthomeentry-agent-selftest\r\n\r\n", p.addr)
+	if _, err := io.WriteString(client, req); err != nil {
+		return fmt.Errorf("write request: %w", err)
+	}
+	status, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("read response: %w", err)
+	}
+	if !strings.HasPrefix(status, "HTTP/") {
+		return fmt.Errorf("unexpected response %q", strings.TrimSpace(status))
+	}
+	return nil
+}
+
+const (
+	sideRelay = "relay"
+	sideLocal = "local"
+)
+
+// copyResult describes how one direction of a proxied connection ended.
+// side names the peer whose read side finished, i.e. who closed first.
+type copyResult struct {
+	side  string
+	bytes int64
+	err   error
+}
+
+// errIdleTimeout marks a proxied connection closed for inactivity.
+var errIdleTimeout = errors.New("idle timeout")
+
+// failed reports whether the connection ended on an error rather than a
+// normal close or the idle timeout.
+func (r copyResult) failed() bool {
+	return r.err != nil && !errors.Is(r.err, io.EOF) && !errors.Is(r.err, errIdleTimeout)
+}
+
+func (r copyResult) reason() string {
+	switch {
+	case errors.Is(r.err, errIdleTimeout):
+		return "idle timeout"
+	case r.err == nil || errors.Is(r.err, io.EOF):
+		return "EOF"
+	default:
+		return "error: " + r.err.Error()
+	}
+}
+
+// pipe copies in both directions between remote and local and returns the
+// result of whichever direction finished first. The caller is expected to
+// close both connections, which unblocks the remaining copy. A positive idle
+// closes both connections once no data has flowed for that long; SSH
+// channels have no deadlines, hence the timer. Copy buffers come from bufs,
+// or the default-size pool when nil.
+func pipe(remote, local net.Conn, idle time.Duration, bufs *bufferPool) copyResult {
+	if bufs == nil {
+		bufs = bufferPoolFor(0)
+	}
+	var fromRemote, fromLocal io.Reader = remote, local
+	var idled atomic.Bool
+	if idle > 0 {
+		timer := time.AfterFunc(idle, func() {
+			idled.Store(true)
+			remote.Close()
+			local.Close()
+		})
+		defer timer.Stop()
+		fromRemote = &activityReader{r: remote, timer: timer, idle: idle}
+		fromLocal = &activityReader{r: local, timer: timer, idle: idle}
+	}
+
+	done := make(chan copyResult, 2)
+	copyDir := func(side string, dst io.Writer, src io.Reader) {
+		buf := bufs.get()
+		defer bufs.put(buf)
+		// Hide ReaderFrom and WriterTo (*net.TCPConn has both), which
+		// would make CopyBuffer ignore buf.
+		n, err := io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+		done <- copyResult{side: side, bytes: n, err: err}
+	}
+	go copyDir(sideRelay, local, fromRemote)
+	go copyDir(sideLocal, remote, fromLocal)
+	res := <-done
+	if idled.Load() {
+		res.err = errIdleTimeout
+	}
+	return res
+}
+
+// activityReader pushes back the idle timer on every read that returns
+// data.
+type activityReader struct {
+	r     io.Reader
+	timer *time.Timer
+	idle  time.Duration
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.timer.Reset(a.idle)
+	}
+	return n, err
+}
+
+// keepAliveConn is implemented by *net.TCPConn. Connections forwarded over
+// SSH channels don't implement it and are left untouched.
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// setTCPKeepAlive enables TCP keepalive with the given period on conn, or
+// disables it when period is negative.
+func setTCPKeepAlive(conn net.Conn, period time.Duration) error {
+	kc, ok := conn.(keepAliveConn)
+	if !ok {
+		return nil
+	}
+	if period < 0 {
+		return kc.SetKeepAlive(false)
+	}
+	if err := kc.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return kc.SetKeepAlivePeriod(period)
+}
+
+// jitterInterval returns d moved by a random amount of up to jitter times
+// d either way. A non-positive jitter returns d unchanged.
+func jitterInterval(d time.Duration, jitter float64, rng *rand.Rand) time.Duration {
+	if jitter <= 0 {
+		return d
+	}
+	jitter = min(jitter, maxKeepAliveJitter)
+	return d + time.Duration((rng.Float64()*2-1)*jitter*float64(d))
+}
+
+// runKeepalive sends an SSH keepalive every interval, jittered by the
+// given fraction, until ctx is done or one fails or times out.
+func runKeepalive(ctx context.Context, client *ssh.Client, interval time.Duration, jitter float64, rtt *RTT) error {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	timer := time.NewTimer(jitterInterval(interval, jitter, rng))
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
-		case <-ticker.C:
+		case <-timer.C:
+			// Rearm at once so the cadence doesn't drift by the RTT.
+			timer.Reset(jitterInterval(interval, jitter, rng))
 			errCh := make(chan error, 1)
 			go func() {
+				start := time.Now()
 				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				if err == nil {
+					rtt.observe(time.Since(start))
+				}
 				errCh <- err
 			}()
 			select {
@@ -178,10 +1066,25 @@ func runKeepalive(ctx context.Context, client *ssh.Client) error {
 	}
 }
 
-// buildHostKeyCallback returns a TOFU (Trust On First Use) host key callback
-// backed by a known_hosts file.
-func buildHostKeyCallback(knownHostsFile string) (ssh.HostKeyCallback, error) {
-	if err := os.MkdirAll("/etc/smarthomeentry", 0o755); err != nil {
+// recordHostKeyType wraps cb, storing the type of each host key it accepts
+// in *algo.
+func recordHostKeyType(cb ssh.HostKeyCallback, algo *string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err := cb(hostname, remote, key); err != nil {
+			return err
+		}
+		*algo = key.Type()
+		return nil
+	}
+}
+
+// buildHostKeyCallback returns a host key callback backed by a known_hosts
+// file. With tofu set, keys of hosts not yet in the file are trusted on
+// first use and recorded; otherwise such hosts are rejected with
+// ErrUnknownHostKey. Each newly trusted key prunes the file to maxEntries
+// entries; zero selects DefaultMaxKnownHosts, negative disables pruning.
+func buildHostKeyCallback(knownHostsFile string, maxEntries int, tofu bool) (ssh.HostKeyCallback, error) {
+	if err := os.MkdirAll(filepath.Dir(knownHostsFile), 0o755); err != nil {
 		return nil, fmt.Errorf("create config dir: %w", err)
 	}
 	if _, err := os.Stat(knownHostsFile); os.IsNotExist(err) {
@@ -206,23 +1109,55 @@ func buildHostKeyCallback(knownHostsFile string) (ssh.HostKeyCallback, error) {
 		var keyErr *knownhosts.KeyError
 		if errors.As(kerr, &keyErr) && len(keyErr.Want) > 0 {
 			return fmt.Errorf(
-				"HOST KEY MISMATCH for %s — possible MITM attack! "+
+				"%w for %s — possible MITM attack! "+
 					"Remove %s to reset if the relay key legitimately changed",
-				hostname, knownHostsFile,
+				ErrHostKeyMismatch, hostname, knownHostsFile,
 			)
 		}
 
-		// New host — trust on first use.
-		log.Printf("[TOFU] Trusting new host key for %s (%s %s)",
-			hostname, key.Type(), ssh.FingerprintSHA256(key))
+		if !tofu {
+			return fmt.Errorf("%w: %s (%s %s) — add it to %s",
+				ErrUnknownHostKey, hostname, key.Type(), ssh.FingerprintSHA256(key), knownHostsFile)
+		}
+
+		// New host — trust on first use. Record the address that actually
+		// presented the key so operators can audit it later.
+		log.Printf("[TOFU] Trusting new host key for %s from %s (%s %s)",
+			hostname, remote, key.Type(), ssh.FingerprintSHA256(key))
 
-		line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
-		f, err := os.OpenFile(knownHostsFile, os.O_APPEND|os.O_WRONLY, 0o600)
-		if err != nil {
-			return fmt.Errorf("save host key to %s: %w", knownHostsFile, err)
+		if err := appendKnownHost(knownHostsFile, hostname, key,
+			fmt.Sprintf("tofu from %s at %s", remote, time.Now().UTC().Format(time.RFC3339))); err != nil {
+			return err
 		}
-		defer f.Close()
-		_, err = fmt.Fprintln(f, line)
-		return err
+		if maxEntries == 0 {
+			maxEntries = DefaultMaxKnownHosts
+		}
+		if maxEntries > 0 {
+			n, err := pruneKnownHosts(knownHostsFile, maxEntries, hostname)
+			if err != nil {
+				log.Printf("WARNING: %v", err)
+			} else if n > 0 {
+				log.Printf("pruned %d old or duplicate entries from %s", n, knownHostsFile)
+			}
+		}
+		return nil
 	}, nil
 }
+
+// appendKnownHost adds a known_hosts line for hostname with a trailing
+// comment recording how the key came to be trusted. The file is replaced
+// atomically so an interrupted write can't corrupt the existing entries.
+func appendKnownHost(knownHostsFile, hostname string, key ssh.PublicKey, comment string) error {
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + " " + comment + "\n"
+	data, err := os.ReadFile(knownHostsFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("save host key to %s: %w", knownHostsFile, err)
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	if err := atomicfile.Write(knownHostsFile, append(data, line...), 0o600); err != nil {
+		return fmt.Errorf("save host key: %w", err)
+	}
+	return nil
+}
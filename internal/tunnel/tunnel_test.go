@@ -1,13 +1,27 @@
 package tunnel
 
 import (
+	"bytes"
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	mrand "math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
@@ -52,7 +66,7 @@ func TestBuildHostKeyCallback_TOFU_firstConnectionTrusted(t *testing.T) {
 	pub := generateTestKey(t)
 	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22}
 
-	cb, err := buildHostKeyCallback(knownHostsFile)
+	cb, err := buildHostKeyCallback(knownHostsFile, 0, true)
 	if err != nil {
 		t.Fatalf("buildHostKeyCallback: %v", err)
 	}
@@ -75,7 +89,7 @@ func TestBuildHostKeyCallback_sameKey_accepted(t *testing.T) {
 	pub := generateTestKey(t)
 	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22}
 
-	cb, err := buildHostKeyCallback(knownHostsFile)
+	cb, err := buildHostKeyCallback(knownHostsFile, 0, true)
 	if err != nil {
 		t.Fatalf("buildHostKeyCallback: %v", err)
 	}
@@ -83,7 +97,7 @@ func TestBuildHostKeyCallback_sameKey_accepted(t *testing.T) {
 		t.Fatalf("first TOFU call: %v", err)
 	}
 
-	cb2, err := buildHostKeyCallback(knownHostsFile)
+	cb2, err := buildHostKeyCallback(knownHostsFile, 0, true)
 	if err != nil {
 		t.Fatalf("buildHostKeyCallback (second): %v", err)
 	}
@@ -92,13 +106,51 @@ func TestBuildHostKeyCallback_sameKey_accepted(t *testing.T) {
 	}
 }
 
+func TestBuildHostKeyCallback_TOFUOff_unseenHostRejected(t *testing.T) {
+	knownHostsFile := setupForTOFU(t)
+	pub := generateTestKey(t)
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22}
+
+	cb, err := buildHostKeyCallback(knownHostsFile, 0, false)
+	if err != nil {
+		t.Fatalf("buildHostKeyCallback: %v", err)
+	}
+	if err := cb("relay.example.com:22", addr, pub); !errors.Is(err, ErrUnknownHostKey) {
+		t.Fatalf("unseen host with TOFU off: got %v, want ErrUnknownHostKey", err)
+	}
+	if content, _ := os.ReadFile(knownHostsFile); len(content) != 0 {
+		t.Errorf("known_hosts written with TOFU off:\n%s", content)
+	}
+}
+
+func TestBuildHostKeyCallback_TOFUOff_preseededHostAccepted(t *testing.T) {
+	knownHostsFile := setupForTOFU(t)
+	pub1 := generateTestKey(t)
+	pub2 := generateTestKey(t)
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22}
+
+	if err := appendKnownHost(knownHostsFile, "relay.example.com:22", pub1, "pre-provisioned"); err != nil {
+		t.Fatalf("seed known_hosts: %v", err)
+	}
+	cb, err := buildHostKeyCallback(knownHostsFile, 0, false)
+	if err != nil {
+		t.Fatalf("buildHostKeyCallback: %v", err)
+	}
+	if err := cb("relay.example.com:22", addr, pub1); err != nil {
+		t.Errorf("pre-seeded key rejected: %v", err)
+	}
+	if err := cb("relay.example.com:22", addr, pub2); !errors.Is(err, ErrHostKeyMismatch) {
+		t.Errorf("changed key with TOFU off: got %v, want ErrHostKeyMismatch", err)
+	}
+}
+
 func TestBuildHostKeyCallback_differentKey_rejected(t *testing.T) {
 	knownHostsFile := setupForTOFU(t)
 	pub1 := generateTestKey(t)
 	pub2 := generateTestKey(t)
 	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22}
 
-	cb, err := buildHostKeyCallback(knownHostsFile)
+	cb, err := buildHostKeyCallback(knownHostsFile, 0, true)
 	if err != nil {
 		t.Fatalf("buildHostKeyCallback: %v", err)
 	}
@@ -106,7 +158,7 @@ func TestBuildHostKeyCallback_differentKey_rejected(t *testing.T) {
 		t.Fatalf("TOFU call: %v", err)
 	}
 
-	cb2, err := buildHostKeyCallback(knownHostsFile)
+	cb2, err := buildHostKeyCallback(knownHostsFile, 0, true)
 	if err != nil {
 		t.Fatalf("buildHostKeyCallback (second): %v", err)
 	}
@@ -122,7 +174,7 @@ func TestBuildHostKeyCallback_createsKnownHostsFile(t *testing.T) {
 		t.Fatalf("known_hosts should not exist yet, err=%v", err)
 	}
 
-	_, err := buildHostKeyCallback(knownHostsFile)
+	_, err := buildHostKeyCallback(knownHostsFile, 0, true)
 	if err != nil {
 		t.Fatalf("buildHostKeyCallback: %v", err)
 	}
@@ -135,7 +187,7 @@ func TestBuildHostKeyCallback_createsKnownHostsFile(t *testing.T) {
 func TestBuildHostKeyCallback_knownHostsPermissions(t *testing.T) {
 	knownHostsFile := setupForTOFU(t)
 
-	if _, err := buildHostKeyCallback(knownHostsFile); err != nil {
+	if _, err := buildHostKeyCallback(knownHostsFile, 0, true); err != nil {
 		t.Fatalf("buildHostKeyCallback: %v", err)
 	}
 
@@ -153,7 +205,7 @@ func TestBuildHostKeyCallback_tofuWritesValidLine(t *testing.T) {
 	pub := generateTestKey(t)
 	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22}
 
-	cb, err := buildHostKeyCallback(knownHostsFile)
+	cb, err := buildHostKeyCallback(knownHostsFile, 0, true)
 	if err != nil {
 		t.Fatalf("buildHostKeyCallback: %v", err)
 	}
@@ -165,3 +217,949 @@ func TestBuildHostKeyCallback_tofuWritesValidLine(t *testing.T) {
 		t.Errorf("known_hosts written by TOFU is not parseable: %v", err)
 	}
 }
+
+type keepAliveRecorder struct {
+	net.Conn
+	enabled bool
+	period  time.Duration
+	calls   int
+}
+
+func (c *keepAliveRecorder) SetKeepAlive(keepalive bool) error {
+	c.enabled = keepalive
+	c.calls++
+	return nil
+}
+
+func (c *keepAliveRecorder) SetKeepAlivePeriod(d time.Duration) error {
+	c.period = d
+	return nil
+}
+
+func TestBuildHostKeyCallback_tofuLogsRemoteAddr(t *testing.T) {
+	knownHostsFile := setupForTOFU(t)
+	pub := generateTestKey(t)
+	addr := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 2222}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	cb, err := buildHostKeyCallback(knownHostsFile, 0, true)
+	if err != nil {
+		t.Fatalf("buildHostKeyCallback: %v", err)
+	}
+	if err := cb("relay.example.com:22", addr, pub); err != nil {
+		t.Fatalf("TOFU call: %v", err)
+	}
+
+	if !strings.Contains(buf.String(), "203.0.113.7:2222") {
+		t.Errorf("TOFU log line missing remote address: %q", buf.String())
+	}
+	content, err := os.ReadFile(knownHostsFile)
+	if err != nil {
+		t.Fatalf("read known_hosts: %v", err)
+	}
+	if !strings.Contains(string(content), "203.0.113.7:2222") {
+		t.Errorf("known_hosts comment missing remote address: %q", content)
+	}
+
+	// The comment must not break lookups for the trusted host.
+	cb2, err := buildHostKeyCallback(knownHostsFile, 0, true)
+	if err != nil {
+		t.Fatalf("buildHostKeyCallback (second): %v", err)
+	}
+	if err := cb2("relay.example.com:22", addr, pub); err != nil {
+		t.Errorf("known host with comment rejected: %v", err)
+	}
+}
+
+func TestSetTCPKeepAlive_enablesWithPeriod(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer raw.Close()
+
+	conn := &keepAliveRecorder{Conn: raw}
+	if err := setTCPKeepAlive(conn, 45*time.Second); err != nil {
+		t.Fatalf("setTCPKeepAlive: %v", err)
+	}
+	if !conn.enabled {
+		t.Error("expected keepalive to be enabled")
+	}
+	if conn.period != 45*time.Second {
+		t.Errorf("period=%v, want 45s", conn.period)
+	}
+}
+
+func TestSetTCPKeepAlive_negativeDisables(t *testing.T) {
+	conn := &keepAliveRecorder{enabled: true}
+	if err := setTCPKeepAlive(conn, -1); err != nil {
+		t.Fatalf("setTCPKeepAlive: %v", err)
+	}
+	if conn.enabled {
+		t.Error("expected keepalive to be disabled")
+	}
+	if conn.period != 0 {
+		t.Errorf("period must not be set when disabled, got %v", conn.period)
+	}
+}
+
+func TestSetTCPKeepAlive_nonTCPConnIgnored(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	if err := setTCPKeepAlive(a, 30*time.Second); err != nil {
+		t.Errorf("expected nil for conn without keepalive support, got %v", err)
+	}
+}
+
+func TestPipe_reportsRelayClose(t *testing.T) {
+	remote, relayPeer := net.Pipe()
+	local, localPeer := net.Pipe()
+	defer remote.Close()
+	defer local.Close()
+	defer localPeer.Close()
+
+	resCh := make(chan copyResult, 1)
+	go func() { resCh <- pipe(remote, local, 0, nil) }()
+
+	relayPeer.Close()
+
+	select {
+	case res := <-resCh:
+		if res.side != sideRelay {
+			t.Errorf("side=%q, want %q", res.side, sideRelay)
+		}
+		if res.reason() != "EOF" {
+			t.Errorf("reason=%q, want EOF", res.reason())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("pipe did not return after relay side closed")
+	}
+}
+
+func TestPipe_idleTimeoutClosesQuietConnection(t *testing.T) {
+	remote, relayPeer := net.Pipe()
+	local, localPeer := net.Pipe()
+	defer relayPeer.Close()
+	defer localPeer.Close()
+
+	resCh := make(chan copyResult, 1)
+	start := time.Now()
+	go func() { resCh <- pipe(remote, local, 100*time.Millisecond, nil) }()
+
+	// Traffic before the deadline keeps the connection open.
+	go func() { _, _ = io.Copy(io.Discard, localPeer) }()
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := relayPeer.Write([]byte("x")); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+
+	select {
+	case res := <-resCh:
+		if res.reason() != "idle timeout" {
+			t.Errorf("reason=%q, want idle timeout", res.reason())
+		}
+		if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+			t.Errorf("closed after %s despite activity", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+}
+
+func TestPipe_reportsLocalClose(t *testing.T) {
+	remote, relayPeer := net.Pipe()
+	local, localPeer := net.Pipe()
+	defer remote.Close()
+	defer local.Close()
+	defer relayPeer.Close()
+
+	resCh := make(chan copyResult, 1)
+	go func() { resCh <- pipe(remote, local, 0, nil) }()
+
+	localPeer.Close()
+
+	select {
+	case res := <-resCh:
+		if res.side != sideLocal {
+			t.Errorf("side=%q, want %q", res.side, sideLocal)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("pipe did not return after local side closed")
+	}
+}
+
+func TestCopyResult_reason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, "EOF"},
+		{io.EOF, "EOF"},
+		{errIdleTimeout, "idle timeout"},
+		{errors.New("boom"), "error: boom"},
+	}
+	for _, tt := range tests {
+		if got := (copyResult{err: tt.err}).reason(); got != tt.want {
+			t.Errorf("reason(%v)=%q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestSelfTest_localHTTPService(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	if err := selfTest(&localProxy{addr: srv.Listener.Addr().String(), tcpKeepAlive: DefaultTCPKeepAlive}); err != nil {
+		t.Fatalf("selfTest against healthy local service: %v", err)
+	}
+}
+
+func TestSelfTest_localServiceDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	if err := selfTest(&localProxy{addr: addr, tcpKeepAlive: DefaultTCPKeepAlive}); err == nil {
+		t.Fatal("expected error when local service is not listening")
+	}
+}
+
+func TestSelfTest_nonHTTPResponse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("SSH-2.0-NotHTTP\r\n"))
+	}()
+
+	if err := selfTest(&localProxy{addr: ln.Addr().String(), tcpKeepAlive: DefaultTCPKeepAlive}); err == nil {
+		t.Fatal("expected error for non-HTTP response")
+	}
+}
+
+func TestRun_usesPreDialedClient(t *testing.T) {
+	client, relay := newTestRelay(t)
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, &Config{
+			Client:        client,
+			TunnelPort:    9000,
+			LocalAddr:     echo.Addr().String(),
+			HeartbeatFunc: func(context.Context) (bool, error) { return true, nil },
+			OnUp:          func(UpInfo) { close(up) },
+		})
+	}()
+
+	select {
+	case <-up:
+	case err := <-done:
+		t.Fatalf("Run returned before forwarding: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel did not come up")
+	}
+	fwd := <-relay.forwards
+	if fwd.Addr != "127.0.0.1" || fwd.Port != 9000 {
+		t.Errorf("forward requested for %s:%d, want 127.0.0.1:9000", fwd.Addr, fwd.Port)
+	}
+
+	ch, err := relay.openForwarded(fwd)
+	if err != nil {
+		t.Fatalf("open forwarded channel: %v", err)
+	}
+	if _, err := ch.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(ch, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("echo=%q, want ping", buf)
+	}
+	ch.Close()
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run returned %v, want context.Canceled", err)
+	}
+
+	// The shared connection belongs to the caller and must survive Run.
+	if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Errorf("pre-dialed client closed by Run: %v", err)
+	}
+}
+
+func TestLocalProxy_TLSServerNameOverride(t *testing.T) {
+	// httptest's certificate is valid for example.com and 127.0.0.1, not
+	// for "localhost", so dialling localhost needs a ServerName override.
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	addr := net.JoinHostPort("localhost", port)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	base := &tls.Config{RootCAs: pool}
+
+	p := &localProxy{addr: addr, tls: localTLSConfig(base, "", addr)}
+	if p.tls.ServerName != "localhost" {
+		t.Fatalf("default ServerName=%q, want localhost", p.tls.ServerName)
+	}
+	if _, err := p.dial(nil, nil); err == nil {
+		t.Fatal("expected verification failure without the override")
+	}
+
+	p.tls = localTLSConfig(base, "example.com", addr)
+	conn, err := p.dial(nil, nil)
+	if err != nil {
+		t.Fatalf("dial with ServerName override: %v", err)
+	}
+	conn.Close()
+
+	if err := selfTest(p); err != nil {
+		t.Errorf("self-test over local TLS: %v", err)
+	}
+}
+
+func TestHeartbeatOnce_timeoutFires(t *testing.T) {
+	slow := func(ctx context.Context) (bool, error) {
+		<-ctx.Done()
+		return true, ctx.Err()
+	}
+
+	start := time.Now()
+	_, err := heartbeatOnce(context.Background(), slow, 20*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("per-call timeout fired after %s", elapsed)
+	}
+}
+
+func TestRun_firstHeartbeatSentPromptly(t *testing.T) {
+	client, _ := newTestRelay(t)
+
+	calls := make(chan time.Time, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var upAt time.Time
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, &Config{
+			Client:            client,
+			TunnelPort:        9000,
+			HeartbeatInterval: time.Hour,
+			OnUp:              func(UpInfo) { upAt = time.Now() },
+			HeartbeatFunc: func(context.Context) (bool, error) {
+				calls <- time.Now()
+				return true, nil
+			},
+		})
+	}()
+
+	select {
+	case at := <-calls:
+		if d := at.Sub(upAt); d > time.Second {
+			t.Errorf("first heartbeat %s after the tunnel came up", d)
+		}
+	case err := <-done:
+		t.Fatalf("Run returned early: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no heartbeat before the first interval elapsed")
+	}
+	cancel()
+	<-done
+}
+
+func TestRun_slowHeartbeatDoesNotStallLoop(t *testing.T) {
+	client, _ := newTestRelay(t)
+
+	calls := make(chan struct{}, 8)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, &Config{
+			Client:            client,
+			TunnelPort:        9000,
+			HeartbeatInterval: 10 * time.Millisecond,
+			HeartbeatTimeout:  20 * time.Millisecond,
+			HeartbeatFunc: func(hbCtx context.Context) (bool, error) {
+				calls <- struct{}{}
+				<-hbCtx.Done() // hangs until the per-call deadline
+				return true, hbCtx.Err()
+			},
+		})
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-calls:
+		case err := <-done:
+			t.Fatalf("Run returned early: %v", err)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("heartbeat %d never ran — loop stalled by slow heartbeat", i+1)
+		}
+	}
+	cancel()
+	<-done
+}
+
+func TestRun_watchdogFiresWhenWedged(t *testing.T) {
+	client, _ := newTestRelay(t)
+
+	// Every heartbeat hangs until its deadline and nothing connects, as if
+	// the control plane and the accept loop were both stuck.
+	hung := func(ctx context.Context) (bool, error) {
+		<-ctx.Done()
+		return false, ctx.Err()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(context.Background(), &Config{
+			Client:            client,
+			TunnelPort:        9000,
+			HeartbeatFunc:     hung,
+			HeartbeatInterval: 20 * time.Millisecond,
+			HeartbeatTimeout:  20 * time.Millisecond,
+			WatchdogWindow:    200 * time.Millisecond,
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrWatchdog) {
+			t.Fatalf("Run: got %v, want ErrWatchdog", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchdog did not fire")
+	}
+}
+
+func TestRun_firstHeartbeatWindow(t *testing.T) {
+	client, _ := newTestRelay(t)
+
+	failing := func(context.Context) (bool, error) { return false, errors.New("control plane unreachable") }
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(context.Background(), &Config{
+			Client:               client,
+			TunnelPort:           9000,
+			HeartbeatFunc:        failing,
+			HeartbeatInterval:    20 * time.Millisecond,
+			FirstHeartbeatWindow: 150 * time.Millisecond,
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrNoFirstHeartbeat) {
+			t.Fatalf("Run: got %v, want ErrNoFirstHeartbeat", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("teardown took %s, want about 150ms", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel kept running without a successful heartbeat")
+	}
+}
+
+func TestRun_firstHeartbeatWindowSatisfied(t *testing.T) {
+	client, _ := newTestRelay(t)
+
+	// Only the first heartbeat succeeds; later failures are normal
+	// operation and left to the watchdog.
+	var calls atomic.Int32
+	hb := func(context.Context) (bool, error) {
+		if calls.Add(1) == 1 {
+			return true, nil
+		}
+		return false, errors.New("blip")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	err := Run(ctx, &Config{
+		Client:               client,
+		TunnelPort:           9000,
+		HeartbeatFunc:        hb,
+		HeartbeatInterval:    20 * time.Millisecond,
+		FirstHeartbeatWindow: 100 * time.Millisecond,
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Run: got %v, want the tunnel to run until cancelled", err)
+	}
+}
+
+// scriptedHeartbeat returns the active flags in order, then active=true.
+func scriptedHeartbeat(flags ...bool) func(context.Context) (bool, error) {
+	var mu sync.Mutex
+	return func(context.Context) (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(flags) == 0 {
+			return true, nil
+		}
+		active := flags[0]
+		flags = flags[1:]
+		return active, nil
+	}
+}
+
+func TestRun_inactiveHeartbeats_singleFalseIgnored(t *testing.T) {
+	client, _ := newTestRelay(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	err := Run(ctx, &Config{
+		Client:             client,
+		TunnelPort:         9000,
+		HeartbeatFunc:      scriptedHeartbeat(true, false, true, false, false, true),
+		HeartbeatInterval:  10 * time.Millisecond,
+		InactiveHeartbeats: 3,
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Run: got %v, want the tunnel kept until cancelled", err)
+	}
+}
+
+func TestRun_inactiveHeartbeats_sustainedFalseTearsDown(t *testing.T) {
+	for _, threshold := range []int{0, 3} {
+		client, _ := newTestRelay(t)
+		done := make(chan error, 1)
+		go func() {
+			done <- Run(context.Background(), &Config{
+				Client:             client,
+				TunnelPort:         9000,
+				HeartbeatFunc:      scriptedHeartbeat(false, true, false, false, false),
+				HeartbeatInterval:  10 * time.Millisecond,
+				InactiveHeartbeats: threshold,
+			})
+		}()
+		select {
+		case err := <-done:
+			if !errors.Is(err, ErrInactive) {
+				t.Errorf("threshold %d: got %v, want ErrInactive", threshold, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("threshold %d: tunnel not closed", threshold)
+		}
+	}
+}
+
+func TestRunWatchdog_healthyTunnelKeepsRunning(t *testing.T) {
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- runWatchdog(ctx, 100*time.Millisecond, &last) }()
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(30 * time.Millisecond)
+		last.Store(time.Now().UnixNano())
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("watchdog fired despite regular activity: %v", err)
+	}
+}
+
+func TestRun_countsAcceptedAndRejectedConnections(t *testing.T) {
+	client, relay := newTestRelay(t)
+
+	// The local service accepts and then holds every connection open.
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer local.Close()
+	go func() {
+		for {
+			c, err := local.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	stats := NewConnStats()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	up := make(chan struct{})
+	go Run(ctx, &Config{
+		Client:         client,
+		TunnelPort:     9000,
+		LocalAddr:      local.Addr().String(),
+		HeartbeatFunc:  func(context.Context) (bool, error) { return true, nil },
+		MaxConnections: 1,
+		Stats:          stats,
+		OnUp:           func(UpInfo) { close(up) },
+	})
+	select {
+	case <-up:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel did not come up")
+	}
+	fwd := <-relay.forwards
+
+	first, err := relay.openForwarded(fwd)
+	if err != nil {
+		t.Fatalf("open first channel: %v", err)
+	}
+	defer first.Close()
+	waitCounts(t, stats, ConnCounts{Accepted: 1})
+
+	second, err := relay.openForwarded(fwd)
+	if err != nil {
+		t.Fatalf("open second channel: %v", err)
+	}
+	// The over-limit connection is closed without being proxied.
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read on rejected connection: %v, want EOF", err)
+	}
+	waitCounts(t, stats, ConnCounts{Accepted: 1, Rejected: 1})
+}
+
+func TestLocalProxy_countsLocalFailures(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	stats := NewConnStats()
+	p := &localProxy{addr: addr, stats: stats}
+	for i := 0; i < 2; i++ {
+		remote, peer := net.Pipe()
+		tc, ok := p.admit(remote)
+		if !ok {
+			t.Fatal("admit refused without a limit")
+		}
+		p.serve(tc)
+		p.release(tc)
+		peer.Close()
+	}
+	if got, want := stats.Counts(), (ConnCounts{Accepted: 2, LocalFailed: 2}); got != want {
+		t.Errorf("counts=%+v, want %+v", got, want)
+	}
+}
+
+func TestLocalProxy_logsConnectionsOnlyWhenEnabled(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(io.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	for _, logConns := range []bool{false, true} {
+		var mu sync.Mutex
+		var lines []string
+		p := &localProxy{addr: ln.Addr().String(), logConns: logConns}
+		p.connLog = &logLimiter{limit: 100, window: time.Hour, logf: func(format string, args ...any) {
+			mu.Lock()
+			defer mu.Unlock()
+			lines = append(lines, fmt.Sprintf(format, args...))
+		}}
+		remote, peer := net.Pipe()
+		peer.Close()
+		p.serve(remote)
+
+		mu.Lock()
+		got := strings.Join(lines, "\n")
+		mu.Unlock()
+		opened := strings.Contains(got, "opened")
+		closed := strings.Contains(got, "closed by")
+		if opened != logConns || closed != logConns {
+			t.Errorf("logConns=%v: opened=%v closed=%v in log %q", logConns, opened, closed, got)
+		}
+	}
+}
+
+func TestLocalProxy_countsBytes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err == nil {
+			_, _ = c.Write([]byte("pong!!"))
+		}
+	}()
+
+	stats := NewConnStats()
+	p := &localProxy{addr: ln.Addr().String(), stats: stats}
+	remote, peer := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		p.serve(remote)
+		close(done)
+	}()
+	if _, err := peer.Write([]byte("ping!")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := io.ReadFull(peer, make([]byte, 6)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	peer.Close()
+	<-done
+
+	if in, out := stats.Bytes(); in != 5 || out != 6 {
+		t.Errorf("bytes in=%d out=%d, want 5 and 6", in, out)
+	}
+}
+
+func waitCounts(t *testing.T, s *ConnStats, want ConnCounts) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if s.Counts() == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("counts=%+v, want %+v", s.Counts(), want)
+}
+
+// startRejectingRelay runs an SSH server with the given host key that
+// rejects every client key.
+func startRejectingRelay(t *testing.T, hostKey ssh.Signer) int {
+	t.Helper()
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, errors.New("key not authorised")
+		},
+	}
+	cfg.AddHostKey(hostKey)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _, _, _ = ssh.NewServerConn(c, cfg)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	s, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("signer: %v", err)
+	}
+	return s
+}
+
+func TestDialRelay_classifiesFailures(t *testing.T) {
+	hostKey := newTestSigner(t)
+	rejecting := startRejectingRelay(t, hostKey)
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	// A server that accepts TCP and hangs up before the SSH handshake.
+	hangup, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer hangup.Close()
+	go func() {
+		for {
+			c, err := hangup.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// known_hosts pins a different key for the relay.
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	relayAddr := fmt.Sprintf("127.0.0.1:%d", rejecting)
+	line := knownhosts.Line([]string{knownhosts.Normalize(relayAddr)}, newTestSigner(t).PublicKey())
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0o600); err != nil {
+		t.Fatalf("write known_hosts: %v", err)
+	}
+	pinned, err := buildHostKeyCallback(knownHosts, 0, true)
+	if err != nil {
+		t.Fatalf("host key callback: %v", err)
+	}
+
+	clientKey := newTestSigner(t)
+	tests := []struct {
+		name string
+		port int
+		hkc  ssh.HostKeyCallback
+		want error
+	}{
+		{"connection refused", closedPort, ssh.InsecureIgnoreHostKey(), ErrRelayUnreachable},
+		{"hangup during handshake", hangup.Addr().(*net.TCPAddr).Port, ssh.InsecureIgnoreHostKey(), ErrRelayUnreachable},
+		{"key rejected", rejecting, ssh.InsecureIgnoreHostKey(), ErrRelayAuth},
+		{"host key mismatch", rejecting, pinned, ErrHostKeyMismatch},
+	}
+	for _, tc := range tests {
+		cfg := &Config{
+			Host:     "127.0.0.1",
+			Port:     tc.port,
+			Resolver: &stubResolver{answers: [][]string{{"127.0.0.1"}}},
+		}
+		addr := fmt.Sprintf("127.0.0.1:%d", tc.port)
+		_, err := dialRelay(context.Background(), cfg, addr, &ssh.ClientConfig{
+			User:            "agent",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+			HostKeyCallback: tc.hkc,
+			Timeout:         5 * time.Second,
+		}, nil)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+		for _, other := range []error{ErrRelayUnreachable, ErrRelayAuth, ErrHostKeyMismatch} {
+			if other != tc.want && errors.Is(err, other) {
+				t.Errorf("%s: error also classified as %v", tc.name, other)
+			}
+		}
+	}
+}
+
+func TestJitterInterval_withinBand(t *testing.T) {
+	rng := mrand.New(mrand.NewSource(1))
+	const d = 30 * time.Second
+	lo, hi := d, d
+	for i := 0; i < 1000; i++ {
+		got := jitterInterval(d, 0.2, rng)
+		if got < 24*time.Second || got > 36*time.Second {
+			t.Fatalf("jitterInterval=%s, want within ±20%% of %s", got, d)
+		}
+		lo, hi = min(lo, got), max(hi, got)
+	}
+	if hi-lo < 10*time.Second {
+		t.Errorf("intervals spread over %s..%s, want most of the ±20%% band used", lo, hi)
+	}
+	if got := jitterInterval(d, -1, rng); got != d {
+		t.Errorf("negative jitter: got %s, want %s", got, d)
+	}
+	for i := 0; i < 100; i++ {
+		if got := jitterInterval(d, 5, rng); got < d/2 || got > d*3/2 {
+			t.Fatalf("jitter above the cap: got %s", got)
+		}
+	}
+}
+
+func TestRunKeepalive_jittersPeriod(t *testing.T) {
+	client, relay := newTestRelay(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const interval = 40 * time.Millisecond
+	go runKeepalive(ctx, client, interval, 0.5, nil)
+
+	var gaps []time.Duration
+	prev := time.Now()
+	for len(gaps) < 8 {
+		select {
+		case at := <-relay.keepalives:
+			gaps = append(gaps, at.Sub(prev))
+			prev = at
+		case <-time.After(5 * time.Second):
+			t.Fatal("keepalives stopped")
+		}
+	}
+	lo, hi := gaps[0], gaps[0]
+	for _, g := range gaps {
+		// ±50% of the interval, with slack for scheduling.
+		if g < interval/2-5*time.Millisecond || g > interval*3/2+15*time.Millisecond {
+			t.Errorf("keepalive gap %s outside the jitter band of %s", g, interval)
+		}
+		lo, hi = min(lo, g), max(hi, g)
+	}
+	if hi == lo {
+		t.Errorf("keepalive gaps all %s, want them to vary", lo)
+	}
+}
@@ -0,0 +1,19 @@
+// Package systemd embeds the agent's systemd unit so the installer prints
+// the same file that is shipped in this directory.
+package systemd
+
+import (
+	_ "embed"
+	"strings"
+)
+
+// DefaultBinary is the agent path ExecStart names in the shipped unit.
+const DefaultBinary = "/usr/local/bin/smarthomeentry-agent"
+
+//go:embed smarthomeentry-agent.service
+var unit string
+
+// Unit returns smarthomeentry-agent.service with ExecStart running bin.
+func Unit(bin string) string {
+	return strings.Replace(unit, "\nExecStart="+DefaultBinary+"\n", "\nExecStart="+bin+"\n", 1)
+}
@@ -0,0 +1,19 @@
+package systemd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnit_execStartUsesBinary(t *testing.T) {
+	got := Unit("/opt/smarthomeentry/agent")
+	if !strings.Contains(got, "\nExecStart=/opt/smarthomeentry/agent\n") {
+		t.Errorf("ExecStart not templated:\n%s", got)
+	}
+	if strings.Contains(got, DefaultBinary) {
+		t.Errorf("unit still names %s:\n%s", DefaultBinary, got)
+	}
+	if !strings.Contains(got, "\nReadWritePaths=") || !strings.HasSuffix(got, "WantedBy=multi-user.target\n") {
+		t.Errorf("unit is not the shipped file:\n%s", got)
+	}
+}